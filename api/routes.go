@@ -3,96 +3,197 @@ package api
 import (
 	"time"
 
+	"ip-allocator-api/internal/config"
 	"ip-allocator-api/internal/handlers"
+	"ip-allocator-api/internal/metrics"
 	"ip-allocator-api/internal/middleware"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/storage"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 )
 
-func SetupRoutes(db *mongo.Database, logger *zap.Logger) *gin.Engine {
+func SetupRoutes(repo storage.Repository, cfg *config.Config, logger *zap.Logger) *gin.Engine {
 	// Set Gin mode based on environment
 	gin.SetMode(gin.ReleaseMode) // Use gin.DebugMode for development
 
 	// Create Gin router
 	router := gin.New()
 
+	// Trace every request, continuing the caller's trace when a traceparent header is present
+	router.Use(middleware.Tracing())
+
+	// Assign every request an ID and a logger tagged with it
+	router.Use(middleware.RequestID(logger))
+
 	// Add custom Zap logging middleware
 	router.Use(middleware.ZapLogger(logger))
 	router.Use(middleware.ZapRecovery(logger, true))
-
-	// CORS configuration for production
+	router.Use(middleware.RequestInfo())
+
+	// CORS: credentials are only allowed for explicitly listed origins, never for "*", and an
+	// empty list disables cross-origin access
+	allowAllOrigins := false
+	for _, origin := range cfg.CORS.AllowOrigins {
+		if origin == "*" {
+			allowAllOrigins = true
+		}
+	}
 	config := cors.Config{
-		AllowOrigins:     []string{"*"}, // Configure specific origins for production
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"*"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
+		AllowMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders: []string{
+			"Origin",
+			"Content-Type",
+			"Authorization",
+			middleware.APIKeyHeader,
+			middleware.TenantHeader,
+			middleware.IdempotencyKeyHeader,
+			middleware.RequestIDHeader,
+			middleware.ActorHeader,
+		},
+		ExposeHeaders: []string{"Content-Length", middleware.IdempotencyReplayedHeader, middleware.RequestIDHeader},
+		MaxAge:        12 * time.Hour,
+	}
+	switch {
+	case allowAllOrigins:
+		config.AllowAllOrigins = true
+		router.Use(cors.New(config))
+	case len(cfg.CORS.AllowOrigins) > 0:
+		config.AllowOrigins = cfg.CORS.AllowOrigins
+		config.AllowCredentials = true
+		router.Use(cors.New(config))
 	}
-	router.Use(cors.New(config))
+
+	// Authenticate callers by API key or OIDC bearer token; routes below declare the role they require
+	authenticators := []middleware.Authenticator{
+		middleware.APIKeyAuthenticator(services.NewAPIKeyService(repo, logger)),
+	}
+	if cfg.Auth.JWT.Enabled {
+		keys, err := services.NewJWKS(cfg.Auth.JWT.JWKSFile, cfg.Auth.JWT.JWKSURL, cfg.Auth.JWT.JWKSRefresh, logger)
+		if err != nil {
+			logger.Fatal("Invalid JWKS configuration", zap.Error(err))
+		}
+		verifier, err := services.NewTokenVerifier(cfg.Auth.JWT, keys, logger)
+		if err != nil {
+			logger.Fatal("Invalid JWT configuration", zap.Error(err))
+		}
+		authenticators = append(authenticators, middleware.JWTAuthenticator(verifier))
+	}
+	auth := middleware.NewAuth(cfg.Auth.Enabled, logger, authenticators...)
+	router.Use(auth.Authenticate())
+	router.Use(middleware.Tenant(logger))
+	viewer := auth.Require(models.RoleViewer)
+	allocator := auth.Require(models.RoleAllocator)
+	admin := auth.Require(models.RoleAdmin)
 
 	// Initialize handlers with Zap logger
-	allocationHandler := handlers.NewAllocationHandler(db, logger)
+	allocationHandler := handlers.NewAllocationHandler(repo, cfg, logger)
+
+	// Idempotency-Key support for the IP mutation endpoints
+	idempotencyService := services.NewIdempotencyService(repo, cfg.Idempotency.Window, logger)
+	idempotent := func(operation string) gin.HandlerFunc {
+		return middleware.Idempotency(idempotencyService, operation, logger)
+	}
 
 	// Root-level health checks
 	router.GET("/health", allocationHandler.HealthCheck)
 	router.GET("/healthz", allocationHandler.HealthCheck)
 
+	// Prometheus metrics, including per-sub-zone address gauges of every tenant, so only
+	// platform-wide viewers may scrape them
+	allocationService := services.NewAllocationService(repo, cfg.Quotas, logger)
+	if err := metrics.Register(metrics.NewSubZoneCollector(allocationService.SubZoneUsage, cfg.Metrics.SubZoneRefresh, logger)); err != nil {
+		logger.Fatal("Failed to register sub-zone metrics", zap.Error(err))
+	}
+	router.GET("/metrics", auth.RequirePlatform(models.RoleViewer), gin.WrapH(metrics.Handler()))
+
 	// API version group
 	v1 := router.Group("/api/v1")
 	{
 		// Health check endpoints
 		v1.GET("/health", allocationHandler.HealthCheck)
 
+		// Audit trail of every mutation
+		v1.GET("/audit", auth.RequireGlobal(models.RoleViewer), allocationHandler.GetAuditEvents)
+
+		// Longest-prefix lookup of an address or CIDR across all regions of the tenant
+		v1.GET("/lookup", auth.RequireGlobal(models.RoleViewer), allocationHandler.Lookup)
+
+		// Usage of the tenant, the caller, owners and sub-zones against the configured quotas
+		v1.GET("/quotas", auth.RequireGlobal(models.RoleViewer), allocationHandler.GetQuotaUsage)
+
+		// Tenant management, across all tenants
+		tenants := v1.Group("/tenants", auth.RequirePlatform(models.RoleAdmin))
+		{
+			tenants.GET("", allocationHandler.ListTenants)
+			tenants.POST("", allocationHandler.CreateTenant)
+			tenants.GET("/:tenant", allocationHandler.GetTenant)
+			tenants.PUT("/:tenant", allocationHandler.UpdateTenant)
+			tenants.DELETE("/:tenant", allocationHandler.DeleteTenant)
+		}
+
+		// API key management
+		keys := v1.Group("/admin/keys", auth.RequireGlobal(models.RoleAdmin))
+		{
+			keys.GET("", allocationHandler.ListAPIKeys)
+			keys.POST("", allocationHandler.CreateAPIKey)
+			keys.DELETE("/:id", allocationHandler.DeleteAPIKey)
+		}
+
 		// Region CRUD endpoints
 		regions := v1.Group("/regions")
 		{
-			regions.GET("", allocationHandler.GetAllRegions)
-			regions.POST("", allocationHandler.CreateRegion)
-			regions.GET("/:region", allocationHandler.GetRegionHierarchy)
-			regions.PUT("/:region", allocationHandler.UpdateRegion)
-			regions.DELETE("/:region", allocationHandler.DeleteRegion)
+			regions.GET("", auth.RequireGlobal(models.RoleViewer), allocationHandler.GetAllRegions)
+			regions.POST("", auth.RequireGlobal(models.RoleAdmin), allocationHandler.CreateRegion)
+			regions.GET("/:region", viewer, allocationHandler.GetRegionHierarchy)
+			regions.PUT("/:region", admin, allocationHandler.UpdateRegion)
+			regions.DELETE("/:region", admin, allocationHandler.DeleteRegion)
+			regions.POST("/:region/subnets/allocate", admin, allocationHandler.AllocateZoneSubnet)
 
 			// Zone CRUD endpoints with enhanced CIDR support
 			zones := regions.Group("/:region/zones")
 			{
-				zones.POST("", allocationHandler.CreateZone)
-				zones.GET("/:zone", allocationHandler.GetZone)
-				zones.PUT("/:zone", allocationHandler.UpdateZone)
-				zones.DELETE("/:zone", allocationHandler.DeleteZone)
+				zones.POST("", admin, allocationHandler.CreateZone)
+				zones.GET("/:zone", viewer, allocationHandler.GetZone)
+				zones.PUT("/:zone", admin, allocationHandler.UpdateZone)
+				zones.DELETE("/:zone", admin, allocationHandler.DeleteZone)
+				zones.POST("/:zone/subnets/allocate", admin, allocationHandler.AllocateSubZoneSubnet)
 
 				// SubZone CRUD endpoints
 				subzones := zones.Group("/:zone/subzones")
 				{
-					subzones.POST("", allocationHandler.CreateSubZone)
-					subzones.GET("/:subzone", allocationHandler.GetSubZoneInfo)
-					subzones.PUT("/:subzone", allocationHandler.UpdateSubZone)
-					subzones.DELETE("/:subzone", allocationHandler.DeleteSubZone)
+					subzones.POST("", admin, allocationHandler.CreateSubZone)
+					subzones.GET("/:subzone", viewer, allocationHandler.GetSubZoneInfo)
+					subzones.PUT("/:subzone", admin, allocationHandler.UpdateSubZone)
+					subzones.DELETE("/:subzone", admin, allocationHandler.DeleteSubZone)
 
 					// Utility endpoints
-					subzones.GET("/:subzone/available", allocationHandler.GetAvailableIPs)
-					subzones.GET("/:subzone/stats", allocationHandler.GetIPStats)
+					subzones.GET("/:subzone/available", viewer, allocationHandler.GetAvailableIPs)
+					subzones.GET("/:subzone/stats", viewer, allocationHandler.GetIPStats)
 				}
 			}
 		}
 
-		// IP management endpoints (grouped for better organization)
+		// IP management endpoints (grouped for better organization); the handlers check the
+		// region and zone of the request body against the caller's scope
 		ip := v1.Group("/ip")
 		{
-			ip.POST("/allocate", allocationHandler.AllocateIPs)
-			ip.POST("/deallocate", allocationHandler.DeallocateIPs)
-			ip.POST("/reserve", allocationHandler.ReserveIPs)
-			ip.POST("/unreserve", allocationHandler.UnreserveIPs)
+			ip.POST("/allocate", allocator, idempotent("allocate"), allocationHandler.AllocateIPs)
+			ip.POST("/deallocate", allocator, idempotent("deallocate"), allocationHandler.DeallocateIPs)
+			ip.POST("/reserve", allocator, idempotent("reserve"), allocationHandler.ReserveIPs)
+			ip.POST("/unreserve", allocator, idempotent("unreserve"), allocationHandler.UnreserveIPs)
+			ip.POST("/renew", allocator, allocationHandler.RenewIPs)
+			ip.GET("/:address/history", auth.RequireGlobal(models.RoleViewer), allocationHandler.GetIPHistory)
 		}
 
 		// Legacy endpoints for backward compatibility
-		v1.POST("/allocate", allocationHandler.AllocateIPs)
-		v1.POST("/deallocate", allocationHandler.DeallocateIPs)
-		v1.POST("/reserve", allocationHandler.ReserveIPs)
-		v1.POST("/unreserve", allocationHandler.UnreserveIPs)
+		v1.POST("/allocate", allocator, idempotent("allocate"), allocationHandler.AllocateIPs)
+		v1.POST("/deallocate", allocator, idempotent("deallocate"), allocationHandler.DeallocateIPs)
+		v1.POST("/reserve", allocator, idempotent("reserve"), allocationHandler.ReserveIPs)
+		v1.POST("/unreserve", allocator, idempotent("unreserve"), allocationHandler.UnreserveIPs)
 	}
 
 	return router
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/middleware"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+func TestMetricsRequirePlatformViewer(t *testing.T) {
+	ctx := context.Background()
+	repo := storage.NewMemoryRepository()
+	now := time.Now()
+	if err := repo.CreateTenant(ctx, &models.Tenant{Name: "t1", CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatalf("CreateTenant: %v", err)
+	}
+	region := models.Region{
+		Name: "r1", Tenant: "t1", IPv4CIDR: "10.0.0.0/8",
+		Zones: []models.Zone{{Name: "z1", IPv4CIDR: "10.0.0.0/16", SubZones: []models.SubZone{{Name: "s1", IPv4CIDR: "10.0.1.0/24"}}}},
+	}
+	if err := repo.CreateRegion(ctx, &region); err != nil {
+		t.Fatalf("CreateRegion: %v", err)
+	}
+
+	keys := services.NewAPIKeyService(repo, zap.NewNop())
+	createKey := func(name, role, tenant string) string {
+		response, err := keys.CreateKey(ctx, &models.CreateAPIKeyRequest{Name: name, Role: role, Tenant: tenant})
+		if err != nil {
+			t.Fatalf("CreateKey(%s): %v", name, err)
+		}
+		return response.Key
+	}
+	platformViewer := createKey("platform-viewer", models.RoleViewer, "")
+	tenantAdmin := createKey("tenant-admin", models.RoleAdmin, "t1")
+
+	cfg := &config.Config{Auth: config.AuthConfig{Enabled: true}, Metrics: config.MetricsConfig{SubZoneRefresh: time.Minute}}
+	router := SetupRoutes(repo, cfg, zap.NewNop())
+
+	tests := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"tenant-bound admin", tenantAdmin, http.StatusForbidden},
+		{"platform viewer", platformViewer, http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tt.key != "" {
+			req.Header.Set(middleware.APIKeyHeader, tt.key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Fatalf("%s: GET /metrics = %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if tt.want == http.StatusOK && !strings.Contains(w.Body.String(), `sub_zone="s1",tenant="t1"`) {
+			t.Fatalf("%s: metrics lack the sub-zone gauges:\n%s", tt.name, w.Body.String())
+		}
+	}
+}
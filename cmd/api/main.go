@@ -13,6 +13,9 @@ import (
 	"ip-allocator-api/api"
 	"ip-allocator-api/internal/config"
 	"ip-allocator-api/internal/database"
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/tracing"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -40,25 +43,115 @@ func main() {
 	logger.Info("Configuration loaded",
 		zap.String("host", cfg.Server.Host),
 		zap.String("port", cfg.Server.Port),
+		zap.String("storage", cfg.Storage.Driver),
 		zap.String("database", cfg.MongoDB.Database))
 
-	// Connect to MongoDB
-	client, err := database.ConnectDB(cfg.MongoDB.URI, cfg.MongoDB.Database)
+	// Install the tracer provider before anything creates spans
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, logger)
 	if err != nil {
-		logger.Fatal("Failed to connect to MongoDB", zap.Error(err))
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
 	}
 	defer func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		if err := client.Disconnect(ctx); err != nil {
-			logger.Error("Failed to disconnect from MongoDB", zap.Error(err))
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("Failed to flush traces", zap.Error(err))
 		}
 	}()
 
-	logger.Info("Successfully connected to MongoDB")
+	indexCtx, indexCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer indexCancel()
+
+	// Open the configured storage backend; regions, IPs and everything around them are kept
+	// behind the storage repository
+	var repo storage.Repository
+	switch cfg.Storage.Driver {
+	case config.StorageDriverFile:
+		fileRepo, err := storage.NewFileRepository(cfg.Storage.Path, logger)
+		if err != nil {
+			logger.Fatal("Failed to open file storage", zap.Error(err), zap.String("path", cfg.Storage.Path))
+		}
+		defer func() {
+			if err := fileRepo.Close(); err != nil {
+				logger.Error("Failed to close file storage", zap.Error(err))
+			}
+		}()
+		repo = fileRepo
+
+		logger.Info("Using file storage", zap.String("path", cfg.Storage.Path))
+
+	case config.StorageDriverMongoDB:
+		// Connect to MongoDB
+		client, err := database.ConnectDB(cfg.MongoDB.URI, cfg.MongoDB.Database)
+		if err != nil {
+			logger.Fatal("Failed to connect to MongoDB", zap.Error(err))
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := client.Disconnect(ctx); err != nil {
+				logger.Error("Failed to disconnect from MongoDB", zap.Error(err))
+			}
+		}()
+
+		logger.Info("Successfully connected to MongoDB")
+
+		if err := database.EnsureIndexes(indexCtx, client.Database(cfg.MongoDB.Database)); err != nil {
+			logger.Fatal("Failed to create MongoDB indexes", zap.Error(err))
+		}
+
+		repo = storage.NewMongoRepository(client.Database(cfg.MongoDB.Database), logger)
+		migration := services.NewMigrationService(repo, client.Database(cfg.MongoDB.Database), logger)
+
+		// Data stored before tenants existed belongs to the default tenant
+		if err := migration.AssignDefaultTenant(indexCtx); err != nil {
+			logger.Fatal("Failed to assign existing data to the default tenant", zap.Error(err))
+		}
+
+		// IPs are only read from their own documents, so addresses still listed in sub-zones
+		// would look free until moved there
+		migrateCtx, migrateCancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		_, err = migration.MigrateEmbeddedIPs(migrateCtx, false)
+		migrateCancel()
+		if err != nil {
+			logger.Fatal("Failed to migrate embedded IP arrays", zap.Error(err))
+		}
+
+	default:
+		logger.Fatal("Unknown storage driver",
+			zap.String("driver", cfg.Storage.Driver),
+			zap.Strings("supported", []string{config.StorageDriverMongoDB, config.StorageDriverFile}))
+	}
+
+	if err := services.NewTenantService(repo, logger).EnsureDefaultTenant(indexCtx); err != nil {
+		logger.Fatal("Failed to create the default tenant", zap.Error(err))
+	}
+
+	// Store the bootstrap admin key so the first API keys can be created
+	if cfg.Auth.Enabled {
+		if cfg.Auth.BootstrapKey != "" {
+			keyCtx, keyCancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err := services.NewAPIKeyService(repo, logger).EnsureBootstrapKey(keyCtx, cfg.Auth.BootstrapKey)
+			keyCancel()
+			if err != nil {
+				logger.Fatal("Failed to store bootstrap API key", zap.Error(err))
+			}
+			logger.Info("Bootstrap API key stored", zap.String("name", services.BootstrapKeyName))
+		} else if !cfg.Auth.JWT.Enabled {
+			logger.Warn("Authentication is enabled without a bootstrap key; only existing API keys can call the API")
+		}
+	} else {
+		logger.Warn("Authentication is disabled; every endpoint is open to unauthenticated callers")
+	}
+
+	// Start the lease reaper that releases expired allocations
+	reaperCtx, stopReaper := context.WithCancel(context.Background())
+	defer stopReaper()
+	reaper := services.NewLeaseReaper(repo, cfg.Leases.ReapInterval, logger)
+	go reaper.Run(reaperCtx)
 
 	// Setup routes with Gin framework
-	router := api.SetupRoutes(client.Database(cfg.MongoDB.Database), logger)
+	router := api.SetupRoutes(repo, cfg, logger)
 
 	// Create HTTP server with production-ready settings
 	server := &http.Server{
@@ -86,6 +179,9 @@ func main() {
 
 	logger.Info("Shutting down server...")
 
+	// Stop releasing leases before the storage is closed
+	stopReaper()
+
 	// Graceful shutdown with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -0,0 +1,137 @@
+// Command devtoken issues OIDC-style bearer tokens from a locally generated keypair, and writes
+// the matching JWKS file for auth.jwt.jwks_file, so JWT authentication can be exercised without
+// an identity provider.
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"ip-allocator-api/internal/services"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func main() {
+	keyFile := flag.String("key", "dev-jwt-key.pem", "private key file, generated if it does not exist")
+	jwksFile := flag.String("jwks", "dev-jwks.json", "JWKS file to write for the public key")
+	alg := flag.String("alg", "RS256", "signing algorithm of a generated key: RS256 or ES256")
+	kid := flag.String("kid", "dev", "key id")
+	subject := flag.String("sub", "dev-user", "subject claim")
+	claim := flag.String("claim", "groups", "claim holding the role mapping values")
+	groups := flag.String("groups", "", "comma separated values of the role mapping claim")
+	issuer := flag.String("iss", "", "issuer claim")
+	audience := flag.String("aud", "", "audience claim")
+	ttl := flag.Duration("ttl", time.Hour, "token lifetime")
+	flag.Parse()
+
+	key, err := loadOrGenerateKey(*keyFile, *alg)
+	if err != nil {
+		fail(err)
+	}
+
+	jwk, err := services.NewJSONWebKey(*kid, key.Public())
+	if err != nil {
+		fail(err)
+	}
+	jwks, err := json.MarshalIndent(services.JSONWebKeySet{Keys: []services.JSONWebKey{jwk}}, "", "  ")
+	if err != nil {
+		fail(err)
+	}
+	if err := os.WriteFile(*jwksFile, jwks, 0o644); err != nil {
+		fail(err)
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"sub": *subject,
+		"iat": now.Unix(),
+		"exp": now.Add(*ttl).Unix(),
+	}
+	if *groups != "" {
+		claims[*claim] = strings.Split(*groups, ",")
+	}
+	if *issuer != "" {
+		claims["iss"] = *issuer
+	}
+	if *audience != "" {
+		claims["aud"] = *audience
+	}
+
+	method := jwt.SigningMethod(jwt.SigningMethodRS256)
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		method = jwt.SigningMethodES256
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = *kid
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Println(signed)
+}
+
+// loadOrGenerateKey reads a PKCS #8 PEM private key, creating and saving one for alg when the
+// file does not exist
+func loadOrGenerateKey(path, alg string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+		}
+		return signer, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	var key crypto.Signer
+	switch alg {
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Generated %s key in %s\n", alg, path)
+	return key, nil
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "devtoken:", err)
+	os.Exit(1)
+}
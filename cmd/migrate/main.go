@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/database"
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// migrate converts the IP arrays embedded in region documents into one
+// ip_allocations document per address. The API runs the same migration when it starts;
+// this command allows a dry run and a longer timeout beforehand.
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report what would be migrated without writing")
+	timeout := flag.Duration("timeout", 30*time.Minute, "maximum duration of the migration")
+	flag.Parse()
+
+	logger, err := zap.NewProduction(zap.Fields(zap.String("service", "ip-allocator-migrate")))
+	if err != nil {
+		log.Fatalf("Failed to initialize logger: %v", err)
+	}
+	defer logger.Sync()
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		logger.Fatal("Failed to load configuration", zap.Error(err))
+	}
+
+	client, err := database.ConnectDB(cfg.MongoDB.URI, cfg.MongoDB.Database)
+	if err != nil {
+		logger.Fatal("Failed to connect to MongoDB", zap.Error(err))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(cfg.MongoDB.Database)
+	if err := database.EnsureIndexes(ctx, db); err != nil {
+		logger.Fatal("Failed to create indexes", zap.Error(err))
+	}
+
+	migration := services.NewMigrationService(storage.NewMongoRepository(db, logger), db, logger)
+	if !*dryRun {
+		if err := migration.AssignDefaultTenant(ctx); err != nil {
+			logger.Fatal("Failed to assign existing data to the default tenant", zap.Error(err))
+		}
+	}
+
+	report, err := migration.MigrateEmbeddedIPs(ctx, *dryRun)
+	if err != nil {
+		logger.Fatal("Migration failed", zap.Error(err))
+	}
+
+	logger.Info("Migration finished",
+		zap.Int("regions_scanned", report.RegionsScanned),
+		zap.Int("sub_zones_migrated", report.SubZonesMigrated),
+		zap.Int("ips_migrated", report.IPsMigrated),
+		zap.Int("ips_skipped", report.IPsSkipped),
+		zap.Bool("dry_run", report.DryRun))
+}
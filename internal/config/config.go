@@ -1,13 +1,24 @@
 package config
 
 import (
+	"strings"
+	"time"
+
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Server  ServerConfig  `mapstructure:"server"`
-	MongoDB MongoDBConfig `mapstructure:"mongodb"`
-	Logging LoggingConfig `mapstructure:"logging"`
+	Server      ServerConfig      `mapstructure:"server"`
+	Storage     StorageConfig     `mapstructure:"storage"`
+	MongoDB     MongoDBConfig     `mapstructure:"mongodb"`
+	Logging     LoggingConfig     `mapstructure:"logging"`
+	Leases      LeaseConfig       `mapstructure:"leases"`
+	Idempotency IdempotencyConfig `mapstructure:"idempotency"`
+	Auth        AuthConfig        `mapstructure:"auth"`
+	CORS        CORSConfig        `mapstructure:"cors"`
+	Quotas      QuotaConfig       `mapstructure:"quotas"`
+	Tracing     TracingConfig     `mapstructure:"tracing"`
+	Metrics     MetricsConfig     `mapstructure:"metrics"`
 }
 
 type ServerConfig struct {
@@ -15,6 +26,21 @@ type ServerConfig struct {
 	Port string `mapstructure:"port"`
 }
 
+// Storage drivers
+const (
+	StorageDriverMongoDB = "mongodb"
+	StorageDriverFile    = "file"
+)
+
+// StorageConfig selects where regions, IPs and everything around them are stored
+type StorageConfig struct {
+	// Driver is mongodb, using the mongodb section, or file, keeping the state in Path on
+	// local disk without any external dependency
+	Driver string `mapstructure:"driver"`
+	// Path is the directory of the file driver's snapshot and write-ahead log
+	Path string `mapstructure:"path"`
+}
+
 type MongoDBConfig struct {
 	URI      string `mapstructure:"uri"`
 	Database string `mapstructure:"database"`
@@ -25,6 +51,93 @@ type LoggingConfig struct {
 	Format string `mapstructure:"format"`
 }
 
+// LeaseConfig controls the expiry of IP leases
+type LeaseConfig struct {
+	ReapInterval       time.Duration `mapstructure:"reap_interval"`
+	ExpiringSoonWindow time.Duration `mapstructure:"expiring_soon_window"`
+}
+
+// IdempotencyConfig controls how long Idempotency-Key responses are kept for replay
+type IdempotencyConfig struct {
+	Window time.Duration `mapstructure:"window"`
+}
+
+// AuthConfig controls authentication of API requests
+type AuthConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// BootstrapKey is stored at startup as the unscoped admin API key named bootstrap, so the
+	// first keys can be created through the API
+	BootstrapKey string    `mapstructure:"bootstrap_key"`
+	JWT          JWTConfig `mapstructure:"jwt"`
+}
+
+// JWTConfig controls validation of OIDC bearer tokens signed with RS256 or ES256
+type JWTConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Exactly one of JWKSFile and JWKSURL holds the issuer's verification keys
+	JWKSFile    string        `mapstructure:"jwks_file"`
+	JWKSURL     string        `mapstructure:"jwks_url"`
+	JWKSRefresh time.Duration `mapstructure:"jwks_refresh"`
+	// Issuer and Audience are checked against the iss and aud claims when set
+	Issuer   string        `mapstructure:"issuer"`
+	Audience string        `mapstructure:"audience"`
+	Leeway   time.Duration `mapstructure:"leeway"`
+	// SubjectClaim identifies the caller; RolesClaim holds the values matched by RoleMappings
+	SubjectClaim string           `mapstructure:"subject_claim"`
+	RolesClaim   string           `mapstructure:"roles_claim"`
+	RoleMappings []JWTRoleMapping `mapstructure:"role_mappings"`
+}
+
+// JWTRoleMapping grants a role, optionally bound to a tenant and scoped to a region or zone of
+// it, to tokens whose roles claim contains Value. Mappings without a tenant grant platform-wide
+// access. The first matching mapping applies, so list the broadest grants first.
+type JWTRoleMapping struct {
+	Value  string `mapstructure:"value"`
+	Role   string `mapstructure:"role"`
+	Tenant string `mapstructure:"tenant"`
+	Region string `mapstructure:"region"`
+	Zone   string `mapstructure:"zone"`
+}
+
+// CORSConfig lists the browser origins allowed to call the API. Credentials are only allowed
+// when the origins are listed explicitly rather than with "*".
+type CORSConfig struct {
+	AllowOrigins []string `mapstructure:"allow_origins"`
+}
+
+// QuotaConfig limits the IPs held, counting both allocated and reserved addresses. A limit of 0
+// disables that quota.
+type QuotaConfig struct {
+	// MaxIPsPerTenant limits the IPs held across all regions of a tenant
+	MaxIPsPerTenant int64 `mapstructure:"max_ips_per_tenant"`
+	// MaxIPsPerOwner limits the IPs held by an owner within a tenant
+	MaxIPsPerOwner int64 `mapstructure:"max_ips_per_owner"`
+	// MaxIPsPerActor limits the IPs held by an API key or token subject within a tenant
+	MaxIPsPerActor int64 `mapstructure:"max_ips_per_actor"`
+	// MaxSubZoneUtilization is the percentage of a sub-zone's IPv4 or IPv6 range that may be held
+	MaxSubZoneUtilization float64 `mapstructure:"max_sub_zone_utilization"`
+}
+
+// TracingConfig controls OpenTelemetry tracing of requests, service methods and MongoDB commands
+type TracingConfig struct {
+	// Exporter is none, otlp (OTLP over HTTP), stdout or file
+	Exporter string `mapstructure:"exporter"`
+	// Endpoint is the host:port of the OTLP collector; empty uses the OTEL_EXPORTER_OTLP_* variables
+	Endpoint string `mapstructure:"endpoint"`
+	Insecure bool   `mapstructure:"insecure"`
+	// File receives one JSON span per line with the file exporter
+	File        string  `mapstructure:"file"`
+	ServiceName string  `mapstructure:"service_name"`
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
+// MetricsConfig controls the Prometheus metrics served on /metrics to platform-wide viewers
+type MetricsConfig struct {
+	// SubZoneRefresh is how long the per-sub-zone address gauges are served from cache before
+	// a scrape reads them again; 0 reads them on every scrape
+	SubZoneRefresh time.Duration `mapstructure:"sub_zone_refresh"`
+}
+
 func LoadConfig() (*Config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -34,14 +147,44 @@ func LoadConfig() (*Config, error) {
 	// Set default values
 	viper.SetDefault("server.host", "0.0.0.0")
 	viper.SetDefault("server.port", "8080")
+	viper.SetDefault("storage.driver", StorageDriverMongoDB)
+	viper.SetDefault("storage.path", "data")
 	viper.SetDefault("mongodb.uri", "mongodb://localhost:27017")
 	viper.SetDefault("mongodb.database", "ip_allocator")
 	viper.SetDefault("logging.level", "info")
 	viper.SetDefault("logging.format", "json")
+	viper.SetDefault("leases.reap_interval", "1m")
+	viper.SetDefault("leases.expiring_soon_window", "1h")
+	viper.SetDefault("idempotency.window", "24h")
+	viper.SetDefault("auth.enabled", true)
+	viper.SetDefault("auth.bootstrap_key", "")
+	viper.SetDefault("auth.jwt.enabled", false)
+	viper.SetDefault("auth.jwt.jwks_file", "")
+	viper.SetDefault("auth.jwt.jwks_url", "")
+	viper.SetDefault("auth.jwt.jwks_refresh", "15m")
+	viper.SetDefault("auth.jwt.issuer", "")
+	viper.SetDefault("auth.jwt.audience", "")
+	viper.SetDefault("auth.jwt.leeway", "30s")
+	viper.SetDefault("auth.jwt.subject_claim", "sub")
+	viper.SetDefault("auth.jwt.roles_claim", "groups")
+	viper.SetDefault("cors.allow_origins", []string{"*"})
+	viper.SetDefault("quotas.max_ips_per_tenant", 0)
+	viper.SetDefault("quotas.max_ips_per_owner", 0)
+	viper.SetDefault("quotas.max_ips_per_actor", 0)
+	viper.SetDefault("quotas.max_sub_zone_utilization", 0)
+	viper.SetDefault("tracing.exporter", "none")
+	viper.SetDefault("tracing.endpoint", "")
+	viper.SetDefault("tracing.insecure", false)
+	viper.SetDefault("tracing.file", "traces.jsonl")
+	viper.SetDefault("tracing.service_name", "ip-allocator-api")
+	viper.SetDefault("tracing.sample_ratio", 1.0)
+	viper.SetDefault("metrics.sub_zone_refresh", "1m")
 
 	// Enable environment variable binding
 	viper.AutomaticEnv()
 	viper.SetEnvPrefix("IP_ALLOCATOR")
+	// Nested keys map to variables such as IP_ALLOCATOR_AUTH_BOOTSTRAP_KEY
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
 	// Read configuration file
 	if err := viper.ReadInConfig(); err != nil {
@@ -4,6 +4,10 @@ import (
 	"context"
 	"time"
 
+	"ip-allocator-api/internal/metrics"
+	"ip-allocator-api/internal/tracing"
+
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -16,7 +20,8 @@ func ConnectDB(uri, dbName string) (*mongo.Client, error) {
 		SetMaxPoolSize(100).
 		SetMinPoolSize(5).
 		SetMaxConnIdleTime(30 * time.Second).
-		SetMaxConnecting(10)
+		SetMaxConnecting(10).
+		SetMonitor(chainMonitors(metrics.CommandMonitor(), tracing.CommandMonitor()))
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -39,3 +44,30 @@ func ConnectDB(uri, dbName string) (*mongo.Client, error) {
 func ContextWithTimeout() (context.Context, context.CancelFunc) {
 	return context.WithTimeout(context.Background(), 30*time.Second)
 }
+
+// chainMonitors returns a command monitor passing every event to each of monitors in order
+func chainMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, monitor := range monitors {
+				if monitor.Started != nil {
+					monitor.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, monitor := range monitors {
+				if monitor.Succeeded != nil {
+					monitor.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, monitor := range monitors {
+				if monitor.Failed != nil {
+					monitor.Failed(ctx, e)
+				}
+			}
+		},
+	}
+}
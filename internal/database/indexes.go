@@ -0,0 +1,184 @@
+package database
+
+import (
+	"context"
+	"errors"
+
+	"ip-allocator-api/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// supersededIndexes were created without a tenant prefix. Their unique constraints span
+// tenants and they cannot serve tenant-scoped queries, so they are dropped in favour of the
+// tenant-prefixed replacements.
+var supersededIndexes = map[string][]string{
+	models.IPAllocationCollection: {"uniq_region_zone_subzone_ip", "idx_region_zone_subzone_owner", "idx_ip_address", "idx_created_by"},
+	models.AuditCollection:        {"idx_timestamp", "idx_resource_path_timestamp", "idx_ip_addresses_timestamp", "idx_actor_timestamp"},
+}
+
+// EnsureIndexes creates the indexes the services rely on for correctness
+func EnsureIndexes(ctx context.Context, db *mongo.Database) error {
+	for collection, names := range supersededIndexes {
+		for _, name := range names {
+			if _, err := db.Collection(collection).Indexes().DropOne(ctx, name); err != nil && !isIndexNotFound(err) {
+				return err
+			}
+		}
+	}
+
+	// One document per address in a sub-zone; concurrent allocations of the same
+	// IP are rejected by this index
+	_, err := db.Collection(models.IPAllocationCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "tenant", Value: 1},
+				{Key: "region", Value: 1},
+				{Key: "zone", Value: 1},
+				{Key: "sub_zone", Value: 1},
+				{Key: "ip_address", Value: 1},
+			},
+			Options: options.Index().SetName("uniq_tenant_region_zone_subzone_ip").SetUnique(true),
+		},
+		// Supports reading the state version of a sub-zone without scanning its IPs
+		{
+			Keys: bson.D{
+				{Key: "tenant", Value: 1},
+				{Key: "region", Value: 1},
+				{Key: "zone", Value: 1},
+				{Key: "sub_zone", Value: 1},
+				{Key: "updated_at", Value: -1},
+			},
+			Options: options.Index().SetName("idx_tenant_region_zone_subzone_updated_at"),
+		},
+		// Supports releasing IPs by owner
+		{
+			Keys: bson.D{
+				{Key: "tenant", Value: 1},
+				{Key: "region", Value: 1},
+				{Key: "zone", Value: 1},
+				{Key: "sub_zone", Value: 1},
+				{Key: "owner", Value: 1},
+			},
+			Options: options.Index().SetName("idx_tenant_region_zone_subzone_owner").SetSparse(true),
+		},
+		// Support counting the IPs held against the owner and actor quotas
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "owner", Value: 1}},
+			Options: options.Index().SetName("idx_tenant_owner").SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "created_by", Value: 1}},
+			Options: options.Index().SetName("idx_tenant_created_by").SetSparse(true),
+		},
+		// Supports looking up the current holders of an address across sub-zones
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "ip_address", Value: 1}},
+			Options: options.Index().SetName("idx_tenant_ip_address"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Allocation cursors are kept once per sub-zone
+	_, err = db.Collection(models.AllocationCursorCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "tenant", Value: 1},
+			{Key: "region", Value: 1},
+			{Key: "zone", Value: 1},
+			{Key: "sub_zone", Value: 1},
+		},
+		Options: options.Index().SetName("uniq_tenant_region_zone_subzone").SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Tenants are addressed by name
+	_, err = db.Collection(models.TenantCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetName("uniq_name").SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Idempotency keys are unique per operation and removed by MongoDB once they expire
+	_, err = db.Collection(models.IdempotencyCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}, {Key: "operation", Value: 1}},
+			Options: options.Index().SetName("uniq_key_operation").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetName("ttl_expires_at").SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Collection(models.RegionCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// Region names are unique within a tenant
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "name", Value: 1}},
+			Options: options.Index().SetName("uniq_tenant_name").SetUnique(true),
+		},
+		// The lookup index checks the latest region update to decide whether it is stale
+		{
+			Keys:    bson.D{{Key: "updated_at", Value: -1}},
+			Options: options.Index().SetName("idx_updated_at"),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// API keys are looked up by the hash of the presented secret and named uniquely
+	_, err = db.Collection(models.APIKeyCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key_hash", Value: 1}},
+			Options: options.Index().SetName("uniq_key_hash").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "name", Value: 1}},
+			Options: options.Index().SetName("uniq_name").SetUnique(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Audit events are queried per tenant newest first, optionally narrowed by resource, IP or actor
+	_, err = db.Collection(models.AuditCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "timestamp", Value: -1}},
+			Options: options.Index().SetName("idx_tenant_timestamp"),
+		},
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "resource_path", Value: 1}, {Key: "timestamp", Value: -1}},
+			Options: options.Index().SetName("idx_tenant_resource_path_timestamp"),
+		},
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "ip_addresses", Value: 1}, {Key: "timestamp", Value: -1}},
+			Options: options.Index().SetName("idx_tenant_ip_addresses_timestamp"),
+		},
+		{
+			Keys:    bson.D{{Key: "tenant", Value: 1}, {Key: "actor", Value: 1}, {Key: "timestamp", Value: -1}},
+			Options: options.Index().SetName("idx_tenant_actor_timestamp"),
+		},
+	})
+	return err
+}
+
+// isIndexNotFound reports whether a drop failed because the index or collection does not exist
+func isIndexNotFound(err error) bool {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Code == 26 || cmdErr.Code == 27 || cmdErr.Name == "IndexNotFound" || cmdErr.Name == "NamespaceNotFound"
+	}
+	return false
+}
@@ -6,53 +6,74 @@ import (
 	"strconv"
 	"time"
 
+	"ip-allocator-api/internal/config"
 	"ip-allocator-api/internal/models"
 	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/storage"
 	"ip-allocator-api/internal/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 )
 
 type AllocationHandler struct {
-	service     *services.AllocationService
-	crudService *services.CRUDService
-	validator   *validator.Validate
-	logger      *zap.Logger
+	service       *services.AllocationService
+	crudService   *services.CRUDService
+	auditService  *services.AuditService
+	lookupService *services.LookupService
+	apiKeyService *services.APIKeyService
+	tenantService *services.TenantService
+	quotaService  *services.QuotaService
+	validator     *validator.Validate
+	config        *config.Config
+	logger        *zap.Logger
 }
 
-func NewAllocationHandler(db *mongo.Database, logger *zap.Logger) *AllocationHandler {
+func NewAllocationHandler(repo storage.Repository, cfg *config.Config, logger *zap.Logger) *AllocationHandler {
 	return &AllocationHandler{
-		service:     services.NewAllocationService(db, logger),
-		crudService: services.NewCRUDService(db, logger),
-		validator:   validator.New(),
-		logger:      logger,
+		service:       services.NewAllocationService(repo, cfg.Quotas, logger),
+		crudService:   services.NewCRUDService(repo, logger),
+		auditService:  services.NewAuditService(repo, logger),
+		lookupService: services.NewLookupService(repo, logger),
+		apiKeyService: services.NewAPIKeyService(repo, logger),
+		tenantService: services.NewTenantService(repo, logger),
+		quotaService:  services.NewQuotaService(repo, cfg.Quotas, logger),
+		validator:     validator.New(),
+		config:        cfg,
+		logger:        logger,
 	}
 }
 
+// log returns the request-scoped logger, which tags every line with the request ID
+func (h *AllocationHandler) log(c *gin.Context) *zap.Logger {
+	return services.LoggerFromContext(c.Request.Context(), h.logger)
+}
+
+// requestContext returns the request's context bounded by timeout. It carries the caller, which
+// the services record in the audit trail, the request's trace and the request-scoped logger, and
+// is cancelled when the client goes away.
+func requestContext(c *gin.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request.Context(), timeout)
+}
+
 // ===============================
 // IP ALLOCATION METHODS
 // ===============================
 
 // AllocateIPs handles IP allocation requests using Gin framework with enhanced logging
 func (h *AllocationHandler) AllocateIPs(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	var req models.AllocationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		h.logger.Warn("Invalid JSON payload for IP allocation",
+		h.log(c).Warn("Invalid JSON payload for IP allocation",
 			zap.Error(err),
 			zap.String("endpoint", "/allocate"),
 			zap.String("client_ip", c.ClientIP()),
 			zap.String("user_agent", c.GetHeader("User-Agent")))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid JSON payload: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
 		return
 	}
 
@@ -63,148 +84,164 @@ func (h *AllocationHandler) AllocateIPs(c *gin.Context) {
 
 	// Validate request structure
 	if err := h.validator.Struct(&req); err != nil {
-		h.logger.Warn("Validation error in IP allocation",
+		h.log(c).Warn("Validation error in IP allocation",
 			zap.Error(err),
 			zap.Any("request", req),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Validation error: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteValidationError(c, err.Error())
 		return
 	}
 
 	// Additional validation for IP version
 	if !utils.ValidateIPVersion(req.IPVersion) {
-		h.logger.Warn("Invalid IP version requested",
+		h.log(c).Warn("Invalid IP version requested",
+			zap.String("ip_version", req.IPVersion),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Invalid IP version. Must be 'ipv4', 'ipv6', or 'both'")
+		return
+	}
+
+	// Explicit per-family counts and host pairs apply to dual-stack requests only
+	if (req.IPv4Count > 0 || req.IPv6Count > 0 || req.HostPairs) && req.IPVersion != "both" {
+		h.log(c).Warn("Dual-stack options used without ip_version both",
 			zap.String("ip_version", req.IPVersion),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid IP version. Must be 'ipv4', 'ipv6', or 'both'",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "ipv4_count, ipv6_count and host_pairs require ip_version 'both'")
+		return
+	}
+	if req.HostPairs && (req.IPv4Count > 0 || req.IPv6Count > 0) {
+		h.log(c).Warn("host_pairs combined with explicit counts",
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "host_pairs allocates count IPv4/IPv6 pairs and cannot be combined with ipv4_count or ipv6_count")
+		return
+	}
+
+	// Strict preferred IPs only make sense when preferred IPs are given
+	if req.StrictPreferred && len(req.PreferredIPs) == 0 {
+		h.log(c).Warn("strict_preferred requested without preferred IPs",
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "strict_preferred requires preferred_ips")
+		return
+	}
+
+	// A contiguous run is chosen by position, so it cannot also honour preferred IPs, and its
+	// alignment is a prefix length of a single IP version
+	if msg := validateContiguous(&req); msg != "" {
+		h.log(c).Warn("Invalid contiguous allocation request",
+			zap.String("reason", msg),
+			zap.Bool("contiguous", req.Contiguous),
+			zap.Int("align_prefix", req.AlignPrefix),
+			zap.String("ip_version", req.IPVersion),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, msg)
+		return
+	}
+
+	// Validate the optional lease lifetime
+	if msg := validateLease(req.TTL, req.ExpiresAt, false); msg != "" {
+		h.log(c).Warn("Invalid lease in allocation request",
+			zap.String("reason", msg),
+			zap.Int64("ttl", req.TTL),
+			zap.Timep("expires_at", req.ExpiresAt),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, msg)
 		return
 	}
 
 	// Enhanced validation for preferred IPs with CIDR checking
 	for _, ip := range req.PreferredIPs {
 		if utils.NormalizeIP(ip) == "" {
-			h.logger.Warn("Invalid preferred IP in allocation request",
+			h.log(c).Warn("Invalid preferred IP in allocation request",
 				zap.String("invalid_ip", ip),
 				zap.Any("request", req),
 				zap.String("client_ip", c.ClientIP()))
-			c.JSON(http.StatusBadRequest, gin.H{
-				"success":   false,
-				"message":   "Invalid IP address in preferred IPs: " + ip,
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
+			utils.WriteBadRequestError(c, "Invalid IP address in preferred IPs: "+ip)
 			return
 		}
 	}
 
+	if !h.authorizeScope(c, req.Region, req.Zone) {
+		return
+	}
+
 	// Call service to allocate IPs
 	response, err := h.service.AllocateIPs(ctx, &req)
 	if err != nil {
-		h.logger.Error("IP allocation service error",
-			zap.Error(err),
-			zap.Any("request", req),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to allocate IPs: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		h.writeError(c, err, "Failed to allocate IPs",
+			zap.Any("request", req))
 		return
 	}
 
-	// Log successful allocation
-	if response.Success {
-		h.logger.Info("IP allocation successful",
-			zap.String("region", req.Region),
-			zap.String("zone", req.Zone),
-			zap.String("subzone", req.SubZone),
-			zap.Int("allocated_count", len(response.AllocatedIPs)),
-			zap.String("ip_version", req.IPVersion),
-			zap.String("client_ip", c.ClientIP()))
-	}
+	h.log(c).Info("IP allocation successful",
+		zap.String("region", req.Region),
+		zap.String("zone", req.Zone),
+		zap.String("subzone", req.SubZone),
+		zap.Int("allocated_count", len(response.AllocatedIPs)),
+		zap.Int("host_pair_count", len(response.HostPairs)),
+		zap.String("ip_version", req.IPVersion),
+		zap.Timep("expires_at", response.ExpiresAt),
+		zap.String("client_ip", c.ClientIP()))
 
-	// Return response
-	if response.Success {
-		c.JSON(http.StatusOK, response)
-	} else {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   response.Message,
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	}
+	c.JSON(http.StatusOK, response)
 }
 
 // DeallocateIPs handles IP deallocation requests with enhanced validation
 func (h *AllocationHandler) DeallocateIPs(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	var req models.DeallocationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		h.logger.Warn("Invalid JSON payload for IP deallocation",
+		h.log(c).Warn("Invalid JSON payload for IP deallocation",
 			zap.Error(err),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid JSON payload: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
 		return
 	}
 
 	if err := h.validator.Struct(&req); err != nil {
-		h.logger.Warn("Validation error in IP deallocation",
+		h.log(c).Warn("Validation error in IP deallocation",
 			zap.Error(err),
 			zap.Any("request", req),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Validation error: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteValidationError(c, err.Error())
+		return
+	}
+
+	// IPs are released either by address or by owner / label selector
+	if req.HasSelector() == (len(req.IPAddresses) > 0) {
+		h.log(c).Warn("Invalid IP selection in deallocation request",
+			zap.Any("request", req),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Specify either ip_addresses or an owner / labels selector, not both")
 		return
 	}
 
 	// Enhanced IP address validation
 	for _, ip := range req.IPAddresses {
 		if utils.NormalizeIP(ip) == "" {
-			h.logger.Warn("Invalid IP address in deallocation request",
+			h.log(c).Warn("Invalid IP address in deallocation request",
 				zap.String("invalid_ip", ip),
 				zap.String("client_ip", c.ClientIP()))
-			c.JSON(http.StatusBadRequest, gin.H{
-				"success":   false,
-				"message":   "Invalid IP address: " + ip,
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
+			utils.WriteBadRequestError(c, "Invalid IP address: "+ip)
 			return
 		}
 	}
 
+	if !h.authorizeScope(c, req.Region, req.Zone) {
+		return
+	}
+
 	response, err := h.service.DeallocateIPs(ctx, &req)
 	if err != nil {
-		h.logger.Error("IP deallocation service error",
-			zap.Error(err),
-			zap.Any("request", req),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to deallocate IPs: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		h.writeError(c, err, "Failed to deallocate IPs",
+			zap.Any("request", req))
 		return
 	}
 
 	// Log successful deallocation
 	if response.Success {
-		h.logger.Info("IP deallocation successful",
+		h.log(c).Info("IP deallocation successful",
 			zap.String("region", req.Region),
 			zap.String("zone", req.Zone),
 			zap.String("subzone", req.SubZone),
@@ -217,19 +254,15 @@ func (h *AllocationHandler) DeallocateIPs(c *gin.Context) {
 
 // ReserveIPs handles IP reservation requests with enhanced CIDR validation
 func (h *AllocationHandler) ReserveIPs(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	var req models.ReservationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		h.logger.Warn("Invalid JSON payload for IP reservation",
+		h.log(c).Warn("Invalid JSON payload for IP reservation",
 			zap.Error(err),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid JSON payload: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
 		return
 	}
 
@@ -237,50 +270,39 @@ func (h *AllocationHandler) ReserveIPs(c *gin.Context) {
 	req.ReservationType = "reserve"
 
 	if err := h.validator.Struct(&req); err != nil {
-		h.logger.Warn("Validation error in IP reservation",
+		h.log(c).Warn("Validation error in IP reservation",
 			zap.Error(err),
 			zap.Any("request", req),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Validation error: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteValidationError(c, err.Error())
 		return
 	}
 
 	// Enhanced IP address validation
 	for _, ip := range req.IPAddresses {
 		if utils.NormalizeIP(ip) == "" {
-			h.logger.Warn("Invalid IP address in reservation request",
+			h.log(c).Warn("Invalid IP address in reservation request",
 				zap.String("invalid_ip", ip),
 				zap.String("client_ip", c.ClientIP()))
-			c.JSON(http.StatusBadRequest, gin.H{
-				"success":   false,
-				"message":   "Invalid IP address: " + ip,
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
+			utils.WriteBadRequestError(c, "Invalid IP address: "+ip)
 			return
 		}
 	}
 
+	if !h.authorizeScope(c, req.Region, req.Zone) {
+		return
+	}
+
 	response, err := h.service.ManageReservations(ctx, &req)
 	if err != nil {
-		h.logger.Error("IP reservation service error",
-			zap.Error(err),
-			zap.Any("request", req),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to reserve IPs: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		h.writeError(c, err, "Failed to reserve IPs",
+			zap.Any("request", req))
 		return
 	}
 
 	// Log successful reservation
 	if response.Success {
-		h.logger.Info("IP reservation successful",
+		h.log(c).Info("IP reservation successful",
 			zap.String("region", req.Region),
 			zap.String("zone", req.Zone),
 			zap.String("subzone", req.SubZone),
@@ -293,19 +315,15 @@ func (h *AllocationHandler) ReserveIPs(c *gin.Context) {
 
 // UnreserveIPs handles IP unreservation requests
 func (h *AllocationHandler) UnreserveIPs(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	var req models.ReservationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		h.logger.Warn("Invalid JSON payload for IP unreservation",
+		h.log(c).Warn("Invalid JSON payload for IP unreservation",
 			zap.Error(err),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid JSON payload: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
 		return
 	}
 
@@ -313,85 +331,167 @@ func (h *AllocationHandler) UnreserveIPs(c *gin.Context) {
 	req.ReservationType = "unreserve"
 
 	if err := h.validator.Struct(&req); err != nil {
-		h.logger.Warn("Validation error in IP unreservation",
+		h.log(c).Warn("Validation error in IP unreservation",
 			zap.Error(err),
 			zap.Any("request", req),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Validation error: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteValidationError(c, err.Error())
 		return
 	}
 
 	// Enhanced IP address validation
 	for _, ip := range req.IPAddresses {
 		if utils.NormalizeIP(ip) == "" {
-			h.logger.Warn("Invalid IP address in unreservation request",
+			h.log(c).Warn("Invalid IP address in unreservation request",
 				zap.String("invalid_ip", ip),
 				zap.String("client_ip", c.ClientIP()))
-			c.JSON(http.StatusBadRequest, gin.H{
-				"success":   false,
-				"message":   "Invalid IP address: " + ip,
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
+			utils.WriteBadRequestError(c, "Invalid IP address: "+ip)
 			return
 		}
 	}
 
+	if !h.authorizeScope(c, req.Region, req.Zone) {
+		return
+	}
+
 	response, err := h.service.ManageReservations(ctx, &req)
 	if err != nil {
-		h.logger.Error("IP unreservation service error",
+		h.writeError(c, err, "Failed to unreserve IPs",
+			zap.Any("request", req))
+		return
+	}
+
+	// Log successful unreservation
+	if response.Success {
+		h.log(c).Info("IP unreservation successful",
+			zap.String("region", req.Region),
+			zap.String("zone", req.Zone),
+			zap.String("subzone", req.SubZone),
+			zap.Int("unreserved_count", len(response.ProcessedIPs)),
+			zap.String("client_ip", c.ClientIP()))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// RenewIPs extends the lease of allocated IPs before they expire
+func (h *AllocationHandler) RenewIPs(c *gin.Context) {
+	ctx, cancel := requestContext(c, 30*time.Second)
+	defer cancel()
+
+	var req models.RenewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.log(c).Warn("Invalid JSON payload for lease renewal",
+			zap.Error(err),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
+		return
+	}
+
+	if err := h.validator.Struct(&req); err != nil {
+		h.log(c).Warn("Validation error in lease renewal",
 			zap.Error(err),
 			zap.Any("request", req),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to unreserve IPs: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteValidationError(c, err.Error())
 		return
 	}
 
-	// Log successful unreservation
+	if msg := validateLease(req.TTL, req.ExpiresAt, true); msg != "" {
+		h.log(c).Warn("Invalid lease in renewal request",
+			zap.String("reason", msg),
+			zap.Int64("ttl", req.TTL),
+			zap.Timep("expires_at", req.ExpiresAt),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, msg)
+		return
+	}
+
+	// Enhanced IP address validation
+	for _, ip := range req.IPAddresses {
+		if utils.NormalizeIP(ip) == "" {
+			h.log(c).Warn("Invalid IP address in renewal request",
+				zap.String("invalid_ip", ip),
+				zap.String("client_ip", c.ClientIP()))
+			utils.WriteBadRequestError(c, "Invalid IP address: "+ip)
+			return
+		}
+	}
+
+	if !h.authorizeScope(c, req.Region, req.Zone) {
+		return
+	}
+
+	response, err := h.service.RenewLeases(ctx, &req)
+	if err != nil {
+		h.writeError(c, err, "Failed to renew leases",
+			zap.Any("request", req))
+		return
+	}
+
+	// Log successful renewal
 	if response.Success {
-		h.logger.Info("IP unreservation successful",
+		h.log(c).Info("Lease renewal successful",
 			zap.String("region", req.Region),
 			zap.String("zone", req.Zone),
 			zap.String("subzone", req.SubZone),
-			zap.Int("unreserved_count", len(response.ProcessedIPs)),
+			zap.Int("renewed_count", len(response.ProcessedIPs)),
+			zap.Timep("expires_at", response.ExpiresAt),
 			zap.String("client_ip", c.ClientIP()))
 	}
 
 	c.JSON(http.StatusOK, response)
 }
 
+// validateContiguous checks the contiguous allocation options, returning an error message or ""
+func validateContiguous(req *models.AllocationRequest) string {
+	switch {
+	case req.AlignPrefix > 0 && !req.Contiguous:
+		return "align_prefix requires contiguous"
+	case !req.Contiguous:
+		return ""
+	case len(req.PreferredIPs) > 0:
+		return "contiguous cannot be combined with preferred_ips"
+	case req.AlignPrefix > 0 && req.IPVersion == "both":
+		return "align_prefix requires ip_version 'ipv4' or 'ipv6'"
+	case req.AlignPrefix > 32 && req.IPVersion == "ipv4":
+		return "align_prefix must be at most 32 for ipv4"
+	}
+	return ""
+}
+
+// validateLease checks the optional ttl / expires_at pair and returns an error message when it is invalid
+func validateLease(ttl int64, expiresAt *time.Time, required bool) string {
+	if ttl > 0 && expiresAt != nil {
+		return "Only one of ttl or expires_at may be specified"
+	}
+	if required && ttl <= 0 && expiresAt == nil {
+		return "Either ttl or expires_at is required"
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return "expires_at must be in the future"
+	}
+	return ""
+}
+
 // ===============================
 // REGION CRUD METHODS
 // ===============================
 
 // GetAllRegions returns all regions with enhanced logging
 func (h *AllocationHandler) GetAllRegions(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	ctx, cancel := requestContext(c, 15*time.Second)
 	defer cancel()
 
-	h.logger.Debug("Fetching all regions", zap.String("client_ip", c.ClientIP()))
+	h.log(c).Debug("Fetching all regions", zap.String("client_ip", c.ClientIP()))
 
 	regions, err := h.service.GetAllRegions(ctx)
 	if err != nil {
-		h.logger.Error("Failed to get all regions",
-			zap.Error(err),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to get regions: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		h.writeError(c, err, "Failed to get regions")
 		return
 	}
 
-	h.logger.Info("All regions retrieved successfully",
+	h.log(c).Info("All regions retrieved successfully",
 		zap.Int("count", len(regions)),
 		zap.String("client_ip", c.ClientIP()))
 
@@ -406,50 +506,28 @@ func (h *AllocationHandler) GetAllRegions(c *gin.Context) {
 
 // GetRegionHierarchy returns the complete hierarchy for a region
 func (h *AllocationHandler) GetRegionHierarchy(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := requestContext(c, 10*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
 	if regionName == "" {
-		h.logger.Warn("Region name missing in request", zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region name is required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		h.log(c).Warn("Region name missing in request", zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Region name is required")
 		return
 	}
 
-	h.logger.Debug("Fetching region hierarchy",
+	h.log(c).Debug("Fetching region hierarchy",
 		zap.String("region", regionName),
 		zap.String("client_ip", c.ClientIP()))
 
 	region, err := h.service.GetRegionHierarchy(ctx, regionName)
 	if err != nil {
-		if err.Error() == "region '"+regionName+"' not found" {
-			h.logger.Warn("Region not found",
-				zap.String("region", regionName),
-				zap.String("client_ip", c.ClientIP()))
-			c.JSON(http.StatusNotFound, gin.H{
-				"success":   false,
-				"message":   err.Error(),
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
-		} else {
-			h.logger.Error("Failed to get region hierarchy",
-				zap.Error(err),
-				zap.String("region", regionName),
-				zap.String("client_ip", c.ClientIP()))
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success":   false,
-				"message":   "Failed to get region hierarchy: " + err.Error(),
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
-		}
+		h.writeError(c, err, "Failed to get region hierarchy",
+			zap.String("region", regionName))
 		return
 	}
 
-	h.logger.Info("Region hierarchy retrieved successfully",
+	h.log(c).Info("Region hierarchy retrieved successfully",
 		zap.String("region", regionName),
 		zap.Int("zones_count", len(region.Zones)),
 		zap.String("client_ip", c.ClientIP()))
@@ -464,33 +542,25 @@ func (h *AllocationHandler) GetRegionHierarchy(c *gin.Context) {
 
 // CreateRegion creates a new region with enhanced Zone CIDR validation
 func (h *AllocationHandler) CreateRegion(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	var region models.Region
 	if err := c.ShouldBindJSON(&region); err != nil {
-		h.logger.Warn("Invalid JSON payload for region creation",
+		h.log(c).Warn("Invalid JSON payload for region creation",
 			zap.Error(err),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid JSON payload: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
 		return
 	}
 
 	// Validate request structure
 	if err := h.validator.Struct(&region); err != nil {
-		h.logger.Warn("Validation error in region creation",
+		h.log(c).Warn("Validation error in region creation",
 			zap.Error(err),
 			zap.Any("region", region),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Validation error: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteValidationError(c, err.Error())
 		return
 	}
 
@@ -498,16 +568,12 @@ func (h *AllocationHandler) CreateRegion(c *gin.Context) {
 	for _, zone := range region.Zones {
 		// Validate Zone CIDR against Region CIDR
 		if err := utils.ValidateZoneCIDRHierarchy(region.IPv4CIDR, region.IPv6CIDR, zone.IPv4CIDR, zone.IPv6CIDR); err != nil {
-			h.logger.Error("Zone CIDR validation failed",
+			h.log(c).Error("Zone CIDR validation failed",
 				zap.Error(err),
 				zap.String("region", region.Name),
 				zap.String("zone", zone.Name),
 				zap.String("client_ip", c.ClientIP()))
-			c.JSON(http.StatusBadRequest, gin.H{
-				"success":   false,
-				"message":   "Zone CIDR validation failed for zone " + zone.Name + ": " + err.Error(),
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
+			utils.WriteBadRequestError(c, "Zone CIDR validation failed for zone "+zone.Name+": "+err.Error())
 			return
 		}
 
@@ -515,49 +581,37 @@ func (h *AllocationHandler) CreateRegion(c *gin.Context) {
 		for _, subZone := range zone.SubZones {
 			// Validate Sub-zone CIDR against Zone CIDR
 			if err := utils.ValidateSubZoneCIDRHierarchy(zone.IPv4CIDR, zone.IPv6CIDR, subZone.IPv4CIDR, subZone.IPv6CIDR); err != nil {
-				h.logger.Error("Sub-zone CIDR validation failed",
+				h.log(c).Error("Sub-zone CIDR validation failed",
 					zap.Error(err),
 					zap.String("region", region.Name),
 					zap.String("zone", zone.Name),
 					zap.String("subzone", subZone.Name),
 					zap.String("client_ip", c.ClientIP()))
-				c.JSON(http.StatusBadRequest, gin.H{
-					"success":   false,
-					"message":   "Sub-zone CIDR validation failed for sub-zone " + subZone.Name + ": " + err.Error(),
-					"timestamp": time.Now().Format(time.RFC3339),
-				})
+				utils.WriteBadRequestError(c, "Sub-zone CIDR validation failed for sub-zone "+subZone.Name+": "+err.Error())
 				return
 			}
 
 			// Validate individual IPv4 and IPv6 CIDRs
 			if subZone.IPv4CIDR != "" {
 				if _, err := utils.ParseCIDR(subZone.IPv4CIDR); err != nil {
-					h.logger.Error("Invalid IPv4 CIDR in sub-zone",
+					h.log(c).Error("Invalid IPv4 CIDR in sub-zone",
 						zap.Error(err),
 						zap.String("subzone", subZone.Name),
 						zap.String("cidr", subZone.IPv4CIDR),
 						zap.String("client_ip", c.ClientIP()))
-					c.JSON(http.StatusBadRequest, gin.H{
-						"success":   false,
-						"message":   "Invalid IPv4 CIDR in sub-zone " + subZone.Name + ": " + err.Error(),
-						"timestamp": time.Now().Format(time.RFC3339),
-					})
+					utils.WriteBadRequestError(c, "Invalid IPv4 CIDR in sub-zone "+subZone.Name+": "+err.Error())
 					return
 				}
 			}
 
 			if subZone.IPv6CIDR != "" {
 				if _, err := utils.ParseCIDR(subZone.IPv6CIDR); err != nil {
-					h.logger.Error("Invalid IPv6 CIDR in sub-zone",
+					h.log(c).Error("Invalid IPv6 CIDR in sub-zone",
 						zap.Error(err),
 						zap.String("subzone", subZone.Name),
 						zap.String("cidr", subZone.IPv6CIDR),
 						zap.String("client_ip", c.ClientIP()))
-					c.JSON(http.StatusBadRequest, gin.H{
-						"success":   false,
-						"message":   "Invalid IPv6 CIDR in sub-zone " + subZone.Name + ": " + err.Error(),
-						"timestamp": time.Now().Format(time.RFC3339),
-					})
+					utils.WriteBadRequestError(c, "Invalid IPv6 CIDR in sub-zone "+subZone.Name+": "+err.Error())
 					return
 				}
 			}
@@ -566,30 +620,12 @@ func (h *AllocationHandler) CreateRegion(c *gin.Context) {
 
 	// Create region
 	if err := h.service.CreateRegion(ctx, &region); err != nil {
-		if mongo.IsDuplicateKeyError(err) {
-			h.logger.Warn("Duplicate region creation attempted",
-				zap.String("region", region.Name),
-				zap.String("client_ip", c.ClientIP()))
-			c.JSON(http.StatusConflict, gin.H{
-				"success":   false,
-				"message":   "Region with this name already exists",
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
-		} else {
-			h.logger.Error("Failed to create region",
-				zap.Error(err),
-				zap.String("region", region.Name),
-				zap.String("client_ip", c.ClientIP()))
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success":   false,
-				"message":   "Failed to create region: " + err.Error(),
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
-		}
+		h.writeError(c, err, "Failed to create region",
+			zap.String("region", region.Name))
 		return
 	}
 
-	h.logger.Info("Region created successfully",
+	h.log(c).Info("Region created successfully",
 		zap.String("region", region.Name),
 		zap.Int("zones_count", len(region.Zones)),
 		zap.String("client_ip", c.ClientIP()))
@@ -604,129 +640,76 @@ func (h *AllocationHandler) CreateRegion(c *gin.Context) {
 
 // UpdateRegion updates an existing region with enhanced validation
 func (h *AllocationHandler) UpdateRegion(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
 	if regionName == "" {
-		h.logger.Warn("Region name missing in update request", zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region name is required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		h.log(c).Warn("Region name missing in update request", zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Region name is required")
 		return
 	}
 
 	var req models.UpdateRegionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		h.logger.Warn("Invalid JSON payload for region update",
+		h.log(c).Warn("Invalid JSON payload for region update",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid JSON payload: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
 		return
 	}
 
 	if err := h.validator.Struct(&req); err != nil {
-		h.logger.Warn("Validation error in region update",
+		h.log(c).Warn("Validation error in region update",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.Any("request", req),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Validation error: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteValidationError(c, err.Error())
 		return
 	}
 
 	response, err := h.crudService.UpdateRegion(ctx, regionName, &req)
 	if err != nil {
-		h.logger.Error("Failed to update region",
-			zap.Error(err),
-			zap.String("region", regionName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to update region: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		h.writeError(c, err, "Failed to update region",
+			zap.String("region", regionName))
 		return
 	}
 
-	if response.Success {
-		h.logger.Info("Region updated successfully",
-			zap.String("region", regionName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusOK, response)
-	} else {
-		h.logger.Warn("Region update failed",
-			zap.String("region", regionName),
-			zap.String("message", response.Message),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   response.Message,
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	}
+	h.log(c).Info("Region updated successfully",
+		zap.String("region", regionName),
+		zap.String("client_ip", c.ClientIP()))
+	c.JSON(http.StatusOK, response)
 }
 
 // DeleteRegion deletes a region with enhanced logging
 func (h *AllocationHandler) DeleteRegion(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
 	if regionName == "" {
-		h.logger.Warn("Region name missing in delete request", zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region name is required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		h.log(c).Warn("Region name missing in delete request", zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Region name is required")
 		return
 	}
 
-	h.logger.Info("Attempting to delete region",
+	h.log(c).Info("Attempting to delete region",
 		zap.String("region", regionName),
 		zap.String("client_ip", c.ClientIP()))
 
 	response, err := h.crudService.DeleteRegion(ctx, regionName)
 	if err != nil {
-		h.logger.Error("Failed to delete region",
-			zap.Error(err),
-			zap.String("region", regionName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to delete region: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		h.writeError(c, err, "Failed to delete region",
+			zap.String("region", regionName))
 		return
 	}
 
-	if response.Success {
-		h.logger.Info("Region deleted successfully",
-			zap.String("region", regionName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusOK, response)
-	} else {
-		h.logger.Warn("Region deletion failed - not found",
-			zap.String("region", regionName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusNotFound, gin.H{
-			"success":   false,
-			"message":   response.Message,
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	}
+	h.log(c).Info("Region deleted successfully",
+		zap.String("region", regionName),
+		zap.String("client_ip", c.ClientIP()))
+	c.JSON(http.StatusOK, response)
 }
 
 // ===============================
@@ -735,49 +718,37 @@ func (h *AllocationHandler) DeleteRegion(c *gin.Context) {
 
 // CreateZone creates a new zone within a region with enhanced CIDR validation
 func (h *AllocationHandler) CreateZone(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
 	if regionName == "" {
-		h.logger.Warn("Region name missing in zone creation", zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region name is required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		h.log(c).Warn("Region name missing in zone creation", zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Region name is required")
 		return
 	}
 
 	var req models.CreateZoneRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		h.logger.Warn("Invalid JSON payload for zone creation",
+		h.log(c).Warn("Invalid JSON payload for zone creation",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid JSON payload: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
 		return
 	}
 
 	if err := h.validator.Struct(&req); err != nil {
-		h.logger.Warn("Validation error in zone creation",
+		h.log(c).Warn("Validation error in zone creation",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.Any("request", req),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Validation error: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteValidationError(c, err.Error())
 		return
 	}
 
-	h.logger.Info("Creating zone with CIDR validation",
+	h.log(c).Info("Creating zone with CIDR validation",
 		zap.String("region", regionName),
 		zap.String("zone", req.Name),
 		zap.String("ipv4_cidr", req.IPv4CIDR),
@@ -786,243 +757,145 @@ func (h *AllocationHandler) CreateZone(c *gin.Context) {
 
 	response, err := h.crudService.CreateZone(ctx, regionName, &req)
 	if err != nil {
-		h.logger.Error("Failed to create zone",
-			zap.Error(err),
+		h.writeError(c, err, "Failed to create zone",
 			zap.String("region", regionName),
-			zap.String("zone", req.Name),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to create zone: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+			zap.String("zone", req.Name))
 		return
 	}
 
-	if response.Success {
-		h.logger.Info("Zone created successfully",
-			zap.String("region", regionName),
-			zap.String("zone", req.Name),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusCreated, response)
-	} else {
-		h.logger.Warn("Zone creation failed",
-			zap.String("region", regionName),
-			zap.String("zone", req.Name),
-			zap.String("message", response.Message),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   response.Message,
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	}
+	h.log(c).Info("Zone created successfully",
+		zap.String("region", regionName),
+		zap.String("zone", req.Name),
+		zap.String("client_ip", c.ClientIP()))
+	c.JSON(http.StatusCreated, response)
 }
 
 // GetZone returns information about a specific zone
 func (h *AllocationHandler) GetZone(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := requestContext(c, 10*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
 	zoneName := c.Param("zone")
 
 	if regionName == "" || zoneName == "" {
-		h.logger.Warn("Missing parameters in zone retrieval",
+		h.log(c).Warn("Missing parameters in zone retrieval",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region and zone names are required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Region and zone names are required")
 		return
 	}
 
-	h.logger.Debug("Fetching zone information",
+	h.log(c).Debug("Fetching zone information",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("client_ip", c.ClientIP()))
 
 	response, err := h.crudService.GetZone(ctx, regionName, zoneName)
 	if err != nil {
-		h.logger.Error("Failed to get zone",
-			zap.Error(err),
+		h.writeError(c, err, "Failed to get zone",
 			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to get zone: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+			zap.String("zone", zoneName))
 		return
 	}
 
-	if response.Success {
-		h.logger.Info("Zone retrieved successfully",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusOK, response)
-	} else {
-		h.logger.Warn("Zone not found",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusNotFound, gin.H{
-			"success":   false,
-			"message":   response.Message,
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	}
+	h.log(c).Info("Zone retrieved successfully",
+		zap.String("region", regionName),
+		zap.String("zone", zoneName),
+		zap.String("client_ip", c.ClientIP()))
+	c.JSON(http.StatusOK, response)
 }
 
 // UpdateZone updates an existing zone with enhanced CIDR validation
 func (h *AllocationHandler) UpdateZone(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
 	zoneName := c.Param("zone")
 
 	if regionName == "" || zoneName == "" {
-		h.logger.Warn("Missing parameters in zone update",
+		h.log(c).Warn("Missing parameters in zone update",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region and zone names are required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Region and zone names are required")
 		return
 	}
 
 	var req models.UpdateZoneRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		h.logger.Warn("Invalid JSON payload for zone update",
+		h.log(c).Warn("Invalid JSON payload for zone update",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid JSON payload: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
 		return
 	}
 
 	if err := h.validator.Struct(&req); err != nil {
-		h.logger.Warn("Validation error in zone update",
+		h.log(c).Warn("Validation error in zone update",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.Any("request", req),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Validation error: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteValidationError(c, err.Error())
 		return
 	}
 
 	response, err := h.crudService.UpdateZone(ctx, regionName, zoneName, &req)
 	if err != nil {
-		h.logger.Error("Failed to update zone",
-			zap.Error(err),
+		h.writeError(c, err, "Failed to update zone",
 			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to update zone: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+			zap.String("zone", zoneName))
 		return
 	}
 
-	if response.Success {
-		h.logger.Info("Zone updated successfully",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusOK, response)
-	} else {
-		h.logger.Warn("Zone update failed",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("message", response.Message),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   response.Message,
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	}
+	h.log(c).Info("Zone updated successfully",
+		zap.String("region", regionName),
+		zap.String("zone", zoneName),
+		zap.String("client_ip", c.ClientIP()))
+	c.JSON(http.StatusOK, response)
 }
 
 // DeleteZone deletes a zone with enhanced logging
 func (h *AllocationHandler) DeleteZone(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
 	zoneName := c.Param("zone")
 
 	if regionName == "" || zoneName == "" {
-		h.logger.Warn("Missing parameters in zone deletion",
+		h.log(c).Warn("Missing parameters in zone deletion",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region and zone names are required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Region and zone names are required")
 		return
 	}
 
-	h.logger.Info("Attempting to delete zone",
+	h.log(c).Info("Attempting to delete zone",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("client_ip", c.ClientIP()))
 
 	response, err := h.crudService.DeleteZone(ctx, regionName, zoneName)
 	if err != nil {
-		h.logger.Error("Failed to delete zone",
-			zap.Error(err),
+		h.writeError(c, err, "Failed to delete zone",
 			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to delete zone: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+			zap.String("zone", zoneName))
 		return
 	}
 
-	if response.Success {
-		h.logger.Info("Zone deleted successfully",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusOK, response)
-	} else {
-		h.logger.Warn("Zone deletion failed - not found",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusNotFound, gin.H{
-			"success":   false,
-			"message":   response.Message,
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	}
+	h.log(c).Info("Zone deleted successfully",
+		zap.String("region", regionName),
+		zap.String("zone", zoneName),
+		zap.String("client_ip", c.ClientIP()))
+	c.JSON(http.StatusOK, response)
 }
 
 // ===============================
@@ -1031,104 +904,76 @@ func (h *AllocationHandler) DeleteZone(c *gin.Context) {
 
 // CreateSubZone creates a new sub-zone within a zone with enhanced validation
 func (h *AllocationHandler) CreateSubZone(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
 	zoneName := c.Param("zone")
 
 	if regionName == "" || zoneName == "" {
-		h.logger.Warn("Missing parameters in sub-zone creation",
+		h.log(c).Warn("Missing parameters in sub-zone creation",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region and zone names are required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Region and zone names are required")
 		return
 	}
 
 	var req models.CreateSubZoneRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		h.logger.Warn("Invalid JSON payload for sub-zone creation",
+		h.log(c).Warn("Invalid JSON payload for sub-zone creation",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid JSON payload: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
 		return
 	}
 
 	if err := h.validator.Struct(&req); err != nil {
-		h.logger.Warn("Validation error in sub-zone creation",
+		h.log(c).Warn("Validation error in sub-zone creation",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.Any("request", req),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Validation error: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteValidationError(c, err.Error())
 		return
 	}
 
-	h.logger.Info("Creating sub-zone with enhanced validation",
+	h.log(c).Info("Creating sub-zone with enhanced validation",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", req.Name),
 		zap.String("ipv4_cidr", req.IPv4CIDR),
 		zap.String("ipv6_cidr", req.IPv6CIDR),
+		zap.String("allocation_strategy", req.AllocationStrategy),
+		zap.String("gateway_ipv4", req.GatewayIPv4),
+		zap.String("gateway_ipv6", req.GatewayIPv6),
+		zap.Bool("no_gateway", req.NoGateway),
+		zap.Strings("excluded_ranges", req.ExcludedRanges),
 		zap.String("client_ip", c.ClientIP()))
 
 	response, err := h.crudService.CreateSubZone(ctx, regionName, zoneName, &req)
 	if err != nil {
-		h.logger.Error("Failed to create sub-zone",
-			zap.Error(err),
+		h.writeError(c, err, "Failed to create sub-zone",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
-			zap.String("subzone", req.Name),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to create sub-zone: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+			zap.String("subzone", req.Name))
 		return
 	}
 
-	if response.Success {
-		h.logger.Info("Sub-zone created successfully",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("subzone", req.Name),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusCreated, response)
-	} else {
-		h.logger.Warn("Sub-zone creation failed",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("subzone", req.Name),
-			zap.String("message", response.Message),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   response.Message,
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	}
+	h.log(c).Info("Sub-zone created successfully",
+		zap.String("region", regionName),
+		zap.String("zone", zoneName),
+		zap.String("subzone", req.Name),
+		zap.String("client_ip", c.ClientIP()))
+	c.JSON(http.StatusCreated, response)
 }
 
 // GetSubZoneInfo returns detailed information about a specific sub-zone with enhanced statistics
 func (h *AllocationHandler) GetSubZoneInfo(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := requestContext(c, 10*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
@@ -1136,20 +981,16 @@ func (h *AllocationHandler) GetSubZoneInfo(c *gin.Context) {
 	subZoneName := c.Param("subzone")
 
 	if regionName == "" || zoneName == "" || subZoneName == "" {
-		h.logger.Warn("Missing parameters in sub-zone info request",
+		h.log(c).Warn("Missing parameters in sub-zone info request",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("subzone", subZoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region, zone, and sub-zone names are required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Region, zone, and sub-zone names are required")
 		return
 	}
 
-	h.logger.Debug("Fetching sub-zone information",
+	h.log(c).Debug("Fetching sub-zone information",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName),
@@ -1157,26 +998,8 @@ func (h *AllocationHandler) GetSubZoneInfo(c *gin.Context) {
 
 	region, err := h.service.GetRegionHierarchy(ctx, regionName)
 	if err != nil {
-		if err.Error() == "region '"+regionName+"' not found" {
-			h.logger.Warn("Region not found for sub-zone info",
-				zap.String("region", regionName),
-				zap.String("client_ip", c.ClientIP()))
-			c.JSON(http.StatusNotFound, gin.H{
-				"success":   false,
-				"message":   err.Error(),
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
-		} else {
-			h.logger.Error("Failed to get region hierarchy for sub-zone info",
-				zap.Error(err),
-				zap.String("region", regionName),
-				zap.String("client_ip", c.ClientIP()))
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"success":   false,
-				"message":   "Failed to get region hierarchy: " + err.Error(),
-				"timestamp": time.Now().Format(time.RFC3339),
-			})
-		}
+		h.writeError(c, err, "Failed to get region hierarchy",
+			zap.String("region", regionName))
 		return
 	}
 
@@ -1197,16 +1020,12 @@ func (h *AllocationHandler) GetSubZoneInfo(c *gin.Context) {
 	}
 
 	if targetSubZone == nil {
-		h.logger.Warn("Sub-zone not found",
+		h.log(c).Warn("Sub-zone not found",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("subzone", subZoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusNotFound, gin.H{
-			"success":   false,
-			"message":   "Sub-zone not found",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteNotFoundError(c, "Sub-zone not found")
 		return
 	}
 
@@ -1214,14 +1033,12 @@ func (h *AllocationHandler) GetSubZoneInfo(c *gin.Context) {
 	ipv4Count, _ := utils.CountIPsInCIDR(targetSubZone.IPv4CIDR)
 	ipv6Count, _ := utils.CountIPsInCIDR(targetSubZone.IPv6CIDR)
 
-	// Calculate available counts
-	ipv4Available := int64(0)
-	ipv6Available := int64(0)
-	if ipv4Count.Int64() > 0 {
-		ipv4Available = ipv4Count.Int64() - int64(len(targetSubZone.AllocatedIPv4)) - int64(len(targetSubZone.ReservedIPv4))
-	}
-	if ipv6Count.Int64() > 0 {
-		ipv6Available = ipv6Count.Int64() - int64(len(targetSubZone.AllocatedIPv6)) - int64(len(targetSubZone.ReservedIPv6))
+	// Available counts leave out the gateways and excluded ranges
+	available, err := h.service.AvailableIPCounts(ctx, regionName, zoneName, targetSubZone)
+	if err != nil {
+		h.writeError(c, err, "Failed to count available addresses",
+			zap.String("subzone", subZoneName))
+		return
 	}
 
 	info := gin.H{
@@ -1236,14 +1053,14 @@ func (h *AllocationHandler) GetSubZoneInfo(c *gin.Context) {
 			"ipv6_allocated_count": len(targetSubZone.AllocatedIPv6),
 			"ipv4_reserved_count":  len(targetSubZone.ReservedIPv4),
 			"ipv6_reserved_count":  len(targetSubZone.ReservedIPv6),
-			"ipv4_available_count": ipv4Available,
-			"ipv6_available_count": ipv6Available,
+			"ipv4_available_count": available["ipv4"].String(),
+			"ipv6_available_count": available["ipv6"].String(),
 		},
 		"message":   "Sub-zone information retrieved successfully",
 		"timestamp": time.Now().Format(time.RFC3339),
 	}
 
-	h.logger.Info("Sub-zone information retrieved successfully",
+	h.log(c).Info("Sub-zone information retrieved successfully",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName),
@@ -1256,7 +1073,7 @@ func (h *AllocationHandler) GetSubZoneInfo(c *gin.Context) {
 
 // UpdateSubZone updates an existing sub-zone with enhanced validation
 func (h *AllocationHandler) UpdateSubZone(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
@@ -1264,92 +1081,59 @@ func (h *AllocationHandler) UpdateSubZone(c *gin.Context) {
 	subZoneName := c.Param("subzone")
 
 	if regionName == "" || zoneName == "" || subZoneName == "" {
-		h.logger.Warn("Missing parameters in sub-zone update",
+		h.log(c).Warn("Missing parameters in sub-zone update",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("subzone", subZoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region, zone, and sub-zone names are required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Region, zone, and sub-zone names are required")
 		return
 	}
 
 	var req models.UpdateSubZoneRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		h.logger.Warn("Invalid JSON payload for sub-zone update",
+		h.log(c).Warn("Invalid JSON payload for sub-zone update",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("subzone", subZoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid JSON payload: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
 		return
 	}
 
 	if err := h.validator.Struct(&req); err != nil {
-		h.logger.Warn("Validation error in sub-zone update",
+		h.log(c).Warn("Validation error in sub-zone update",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("subzone", subZoneName),
 			zap.Any("request", req),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Validation error: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteValidationError(c, err.Error())
 		return
 	}
 
 	response, err := h.crudService.UpdateSubZone(ctx, regionName, zoneName, subZoneName, &req)
 	if err != nil {
-		h.logger.Error("Failed to update sub-zone",
-			zap.Error(err),
+		h.writeError(c, err, "Failed to update sub-zone",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
-			zap.String("subzone", subZoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to update sub-zone: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+			zap.String("subzone", subZoneName))
 		return
 	}
 
-	if response.Success {
-		h.logger.Info("Sub-zone updated successfully",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("subzone", subZoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusOK, response)
-	} else {
-		h.logger.Warn("Sub-zone update failed",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("subzone", subZoneName),
-			zap.String("message", response.Message),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   response.Message,
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	}
+	h.log(c).Info("Sub-zone updated successfully",
+		zap.String("region", regionName),
+		zap.String("zone", zoneName),
+		zap.String("subzone", subZoneName),
+		zap.String("client_ip", c.ClientIP()))
+	c.JSON(http.StatusOK, response)
 }
 
 // DeleteSubZone deletes a sub-zone with enhanced logging
 func (h *AllocationHandler) DeleteSubZone(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := requestContext(c, 30*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
@@ -1357,20 +1141,16 @@ func (h *AllocationHandler) DeleteSubZone(c *gin.Context) {
 	subZoneName := c.Param("subzone")
 
 	if regionName == "" || zoneName == "" || subZoneName == "" {
-		h.logger.Warn("Missing parameters in sub-zone deletion",
+		h.log(c).Warn("Missing parameters in sub-zone deletion",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("subzone", subZoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region, zone, and sub-zone names are required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Region, zone, and sub-zone names are required")
 		return
 	}
 
-	h.logger.Info("Attempting to delete sub-zone",
+	h.log(c).Info("Attempting to delete sub-zone",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName),
@@ -1378,39 +1158,19 @@ func (h *AllocationHandler) DeleteSubZone(c *gin.Context) {
 
 	response, err := h.crudService.DeleteSubZone(ctx, regionName, zoneName, subZoneName)
 	if err != nil {
-		h.logger.Error("Failed to delete sub-zone",
-			zap.Error(err),
+		h.writeError(c, err, "Failed to delete sub-zone",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
-			zap.String("subzone", subZoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to delete sub-zone: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+			zap.String("subzone", subZoneName))
 		return
 	}
 
-	if response.Success {
-		h.logger.Info("Sub-zone deleted successfully",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("subzone", subZoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusOK, response)
-	} else {
-		h.logger.Warn("Sub-zone deletion failed - not found",
-			zap.String("region", regionName),
-			zap.String("zone", zoneName),
-			zap.String("subzone", subZoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusNotFound, gin.H{
-			"success":   false,
-			"message":   response.Message,
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
-	}
+	h.log(c).Info("Sub-zone deleted successfully",
+		zap.String("region", regionName),
+		zap.String("zone", zoneName),
+		zap.String("subzone", subZoneName),
+		zap.String("client_ip", c.ClientIP()))
+	c.JSON(http.StatusOK, response)
 }
 
 // ===============================
@@ -1419,7 +1179,7 @@ func (h *AllocationHandler) DeleteSubZone(c *gin.Context) {
 
 // GetAvailableIPs returns available IP addresses with enhanced query parameter handling
 func (h *AllocationHandler) GetAvailableIPs(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := requestContext(c, 10*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
@@ -1427,16 +1187,12 @@ func (h *AllocationHandler) GetAvailableIPs(c *gin.Context) {
 	subZoneName := c.Param("subzone")
 
 	if regionName == "" || zoneName == "" || subZoneName == "" {
-		h.logger.Warn("Missing parameters in available IPs request",
+		h.log(c).Warn("Missing parameters in available IPs request",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("subzone", subZoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region, zone, and sub-zone names are required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Region, zone, and sub-zone names are required")
 		return
 	}
 
@@ -1454,18 +1210,14 @@ func (h *AllocationHandler) GetAvailableIPs(c *gin.Context) {
 
 	// Validate IP version
 	if !utils.ValidateIPVersion(ipVersion) || ipVersion == "both" {
-		h.logger.Warn("Invalid IP version for available IPs",
+		h.log(c).Warn("Invalid IP version for available IPs",
 			zap.String("ip_version", ipVersion),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Invalid IP version. Must be 'ipv4' or 'ipv6'",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Invalid IP version. Must be 'ipv4' or 'ipv6'")
 		return
 	}
 
-	h.logger.Debug("Fetching available IPs",
+	h.log(c).Debug("Fetching available IPs",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName),
@@ -1475,22 +1227,15 @@ func (h *AllocationHandler) GetAvailableIPs(c *gin.Context) {
 
 	response, err := h.service.GetAvailableIPs(ctx, regionName, zoneName, subZoneName, ipVersion, limit)
 	if err != nil {
-		h.logger.Error("Failed to get available IPs",
-			zap.Error(err),
+		h.writeError(c, err, "Failed to get available IPs",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("subzone", subZoneName),
-			zap.String("ip_version", ipVersion),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to get available IPs: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+			zap.String("ip_version", ipVersion))
 		return
 	}
 
-	h.logger.Info("Available IPs retrieved successfully",
+	h.log(c).Info("Available IPs retrieved successfully",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName),
@@ -1503,7 +1248,7 @@ func (h *AllocationHandler) GetAvailableIPs(c *gin.Context) {
 
 // GetIPStats returns comprehensive IP statistics with enhanced metrics
 func (h *AllocationHandler) GetIPStats(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := requestContext(c, 10*time.Second)
 	defer cancel()
 
 	regionName := c.Param("region")
@@ -1511,42 +1256,46 @@ func (h *AllocationHandler) GetIPStats(c *gin.Context) {
 	subZoneName := c.Param("subzone")
 
 	if regionName == "" || zoneName == "" || subZoneName == "" {
-		h.logger.Warn("Missing parameters in IP stats request",
+		h.log(c).Warn("Missing parameters in IP stats request",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
 			zap.String("subzone", subZoneName),
 			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusBadRequest, gin.H{
-			"success":   false,
-			"message":   "Region, zone, and sub-zone names are required",
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+		utils.WriteBadRequestError(c, "Region, zone, and sub-zone names are required")
 		return
 	}
 
-	h.logger.Debug("Fetching IP statistics",
+	// Window used for the leases expiring soon count
+	expiringWithin := h.config.Leases.ExpiringSoonWindow
+	if value := c.Query("expiring_within"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			h.log(c).Warn("Invalid expiring_within parameter",
+				zap.String("expiring_within", value),
+				zap.String("client_ip", c.ClientIP()))
+			utils.WriteBadRequestError(c, "Invalid expiring_within parameter. Must be a positive duration such as 30m or 24h")
+			return
+		}
+		expiringWithin = parsed
+	}
+
+	h.log(c).Debug("Fetching IP statistics",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName),
+		zap.Duration("expiring_within", expiringWithin),
 		zap.String("client_ip", c.ClientIP()))
 
-	response, err := h.service.GetIPStats(ctx, regionName, zoneName, subZoneName)
+	response, err := h.service.GetIPStats(ctx, regionName, zoneName, subZoneName, expiringWithin)
 	if err != nil {
-		h.logger.Error("Failed to get IP statistics",
-			zap.Error(err),
+		h.writeError(c, err, "Failed to get IP statistics",
 			zap.String("region", regionName),
 			zap.String("zone", zoneName),
-			zap.String("subzone", subZoneName),
-			zap.String("client_ip", c.ClientIP()))
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"success":   false,
-			"message":   "Failed to get IP statistics: " + err.Error(),
-			"timestamp": time.Now().Format(time.RFC3339),
-		})
+			zap.String("subzone", subZoneName))
 		return
 	}
 
-	h.logger.Info("IP statistics retrieved successfully",
+	h.log(c).Info("IP statistics retrieved successfully",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName),
@@ -1557,10 +1306,10 @@ func (h *AllocationHandler) GetIPStats(c *gin.Context) {
 
 // HealthCheck with enhanced Gin support and comprehensive Zap logging
 func (h *AllocationHandler) HealthCheck(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := requestContext(c, 5*time.Second)
 	defer cancel()
 
-	h.logger.Debug("Health check requested", zap.String("client_ip", c.ClientIP()))
+	h.log(c).Debug("Health check requested", zap.String("client_ip", c.ClientIP()))
 
 	health := gin.H{
 		"status":     "healthy",
@@ -1575,12 +1324,24 @@ func (h *AllocationHandler) HealthCheck(c *gin.Context) {
 			"zap_logging":         true,
 			"gin_framework":       true,
 			"first_last_ip_check": true,
+			"ip_leases":           true,
+			"ip_metadata":         true,
+			"audit_trail":         true,
+			"global_lookup":       true,
+			"authentication":      h.config.Auth.Enabled,
+			"jwt_authentication":  h.config.Auth.Enabled && h.config.Auth.JWT.Enabled,
+			"multi_tenancy":       true,
+			"quotas":              true,
+			"prometheus_metrics":  true,
+			"tracing":             h.config.Tracing.Exporter != "" && h.config.Tracing.Exporter != "none",
+			"request_ids":         true,
+			"problem_details":     true,
 		},
 	}
 
 	// Test database connectivity
 	if err := h.service.TestConnection(ctx); err != nil {
-		h.logger.Error("Database health check failed",
+		h.log(c).Error("Database health check failed",
 			zap.Error(err),
 			zap.String("client_ip", c.ClientIP()))
 		health["status"] = "unhealthy"
@@ -1591,6 +1352,6 @@ func (h *AllocationHandler) HealthCheck(c *gin.Context) {
 	}
 
 	health["database"] = "connected"
-	h.logger.Info("Health check passed", zap.String("client_ip", c.ClientIP()))
+	h.log(c).Info("Health check passed", zap.String("client_ip", c.ClientIP()))
 	c.JSON(http.StatusOK, health)
 }
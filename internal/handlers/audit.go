@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// ===============================
+// AUDIT METHODS
+// ===============================
+
+// GetAuditEvents returns audit events, newest first, filtered by the query parameters
+// resource_path, ip, actor, since, until and limit
+func (h *AllocationHandler) GetAuditEvents(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	query, message := parseAuditQuery(c)
+	if message != "" {
+		h.log(c).Warn("Invalid audit query",
+			zap.String("message", message),
+			zap.String("raw_query", c.Request.URL.RawQuery),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, message)
+		return
+	}
+
+	h.log(c).Debug("Fetching audit events",
+		zap.Any("query", query),
+		zap.String("client_ip", c.ClientIP()))
+
+	events, err := h.auditService.Query(ctx, query)
+	if err != nil {
+		h.writeError(c, err, "Failed to get audit events",
+			zap.Any("query", query))
+		return
+	}
+
+	h.log(c).Info("Audit events retrieved successfully",
+		zap.Int("count", len(events)),
+		zap.String("client_ip", c.ClientIP()))
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      events,
+		"count":     len(events),
+		"message":   "Audit events retrieved successfully",
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+// GetIPHistory returns the current holders of an address and the lifecycle of the address
+// across allocations, reservations and releases, filtered by since, until and limit
+func (h *AllocationHandler) GetIPHistory(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	address := c.Param("address")
+	ip := utils.NormalizeIP(address)
+	if ip == "" {
+		h.log(c).Warn("Invalid IP address in history request",
+			zap.String("address", address),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Invalid IP address: "+address)
+		return
+	}
+
+	query, message := parseAuditQuery(c)
+	if message != "" {
+		h.log(c).Warn("Invalid IP history query",
+			zap.String("message", message),
+			zap.String("raw_query", c.Request.URL.RawQuery),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, message)
+		return
+	}
+
+	h.log(c).Debug("Fetching IP history",
+		zap.String("ip", ip),
+		zap.String("client_ip", c.ClientIP()))
+
+	response, err := h.service.GetIPHistory(ctx, ip, query)
+	if err != nil {
+		h.writeError(c, err, "Failed to get IP history",
+			zap.String("ip", ip))
+		return
+	}
+
+	h.log(c).Info("IP history retrieved successfully",
+		zap.String("ip", ip),
+		zap.Any("count", response["count"]),
+		zap.String("client_ip", c.ClientIP()))
+
+	c.JSON(http.StatusOK, response)
+}
+
+// parseAuditQuery reads the audit filters from the query string, returning a message
+// describing the first invalid parameter
+func parseAuditQuery(c *gin.Context) (*models.AuditQuery, string) {
+	query := &models.AuditQuery{
+		ResourcePath: strings.Trim(c.Query("resource_path"), "/"),
+		Actor:        c.Query("actor"),
+	}
+
+	if ip := c.Query("ip"); ip != "" {
+		query.IPAddress = utils.NormalizeIP(ip)
+		if query.IPAddress == "" {
+			return nil, "Invalid ip parameter: " + ip
+		}
+	}
+
+	for _, param := range []struct {
+		name   string
+		target *time.Time
+	}{
+		{"since", &query.Since},
+		{"until", &query.Until},
+	} {
+		value := c.Query(param.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, "Invalid " + param.name + " parameter. Must be an RFC 3339 timestamp"
+		}
+		*param.target = parsed
+	}
+	if !query.Since.IsZero() && !query.Until.IsZero() && query.Until.Before(query.Since) {
+		return nil, "until must not be before since"
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return nil, "Invalid limit parameter. Must be a positive integer"
+		}
+		query.Limit = limit
+	}
+
+	return query, ""
+}
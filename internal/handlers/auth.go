@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// ===============================
+// AUTHORIZATION AND API KEY METHODS
+// ===============================
+
+// authorizeScope rejects the request with 403 when the caller is limited to a region or zone
+// that does not contain the given zone. Routes naming the region and zone in the URL are
+// checked by the auth middleware; this covers requests naming them in the body.
+func (h *AllocationHandler) authorizeScope(c *gin.Context, regionName, zoneName string) bool {
+	principal := services.RequestInfoFromContext(c.Request.Context()).Principal
+	if principal == nil || principal.Covers(regionName, zoneName) {
+		return true
+	}
+
+	h.log(c).Warn("Request outside the caller's scope",
+		zap.String("subject", principal.Subject),
+		zap.String("scope_region", principal.Region),
+		zap.String("scope_zone", principal.Zone),
+		zap.String("region", regionName),
+		zap.String("zone", zoneName),
+		zap.String("client_ip", c.ClientIP()))
+	utils.WriteErrorResponse(c, http.StatusForbidden, "This operation is outside the scope of your credentials")
+	return false
+}
+
+// CreateAPIKey creates an API key and returns its secret, which is not stored and cannot be
+// retrieved again
+func (h *AllocationHandler) CreateAPIKey(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	var req models.CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.log(c).Warn("Invalid JSON payload for API key creation",
+			zap.Error(err),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
+		return
+	}
+
+	if err := h.validator.Struct(&req); err != nil {
+		h.log(c).Warn("Validation error in API key creation",
+			zap.Error(err),
+			zap.String("name", req.Name),
+			zap.String("role", req.Role),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteValidationError(c, err.Error())
+		return
+	}
+
+	response, err := h.apiKeyService.CreateKey(ctx, &req)
+	if err != nil {
+		h.writeError(c, err, "Failed to create API key",
+			zap.String("name", req.Name))
+		return
+	}
+
+	h.log(c).Info("API key created successfully",
+		zap.String("name", req.Name),
+		zap.String("role", req.Role),
+		zap.String("prefix", response.Data.Prefix),
+		zap.String("client_ip", c.ClientIP()))
+
+	c.JSON(http.StatusCreated, response)
+}
+
+// ListAPIKeys returns every API key without secrets
+func (h *AllocationHandler) ListAPIKeys(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	keys, err := h.apiKeyService.ListKeys(ctx)
+	if err != nil {
+		h.writeError(c, err, "Failed to list API keys")
+		return
+	}
+
+	h.log(c).Info("API keys retrieved successfully",
+		zap.Int("count", len(keys)),
+		zap.String("client_ip", c.ClientIP()))
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      keys,
+		"count":     len(keys),
+		"message":   "API keys retrieved successfully",
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+// DeleteAPIKey revokes an API key
+func (h *AllocationHandler) DeleteAPIKey(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	id := c.Param("id")
+	h.log(c).Info("Attempting to delete API key",
+		zap.String("id", id),
+		zap.String("client_ip", c.ClientIP()))
+
+	response, err := h.apiKeyService.DeleteKey(ctx, id)
+	if err != nil {
+		h.writeError(c, err, "Failed to delete API key",
+			zap.String("id", id))
+		return
+	}
+
+	h.log(c).Info("API key deleted successfully",
+		zap.String("id", id),
+		zap.String("name", response.Data.Name),
+		zap.String("client_ip", c.ClientIP()))
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// errorStatuses maps each kind of domain error to the HTTP status it is reported with
+var errorStatuses = []struct {
+	kind   error
+	status int
+}{
+	{services.ErrNotFound, http.StatusNotFound},
+	{services.ErrConflict, http.StatusConflict},
+	{services.ErrCIDROutOfRange, http.StatusBadRequest},
+	{services.ErrExhausted, http.StatusConflict},
+	{services.ErrValidationFailed, http.StatusBadRequest},
+	{services.ErrQuotaExceeded, http.StatusForbidden},
+	{services.ErrForbidden, http.StatusForbidden},
+}
+
+// errorStatus returns the HTTP status of a domain error
+func errorStatus(err *services.Error) int {
+	for _, mapping := range errorStatuses {
+		if errors.Is(err, mapping.kind) {
+			return mapping.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError reports a failed service call as a problem document. Domain errors get the status
+// of their kind and their own code; any other error is an internal error, described by message.
+func (h *AllocationHandler) writeError(c *gin.Context, err error, message string, fields ...zap.Field) {
+	fields = append(fields, zap.Error(err), zap.String("client_ip", c.ClientIP()))
+
+	if domainErr, ok := services.AsError(err); ok {
+		h.log(c).Warn(message, append(fields, zap.String("code", domainErr.Code))...)
+		utils.WriteProblem(c, errorStatus(domainErr), domainErr.Code, domainErr.Message, domainErr.Details)
+		return
+	}
+
+	h.log(c).Error(message, fields...)
+	utils.WriteInternalServerError(c, message+": "+err.Error())
+}
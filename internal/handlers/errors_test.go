@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestWriteErrorMapsDomainErrorsToProblems(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := NewAllocationHandler(storage.NewMemoryRepository(), &config.Config{}, zap.NewNop())
+	ctx := context.Background()
+	if err := h.tenantService.EnsureDefaultTenant(ctx); err != nil {
+		t.Fatalf("EnsureDefaultTenant: %v", err)
+	}
+
+	if _, err := h.crudService.CreateRegion(ctx, &models.CreateRegionRequest{Name: "r1", IPv4CIDR: "10.0.0.0/8"}); err != nil {
+		t.Fatalf("CreateRegion: %v", err)
+	}
+	_, regionExists := h.crudService.CreateRegion(ctx, &models.CreateRegionRequest{Name: "r1", IPv4CIDR: "10.0.0.0/8"})
+	_, regionNotFound := h.service.AllocateIPs(ctx, &models.AllocationRequest{Region: "r2", Zone: "z1", SubZone: "s1", IPVersion: "ipv4", Count: 1})
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"conflict", regionExists, http.StatusConflict, services.CodeRegionExists},
+		{"not found", regionNotFound, http.StatusNotFound, services.CodeRegionNotFound},
+		{"wrapped domain error", errors.Join(errors.New("context"), regionNotFound), http.StatusNotFound, services.CodeRegionNotFound},
+		{"internal error", errors.New("connection reset"), http.StatusInternalServerError, "internal_server_error"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/regions", nil)
+		h.writeError(c, tt.err, "Failed to create region")
+
+		if w.Code != tt.status || w.Header().Get("Content-Type") != utils.ProblemContentType {
+			t.Fatalf("%s: got %d %s, want a %d problem document", tt.name, w.Code, w.Header().Get("Content-Type"), tt.status)
+		}
+		var problem struct {
+			Code   string `json:"code"`
+			Status int    `json:"status"`
+			Detail string `json:"detail"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+			t.Fatalf("%s: invalid JSON %s: %v", tt.name, w.Body.String(), err)
+		}
+		if problem.Code != tt.code || problem.Status != tt.status {
+			t.Fatalf("%s: problem = %+v, want code %q and status %d", tt.name, problem, tt.code, tt.status)
+		}
+		if tt.status == http.StatusInternalServerError && problem.Detail != "Failed to create region: connection reset" {
+			t.Fatalf("%s: detail = %q, want the message and the cause", tt.name, problem.Detail)
+		}
+	}
+}
+
+func TestErrorStatusOfEveryKind(t *testing.T) {
+	for _, mapping := range errorStatuses {
+		if mapping.status < 400 || mapping.status >= 500 {
+			t.Fatalf("%v maps to %d, domain errors are the caller's mistake", mapping.kind, mapping.status)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// ===============================
+// LOOKUP METHODS
+// ===============================
+
+// Lookup finds the region, zone and sub-zone owning the ip or cidr query parameter, with the
+// allocation status of the address or the number of addresses in use within the CIDR
+func (h *AllocationHandler) Lookup(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	ip := c.Query("ip")
+	cidr := c.Query("cidr")
+	if (ip == "") == (cidr == "") {
+		h.log(c).Warn("Invalid lookup query",
+			zap.String("raw_query", c.Request.URL.RawQuery),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Exactly one of the ip or cidr query parameters is required")
+		return
+	}
+
+	h.log(c).Debug("Looking up address",
+		zap.String("ip", ip),
+		zap.String("cidr", cidr),
+		zap.String("client_ip", c.ClientIP()))
+
+	var response *models.LookupResult
+	var err error
+	if ip != "" {
+		response, err = h.lookupService.LookupIP(ctx, ip)
+	} else {
+		response, err = h.lookupService.LookupCIDR(ctx, cidr)
+	}
+	if err != nil {
+		h.writeError(c, err, "Lookup failed",
+			zap.String("ip", ip),
+			zap.String("cidr", cidr))
+		return
+	}
+
+	h.log(c).Info("Lookup completed",
+		zap.String("query", response.Query),
+		zap.Bool("found", response.Found),
+		zap.String("status", response.Status),
+		zap.String("client_ip", c.ClientIP()))
+
+	c.JSON(http.StatusOK, response)
+}
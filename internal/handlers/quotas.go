@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// GetQuotaUsage reports the IPs held by the tenant, the caller, each owner and each sub-zone
+// against the configured quotas
+func (h *AllocationHandler) GetQuotaUsage(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	response, err := h.quotaService.Usage(ctx)
+	if err != nil {
+		h.writeError(c, err, "Failed to compute quota usage")
+		return
+	}
+
+	h.log(c).Debug("Quota usage retrieved",
+		zap.String("tenant", response.Tenant),
+		zap.Int("quota_count", len(response.Quotas)),
+		zap.String("client_ip", c.ClientIP()))
+
+	c.JSON(http.StatusOK, response)
+}
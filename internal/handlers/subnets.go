@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// ===============================
+// SUBNET CARVING METHODS
+// ===============================
+
+// AllocateZoneSubnet creates a zone from the first free block of the region CIDRs
+func (h *AllocationHandler) AllocateZoneSubnet(c *gin.Context) {
+	ctx, cancel := requestContext(c, 30*time.Second)
+	defer cancel()
+
+	regionName := c.Param("region")
+	if regionName == "" {
+		h.log(c).Warn("Missing region name in zone subnet allocation",
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Region name is required")
+		return
+	}
+
+	req, ok := h.bindSubnetAllocationRequest(c)
+	if !ok {
+		return
+	}
+
+	response, err := h.crudService.AllocateZoneSubnet(ctx, regionName, req)
+	if err != nil {
+		h.writeError(c, err, "Failed to allocate zone subnet",
+			zap.String("region", regionName),
+			zap.String("zone", req.Name))
+		return
+	}
+
+	h.writeSubnetAllocationResponse(c, response, regionName, "", req.Name)
+}
+
+// AllocateSubZoneSubnet creates a sub-zone from the first free block of the zone CIDRs
+func (h *AllocationHandler) AllocateSubZoneSubnet(c *gin.Context) {
+	ctx, cancel := requestContext(c, 30*time.Second)
+	defer cancel()
+
+	regionName := c.Param("region")
+	zoneName := c.Param("zone")
+	if regionName == "" || zoneName == "" {
+		h.log(c).Warn("Missing parameters in sub-zone subnet allocation",
+			zap.String("region", regionName),
+			zap.String("zone", zoneName),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Region and zone names are required")
+		return
+	}
+
+	req, ok := h.bindSubnetAllocationRequest(c)
+	if !ok {
+		return
+	}
+
+	response, err := h.crudService.AllocateSubZoneSubnet(ctx, regionName, zoneName, req)
+	if err != nil {
+		h.writeError(c, err, "Failed to allocate sub-zone subnet",
+			zap.String("region", regionName),
+			zap.String("zone", zoneName),
+			zap.String("subzone", req.Name))
+		return
+	}
+
+	h.writeSubnetAllocationResponse(c, response, regionName, zoneName, req.Name)
+}
+
+// bindSubnetAllocationRequest parses and validates a subnet allocation body, writing the error response itself
+func (h *AllocationHandler) bindSubnetAllocationRequest(c *gin.Context) (*models.SubnetAllocationRequest, bool) {
+	var req models.SubnetAllocationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.log(c).Warn("Invalid JSON payload for subnet allocation",
+			zap.Error(err),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
+		return nil, false
+	}
+
+	if err := h.validator.Struct(&req); err != nil {
+		h.log(c).Warn("Validation error in subnet allocation",
+			zap.Error(err),
+			zap.Any("request", req),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteValidationError(c, err.Error())
+		return nil, false
+	}
+
+	if req.IPv4PrefixLength == 0 && req.IPv6PrefixLength == 0 {
+		h.log(c).Warn("Subnet allocation without prefix length",
+			zap.Any("request", req),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "At least one of ipv4_prefix_length or ipv6_prefix_length is required")
+		return nil, false
+	}
+
+	return &req, true
+}
+
+// writeSubnetAllocationResponse writes the outcome of a subnet allocation
+func (h *AllocationHandler) writeSubnetAllocationResponse(c *gin.Context, response *models.CRUDResponse, regionName, zoneName, name string) {
+	h.log(c).Info("Subnet allocated successfully",
+		zap.String("region", regionName),
+		zap.String("zone", zoneName),
+		zap.String("name", name),
+		zap.String("client_ip", c.ClientIP()))
+	c.JSON(http.StatusCreated, response)
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// ===============================
+// TENANT METHODS
+// ===============================
+
+// CreateTenant creates an empty tenant
+func (h *AllocationHandler) CreateTenant(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	var req models.CreateTenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.log(c).Warn("Invalid JSON payload for tenant creation",
+			zap.Error(err),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
+		return
+	}
+
+	if err := h.validator.Struct(&req); err != nil {
+		h.log(c).Warn("Validation error in tenant creation",
+			zap.Error(err),
+			zap.String("tenant", req.Name),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteValidationError(c, err.Error())
+		return
+	}
+
+	response, err := h.tenantService.CreateTenant(ctx, &req)
+	if err != nil {
+		h.writeError(c, err, "Failed to create tenant",
+			zap.String("tenant", req.Name))
+		return
+	}
+
+	h.log(c).Info("Tenant created successfully",
+		zap.String("tenant", req.Name),
+		zap.String("client_ip", c.ClientIP()))
+
+	c.JSON(http.StatusCreated, response)
+}
+
+// ListTenants returns every tenant
+func (h *AllocationHandler) ListTenants(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	tenants, err := h.tenantService.ListTenants(ctx)
+	if err != nil {
+		h.writeError(c, err, "Failed to list tenants")
+		return
+	}
+
+	h.log(c).Info("Tenants retrieved successfully",
+		zap.Int("count", len(tenants)),
+		zap.String("client_ip", c.ClientIP()))
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":   true,
+		"data":      tenants,
+		"count":     len(tenants),
+		"message":   "Tenants retrieved successfully",
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+// GetTenant returns a single tenant
+func (h *AllocationHandler) GetTenant(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	name := c.Param("tenant")
+	response, err := h.tenantService.GetTenant(ctx, name)
+	if err != nil {
+		h.writeError(c, err, "Failed to get tenant",
+			zap.String("tenant", name))
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// UpdateTenant updates the description of a tenant
+func (h *AllocationHandler) UpdateTenant(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	name := c.Param("tenant")
+
+	var req models.UpdateTenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.log(c).Warn("Invalid JSON payload for tenant update",
+			zap.Error(err),
+			zap.String("tenant", name),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteBadRequestError(c, "Invalid JSON payload: "+err.Error())
+		return
+	}
+
+	if err := h.validator.Struct(&req); err != nil {
+		h.log(c).Warn("Validation error in tenant update",
+			zap.Error(err),
+			zap.String("tenant", name),
+			zap.String("client_ip", c.ClientIP()))
+		utils.WriteValidationError(c, err.Error())
+		return
+	}
+
+	response, err := h.tenantService.UpdateTenant(ctx, name, &req)
+	if err != nil {
+		h.writeError(c, err, "Failed to update tenant",
+			zap.String("tenant", name))
+		return
+	}
+
+	h.log(c).Info("Tenant updated successfully",
+		zap.String("tenant", name),
+		zap.String("client_ip", c.ClientIP()))
+
+	c.JSON(http.StatusOK, response)
+}
+
+// DeleteTenant deletes a tenant that owns no regions
+func (h *AllocationHandler) DeleteTenant(c *gin.Context) {
+	ctx, cancel := requestContext(c, 15*time.Second)
+	defer cancel()
+
+	name := c.Param("tenant")
+	h.log(c).Info("Attempting to delete tenant",
+		zap.String("tenant", name),
+		zap.String("client_ip", c.ClientIP()))
+
+	response, err := h.tenantService.DeleteTenant(ctx, name)
+	if err != nil {
+		h.writeError(c, err, "Failed to delete tenant",
+			zap.String("tenant", name))
+		return
+	}
+
+	h.log(c).Info("Tenant deleted successfully",
+		zap.String("tenant", name),
+		zap.String("client_ip", c.ClientIP()))
+
+	c.JSON(http.StatusOK, response)
+}
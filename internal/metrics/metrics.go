@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+const namespace = "ip_allocator"
+
+// registry holds every metric exported on /metrics
+var registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by method, route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	mongoCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "mongodb",
+		Name:      "command_duration_seconds",
+		Help:      "MongoDB command latency by command name, failed commands included.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command"})
+
+	mongoCommandErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mongodb",
+		Name:      "command_errors_total",
+		Help:      "Failed MongoDB commands by command name.",
+	}, []string{"command"})
+
+	ipOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ip",
+		Name:      "operations_total",
+		Help:      "IP allocations, deallocations, reservations, renewals and lease expiries by outcome.",
+	}, []string{"operation", "outcome"})
+
+	ipAddresses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ip",
+		Name:      "addresses_total",
+		Help:      "Addresses processed by IP operations, by operation.",
+	}, []string{"operation"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		mongoCommandDuration,
+		mongoCommandErrors,
+		ipOperations,
+		ipAddresses,
+	)
+}
+
+// Handler serves the registered metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Register adds collectors to the metrics served by Handler
+func Register(cs ...prometheus.Collector) error {
+	for _, c := range cs {
+		if err := registry.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ObserveRequest records a served HTTP request. route is the matched route pattern rather than
+// the request path, so addresses and names in the path do not create new series.
+func ObserveRequest(method, route string, status int, latency time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	code := strconv.Itoa(status)
+	httpRequests.WithLabelValues(method, route, code).Inc()
+	httpRequestDuration.WithLabelValues(method, route, code).Observe(latency.Seconds())
+}
+
+// ObserveIPOperation records the outcome of an IP operation and the number of addresses it
+// processed
+func ObserveIPOperation(operation, outcome string, addresses int) {
+	ipOperations.WithLabelValues(operation, outcome).Inc()
+	if addresses > 0 {
+		ipAddresses.WithLabelValues(operation).Add(float64(addresses))
+	}
+}
+
+// CommandMonitor returns a MongoDB command monitor recording command latency and errors
+func CommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mongoCommandDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			mongoCommandDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+			mongoCommandErrors.WithLabelValues(e.CommandName).Inc()
+		},
+	}
+}
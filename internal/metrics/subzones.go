@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"ip-allocator-api/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// subZoneScrapeTimeout bounds how long a scrape waits for the sub-zone usage
+const subZoneScrapeTimeout = 10 * time.Second
+
+var subZoneLabels = []string{"tenant", "region", "zone", "sub_zone", "ip_version"}
+
+// SubZoneSource returns the current address usage of every sub-zone
+type SubZoneSource func(ctx context.Context) ([]models.SubZoneUsage, error)
+
+// subZoneCollector reads the address usage of every sub-zone, which means every stored IP, at
+// most once per refresh interval and serves the last reading to the scrapes in between
+type subZoneCollector struct {
+	source    SubZoneSource
+	refresh   time.Duration
+	logger    *zap.Logger
+	total     *prometheus.Desc
+	allocated *prometheus.Desc
+	reserved  *prometheus.Desc
+	free      *prometheus.Desc
+
+	// mu is held while reading, so concurrent scrapes share one reading
+	mu     sync.Mutex
+	usages []models.SubZoneUsage
+	readAt time.Time
+}
+
+// NewSubZoneCollector returns a collector exporting total, allocated, reserved and free address
+// gauges per sub-zone and address family, read from source at most once per refresh. A refresh
+// of 0 reads them on every scrape.
+func NewSubZoneCollector(source SubZoneSource, refresh time.Duration, logger *zap.Logger) prometheus.Collector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "subzone", name), help, subZoneLabels, nil)
+	}
+	return &subZoneCollector{
+		source:    source,
+		refresh:   refresh,
+		logger:    logger,
+		total:     desc("total_addresses", "Usable addresses in the sub-zone CIDR."),
+		allocated: desc("allocated_addresses", "Allocated addresses in the sub-zone."),
+		reserved:  desc("reserved_addresses", "Reserved addresses in the sub-zone."),
+		free:      desc("free_addresses", "Addresses in the sub-zone that can still be allocated: neither allocated, reserved nor excluded."),
+	}
+}
+
+func (c *subZoneCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.total
+	ch <- c.allocated
+	ch <- c.reserved
+	ch <- c.free
+}
+
+func (c *subZoneCollector) Collect(ch chan<- prometheus.Metric) {
+	usages, err := c.read()
+	if err != nil {
+		// Leave the gauges out rather than failing the whole scrape
+		c.logger.Error("Failed to collect sub-zone usage metrics", zap.Error(err))
+		return
+	}
+
+	for _, usage := range usages {
+		labels := []string{usage.Tenant, usage.Region, usage.Zone, usage.SubZone, usage.IPVersion}
+		ch <- prometheus.MustNewConstMetric(c.total, prometheus.GaugeValue, usage.Total, labels...)
+		ch <- prometheus.MustNewConstMetric(c.allocated, prometheus.GaugeValue, float64(usage.Allocated), labels...)
+		ch <- prometheus.MustNewConstMetric(c.reserved, prometheus.GaugeValue, float64(usage.Reserved), labels...)
+		ch <- prometheus.MustNewConstMetric(c.free, prometheus.GaugeValue, usage.Available, labels...)
+	}
+}
+
+// read returns the last reading while it is younger than the refresh interval and reads the
+// source again otherwise. A failed reading is not kept, so the next scrape tries again.
+func (c *subZoneCollector) read() ([]models.SubZoneUsage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.readAt.IsZero() && time.Since(c.readAt) < c.refresh {
+		return c.usages, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), subZoneScrapeTimeout)
+	defer cancel()
+
+	usages, err := c.source(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.usages, c.readAt = usages, time.Now()
+	return usages, nil
+}
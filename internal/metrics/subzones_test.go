@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/models"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// usageSource is a sub-zone source counting its readings, failing while fail is set
+type usageSource struct {
+	reads int
+	fail  bool
+}
+
+func (s *usageSource) read(ctx context.Context) ([]models.SubZoneUsage, error) {
+	s.reads++
+	if s.fail {
+		return nil, errors.New("unavailable")
+	}
+	return []models.SubZoneUsage{{Tenant: "t1", Region: "r1", Zone: "z1", SubZone: "s1", IPVersion: "ipv4", Total: 254, Allocated: 2, Available: 252}}, nil
+}
+
+// collect runs one scrape of the collector and returns how many metrics it exported
+func collect(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 64)
+	c.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
+func TestSubZoneCollectorCachesReadings(t *testing.T) {
+	source := &usageSource{}
+	collector := NewSubZoneCollector(source.read, time.Hour, zap.NewNop())
+
+	for scrape := 1; scrape <= 3; scrape++ {
+		if n := collect(collector); n != 4 || source.reads != 1 {
+			t.Fatalf("scrape %d exported %d metrics after %d readings, want 4 after one", scrape, n, source.reads)
+		}
+		// Within the interval the source is not consulted, so its failures go unnoticed
+		source.fail = true
+	}
+}
+
+func TestSubZoneCollectorWithoutRefresh(t *testing.T) {
+	source := &usageSource{}
+	collector := NewSubZoneCollector(source.read, 0, zap.NewNop())
+
+	collect(collector)
+	collect(collector)
+	if source.reads != 2 {
+		t.Fatalf("took %d readings for 2 scrapes without a refresh interval", source.reads)
+	}
+
+	// A failed reading leaves the gauges out and is not kept
+	source.fail = true
+	if n := collect(collector); n != 0 {
+		t.Fatalf("exported %d metrics from a failed reading", n)
+	}
+	source.fail = false
+	if n := collect(collector); n != 4 || source.reads != 4 {
+		t.Fatalf("exported %d metrics after %d readings, want 4 after a fresh reading", n, source.reads)
+	}
+}
+
+func TestSubZoneCollectorRetriesAFailedFirstReading(t *testing.T) {
+	source := &usageSource{fail: true}
+	collector := NewSubZoneCollector(source.read, time.Hour, zap.NewNop())
+
+	if n := collect(collector); n != 0 {
+		t.Fatalf("exported %d metrics from a failed reading", n)
+	}
+	source.fail = false
+	if n := collect(collector); n != 4 || source.reads != 2 {
+		t.Fatalf("exported %d metrics after %d readings, want the failure retried within the interval", n, source.reads)
+	}
+}
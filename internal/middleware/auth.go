@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	// APIKeyHeader carries the API key of the caller
+	APIKeyHeader = "X-API-Key"
+	// PrincipalContextKey holds the authenticated *models.Principal in the Gin context
+	PrincipalContextKey = "principal"
+
+	bearerPrefix = "Bearer "
+)
+
+// CurrentPrincipal returns the authenticated caller of the request, or nil
+func CurrentPrincipal(c *gin.Context) *models.Principal {
+	principal, _ := c.Get(PrincipalContextKey)
+	p, _ := principal.(*models.Principal)
+	return p
+}
+
+// Authenticator identifies the caller of a request from one kind of credentials. It returns
+// services.ErrNoCredentials when the request carries none of its kind, so the next
+// authenticator is tried, and services.ErrInvalidCredentials when they are not accepted.
+type Authenticator interface {
+	Authenticate(c *gin.Context) (*models.Principal, error)
+}
+
+type apiKeyAuthenticator struct {
+	service *services.APIKeyService
+}
+
+// APIKeyAuthenticator authenticates requests carrying an X-API-Key header
+func APIKeyAuthenticator(service *services.APIKeyService) Authenticator {
+	return &apiKeyAuthenticator{service: service}
+}
+
+func (a *apiKeyAuthenticator) Authenticate(c *gin.Context) (*models.Principal, error) {
+	key := c.GetHeader(APIKeyHeader)
+	if key == "" {
+		return nil, services.ErrNoCredentials
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+	return a.service.Authenticate(ctx, key)
+}
+
+type jwtAuthenticator struct {
+	verifier *services.TokenVerifier
+}
+
+// JWTAuthenticator authenticates requests carrying an "Authorization: Bearer" token
+func JWTAuthenticator(verifier *services.TokenVerifier) Authenticator {
+	return &jwtAuthenticator{verifier: verifier}
+}
+
+func (a *jwtAuthenticator) Authenticate(c *gin.Context) (*models.Principal, error) {
+	header := c.GetHeader("Authorization")
+	if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return nil, services.ErrNoCredentials
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+	defer cancel()
+	return a.verifier.Verify(ctx, strings.TrimSpace(header[len(bearerPrefix):]))
+}
+
+// Auth authenticates requests with a chain of authenticators and authorizes them by role and
+// scope. When disabled every request is let through unauthenticated.
+type Auth struct {
+	enabled        bool
+	authenticators []Authenticator
+	logger         *zap.Logger
+}
+
+func NewAuth(enabled bool, logger *zap.Logger, authenticators ...Authenticator) *Auth {
+	return &Auth{
+		enabled:        enabled,
+		authenticators: authenticators,
+		logger:         logger,
+	}
+}
+
+// Authenticate identifies the caller and records it in the request info. Requests without
+// credentials continue unauthenticated and are rejected by Require on protected routes.
+func (a *Auth) Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.enabled {
+			c.Next()
+			return
+		}
+
+		for _, authenticator := range a.authenticators {
+			principal, err := authenticator.Authenticate(c)
+			if errors.Is(err, services.ErrNoCredentials) {
+				continue
+			}
+			if errors.Is(err, services.ErrInvalidCredentials) {
+				requestLogger(c, a.logger).Warn("Rejected invalid credentials",
+					zap.Error(err),
+					zap.String("path", c.Request.URL.Path),
+					zap.String("client_ip", getClientIP(c)))
+				abortWithMessage(c, http.StatusUnauthorized, "Invalid or expired credentials")
+				return
+			}
+			if err != nil {
+				requestLogger(c, a.logger).Error("Failed to authenticate request",
+					zap.Error(err),
+					zap.String("path", c.Request.URL.Path),
+					zap.String("client_ip", getClientIP(c)))
+				abortWithMessage(c, http.StatusInternalServerError, "Failed to authenticate request: "+err.Error())
+				return
+			}
+
+			c.Set(PrincipalContextKey, principal)
+			info := services.RequestInfoFromContext(c.Request.Context())
+			info.Actor = principal.Subject
+			info.Principal = principal
+			c.Request = c.Request.WithContext(services.WithRequestInfo(c.Request.Context(), info))
+			break
+		}
+
+		c.Next()
+	}
+}
+
+// Require lets through callers whose role grants at least role and whose scope covers the
+// :region and :zone route parameters. Routes taking the region and zone from the request body
+// check the scope in the handler.
+func (a *Auth) Require(role string) gin.HandlerFunc {
+	return a.require(role, false, false)
+}
+
+// RequireGlobal is Require for endpoints spanning the whole hierarchy, which callers limited
+// to a region or zone may not use
+func (a *Auth) RequireGlobal(role string) gin.HandlerFunc {
+	return a.require(role, true, false)
+}
+
+// RequirePlatform is RequireGlobal for endpoints spanning all tenants, which callers bound to
+// a tenant may not use
+func (a *Auth) RequirePlatform(role string) gin.HandlerFunc {
+	return a.require(role, true, true)
+}
+
+func (a *Auth) require(role string, global, platform bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !a.enabled {
+			c.Next()
+			return
+		}
+
+		principal := services.RequestInfoFromContext(c.Request.Context()).Principal
+		if principal == nil {
+			requestLogger(c, a.logger).Warn("Unauthenticated request to protected endpoint",
+				zap.String("path", c.Request.URL.Path),
+				zap.String("client_ip", getClientIP(c)))
+			abortWithMessage(c, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+
+		fields := []zap.Field{
+			zap.String("subject", principal.Subject),
+			zap.String("role", principal.Role),
+			zap.String("tenant", principal.Tenant),
+			zap.String("path", c.Request.URL.Path),
+			zap.String("client_ip", getClientIP(c)),
+		}
+
+		regionName := c.Param("region")
+		switch {
+		case !principal.HasRole(role):
+			requestLogger(c, a.logger).Warn("Insufficient role", append(fields, zap.String("required_role", role))...)
+			abortWithMessage(c, http.StatusForbidden, "This operation requires the "+role+" role")
+		case platform && !principal.IsPlatform():
+			requestLogger(c, a.logger).Warn("Tenant principal used on a platform endpoint", fields...)
+			abortWithMessage(c, http.StatusForbidden, "This operation is not available to credentials bound to a tenant")
+		case global && !principal.IsGlobal():
+			requestLogger(c, a.logger).Warn("Scoped principal used on a global endpoint", fields...)
+			abortWithMessage(c, http.StatusForbidden, "This operation is not available to keys limited to a region or zone")
+		case regionName != "" && !principal.Covers(regionName, c.Param("zone")):
+			requestLogger(c, a.logger).Warn("Request outside the principal's scope", fields...)
+			abortWithMessage(c, http.StatusForbidden, "This operation is outside the scope of your credentials")
+		default:
+			c.Next()
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// headerAuthenticator stands in for real credentials: the principal comes from test headers
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) Authenticate(c *gin.Context) (*models.Principal, error) {
+	switch c.GetHeader("X-Subject") {
+	case "":
+		return nil, services.ErrNoCredentials
+	case "invalid":
+		return nil, services.ErrInvalidCredentials
+	}
+	return &models.Principal{
+		Subject: c.GetHeader("X-Subject"),
+		Role:    c.GetHeader("X-Role"),
+		Tenant:  c.GetHeader("X-Principal-Tenant"),
+		Region:  c.GetHeader("X-Principal-Region"),
+		Zone:    c.GetHeader("X-Principal-Zone"),
+	}, nil
+}
+
+func TestRequireRejectsCallersOutsideRoleAndScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	auth := NewAuth(true, zap.NewNop(), headerAuthenticator{})
+
+	router := gin.New()
+	router.Use(auth.Authenticate())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.GET("/regions/:region/zones/:zone", auth.Require(models.RoleViewer), ok)
+	router.POST("/regions/:region/zones/:zone/allocate", auth.Require(models.RoleAllocator), ok)
+	router.GET("/stats", auth.RequireGlobal(models.RoleViewer), ok)
+	router.GET("/tenants", auth.RequirePlatform(models.RoleAdmin), ok)
+
+	tests := []struct {
+		name                 string
+		method, path         string
+		subject, role        string
+		tenant, region, zone string
+		status               int
+		code                 string
+	}{
+		{"no credentials", http.MethodGet, "/regions/r1/zones/z1", "", "", "", "", "", http.StatusUnauthorized, "unauthorized"},
+		{"invalid credentials", http.MethodGet, "/regions/r1/zones/z1", "invalid", "", "", "", "", http.StatusUnauthorized, "unauthorized"},
+		{"viewer reads", http.MethodGet, "/regions/r1/zones/z1", "apikey:a", models.RoleViewer, "", "", "", http.StatusOK, ""},
+		{"viewer allocates", http.MethodPost, "/regions/r1/zones/z1/allocate", "apikey:a", models.RoleViewer, "", "", "", http.StatusForbidden, "forbidden"},
+		{"admin allocates", http.MethodPost, "/regions/r1/zones/z1/allocate", "apikey:a", models.RoleAdmin, "", "", "", http.StatusOK, ""},
+		{"unknown role", http.MethodGet, "/regions/r1/zones/z1", "apikey:a", "owner", "", "", "", http.StatusForbidden, "forbidden"},
+		{"region key in its region", http.MethodGet, "/regions/r1/zones/z1", "apikey:a", models.RoleViewer, "", "r1", "", http.StatusOK, ""},
+		{"region key in another region", http.MethodGet, "/regions/r2/zones/z1", "apikey:a", models.RoleViewer, "", "r1", "", http.StatusForbidden, "forbidden"},
+		{"zone key in its zone", http.MethodGet, "/regions/r1/zones/z1", "apikey:a", models.RoleViewer, "", "r1", "z1", http.StatusOK, ""},
+		{"zone key in another zone", http.MethodGet, "/regions/r1/zones/z2", "apikey:a", models.RoleViewer, "", "r1", "z1", http.StatusForbidden, "forbidden"},
+		{"global key on a global endpoint", http.MethodGet, "/stats", "apikey:a", models.RoleViewer, "t1", "", "", http.StatusOK, ""},
+		{"region key on a global endpoint", http.MethodGet, "/stats", "apikey:a", models.RoleAdmin, "", "r1", "", http.StatusForbidden, "forbidden"},
+		{"platform key on a platform endpoint", http.MethodGet, "/tenants", "apikey:a", models.RoleAdmin, "", "", "", http.StatusOK, ""},
+		{"tenant key on a platform endpoint", http.MethodGet, "/tenants", "apikey:a", models.RoleAdmin, "t1", "", "", http.StatusForbidden, "forbidden"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("X-Subject", tt.subject)
+		req.Header.Set("X-Role", tt.role)
+		req.Header.Set("X-Principal-Tenant", tt.tenant)
+		req.Header.Set("X-Principal-Region", tt.region)
+		req.Header.Set("X-Principal-Zone", tt.zone)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Fatalf("%s: got %d %s, want %d", tt.name, w.Code, w.Body.String(), tt.status)
+		}
+		if tt.code != "" {
+			if code := problemCode(t, w); code != tt.code {
+				t.Fatalf("%s: code = %q, want %q", tt.name, code, tt.code)
+			}
+		}
+	}
+}
+
+func TestRequireLetsEverythingThroughWhenDisabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	auth := NewAuth(false, zap.NewNop(), headerAuthenticator{})
+
+	router := gin.New()
+	router.Use(auth.Authenticate())
+	router.GET("/tenants", auth.RequirePlatform(models.RoleAdmin), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/tenants", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body.String())
+	}
+}
+
+// problemCode returns the code of the problem document in the response
+func problemCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var problem struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("response is not a problem document: %v: %s", err, w.Body.String())
+	}
+	return problem.Code
+}
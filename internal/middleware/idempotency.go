@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header carrying the client supplied key
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotencyReplayedHeader is set on responses replayed from a stored record
+	IdempotencyReplayedHeader = "Idempotency-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+// bodyRecorder captures the response body so it can be stored for replays
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *bodyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency returns a gin.HandlerFunc that honors the Idempotency-Key header for the given
+// operation. The first request with a key is executed and its response stored; retries with the
+// same payload replay that response, and a key reused with a different payload is rejected.
+func Idempotency(service *services.IdempotencyService, operation string, logger *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		operation := idempotencyScope(c.Request.Context(), operation)
+
+		if len(key) > maxIdempotencyKeyLength {
+			requestLogger(c, logger).Warn("Idempotency key too long",
+				zap.Int("length", len(key)),
+				zap.String("client_ip", getClientIP(c)))
+			abortWithMessage(c, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			requestLogger(c, logger).Warn("Failed to read request body for idempotency check",
+				zap.Error(err),
+				zap.String("client_ip", getClientIP(c)))
+			abortWithMessage(c, http.StatusBadRequest, "Failed to read request body: "+err.Error())
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(hash[:])
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 10*time.Second)
+		record, claimed, err := service.Begin(ctx, key, operation, requestHash)
+		cancel()
+		if err != nil {
+			requestLogger(c, logger).Error("Failed to check idempotency key",
+				zap.Error(err),
+				zap.String("idempotency_key", key),
+				zap.String("operation", operation),
+				zap.String("client_ip", getClientIP(c)))
+			abortWithMessage(c, http.StatusInternalServerError, "Failed to check idempotency key: "+err.Error())
+			return
+		}
+
+		if !claimed {
+			replayIdempotentResponse(c, record, requestHash, logger)
+			return
+		}
+
+		recorder := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		// Server-side failures are not stored so the client can retry with the same key. The
+		// outcome is stored even if the client has gone away in the meantime.
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request.Context()), 10*time.Second)
+		defer cancel()
+
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError {
+			if err := service.Release(ctx, record); err != nil {
+				requestLogger(c, logger).Error("Failed to release idempotency key",
+					zap.Error(err),
+					zap.String("idempotency_key", key),
+					zap.String("operation", operation))
+			}
+			return
+		}
+
+		if err := service.Complete(ctx, record, status, recorder.Header().Get("Content-Type"), recorder.body.Bytes()); err != nil {
+			requestLogger(c, logger).Error("Failed to store idempotent response",
+				zap.Error(err),
+				zap.String("idempotency_key", key),
+				zap.String("operation", operation))
+		}
+	}
+}
+
+// idempotencyScope scopes keys to the tenant and the authenticated caller. Replays skip the
+// handler and its authorization checks, so a response is only ever replayed to the caller it
+// was first returned to, never to another tenant or to a caller without access to it.
+func idempotencyScope(ctx context.Context, operation string) string {
+	subject := services.AnonymousActor
+	if principal := services.RequestInfoFromContext(ctx).Principal; principal != nil {
+		subject = principal.Subject
+	}
+	return services.TenantFromContext(ctx) + "/" + subject + "/" + operation
+}
+
+// replayIdempotentResponse answers a request whose key was already used
+func replayIdempotentResponse(c *gin.Context, record *models.IdempotencyRecord, requestHash string, logger *zap.Logger) {
+	fields := []zap.Field{
+		zap.String("idempotency_key", record.Key),
+		zap.String("operation", record.Operation),
+		zap.String("client_ip", getClientIP(c)),
+	}
+
+	switch {
+	case record.RequestHash != requestHash:
+		requestLogger(c, logger).Warn("Idempotency key reused with a different payload", fields...)
+		abortWithProblem(c, http.StatusConflict, services.CodeIdempotencyKeyReused, "Idempotency-Key was already used with a different request payload")
+	case record.State != models.IdempotencyStateCompleted:
+		requestLogger(c, logger).Warn("Idempotency key is still being processed", fields...)
+		abortWithProblem(c, http.StatusConflict, services.CodeIdempotencyKeyInUse, "A request with this Idempotency-Key is still being processed")
+	default:
+		requestLogger(c, logger).Info("Replaying idempotent response", append(fields, zap.Int("status", record.StatusCode))...)
+		c.Header(IdempotencyReplayedHeader, "true")
+		c.Data(record.StatusCode, record.ContentType, record.Body)
+		c.Abort()
+	}
+}
+
+// abortWithMessage stops the handler chain with a problem document carrying the generic error
+// code of status
+func abortWithMessage(c *gin.Context, status int, message string) {
+	abortWithProblem(c, status, utils.StatusErrorCode(status), message)
+}
+
+// abortWithProblem stops the handler chain with a problem document
+func abortWithProblem(c *gin.Context, status int, code, message string) {
+	c.Abort()
+	utils.WriteProblem(c, status, code, message, nil)
+}
@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestIdempotencyReplaysOnlyToTheSameCaller(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := services.NewIdempotencyService(storage.NewMemoryRepository(), time.Hour, zap.NewNop())
+
+	executions := 0
+	router := gin.New()
+	// Stands in for authentication: the caller and tenant come from test headers
+	router.Use(func(c *gin.Context) {
+		info := services.RequestInfo{Tenant: c.GetHeader("X-Tenant")}
+		if subject := c.GetHeader("X-Subject"); subject != "" {
+			info.Principal = &models.Principal{Subject: subject, Role: models.RoleAllocator, Tenant: info.Tenant}
+		}
+		c.Request = c.Request.WithContext(services.WithRequestInfo(c.Request.Context(), info))
+	})
+	router.POST("/allocate", Idempotency(service, "allocate", zap.NewNop()), func(c *gin.Context) {
+		executions++
+		c.JSON(http.StatusCreated, gin.H{"execution": executions})
+	})
+
+	send := func(tenant, subject string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/allocate", strings.NewReader(`{"count":1}`))
+		req.Header.Set(IdempotencyKeyHeader, "key-1")
+		req.Header.Set("X-Tenant", tenant)
+		req.Header.Set("X-Subject", subject)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name            string
+		tenant, subject string
+		replayed        bool
+		execution       string
+	}{
+		{"first request", "t1", "apikey:a", false, `{"execution":1}`},
+		{"retry by the same caller", "t1", "apikey:a", true, `{"execution":1}`},
+		{"other caller of the tenant", "t1", "apikey:b", false, `{"execution":2}`},
+		{"same subject in another tenant", "t2", "apikey:a", false, `{"execution":3}`},
+		{"unauthenticated caller", "t1", "", false, `{"execution":4}`},
+		{"unauthenticated retry", "t1", "", true, `{"execution":4}`},
+	}
+	for _, tt := range tests {
+		w := send(tt.tenant, tt.subject)
+		if w.Code != http.StatusCreated || w.Body.String() != tt.execution {
+			t.Fatalf("%s: got %d %s, want 201 %s", tt.name, w.Code, w.Body.String(), tt.execution)
+		}
+		if replayed := w.Header().Get(IdempotencyReplayedHeader) == "true"; replayed != tt.replayed {
+			t.Fatalf("%s: replayed = %v, want %v", tt.name, replayed, tt.replayed)
+		}
+	}
+}
@@ -2,13 +2,16 @@ package middleware
 
 import (
 	"net"
-	"net/http"
 	"net/http/httputil"
 	"os"
 	"runtime/debug"
 	"strings"
 	"time"
 
+	"ip-allocator-api/internal/metrics"
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/utils"
+
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -30,6 +33,9 @@ func ZapLogger(logger *zap.Logger) gin.HandlerFunc {
 		// Get client IP
 		clientIP := getClientIP(c)
 
+		// Export the request count and latency by matched route
+		metrics.ObserveRequest(c.Request.Method, c.FullPath(), c.Writer.Status(), latency)
+
 		// Build log fields
 		fields := []zapcore.Field{
 			zap.String("method", c.Request.Method),
@@ -42,19 +48,28 @@ func ZapLogger(logger *zap.Logger) gin.HandlerFunc {
 			zap.Int("body_size", c.Writer.Size()),
 		}
 
+		// Add the authenticated caller and the tenant if any
+		if principal := CurrentPrincipal(c); principal != nil {
+			fields = append(fields, zap.String("subject", principal.Subject))
+		}
+		if tenant := services.RequestInfoFromContext(c.Request.Context()).Tenant; tenant != "" {
+			fields = append(fields, zap.String("tenant", tenant))
+		}
+
 		// Add error information if present
 		if len(c.Errors) > 0 {
 			fields = append(fields, zap.String("errors", c.Errors.ByType(gin.ErrorTypePrivate).String()))
 		}
 
-		// Log based on status code
+		// Log based on status code, with the request-scoped logger so the line carries the request ID
+		log := requestLogger(c, logger)
 		switch {
 		case c.Writer.Status() >= 400 && c.Writer.Status() < 500:
-			logger.Warn("Client error", fields...)
+			log.Warn("Client error", fields...)
 		case c.Writer.Status() >= 500:
-			logger.Error("Server error", fields...)
+			log.Error("Server error", fields...)
 		default:
-			logger.Info("Request processed", fields...)
+			log.Info("Request processed", fields...)
 		}
 	}
 }
@@ -96,7 +111,7 @@ func ZapRecovery(logger *zap.Logger, stack bool) gin.HandlerFunc {
 				}
 
 				// Log the panic
-				logger.Error("Panic recovered", fields...)
+				requestLogger(c, logger).Error("Panic recovered", fields...)
 
 				// If the connection is dead, we can't write a status to it
 				if brokenPipe {
@@ -106,11 +121,7 @@ func ZapRecovery(logger *zap.Logger, stack bool) gin.HandlerFunc {
 				}
 
 				// Return structured error response
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"success":   false,
-					"message":   "Internal server error occurred",
-					"timestamp": time.Now().Format(time.RFC3339),
-				})
+				utils.WriteInternalServerError(c, "Internal server error occurred")
 			}
 		}()
 		c.Next()
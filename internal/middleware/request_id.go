@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// RequestIDContextKey is the gin context key holding the request ID
+const RequestIDContextKey = "request_id"
+
+// maxRequestIDLength bounds the X-Request-ID values accepted from callers
+const maxRequestIDLength = 128
+
+// CurrentRequestID returns the ID of the request, or "" before RequestID has run
+func CurrentRequestID(c *gin.Context) string {
+	return c.GetString(RequestIDContextKey)
+}
+
+// RequestID assigns every request an ID, taken from a well-formed X-Request-ID header or
+// generated otherwise. The ID is echoed in the X-Request-ID response header and the request_id
+// field of JSON responses, and a logger tagged with it is stored in the request context so the
+// handler and service log lines of one request can be correlated.
+func RequestID(logger *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			if id != "" {
+				logger.Debug("Replacing malformed request ID",
+					zap.Int("length", len(id)),
+					zap.String("client_ip", getClientIP(c)))
+			}
+			id = newRequestID()
+		}
+
+		c.Set(RequestIDContextKey, id)
+		c.Header(RequestIDHeader, id)
+		c.Writer = &requestIDWriter{ResponseWriter: c.Writer, id: id}
+
+		ctx := c.Request.Context()
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("request_id", id))
+		ctx = services.WithLogger(ctx, logger.With(zap.String("request_id", id)))
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+// requestLogger returns the request-scoped logger, or fallback before RequestID has run
+func requestLogger(c *gin.Context, fallback *zap.Logger) *zap.Logger {
+	return services.LoggerFromContext(c.Request.Context(), fallback)
+}
+
+// validRequestID reports whether a caller-supplied ID is short and made of characters that are
+// safe to log and echo
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("-_.:", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 128-bit ID in hex
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// requestIDWriter adds the request_id field to JSON object responses. Gin renders a JSON body
+// in a single write, so only the first write is rewritten.
+type requestIDWriter struct {
+	gin.ResponseWriter
+	id      string
+	written bool
+}
+
+func (w *requestIDWriter) Write(data []byte) (int, error) {
+	if w.written || !isJSON(w.Header().Get("Content-Type")) {
+		w.written = true
+		return w.ResponseWriter.Write(data)
+	}
+	w.written = true
+	if _, err := w.ResponseWriter.Write(withRequestID(data, w.id)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *requestIDWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// isJSON reports whether a response content type is JSON, problem documents included
+func isJSON(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/json") || strings.HasPrefix(contentType, utils.ProblemContentType)
+}
+
+// withRequestID returns body with the request_id field inserted first, or body unchanged when
+// it is not a JSON object
+func withRequestID(body []byte, id string) []byte {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return body
+	}
+	value, _ := json.Marshal(id)
+
+	rest := trimmed[1:]
+	out := make([]byte, 0, len(body)+len(value)+16)
+	out = append(out, `{"request_id":`...)
+	out = append(out, value...)
+	if next := bytes.TrimLeft(rest, " \t\r\n"); len(next) > 0 && next[0] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, rest...)
+}
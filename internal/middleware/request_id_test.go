@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequestIDIsEchoedAndTagsTheLogs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(core)
+	// The service is built with its own logger; only the request-scoped one carries the ID
+	service := services.NewAllocationService(storage.NewMemoryRepository(), config.QuotaConfig{}, zap.NewNop())
+
+	router := gin.New()
+	router.Use(RequestID(logger))
+	router.GET("/health", func(c *gin.Context) {
+		if err := service.TestConnection(c.Request.Context()); err != nil {
+			utils.WriteErrorResponse(c, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	router.GET("/missing", func(c *gin.Context) { utils.WriteNotFoundError(c, "not here") })
+	router.GET("/empty", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{}) })
+	router.GET("/list", func(c *gin.Context) { c.JSON(http.StatusOK, []string{"a"}) })
+	router.GET("/text", func(c *gin.Context) { c.String(http.StatusOK, "{plain}") })
+
+	send := func(path, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name, id string
+		kept     bool
+	}{
+		{"caller's ID", "req-1.a_b:c", true},
+		{"no ID", "", false},
+		{"ID with unsafe characters", "req 1\n", false},
+		{"overlong ID", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tt := range tests {
+		logs.TakeAll()
+		w := send("/health", tt.id)
+
+		id := w.Header().Get(RequestIDHeader)
+		if tt.kept && id != tt.id {
+			t.Fatalf("%s: response ID = %q, want %q", tt.name, id, tt.id)
+		}
+		if !tt.kept && (id == tt.id || len(id) != 32) {
+			t.Fatalf("%s: response ID = %q, want a generated one", tt.name, id)
+		}
+
+		var body map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: invalid JSON %s: %v", tt.name, w.Body.String(), err)
+		}
+		if body["request_id"] != id || body["status"] != "ok" {
+			t.Fatalf("%s: body = %v, want request_id %q next to the handler's fields", tt.name, body, id)
+		}
+
+		serviceLogs := logs.FilterMessage("Database connection test successful").All()
+		if len(serviceLogs) != 1 || serviceLogs[0].ContextMap()["request_id"] != id {
+			t.Fatalf("%s: service log lines %v are not tagged with request_id %q", tt.name, serviceLogs, id)
+		}
+	}
+
+	bodies := []struct {
+		path, want string
+	}{
+		{"/empty", `{"request_id":"id-1"}`},
+		{"/list", `["a"]`},
+		{"/text", `{plain}`},
+	}
+	for _, tt := range bodies {
+		if w := send(tt.path, "id-1"); w.Body.String() != tt.want {
+			t.Fatalf("%s: body = %s, want %s", tt.path, w.Body.String(), tt.want)
+		}
+	}
+
+	w := send("/missing", "id-2")
+	var problem map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("invalid problem document %s: %v", w.Body.String(), err)
+	}
+	if problem["request_id"] != "id-2" || problem["code"] != "not_found" {
+		t.Fatalf("problem document = %v, want request_id id-2", problem)
+	}
+}
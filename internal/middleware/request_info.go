@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"ip-allocator-api/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// ActorHeader names the caller recorded in the audit trail
+	ActorHeader = "X-Actor"
+	// RequestIDHeader correlates a request across services and audit events
+	RequestIDHeader = "X-Request-ID"
+)
+
+// RequestInfo attaches the caller's identity to the request context so that the services
+// can record who made each change. It must run after RequestID.
+func RequestInfo() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		info := services.RequestInfo{
+			Actor:     c.GetHeader(ActorHeader),
+			ClientIP:  getClientIP(c),
+			RequestID: CurrentRequestID(c),
+		}
+		c.Request = c.Request.WithContext(services.WithRequestInfo(c.Request.Context(), info))
+		c.Next()
+	}
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"net/http"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// TenantHeader selects the tenant a request operates on
+const TenantHeader = "X-Tenant"
+
+// Tenant records the tenant of the request in the request info. Callers bound to a tenant
+// always operate on it and are rejected when they name another one; platform callers, and all
+// callers when authentication is disabled, choose it with the X-Tenant header, defaulting to
+// the default tenant. It must run after Auth.Authenticate.
+func Tenant(logger *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		info := services.RequestInfoFromContext(c.Request.Context())
+		requested := c.GetHeader(TenantHeader)
+
+		tenant := requested
+		if info.Principal != nil && !info.Principal.IsPlatform() {
+			if requested != "" && requested != info.Principal.Tenant {
+				requestLogger(c, logger).Warn("Request for a tenant other than the principal's",
+					zap.String("subject", info.Principal.Subject),
+					zap.String("tenant", info.Principal.Tenant),
+					zap.String("requested_tenant", requested),
+					zap.String("path", c.Request.URL.Path),
+					zap.String("client_ip", getClientIP(c)))
+				abortWithProblem(c, http.StatusForbidden, services.CodeTenantMismatch, "Your credentials are bound to tenant "+info.Principal.Tenant)
+				return
+			}
+			tenant = info.Principal.Tenant
+		}
+		if tenant == "" {
+			tenant = models.DefaultTenant
+		}
+
+		info.Tenant = tenant
+		c.Request = c.Request.WithContext(services.WithRequestInfo(c.Request.Context(), info))
+		c.Next()
+	}
+}
@@ -0,0 +1,61 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+func TestTenantBindsTenantPrincipals(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	auth := NewAuth(true, zap.NewNop(), headerAuthenticator{})
+
+	router := gin.New()
+	router.Use(auth.Authenticate(), Tenant(zap.NewNop()))
+	router.GET("/tenant", func(c *gin.Context) {
+		c.String(http.StatusOK, services.RequestInfoFromContext(c.Request.Context()).Tenant)
+	})
+
+	tests := []struct {
+		name                     string
+		subject, principalTenant string
+		requested                string
+		status                   int
+		body                     string
+	}{
+		{"unauthenticated caller without header", "", "", "", http.StatusOK, models.DefaultTenant},
+		{"unauthenticated caller names a tenant", "", "", "t2", http.StatusOK, "t2"},
+		{"platform caller names a tenant", "apikey:a", "", "t2", http.StatusOK, "t2"},
+		{"tenant caller without header", "apikey:a", "t1", "", http.StatusOK, "t1"},
+		{"tenant caller names its tenant", "apikey:a", "t1", "t1", http.StatusOK, "t1"},
+		{"tenant caller names another tenant", "apikey:a", "t1", "t2", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/tenant", nil)
+		req.Header.Set("X-Subject", tt.subject)
+		req.Header.Set("X-Role", models.RoleViewer)
+		req.Header.Set("X-Principal-Tenant", tt.principalTenant)
+		req.Header.Set(TenantHeader, tt.requested)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Fatalf("%s: got %d %s, want %d", tt.name, w.Code, w.Body.String(), tt.status)
+		}
+		if tt.status != http.StatusOK {
+			if code := problemCode(t, w); code != services.CodeTenantMismatch {
+				t.Fatalf("%s: code = %q, want %q", tt.name, code, services.CodeTenantMismatch)
+			}
+			continue
+		}
+		if w.Body.String() != tt.body {
+			t.Fatalf("%s: tenant = %q, want %q", tt.name, w.Body.String(), tt.body)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/services"
+	"ip-allocator-api/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+func TestTracingContinuesTheCallersTrace(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+
+	service := services.NewAllocationService(storage.NewMemoryRepository(), config.QuotaConfig{}, zap.NewNop())
+	router := gin.New()
+	router.Use(Tracing())
+	router.GET("/health", func(c *gin.Context) {
+		if err := service.TestConnection(c.Request.Context()); err != nil {
+			c.Status(http.StatusServiceUnavailable)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	router.GET("/broken", func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", w.Code)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want the service span and the server span", len(spans))
+	}
+	serviceSpan, serverSpan := spans[0], spans[1]
+	if serverSpan.Name() != "GET /health" || serviceSpan.Name() != "AllocationService.TestConnection" {
+		t.Fatalf("spans = %q, %q", serviceSpan.Name(), serverSpan.Name())
+	}
+	if got := serverSpan.SpanContext().TraceID().String(); got != traceID {
+		t.Fatalf("server span trace = %s, want the caller's %s", got, traceID)
+	}
+	if got := serverSpan.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Fatalf("server span parent = %s, want the caller's span", got)
+	}
+	if serviceSpan.Parent().SpanID() != serverSpan.SpanContext().SpanID() {
+		t.Fatalf("service span is not a child of the server span")
+	}
+	if !hasAttribute(serverSpan.Attributes(), attribute.Int("http.response.status_code", http.StatusOK)) {
+		t.Fatalf("server span attributes = %v, want the response status", serverSpan.Attributes())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/broken", nil))
+	spans = recorder.Ended()
+	broken := spans[len(spans)-1]
+	if broken.Status().Code != codes.Error {
+		t.Fatalf("span of a 500 response has status %v, want an error", broken.Status())
+	}
+	if broken.SpanContext().TraceID().String() == traceID {
+		t.Fatalf("request without traceparent continued an earlier trace")
+	}
+}
+
+func hasAttribute(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, attr := range attrs {
+		if attr == want {
+			return true
+		}
+	}
+	return false
+}
@@ -14,13 +14,85 @@ type AllocationRequest struct {
 	PreferredIPs []string `json:"preferred_ips,omitempty"`
 	IPVersion    string   `json:"ip_version" validate:"required,oneof=ipv4 ipv6 both"`
 	Count        int      `json:"count" validate:"min=1,max=100"`
+	// Explicit dual-stack counts, used instead of splitting Count when ip_version is both
+	IPv4Count int `json:"ipv4_count,omitempty" validate:"omitempty,min=0,max=100"`
+	IPv6Count int `json:"ipv6_count,omitempty" validate:"omitempty,min=0,max=100"`
+	// HostPairs allocates Count linked IPv4/IPv6 pairs, one per host
+	HostPairs bool `json:"host_pairs,omitempty"`
+	// Optional lease lifetime; TTL is in seconds and is mutually exclusive with ExpiresAt
+	TTL       int64      `json:"ttl,omitempty" validate:"omitempty,min=1"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Atomic fails the request without allocating anything unless exactly Count IPs can be
+	// allocated; StrictPreferred additionally requires every preferred IP to be granted
+	Atomic          bool `json:"atomic,omitempty"`
+	StrictPreferred bool `json:"strict_preferred,omitempty"`
+	// AllocationStrategy overrides the strategy of the sub-zone for this request
+	AllocationStrategy string `json:"allocation_strategy,omitempty" validate:"omitempty,oneof=lowest_first highest_first random round_robin least_recently_used"`
+	// Contiguous allocates each version's IPs as one run of consecutive free addresses, all or
+	// nothing; AlignPrefix makes the run start on a boundary of that prefix length
+	Contiguous  bool `json:"contiguous,omitempty"`
+	AlignPrefix int  `json:"align_prefix,omitempty" validate:"omitempty,max=128"`
+	// Optional metadata recorded on every allocated IP
+	IPMetadata
+}
+
+// IPMetadata describes who holds an IP and what it is used for
+type IPMetadata struct {
+	Owner       string            `bson:"owner,omitempty" json:"owner,omitempty" validate:"omitempty,max=128"`
+	Hostname    string            `bson:"hostname,omitempty" json:"hostname,omitempty" validate:"omitempty,hostname_rfc1123"`
+	MACAddress  string            `bson:"mac_address,omitempty" json:"mac_address,omitempty" validate:"omitempty,mac"`
+	Description string            `bson:"description,omitempty" json:"description,omitempty" validate:"omitempty,max=1024"`
+	Labels      map[string]string `bson:"labels,omitempty" json:"labels,omitempty" validate:"omitempty,max=32,dive,keys,min=1,max=63,excludesall=.$,endkeys,max=256"`
 }
 
 type AllocationResponse struct {
-	Success      bool      `json:"success"`
-	AllocatedIPs []string  `json:"allocated_ips,omitempty"`
-	Message      string    `json:"message,omitempty"`
-	Timestamp    time.Time `json:"timestamp"`
+	Success      bool          `json:"success"`
+	AllocatedIPs []string      `json:"allocated_ips,omitempty"`
+	HostPairs    []HostPair    `json:"host_pairs,omitempty"`
+	Rejections   []IPRejection `json:"rejections,omitempty"`
+	ExpiresAt    *time.Time    `json:"expires_at,omitempty"`
+	Message      string        `json:"message,omitempty"`
+	Timestamp    time.Time     `json:"timestamp"`
+}
+
+// HostPair links the IPv4 and IPv6 address allocated to one dual-stack host
+type HostPair struct {
+	PairID string `json:"pair_id"`
+	IPv4   string `json:"ipv4"`
+	IPv6   string `json:"ipv6"`
+}
+
+// IPRejection explains why a preferred IP, or part of the requested count, was not allocated
+type IPRejection struct {
+	IP        string `json:"ip,omitempty"`
+	IPVersion string `json:"ip_version,omitempty"`
+	Reason    string `json:"reason"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// IP rejection reasons
+const (
+	RejectionInvalidIP       = "invalid_ip"
+	RejectionVersionMismatch = "version_mismatch"
+	RejectionOutOfRange      = "out_of_range"
+	RejectionInUse           = "in_use"
+	RejectionDuplicate       = "duplicate"
+	RejectionCountExceeded   = "count_exceeded"
+	RejectionNoCIDR          = "no_cidr"
+	RejectionRangeExhausted  = "range_exhausted"
+	RejectionUnpaired        = "unpaired"
+	RejectionNoContiguousRun = "no_contiguous_run"
+	RejectionExcluded        = "excluded"
+)
+
+// Lease renewal Models
+type RenewRequest struct {
+	Region      string     `json:"region" validate:"required"`
+	Zone        string     `json:"zone" validate:"required"`
+	SubZone     string     `json:"sub_zone" validate:"required"`
+	IPAddresses []string   `json:"ip_addresses" validate:"required,min=1"`
+	TTL         int64      `json:"ttl,omitempty" validate:"omitempty,min=1"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
 }
 
 // Deallocation Models
@@ -28,7 +100,18 @@ type DeallocationRequest struct {
 	Region      string   `json:"region" validate:"required"`
 	Zone        string   `json:"zone" validate:"required"`
 	SubZone     string   `json:"sub_zone" validate:"required"`
-	IPAddresses []string `json:"ip_addresses" validate:"required,min=1"`
+	IPAddresses []string `json:"ip_addresses,omitempty" validate:"required_without_all=Owner Labels"`
+	// Selector releasing every allocated IP with this owner and all of these labels,
+	// used instead of listing IP addresses
+	Owner  string            `json:"owner,omitempty"`
+	Labels map[string]string `json:"labels,omitempty" validate:"omitempty,dive,keys,min=1,excludesall=.$,endkeys"`
+	// ReleasePaired also releases the partner of every released IP allocated as a host pair
+	ReleasePaired bool `json:"release_paired,omitempty"`
+}
+
+// HasSelector reports whether the request selects IPs by owner or labels
+func (r *DeallocationRequest) HasSelector() bool {
+	return r.Owner != "" || len(r.Labels) > 0
 }
 
 // Reservation Models
@@ -38,27 +121,45 @@ type ReservationRequest struct {
 	SubZone         string   `json:"sub_zone" validate:"required"`
 	IPAddresses     []string `json:"ip_addresses" validate:"required,min=1"`
 	ReservationType string   `json:"reservation_type" validate:"required,oneof=reserve unreserve"`
+	// Optional metadata recorded on every reserved IP
+	IPMetadata
 }
 
 type IPOperationResponse struct {
-	Success      bool      `json:"success"`
-	ProcessedIPs []string  `json:"processed_ips,omitempty"`
-	FailedIPs    []string  `json:"failed_ips,omitempty"`
-	Message      string    `json:"message"`
-	Timestamp    time.Time `json:"timestamp"`
+	Success      bool       `json:"success"`
+	ProcessedIPs []string   `json:"processed_ips,omitempty"`
+	FailedIPs    []string   `json:"failed_ips,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Message      string     `json:"message"`
+	Timestamp    time.Time  `json:"timestamp"`
 }
 
-// IP Allocation tracking model
+// IP allocation statuses
+const (
+	IPStatusAllocated = "allocated"
+	IPStatusReserved  = "reserved"
+	IPStatusAvailable = "available"
+)
+
+// IP Allocation tracking model, stored one document per address in the ip_allocations collection
 type IPAllocation struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Tenant    string             `bson:"tenant" json:"tenant,omitempty"`
 	Region    string             `bson:"region" json:"region"`
 	Zone      string             `bson:"zone" json:"zone"`
 	SubZone   string             `bson:"sub_zone" json:"sub_zone"`
 	IPAddress string             `bson:"ip_address" json:"ip_address"`
 	IPVersion string             `bson:"ip_version" json:"ip_version"`
 	Status    string             `bson:"status" json:"status"` // allocated, reserved, available
+	ExpiresAt *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+	// Host pair link for dual-stack allocations made with host_pairs
+	PairID   string `bson:"pair_id,omitempty" json:"pair_id,omitempty"`
+	PairedIP string `bson:"paired_ip,omitempty" json:"paired_ip,omitempty"`
+	// CreatedBy is the authenticated caller that allocated or reserved the IP
+	CreatedBy  string `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	IPMetadata `bson:",inline"`
 }
 
 // CRUD Models for enhanced operations
@@ -87,15 +188,31 @@ type UpdateZoneRequest struct {
 }
 
 type CreateSubZoneRequest struct {
-	Name     string `json:"name" validate:"required"`
-	IPv4CIDR string `json:"ipv4_cidr,omitempty" validate:"omitempty,cidr"`
-	IPv6CIDR string `json:"ipv6_cidr,omitempty" validate:"omitempty,cidr"`
+	Name               string `json:"name" validate:"required"`
+	IPv4CIDR           string `json:"ipv4_cidr,omitempty" validate:"omitempty,cidr"`
+	IPv6CIDR           string `json:"ipv6_cidr,omitempty" validate:"omitempty,cidr"`
+	AllocationStrategy string `json:"allocation_strategy,omitempty" validate:"omitempty,oneof=lowest_first highest_first random round_robin least_recently_used"`
+	// Gateways default to the first usable address of each CIDR unless NoGateway is set;
+	// excluded ranges are given as start-end, as a CIDR or as a single IP
+	GatewayIPv4    string   `json:"gateway_ipv4,omitempty" validate:"omitempty,ipv4"`
+	GatewayIPv6    string   `json:"gateway_ipv6,omitempty" validate:"omitempty,ipv6"`
+	NoGateway      bool     `json:"no_gateway,omitempty"`
+	ExcludedRanges []string `json:"excluded_ranges,omitempty" validate:"omitempty,max=256,dive,required"`
 }
 
 type UpdateSubZoneRequest struct {
-	Name     string `json:"name,omitempty"`
-	IPv4CIDR string `json:"ipv4_cidr,omitempty" validate:"omitempty,cidr"`
-	IPv6CIDR string `json:"ipv6_cidr,omitempty" validate:"omitempty,cidr"`
+	Name               string `json:"name,omitempty"`
+	IPv4CIDR           string `json:"ipv4_cidr,omitempty" validate:"omitempty,cidr"`
+	IPv6CIDR           string `json:"ipv6_cidr,omitempty" validate:"omitempty,cidr"`
+	AllocationStrategy string `json:"allocation_strategy,omitempty" validate:"omitempty,oneof=lowest_first highest_first random round_robin least_recently_used"`
+}
+
+// SubnetAllocationRequest creates a zone or sub-zone whose CIDRs are carved from the first
+// free, aligned block of the given prefix length in the parent CIDR
+type SubnetAllocationRequest struct {
+	Name             string `json:"name" validate:"required"`
+	IPv4PrefixLength int    `json:"ipv4_prefix_length,omitempty" validate:"omitempty,min=1,max=32"`
+	IPv6PrefixLength int    `json:"ipv6_prefix_length,omitempty" validate:"omitempty,min=1,max=128"`
 }
 
 type CRUDResponse struct {
@@ -104,3 +221,18 @@ type CRUDResponse struct {
 	Message   string      `json:"message"`
 	Timestamp time.Time   `json:"timestamp"`
 }
+
+// SubZoneUsage holds the address counts of one address family of a sub-zone
+type SubZoneUsage struct {
+	Tenant    string
+	Region    string
+	Zone      string
+	SubZone   string
+	IPVersion string
+	Total     float64
+	Allocated int
+	Reserved  int
+	// Available counts the addresses that can still be allocated, leaving out the gateways and
+	// excluded ranges
+	Available float64
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Audit actions
+const (
+	AuditActionAllocate   = "allocate"
+	AuditActionDeallocate = "deallocate"
+	AuditActionReserve    = "reserve"
+	AuditActionUnreserve  = "unreserve"
+	AuditActionRenew      = "renew"
+	AuditActionExpire     = "expire"
+	AuditActionCreate     = "create"
+	AuditActionUpdate     = "update"
+	AuditActionDelete     = "delete"
+)
+
+// Audited resource types
+const (
+	AuditResourceRegion  = "region"
+	AuditResourceZone    = "zone"
+	AuditResourceSubZone = "sub_zone"
+	AuditResourceIP      = "ip"
+	AuditResourceAPIKey  = "api_key"
+	AuditResourceTenant  = "tenant"
+)
+
+// Audit outcomes
+const (
+	AuditOutcomeSuccess  = "success"  // the mutation was applied, possibly partially
+	AuditOutcomeRejected = "rejected" // the request was refused and nothing changed
+	AuditOutcomeError    = "error"    // the mutation failed server-side
+)
+
+// AuditEvent is an append-only record of one mutation of the IPAM state
+type AuditEvent struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Timestamp    time.Time          `bson:"timestamp" json:"timestamp"`
+	Tenant       string             `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	Action       string             `bson:"action" json:"action"`
+	ResourceType string             `bson:"resource_type" json:"resource_type"`
+	// ResourcePath mirrors the API path, e.g. regions/eu/zones/a/subzones/web
+	ResourcePath string   `bson:"resource_path" json:"resource_path"`
+	IPAddresses  []string `bson:"ip_addresses,omitempty" json:"ip_addresses,omitempty"`
+	Actor        string   `bson:"actor" json:"actor"`
+	ClientIP     string   `bson:"client_ip,omitempty" json:"client_ip,omitempty"`
+	RequestID    string   `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	// State of the resource before and after the mutation; absent for creations and deletions respectively
+	Before  interface{} `bson:"before,omitempty" json:"before,omitempty"`
+	After   interface{} `bson:"after,omitempty" json:"after,omitempty"`
+	Outcome string      `bson:"outcome" json:"outcome"`
+	Message string      `bson:"message,omitempty" json:"message,omitempty"`
+}
+
+// AuditQuery filters audit events; zero values match everything
+type AuditQuery struct {
+	ResourcePath string
+	IPAddress    string
+	Actor        string
+	Since        time.Time
+	Until        time.Time
+	Limit        int
+}
+
+// IPStatusReleased is the history status of an address that is no longer held in a sub-zone
+const IPStatusReleased = "released"
+
+// IPHistoryEntry is one change in the lifecycle of an address, derived from the audit trail
+type IPHistoryEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	// Status of the address in the sub-zone after the change: allocated, reserved or released
+	Status       string     `json:"status"`
+	Region       string     `json:"region"`
+	Zone         string     `json:"zone"`
+	SubZone      string     `json:"sub_zone"`
+	ResourcePath string     `json:"resource_path"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	PairedIP     string     `json:"paired_ip,omitempty"`
+	IPMetadata
+	Actor     string `json:"actor"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKeyCollection holds the hashed API keys
+const APIKeyCollection = "api_keys"
+
+// Roles, each granting everything the previous one does
+const (
+	RoleViewer    = "viewer"    // read regions, zones, sub-zones, IPs and the audit trail
+	RoleAllocator = "allocator" // also allocate, release, reserve and renew IPs
+	RoleAdmin     = "admin"     // also manage regions, zones, sub-zones and API keys
+)
+
+var roleRanks = map[string]int{
+	RoleViewer:    1,
+	RoleAllocator: 2,
+	RoleAdmin:     3,
+}
+
+// IsValidRole reports whether role is one of the known roles
+func IsValidRole(role string) bool {
+	return roleRanks[role] > 0
+}
+
+// Authentication methods
+const (
+	AuthMethodAPIKey = "api_key"
+	AuthMethodJWT    = "jwt"
+)
+
+// Principal is the authenticated caller of a request. A principal with a Tenant is bound to
+// that tenant; one without is a platform principal that may act in any tenant. A principal with
+// a Region is limited to that region's subtree, and one with a Zone as well to that zone's subtree.
+type Principal struct {
+	Subject string `json:"subject"`
+	Method  string `json:"method"`
+	Role    string `json:"role"`
+	Tenant  string `json:"tenant,omitempty"`
+	Region  string `json:"region,omitempty"`
+	Zone    string `json:"zone,omitempty"`
+}
+
+// HasRole reports whether the principal's role grants at least the given role
+func (p *Principal) HasRole(role string) bool {
+	return roleRanks[p.Role] >= roleRanks[role] && roleRanks[role] > 0
+}
+
+// IsPlatform reports whether the principal is not bound to a tenant
+func (p *Principal) IsPlatform() bool {
+	return p.Tenant == ""
+}
+
+// IsGlobal reports whether the principal is not limited to a subtree
+func (p *Principal) IsGlobal() bool {
+	return p.Region == ""
+}
+
+// Covers reports whether the region, or the zone of the region when zoneName is set, lies
+// within the principal's scope
+func (p *Principal) Covers(regionName, zoneName string) bool {
+	if p.Region == "" {
+		return true
+	}
+	if regionName != p.Region {
+		return false
+	}
+	return p.Zone == "" || zoneName == p.Zone
+}
+
+// APIKey is a stored API key. Only a SHA-256 hash of the secret is kept; the secret itself is
+// returned once, when the key is created.
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name       string             `bson:"name" json:"name"`
+	Prefix     string             `bson:"prefix" json:"prefix"`
+	KeyHash    string             `bson:"key_hash" json:"-"`
+	Role       string             `bson:"role" json:"role"`
+	Tenant     string             `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	Region     string             `bson:"region,omitempty" json:"region,omitempty"`
+	Zone       string             `bson:"zone,omitempty" json:"zone,omitempty"`
+	CreatedBy  string             `bson:"created_by" json:"created_by"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt  *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+}
+
+// Principal returns the caller authenticated by the key
+func (k *APIKey) Principal() *Principal {
+	return &Principal{
+		Subject: AuthMethodAPIKey + ":" + k.Name,
+		Method:  AuthMethodAPIKey,
+		Role:    k.Role,
+		Tenant:  k.Tenant,
+		Region:  k.Region,
+		Zone:    k.Zone,
+	}
+}
+
+// CreateAPIKeyRequest creates a key, optionally scoped to a region or a zone of a region. Keys
+// created by tenant-bound callers always belong to the caller's tenant; platform callers may
+// name a tenant, or leave it empty for a platform key.
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" validate:"required,min=1,max=100"`
+	Role      string     `json:"role" validate:"required,oneof=viewer allocator admin"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Region    string     `json:"region,omitempty" validate:"required_with=Zone"`
+	Zone      string     `json:"zone,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// APIKeyResponse returns a created key; Key holds the secret and is only set on creation
+type APIKeyResponse struct {
+	Success   bool      `json:"success"`
+	Key       string    `json:"key,omitempty"`
+	Data      *APIKey   `json:"data,omitempty"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
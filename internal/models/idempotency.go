@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Idempotency record states
+const (
+	IdempotencyStatePending   = "pending"
+	IdempotencyStateCompleted = "completed"
+)
+
+// IdempotencyRecord stores the outcome of a request sent with an Idempotency-Key header
+// so that retries of the same request replay the original response
+type IdempotencyRecord struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Key         string             `bson:"key" json:"key"`
+	Operation   string             `bson:"operation" json:"operation"`
+	RequestHash string             `bson:"request_hash" json:"request_hash"`
+	State       string             `bson:"state" json:"state"` // pending, completed
+	StatusCode  int                `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	ContentType string             `bson:"content_type,omitempty" json:"content_type,omitempty"`
+	Body        []byte             `bson:"body,omitempty" json:"-"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	ExpiresAt   time.Time          `bson:"expires_at" json:"expires_at"`
+}
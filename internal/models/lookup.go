@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// Lookup match levels
+const (
+	LookupLevelRegion  = "region"
+	LookupLevelZone    = "zone"
+	LookupLevelSubZone = "sub_zone"
+)
+
+// Lookup statuses; IP lookups report the IP allocation status, or free
+const (
+	LookupStatusFree  = "free"
+	LookupStatusInUse = "in_use" // some address of a looked up CIDR is allocated or reserved
+)
+
+// LookupMatch is a region, zone or sub-zone whose CIDR contains the looked up address or CIDR
+type LookupMatch struct {
+	Level   string `json:"level"`
+	Region  string `json:"region"`
+	Zone    string `json:"zone,omitempty"`
+	SubZone string `json:"sub_zone,omitempty"`
+	Path    string `json:"path"`
+	CIDR    string `json:"cidr"`
+}
+
+// LookupResult tells which part of the hierarchy owns an address or CIDR
+type LookupResult struct {
+	Success bool   `json:"success"`
+	Query   string `json:"query"`
+	Found   bool   `json:"found"`
+	// Owner is the most specific match; Hierarchy lists every match, least specific first
+	Owner     *LookupMatch  `json:"owner,omitempty"`
+	Hierarchy []LookupMatch `json:"hierarchy"`
+	// Status is allocated, reserved or free for an address owned by a sub-zone, and
+	// free or in_use for a CIDR
+	Status string `json:"status,omitempty"`
+	// Allocation holds the lease and metadata of an allocated or reserved address
+	Allocation     *IPAllocation `json:"allocation,omitempty"`
+	AllocatedCount int           `json:"allocated_count,omitempty"`
+	ReservedCount  int           `json:"reserved_count,omitempty"`
+	Message        string        `json:"message,omitempty"`
+	Timestamp      time.Time     `json:"timestamp"`
+}
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// Quota names
+const (
+	QuotaTenant             = "tenant"
+	QuotaOwner              = "owner"
+	QuotaActor              = "actor"
+	QuotaSubZoneUtilization = "sub_zone_utilization"
+)
+
+// QuotaUsage reports the IPs held against one quota. A limit of 0 means the quota is disabled,
+// except for utilization quotas, which are disabled by a limit_percent of 0.
+type QuotaUsage struct {
+	Quota string `json:"quota"`
+	// Subject is the tenant, owner, actor or sub-zone path the quota applies to
+	Subject   string `json:"subject"`
+	IPVersion string `json:"ip_version,omitempty"`
+	Used      int64  `json:"used"`
+	// Requested is set on the quota a rejected request would have exceeded
+	Requested int64 `json:"requested,omitempty"`
+	Limit     int64 `json:"limit"`
+	// Utilization quotas also report the held and allowed share of the sub-zone's range
+	UtilizationPercent float64 `json:"utilization_percent,omitempty"`
+	LimitPercent       float64 `json:"limit_percent,omitempty"`
+}
+
+// Exceeded reports whether holding requested more IPs would exceed the quota
+func (u *QuotaUsage) Exceeded(requested int64) bool {
+	if u.Limit <= 0 && u.LimitPercent <= 0 {
+		return false
+	}
+	return u.Used+requested > u.Limit
+}
+
+type QuotaUsageResponse struct {
+	Success   bool         `json:"success"`
+	Tenant    string       `json:"tenant"`
+	Quotas    []QuotaUsage `json:"quotas"`
+	Message   string       `json:"message"`
+	Timestamp time.Time    `json:"timestamp"`
+}
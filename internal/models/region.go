@@ -7,17 +7,24 @@ import (
 )
 
 // Collection names
-const RegionCollection = "regions"
+const (
+	RegionCollection       = "regions"
+	IPAllocationCollection = "ip_allocations"
+	IdempotencyCollection  = "idempotency_keys"
+	AuditCollection        = "audit_events"
+)
 
 // Region represents a geographical or logical region with enhanced CIDR support
 type Region struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	Name      string             `bson:"name" json:"name" validate:"required"`
-	IPv4CIDR  string             `bson:"ipv4_cidr,omitempty" json:"ipv4_cidr,omitempty" validate:"omitempty,cidr"`
-	IPv6CIDR  string             `bson:"ipv6_cidr,omitempty" json:"ipv6_cidr,omitempty" validate:"omitempty,cidr"`
-	Zones     []Zone             `bson:"zones" json:"zones"`
-	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name string             `bson:"name" json:"name" validate:"required"`
+	// Tenant owning the region; set from the caller, never from the request body
+	Tenant    string    `bson:"tenant" json:"tenant,omitempty"`
+	IPv4CIDR  string    `bson:"ipv4_cidr,omitempty" json:"ipv4_cidr,omitempty" validate:"omitempty,cidr"`
+	IPv6CIDR  string    `bson:"ipv6_cidr,omitempty" json:"ipv6_cidr,omitempty" validate:"omitempty,cidr"`
+	Zones     []Zone    `bson:"zones" json:"zones"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
 }
 
 // Zone represents a zone within a region - ENHANCED with CIDR fields
@@ -34,14 +41,26 @@ type Zone struct {
 
 // SubZone represents a sub-zone within a zone
 type SubZone struct {
-	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	Name          string             `bson:"name" json:"name" validate:"required"`
-	IPv4CIDR      string             `bson:"ipv4_cidr,omitempty" json:"ipv4_cidr,omitempty" validate:"omitempty,cidr"`
-	IPv6CIDR      string             `bson:"ipv6_cidr,omitempty" json:"ipv6_cidr,omitempty" validate:"omitempty,cidr"`
-	AllocatedIPv4 []string           `bson:"allocated_ipv4" json:"allocated_ipv4"`
-	AllocatedIPv6 []string           `bson:"allocated_ipv6" json:"allocated_ipv6"`
-	ReservedIPv4  []string           `bson:"reserved_ipv4" json:"reserved_ipv4"`
-	ReservedIPv6  []string           `bson:"reserved_ipv6" json:"reserved_ipv6"`
-	CreatedAt     time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt     time.Time          `bson:"updated_at" json:"updated_at"`
+	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name     string             `bson:"name" json:"name" validate:"required"`
+	IPv4CIDR string             `bson:"ipv4_cidr,omitempty" json:"ipv4_cidr,omitempty" validate:"omitempty,cidr"`
+	IPv6CIDR string             `bson:"ipv6_cidr,omitempty" json:"ipv6_cidr,omitempty" validate:"omitempty,cidr"`
+	// AllocationStrategy orders the free addresses handed out when no preferred IPs are given;
+	// empty means lowest_first
+	AllocationStrategy string `bson:"allocation_strategy,omitempty" json:"allocation_strategy,omitempty" validate:"omitempty,oneof=lowest_first highest_first random round_robin least_recently_used"`
+	// The gateways and the excluded ranges, such as VRRP addresses or a DHCP pool, are never
+	// allocated; ranges are stored as start-end or as a single IP
+	GatewayIPv4    string   `bson:"gateway_ipv4,omitempty" json:"gateway_ipv4,omitempty"`
+	GatewayIPv6    string   `bson:"gateway_ipv6,omitempty" json:"gateway_ipv6,omitempty"`
+	ExcludedRanges []string `bson:"excluded_ranges,omitempty" json:"excluded_ranges,omitempty"`
+	// IP lists are populated from the ip_allocations collection on read; the
+	// embedded arrays are only kept for documents that predate the migration
+	AllocatedIPv4 []string `bson:"allocated_ipv4,omitempty" json:"allocated_ipv4"`
+	AllocatedIPv6 []string `bson:"allocated_ipv6,omitempty" json:"allocated_ipv6"`
+	ReservedIPv4  []string `bson:"reserved_ipv4,omitempty" json:"reserved_ipv4"`
+	ReservedIPv6  []string `bson:"reserved_ipv6,omitempty" json:"reserved_ipv6"`
+	// Per-IP details including ownership metadata, never stored on the region document
+	IPs       []IPAllocation `bson:"-" json:"ips,omitempty"`
+	CreatedAt time.Time      `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time      `bson:"updated_at" json:"updated_at"`
 }
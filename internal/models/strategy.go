@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AllocationCursorCollection holds the allocation cursors of the sub-zones
+const AllocationCursorCollection = "allocation_cursors"
+
+// Allocation strategies decide which free addresses of a sub-zone are handed out first
+const (
+	// AllocationStrategyLowestFirst hands out the lowest free address, the default
+	AllocationStrategyLowestFirst = "lowest_first"
+	// AllocationStrategyHighestFirst allocates from the top of the range down
+	AllocationStrategyHighestFirst = "highest_first"
+	// AllocationStrategyRandom picks free addresses uniformly at random, so they cannot be guessed
+	AllocationStrategyRandom = "random"
+	// AllocationStrategyRoundRobin continues after the address handed out last and wraps
+	// around at the end of the range
+	AllocationStrategyRoundRobin = "round_robin"
+	// AllocationStrategyLeastRecentlyUsed prefers addresses that were never released, then the
+	// ones released the longest time ago
+	AllocationStrategyLeastRecentlyUsed = "least_recently_used"
+)
+
+// AllocationCursor is what the round-robin and least-recently-used strategies remember about
+// a sub-zone, one document per sub-zone addressed like its IP documents
+type AllocationCursor struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Tenant  string             `bson:"tenant" json:"tenant,omitempty"`
+	Region  string             `bson:"region" json:"region"`
+	Zone    string             `bson:"zone" json:"zone"`
+	SubZone string             `bson:"sub_zone" json:"sub_zone"`
+	// LastIPv4 and LastIPv6 are the addresses round-robin allocation handed out last
+	LastIPv4 string `bson:"last_ipv4,omitempty" json:"last_ipv4,omitempty"`
+	LastIPv6 string `bson:"last_ipv6,omitempty" json:"last_ipv6,omitempty"`
+	// Released lists the most recently released addresses, oldest first
+	Released  []ReleasedIP `bson:"released,omitempty" json:"released,omitempty"`
+	UpdatedAt time.Time    `bson:"updated_at" json:"updated_at"`
+}
+
+// ReleasedIP records when an address was deallocated, unreserved or expired
+type ReleasedIP struct {
+	IPAddress  string    `bson:"ip_address" json:"ip_address"`
+	ReleasedAt time.Time `bson:"released_at" json:"released_at"`
+}
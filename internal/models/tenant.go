@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TenantCollection holds the tenants
+const TenantCollection = "tenants"
+
+// DefaultTenant owns the data of requests that name no tenant, and everything created before
+// tenants existed
+const DefaultTenant = "default"
+
+// Tenant is an isolated address space. Region, zone and sub-zone names and CIDRs only need to
+// be unique within a tenant, so two tenants may both use 10.0.0.0/8.
+type Tenant struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name        string             `bson:"name" json:"name"`
+	Description string             `bson:"description,omitempty" json:"description,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+// CreateTenantRequest creates a tenant; the name is used in the X-Tenant header and can not be
+// changed later
+type CreateTenantRequest struct {
+	Name        string `json:"name" validate:"required,min=1,max=63,hostname_rfc1123"`
+	Description string `json:"description,omitempty" validate:"max=500"`
+}
+
+// UpdateTenantRequest updates the mutable fields of a tenant
+type UpdateTenantRequest struct {
+	Description string `json:"description" validate:"max=500"`
+}
+
+// TenantResponse returns a single tenant
+type TenantResponse struct {
+	Success   bool      `json:"success"`
+	Data      *Tenant   `json:"data,omitempty"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
@@ -2,287 +2,494 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/big"
+	"math/rand"
 	"net"
 	"time"
 
+	"ip-allocator-api/internal/config"
 	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
 	"ip-allocator-api/internal/utils"
 
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.uber.org/zap"
 )
 
+// maxAllocationAttempts bounds how many times a conflicting allocation is re-selected and retried
+const maxAllocationAttempts = 5
+
+// errAllocationConflict is returned when an IP write lost a race with a concurrent request
+var errAllocationConflict = errors.New("selected IPs were claimed by a concurrent request")
+
 type AllocationService struct {
-	collection *mongo.Collection
-	logger     *zap.Logger
+	repo   storage.Repository
+	ips    *ipAllocationStore
+	free   *freeIndexCache
+	quotas *QuotaService
+	audit  *AuditService
+	logger *zap.Logger
 }
 
-func NewAllocationService(db *mongo.Database, logger *zap.Logger) *AllocationService {
+func NewAllocationService(repo storage.Repository, quotas config.QuotaConfig, logger *zap.Logger) *AllocationService {
 	return &AllocationService{
-		collection: db.Collection(models.RegionCollection),
-		logger:     logger,
+		repo:   repo,
+		ips:    newIPAllocationStore(repo, logger),
+		free:   newFreeIndexCache(repo),
+		quotas: NewQuotaService(repo, quotas, logger),
+		audit:  NewAuditService(repo, logger),
+		logger: logger,
 	}
 }
 
+// log returns the request-scoped logger of ctx, falling back to the service logger
+func (s *AllocationService) log(ctx context.Context) *zap.Logger {
+	return LoggerFromContext(ctx, s.logger)
+}
+
 // TestConnection tests the database connection with enhanced logging
-func (s *AllocationService) TestConnection(ctx context.Context) error {
-	s.logger.Debug("Testing database connection")
-	err := s.collection.Database().Client().Ping(ctx, nil)
+func (s *AllocationService) TestConnection(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "AllocationService.TestConnection", "", "", "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Debug("Testing database connection")
+	err = s.repo.Ping(ctx)
 	if err != nil {
-		s.logger.Error("Database connection test failed", zap.Error(err))
+		s.log(ctx).Error("Database connection test failed", zap.Error(err))
 		return err
 	}
-	s.logger.Debug("Database connection test successful")
+	s.log(ctx).Debug("Database connection test successful")
 	return nil
 }
 
 // AllocateIPs allocates IP addresses with enhanced CIDR validation and logging
-func (s *AllocationService) AllocateIPs(ctx context.Context, req *models.AllocationRequest) (*models.AllocationResponse, error) {
-	s.logger.Info("Starting IP allocation process",
+func (s *AllocationService) AllocateIPs(ctx context.Context, req *models.AllocationRequest) (response *models.AllocationResponse, err error) {
+	ctx, span := startSpan(ctx, "AllocationService.AllocateIPs", req.Region, req.Zone, req.SubZone)
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Starting IP allocation process",
 		zap.String("region", req.Region),
 		zap.String("zone", req.Zone),
 		zap.String("subzone", req.SubZone),
 		zap.String("ip_version", req.IPVersion),
 		zap.Int("count", req.Count),
-		zap.Int("preferred_ips_count", len(req.PreferredIPs)))
+		zap.Int("preferred_ips_count", len(req.PreferredIPs)),
+		zap.String("allocation_strategy", req.AllocationStrategy),
+		zap.Bool("contiguous", req.Contiguous),
+		zap.Int("align_prefix", req.AlignPrefix))
 
-	// Find the target sub-zone with enhanced validation
-	subZone, regionData, zoneData, err := s.findSubZoneWithHierarchy(ctx, req.Region, req.Zone, req.SubZone)
-	if err != nil {
-		s.logger.Error("Failed to find sub-zone in hierarchy",
-			zap.Error(err),
-			zap.String("region", req.Region),
-			zap.String("zone", req.Zone),
-			zap.String("subzone", req.SubZone))
-		return &models.AllocationResponse{
-			Success:   false,
-			Message:   fmt.Sprintf("Failed to find sub-zone: %v", err),
-			Timestamp: time.Now(),
-		}, nil
-	}
-
-	// Enhanced CIDR hierarchy validation
-	if err := s.validateCIDRHierarchy(regionData, zoneData, subZone); err != nil {
-		s.logger.Warn("CIDR hierarchy validation warning",
-			zap.Error(err),
-			zap.String("region", req.Region),
-			zap.String("zone", req.Zone),
-			zap.String("subzone", req.SubZone))
-		// Continue with warning logged
-	}
+	event := newAuditEvent(models.AuditActionAllocate, models.AuditResourceIP, subZonePath(req.Region, req.Zone, req.SubZone))
+	defer func() { s.audit.recordAllocation(ctx, event, response, err) }()
 
 	var allocatedIPs []string
 	var errors []string
+	var rejections []models.IPRejection
+	var hostPairs []models.HostPair
+
+	template := ipTemplate(TenantFromContext(ctx), req.Region, req.Zone, req.SubZone, models.IPStatusAllocated)
+	template.ExpiresAt = leaseExpiry(req.TTL, req.ExpiresAt, time.Now())
+	template.IPMetadata = req.IPMetadata
+	template.CreatedBy = RequestInfoFromContext(ctx).Actor
+
+	// Select candidate IPs and commit them as per-IP documents. If another request
+	// claimed any of the candidates in the meantime, the unique index rejects the
+	// write, so re-read the sub-zone and select again.
+	for attempt := 1; ; attempt++ {
+		// Find the target sub-zone with enhanced validation
+		subZone, regionData, zoneData, err := s.findSubZone(ctx, req.Region, req.Zone, req.SubZone)
+		if err != nil {
+			s.log(ctx).Error("Failed to find sub-zone in hierarchy",
+				zap.Error(err),
+				zap.String("region", req.Region),
+				zap.String("zone", req.Zone),
+				zap.String("subzone", req.SubZone))
+			return nil, err
+		}
 
-	// Handle different IP version requirements with enhanced validation
-	switch req.IPVersion {
-	case "ipv4":
-		ips, err := s.allocateIPsForVersionEnhanced(ctx, subZone, req.PreferredIPs, req.Count, "ipv4")
+		// Enhanced CIDR hierarchy validation
+		if attempt == 1 {
+			if err := s.validateCIDRHierarchy(regionData, zoneData, subZone); err != nil {
+				s.log(ctx).Warn("CIDR hierarchy validation warning",
+					zap.Error(err),
+					zap.String("region", req.Region),
+					zap.String("zone", req.Zone),
+					zap.String("subzone", req.SubZone))
+				// Continue with warning logged
+			}
+		}
+
+		strategy, err := s.loadAllocationStrategy(ctx, req, subZone)
 		if err != nil {
-			s.logger.Error("IPv4 allocation failed", zap.Error(err))
-			errors = append(errors, fmt.Sprintf("IPv4 allocation failed: %v", err))
-		} else {
-			allocatedIPs = append(allocatedIPs, ips...)
-			s.logger.Info("IPv4 allocation successful",
-				zap.Int("allocated_count", len(ips)),
-				zap.Strings("allocated_ips", ips))
+			s.log(ctx).Error("Failed to load allocation cursor",
+				zap.Error(err),
+				zap.String("region", req.Region),
+				zap.String("zone", req.Zone),
+				zap.String("subzone", req.SubZone))
+			return nil, fmt.Errorf("failed to load allocation cursor: %w", err)
 		}
-	case "ipv6":
-		ips, err := s.allocateIPsForVersionEnhanced(ctx, subZone, req.PreferredIPs, req.Count, "ipv6")
+
+		// Selection and the write hold the sub-zone's index, so requests of this service do
+		// not pick the same free addresses
+		index, err := s.free.lock(ctx, req.Region, req.Zone, subZone)
 		if err != nil {
-			s.logger.Error("IPv6 allocation failed", zap.Error(err))
-			errors = append(errors, fmt.Sprintf("IPv6 allocation failed: %v", err))
-		} else {
-			allocatedIPs = append(allocatedIPs, ips...)
-			s.logger.Info("IPv6 allocation successful",
-				zap.Int("allocated_count", len(ips)),
-				zap.Strings("allocated_ips", ips))
+			s.log(ctx).Error("Failed to load free IPs of sub-zone",
+				zap.Error(err),
+				zap.String("region", req.Region),
+				zap.String("zone", req.Zone),
+				zap.String("subzone", req.SubZone))
+			return nil, err
 		}
-	case "both":
-		// Enhanced dual-stack allocation
-		ipv4Count := req.Count / 2
-		ipv6Count := req.Count - ipv4Count
 
-		s.logger.Debug("Dual-stack allocation requested",
-			zap.Int("ipv4_count", ipv4Count),
-			zap.Int("ipv6_count", ipv6Count))
+		allocatedIPs, errors, rejections = s.selectIPsForRequest(ctx, req, subZone, index, strategy)
+		if req.HostPairs {
+			allocatedIPs, hostPairs, rejections = pairHosts(allocatedIPs, rejections)
+		}
 
-		if ipv4Count > 0 {
-			ipv4Preferred, _, err := utils.SplitIPsByVersion(req.PreferredIPs)
-			if err != nil {
-				s.logger.Error("Failed to split preferred IPs by version", zap.Error(err))
-				errors = append(errors, fmt.Sprintf("Failed to split preferred IPs: %v", err))
-			} else {
-				ips, err := s.allocateIPsForVersionEnhanced(ctx, subZone, ipv4Preferred, ipv4Count, "ipv4")
-				if err != nil {
-					s.logger.Error("IPv4 allocation in dual-stack failed", zap.Error(err))
-					errors = append(errors, fmt.Sprintf("IPv4 allocation failed: %v", err))
-				} else {
-					allocatedIPs = append(allocatedIPs, ips...)
-					s.logger.Info("IPv4 allocation in dual-stack successful",
-						zap.Int("allocated_count", len(ips)))
-				}
-			}
+		// A contiguous request is all or nothing: one version without a run fails all of it
+		if missing := noContiguousRunError(strategy, rejections); missing != nil {
+			index.unlock()
+			s.log(ctx).Warn("No contiguous run of the requested length, nothing allocated",
+				zap.String("reason", missing.Message),
+				zap.Int("align_prefix", req.AlignPrefix),
+				zap.Int("selected_count", len(allocatedIPs)),
+				zap.Int("requested_count", requestedIPCount(req)))
+			return nil, missing.withDetail("rejections", rejections)
+		}
+		if len(allocatedIPs) == 0 {
+			index.unlock()
+			break
 		}
 
-		if ipv6Count > 0 {
-			_, ipv6Preferred, err := utils.SplitIPsByVersion(req.PreferredIPs)
-			if err != nil {
-				s.logger.Error("Failed to split preferred IPs by version for IPv6", zap.Error(err))
-				errors = append(errors, fmt.Sprintf("Failed to split preferred IPs: %v", err))
-			} else {
-				ips, err := s.allocateIPsForVersionEnhanced(ctx, subZone, ipv6Preferred, ipv6Count, "ipv6")
-				if err != nil {
-					s.logger.Error("IPv6 allocation in dual-stack failed", zap.Error(err))
-					errors = append(errors, fmt.Sprintf("IPv6 allocation failed: %v", err))
-				} else {
-					allocatedIPs = append(allocatedIPs, ips...)
-					s.logger.Info("IPv6 allocation in dual-stack successful",
-						zap.Int("allocated_count", len(ips)))
-				}
-			}
+		// All-or-nothing requests write nothing unless the full request can be satisfied
+		if unsatisfied := unsatisfiedError(req, allocatedIPs, rejections); unsatisfied != nil {
+			index.unlock()
+			s.log(ctx).Warn("Allocation request cannot be fully satisfied, nothing allocated",
+				zap.String("reason", unsatisfied.Message),
+				zap.Bool("atomic", req.Atomic),
+				zap.Bool("contiguous", req.Contiguous),
+				zap.Bool("strict_preferred", req.StrictPreferred),
+				zap.Int("selected_count", len(allocatedIPs)),
+				zap.Int("requested_count", requestedIPCount(req)),
+				zap.Int("rejection_count", len(rejections)))
+			return nil, unsatisfied.withDetail("rejections", rejections)
 		}
-	}
 
-	// Update the database with allocated IPs
-	if len(allocatedIPs) > 0 {
-		s.logger.Debug("Updating database with allocated IPs",
-			zap.Int("total_allocated", len(allocatedIPs)))
-		err = s.updateAllocatedIPs(ctx, req.Region, req.Zone, req.SubZone, allocatedIPs)
+		// Quotas reject the request as a whole rather than trimming it to what still fits
+		exceeded, err := s.quotas.Check(ctx, req.Region, req.Zone, subZone, index.heldCounts(), req.Owner, allocatedIPs)
 		if err != nil {
-			s.logger.Error("Failed to update allocated IPs in database",
+			index.unlock()
+			s.log(ctx).Error("Failed to check quotas",
+				zap.Error(err),
+				zap.String("region", req.Region),
+				zap.String("zone", req.Zone),
+				zap.String("subzone", req.SubZone))
+			return nil, fmt.Errorf("failed to check quotas: %w", err)
+		}
+		if exceeded != nil {
+			index.unlock()
+			s.log(ctx).Warn("Allocation rejected by quota, nothing allocated",
+				zap.String("quota", exceeded.Quota),
+				zap.String("subject", exceeded.Subject),
+				zap.Int64("used", exceeded.Used),
+				zap.Int64("requested", exceeded.Requested),
+				zap.Int64("limit", exceeded.Limit))
+			return nil, quotaExceededError(exceeded)
+		}
+
+		// Update the database with allocated IPs
+		s.log(ctx).Debug("Updating database with allocated IPs",
+			zap.Int("total_allocated", len(allocatedIPs)),
+			zap.Int("attempt", attempt))
+		docs, err := s.updateAllocatedIPs(ctx, template, allocatedIPs, hostPairs)
+		if err == nil {
+			index.inserted(docs)
+		} else {
+			// A conflict means another writer got in first; either way the stored state is
+			// no longer the one the index tracks
+			index.invalidate()
+		}
+		index.unlock()
+		if err == nil {
+			s.log(ctx).Info("Database updated successfully with allocated IPs")
+			event.After = docs
+			s.advanceCursor(ctx, req, strategy)
+			break
+		}
+
+		if err != errAllocationConflict {
+			s.log(ctx).Error("Failed to update allocated IPs in database",
 				zap.Error(err),
 				zap.Strings("allocated_ips", allocatedIPs))
-			return &models.AllocationResponse{
-				Success:   false,
-				Message:   fmt.Sprintf("Failed to update database: %v", err),
-				Timestamp: time.Now(),
-			}, nil
+			return nil, fmt.Errorf("failed to update database: %w", err)
+		}
+
+		if attempt >= maxAllocationAttempts {
+			s.log(ctx).Error("Giving up on IP allocation after repeated conflicts",
+				zap.Int("attempts", attempt),
+				zap.String("region", req.Region),
+				zap.String("zone", req.Zone),
+				zap.String("subzone", req.SubZone))
+			return nil, conflict(CodeConcurrentUpdate, "Allocation failed: sub-zone is busy, gave up after %d conflicting attempts", attempt)
+		}
+
+		s.log(ctx).Warn("Concurrent allocation conflict, retrying with fresh selection",
+			zap.Int("attempt", attempt),
+			zap.Strings("conflicting_candidates", allocatedIPs))
+		if err := waitForRetry(ctx, attempt); err != nil {
+			return nil, err
 		}
-		s.logger.Info("Database updated successfully with allocated IPs")
 	}
 
-	// Prepare response
-	success := len(allocatedIPs) > 0
-	message := "IPs allocated successfully"
-	if len(errors) > 0 {
-		if !success {
+	// Nothing could be allocated at all
+	if len(allocatedIPs) == 0 {
+		message := "Allocation failed: no IPs could be allocated"
+		if len(errors) > 0 {
 			message = fmt.Sprintf("Allocation failed: %v", errors)
-		} else {
-			message = fmt.Sprintf("Partial allocation completed with warnings: %v", errors)
 		}
+		s.log(ctx).Warn("IP allocation process completed without allocating",
+			zap.Int("error_count", len(errors)),
+			zap.Int("rejection_count", len(rejections)))
+		failure := exhausted(CodeAddressesExhausted, "%s", message)
+		if len(rejections) > 0 {
+			failure.withDetail("rejections", rejections)
+		}
+		return nil, failure
 	}
 
-	s.logger.Info("IP allocation process completed",
-		zap.Bool("success", success),
+	// Prepare response
+	message := "IPs allocated successfully"
+	switch {
+	case len(errors) > 0:
+		message = fmt.Sprintf("Partial allocation completed with warnings: %v", errors)
+	case len(rejections) > 0:
+		message = fmt.Sprintf("IPs allocated with %d rejections", len(rejections))
+	}
+
+	s.log(ctx).Info("IP allocation process completed",
 		zap.Int("total_allocated", len(allocatedIPs)),
-		zap.Int("error_count", len(errors)))
+		zap.Int("error_count", len(errors)),
+		zap.Int("rejection_count", len(rejections)))
 
 	return &models.AllocationResponse{
-		Success:      success,
+		Success:      true,
 		AllocatedIPs: allocatedIPs,
+		HostPairs:    hostPairs,
+		Rejections:   rejections,
+		ExpiresAt:    template.ExpiresAt,
 		Message:      message,
 		Timestamp:    time.Now(),
 	}, nil
 }
 
+// unsatisfiedError explains why an atomic, contiguous or strict_preferred request cannot be committed
+// with the selected IPs, or returns nil when it can
+func unsatisfiedError(req *models.AllocationRequest, selected []string, rejections []models.IPRejection) *Error {
+	if req.StrictPreferred {
+		for _, rejection := range rejections {
+			if rejection.IP != "" {
+				return conflict(CodePreferredIPUnavailable, "Allocation failed: preferred IP %s was rejected (%s); no IPs were allocated", rejection.IP, rejection.Reason)
+			}
+		}
+	}
+	if requested := requestedIPCount(req); (req.Atomic || req.Contiguous) && len(selected) != requested {
+		return exhausted(CodeAddressesExhausted, "Allocation failed: only %d of %d requested IPs are available; no IPs were allocated", len(selected), requested)
+	}
+	return nil
+}
+
 // DeallocateIPs removes IPs from allocated lists with enhanced validation and logging
-func (s *AllocationService) DeallocateIPs(ctx context.Context, req *models.DeallocationRequest) (*models.IPOperationResponse, error) {
-	s.logger.Info("Starting IP deallocation process",
+func (s *AllocationService) DeallocateIPs(ctx context.Context, req *models.DeallocationRequest) (response *models.IPOperationResponse, err error) {
+	ctx, span := startSpan(ctx, "AllocationService.DeallocateIPs", req.Region, req.Zone, req.SubZone)
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Starting IP deallocation process",
 		zap.String("region", req.Region),
 		zap.String("zone", req.Zone),
 		zap.String("subzone", req.SubZone),
 		zap.Int("ip_count", len(req.IPAddresses)))
 
+	event := newAuditEvent(models.AuditActionDeallocate, models.AuditResourceIP, subZonePath(req.Region, req.Zone, req.SubZone))
+	defer func() { s.audit.recordIPOperation(ctx, event, response, err) }()
+
 	// Find the target sub-zone with enhanced validation
-	subZone, _, _, err := s.findSubZoneWithHierarchy(ctx, req.Region, req.Zone, req.SubZone)
+	subZone, _, _, err := s.findSubZone(ctx, req.Region, req.Zone, req.SubZone)
 	if err != nil {
-		s.logger.Error("Failed to find sub-zone for deallocation",
+		s.log(ctx).Error("Failed to find sub-zone for deallocation",
 			zap.Error(err),
 			zap.String("region", req.Region),
 			zap.String("zone", req.Zone),
 			zap.String("subzone", req.SubZone))
-		return &models.IPOperationResponse{
-			Success:   false,
-			Message:   fmt.Sprintf("Failed to find sub-zone: %v", err),
-			Timestamp: time.Now(),
-		}, nil
+		return nil, err
+	}
+
+	// Resolve an owner / label selector into the allocated IPs it matches
+	ipAddresses := req.IPAddresses
+	if req.HasSelector() {
+		matches, err := s.ips.findBySelector(ctx, req.Region, req.Zone, req.SubZone, req.Owner, req.Labels)
+		if err != nil {
+			s.log(ctx).Error("Failed to find IPs matching deallocation selector",
+				zap.Error(err),
+				zap.String("owner", req.Owner),
+				zap.Any("labels", req.Labels))
+			return nil, err
+		}
+
+		ipAddresses = make([]string, 0, len(matches))
+		for _, doc := range matches {
+			ipAddresses = append(ipAddresses, doc.IPAddress)
+		}
+
+		s.log(ctx).Info("Resolved deallocation selector",
+			zap.String("owner", req.Owner),
+			zap.Any("labels", req.Labels),
+			zap.Int("matched_count", len(ipAddresses)))
+
+		if len(ipAddresses) == 0 {
+			return nil, notFound(CodeNoMatchingIPs, "No allocated IPs match the given owner and labels")
+		}
+	}
+
+	index, err := s.free.lock(ctx, req.Region, req.Zone, subZone)
+	if err != nil {
+		s.log(ctx).Error("Failed to load free IPs of sub-zone", zap.Error(err), zap.String("subzone", req.SubZone))
+		return nil, err
 	}
+	defer index.unlock()
 
 	var processedIPs, failedIPs []string
 	ipv4sToRemove := []string{}
 	ipv6sToRemove := []string{}
 
-	// Process each IP address with enhanced validation
-	for _, ip := range req.IPAddresses {
-		s.logger.Debug("Processing IP for deallocation", zap.String("ip", ip))
+	// Validate each IP address before looking up the allocated ones among them
+	var candidates []string
+	for _, ip := range ipAddresses {
+		s.log(ctx).Debug("Processing IP for deallocation", zap.String("ip", ip))
 
 		normalizedIP := utils.NormalizeIP(ip)
 		if normalizedIP == "" {
-			s.logger.Warn("Invalid IP address format", zap.String("ip", ip))
+			s.log(ctx).Warn("Invalid IP address format", zap.String("ip", ip))
 			failedIPs = append(failedIPs, ip)
 			continue
 		}
 
 		// Enhanced CIDR validation - check if IP is in valid range
 		if err := s.validateIPInSubZoneCIDR(normalizedIP, subZone); err != nil {
-			s.logger.Warn("IP not in valid CIDR range for deallocation",
+			s.log(ctx).Warn("IP not in valid CIDR range for deallocation",
 				zap.String("ip", normalizedIP),
 				zap.Error(err))
 			failedIPs = append(failedIPs, normalizedIP)
 			continue
 		}
+		candidates = append(candidates, normalizedIP)
+	}
 
-		// Check if IP is actually allocated
-		var found bool
-		if utils.IsIPv4(net.ParseIP(normalizedIP)) {
-			for _, allocatedIP := range subZone.AllocatedIPv4 {
-				if allocatedIP == normalizedIP {
-					ipv4sToRemove = append(ipv4sToRemove, normalizedIP)
-					processedIPs = append(processedIPs, normalizedIP)
-					found = true
-					s.logger.Debug("IPv4 found in allocated list", zap.String("ip", normalizedIP))
-					break
-				}
+	docs, err := s.ips.findHeld(ctx, req.Region, req.Zone, req.SubZone, models.IPStatusAllocated, candidates)
+	if err != nil {
+		s.log(ctx).Error("Failed to find allocated IPs for deallocation", zap.Error(err))
+		return nil, err
+	}
+	allocated := make(map[string]models.IPAllocation, len(docs))
+	for _, doc := range docs {
+		allocated[doc.IPAddress] = doc
+	}
+
+	// Check if each IP is actually allocated
+	var removed []models.IPAllocation
+	releasing := make(map[string]bool, len(candidates))
+	for _, ip := range candidates {
+		doc, found := allocated[ip]
+		if !found || releasing[ip] {
+			if !found {
+				s.log(ctx).Warn("IP not found in allocated list", zap.String("ip", ip))
+				failedIPs = append(failedIPs, ip)
 			}
-		} else if utils.IsIPv6(net.ParseIP(normalizedIP)) {
-			for _, allocatedIP := range subZone.AllocatedIPv6 {
-				if allocatedIP == normalizedIP {
-					ipv6sToRemove = append(ipv6sToRemove, normalizedIP)
-					processedIPs = append(processedIPs, normalizedIP)
-					found = true
-					s.logger.Debug("IPv6 found in allocated list", zap.String("ip", normalizedIP))
-					break
-				}
+			continue
+		}
+
+		releasing[ip] = true
+		removed = append(removed, doc)
+		processedIPs = append(processedIPs, ip)
+		if doc.IPVersion == "ipv4" {
+			ipv4sToRemove = append(ipv4sToRemove, ip)
+		} else {
+			ipv6sToRemove = append(ipv6sToRemove, ip)
+		}
+		s.log(ctx).Debug("IP found in allocated list", zap.String("ip", ip), zap.String("version", doc.IPVersion))
+	}
+
+	// Release the partner of every host pair member being released when requested
+	if req.ReleasePaired {
+		var partners []string
+		for _, doc := range removed {
+			if doc.PairedIP == "" || releasing[doc.PairedIP] {
+				continue
+			}
+			if version := ipVersion(doc.PairedIP); index.held(version, doc.PairedIP) {
+				partners = append(partners, doc.PairedIP)
 			}
 		}
 
-		if !found {
-			s.logger.Warn("IP not found in allocated list", zap.String("ip", normalizedIP))
-			failedIPs = append(failedIPs, normalizedIP)
+		partnerDocs, err := s.ips.findHeld(ctx, req.Region, req.Zone, req.SubZone, models.IPStatusAllocated, partners)
+		if err != nil {
+			s.log(ctx).Error("Failed to find host pair partners for deallocation", zap.Error(err))
+			return nil, err
+		}
+		for _, partner := range partnerDocs {
+			if releasing[partner.IPAddress] {
+				continue
+			}
+
+			releasing[partner.IPAddress] = true
+			removed = append(removed, partner)
+			processedIPs = append(processedIPs, partner.IPAddress)
+			if partner.IPVersion == "ipv4" {
+				ipv4sToRemove = append(ipv4sToRemove, partner.IPAddress)
+			} else {
+				ipv6sToRemove = append(ipv6sToRemove, partner.IPAddress)
+			}
+			s.log(ctx).Debug("Releasing host pair partner",
+				zap.String("ip", partner.PairedIP),
+				zap.String("partner", partner.IPAddress),
+				zap.String("pair_id", partner.PairID))
 		}
 	}
 
 	// Update database to remove IPs
 	if len(processedIPs) > 0 {
-		s.logger.Debug("Updating database to remove allocated IPs",
+		s.log(ctx).Debug("Updating database to remove allocated IPs",
 			zap.Int("ipv4_count", len(ipv4sToRemove)),
 			zap.Int("ipv6_count", len(ipv6sToRemove)))
 		err = s.removeAllocatedIPs(ctx, req.Region, req.Zone, req.SubZone, ipv4sToRemove, ipv6sToRemove)
 		if err != nil {
-			s.logger.Error("Failed to update database for deallocation",
+			index.invalidate()
+			s.log(ctx).Error("Failed to update database for deallocation",
 				zap.Error(err),
 				zap.Strings("processed_ips", processedIPs))
-			return &models.IPOperationResponse{
-				Success:   false,
-				Message:   fmt.Sprintf("Failed to update database: %v", err),
-				Timestamp: time.Now(),
-			}, nil
+			return nil, fmt.Errorf("failed to update database: %w", err)
+		}
+		s.log(ctx).Info("Database updated successfully for deallocation")
+		index.removed(ctx, s.ips.repo, removed)
+		event.Before = removed
+
+		// Partners that stay allocated are no longer part of a pair
+		var paired []string
+		for _, doc := range removed {
+			if doc.PairedIP != "" && !releasing[doc.PairedIP] {
+				paired = append(paired, doc.IPAddress)
+			}
+		}
+		unpaired, err := s.ips.unpair(ctx, req.Region, req.Zone, req.SubZone, paired)
+		if err != nil {
+			s.log(ctx).Warn("Failed to unlink host pair partners of deallocated IPs",
+				zap.Error(err),
+				zap.Strings("processed_ips", paired))
+		}
+		if err != nil || unpaired > 0 {
+			// Unlinking moved the partners' documents along in a way the index does not track
+			index.invalidate()
 		}
-		s.logger.Info("Database updated successfully for deallocation")
 	}
 
 	success := len(processedIPs) > 0
@@ -295,7 +502,7 @@ func (s *AllocationService) DeallocateIPs(ctx context.Context, req *models.Deall
 		}
 	}
 
-	s.logger.Info("IP deallocation process completed",
+	s.log(ctx).Info("IP deallocation process completed",
 		zap.Bool("success", success),
 		zap.Int("processed_count", len(processedIPs)),
 		zap.Int("failed_count", len(failedIPs)))
@@ -310,114 +517,181 @@ func (s *AllocationService) DeallocateIPs(ctx context.Context, req *models.Deall
 }
 
 // ManageReservations handles IP reservation and unreservation with enhanced validation
-func (s *AllocationService) ManageReservations(ctx context.Context, req *models.ReservationRequest) (*models.IPOperationResponse, error) {
-	s.logger.Info("Starting IP reservation management",
+func (s *AllocationService) ManageReservations(ctx context.Context, req *models.ReservationRequest) (response *models.IPOperationResponse, err error) {
+	ctx, span := startSpan(ctx, "AllocationService.ManageReservations", req.Region, req.Zone, req.SubZone)
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Starting IP reservation management",
 		zap.String("region", req.Region),
 		zap.String("zone", req.Zone),
 		zap.String("subzone", req.SubZone),
 		zap.String("operation", req.ReservationType),
 		zap.Int("ip_count", len(req.IPAddresses)))
 
-	// Find the target sub-zone with enhanced validation
-	subZone, _, _, err := s.findSubZoneWithHierarchy(ctx, req.Region, req.Zone, req.SubZone)
-	if err != nil {
-		s.logger.Error("Failed to find sub-zone for reservation management",
-			zap.Error(err),
-			zap.String("region", req.Region),
-			zap.String("zone", req.Zone),
-			zap.String("subzone", req.SubZone))
-		return &models.IPOperationResponse{
-			Success:   false,
-			Message:   fmt.Sprintf("Failed to find sub-zone: %v", err),
-			Timestamp: time.Now(),
-		}, nil
+	action := models.AuditActionReserve
+	if req.ReservationType == "unreserve" {
+		action = models.AuditActionUnreserve
 	}
+	event := newAuditEvent(action, models.AuditResourceIP, subZonePath(req.Region, req.Zone, req.SubZone))
+	defer func() { s.audit.recordIPOperation(ctx, event, response, err) }()
 
 	var processedIPs, failedIPs []string
 
-	for _, ip := range req.IPAddresses {
-		s.logger.Debug("Processing IP for reservation management",
-			zap.String("ip", ip),
-			zap.String("operation", req.ReservationType))
-
-		normalizedIP := utils.NormalizeIP(ip)
-		if normalizedIP == "" {
-			s.logger.Warn("Invalid IP address format", zap.String("ip", ip))
-			failedIPs = append(failedIPs, ip)
-			continue
+	// Reservations share the per-IP unique index with allocations, so a request
+	// that races with an allocation re-evaluates its IPs against the fresh state
+	for attempt := 1; ; attempt++ {
+		// Find the target sub-zone with enhanced validation
+		subZone, _, _, err := s.findSubZone(ctx, req.Region, req.Zone, req.SubZone)
+		if err != nil {
+			s.log(ctx).Error("Failed to find sub-zone for reservation management",
+				zap.Error(err),
+				zap.String("region", req.Region),
+				zap.String("zone", req.Zone),
+				zap.String("subzone", req.SubZone))
+			return nil, err
 		}
 
-		// Enhanced CIDR validation with both first and last IP checking
-		if err := s.validateIPInSubZoneCIDR(normalizedIP, subZone); err != nil {
-			s.logger.Warn("IP not in valid CIDR range",
-				zap.String("ip", normalizedIP),
-				zap.Error(err))
-			failedIPs = append(failedIPs, normalizedIP)
-			continue
+		index, err := s.free.lock(ctx, req.Region, req.Zone, subZone)
+		if err != nil {
+			s.log(ctx).Error("Failed to load free IPs of sub-zone", zap.Error(err), zap.String("subzone", req.SubZone))
+			return nil, err
 		}
 
-		if req.ReservationType == "reserve" {
-			// Check if IP is not already allocated or reserved
-			if !s.isIPUsed(normalizedIP, subZone.AllocatedIPv4, subZone.ReservedIPv4) &&
-				!s.isIPUsed(normalizedIP, subZone.AllocatedIPv6, subZone.ReservedIPv6) {
-				processedIPs = append(processedIPs, normalizedIP)
-				s.logger.Debug("IP available for reservation", zap.String("ip", normalizedIP))
-			} else {
-				s.logger.Warn("IP already in use, cannot reserve", zap.String("ip", normalizedIP))
+		processedIPs, failedIPs = nil, nil
+
+		var candidates []string
+		for _, ip := range req.IPAddresses {
+			s.log(ctx).Debug("Processing IP for reservation management",
+				zap.String("ip", ip),
+				zap.String("operation", req.ReservationType))
+
+			normalizedIP := utils.NormalizeIP(ip)
+			if normalizedIP == "" {
+				s.log(ctx).Warn("Invalid IP address format", zap.String("ip", ip))
+				failedIPs = append(failedIPs, ip)
+				continue
+			}
+
+			// Enhanced CIDR validation with both first and last IP checking
+			if err := s.validateIPInSubZoneCIDR(normalizedIP, subZone); err != nil {
+				s.log(ctx).Warn("IP not in valid CIDR range",
+					zap.String("ip", normalizedIP),
+					zap.Error(err))
 				failedIPs = append(failedIPs, normalizedIP)
+				continue
 			}
-		} else { // unreserve
-			// Check if IP is actually reserved
-			var isReserved bool
-			if utils.IsIPv4(net.ParseIP(normalizedIP)) {
-				for _, reservedIP := range subZone.ReservedIPv4 {
-					if reservedIP == normalizedIP {
-						isReserved = true
-						break
-					}
+			candidates = append(candidates, normalizedIP)
+		}
+
+		// Unreserving looks up the reserved documents, which the audit event records as well
+		var unreserved []models.IPAllocation
+		reservedIPs := map[string]bool{}
+		if req.ReservationType == "unreserve" {
+			docs, err := s.ips.findHeld(ctx, req.Region, req.Zone, req.SubZone, models.IPStatusReserved, candidates)
+			if err != nil {
+				index.unlock()
+				s.log(ctx).Error("Failed to find reserved IPs", zap.Error(err))
+				return nil, err
+			}
+			for _, doc := range docs {
+				reservedIPs[doc.IPAddress] = true
+			}
+			unreserved = docs
+		}
+
+		for _, ip := range candidates {
+			if req.ReservationType == "reserve" {
+				// Check if IP is not already allocated or reserved
+				if !index.held(ipVersion(ip), ip) {
+					processedIPs = append(processedIPs, ip)
+					s.log(ctx).Debug("IP available for reservation", zap.String("ip", ip))
+				} else {
+					s.log(ctx).Warn("IP already in use, cannot reserve", zap.String("ip", ip))
+					failedIPs = append(failedIPs, ip)
 				}
-			} else if utils.IsIPv6(net.ParseIP(normalizedIP)) {
-				for _, reservedIP := range subZone.ReservedIPv6 {
-					if reservedIP == normalizedIP {
-						isReserved = true
-						break
-					}
+			} else { // unreserve
+				// Check if IP is actually reserved
+				if reservedIPs[ip] {
+					processedIPs = append(processedIPs, ip)
+					s.log(ctx).Debug("IP found in reserved list for unreservation", zap.String("ip", ip))
+				} else {
+					s.log(ctx).Warn("IP not found in reserved list", zap.String("ip", ip))
+					failedIPs = append(failedIPs, ip)
 				}
 			}
+		}
 
-			if isReserved {
-				processedIPs = append(processedIPs, normalizedIP)
-				s.logger.Debug("IP found in reserved list for unreservation", zap.String("ip", normalizedIP))
-			} else {
-				s.logger.Warn("IP not found in reserved list", zap.String("ip", normalizedIP))
-				failedIPs = append(failedIPs, normalizedIP)
-			}
+		// Update database
+		if len(processedIPs) == 0 {
+			index.unlock()
+			break
 		}
-	}
 
-	// Update database
-	if len(processedIPs) > 0 {
-		s.logger.Debug("Updating database for reservation management",
+		s.log(ctx).Debug("Updating database for reservation management",
 			zap.String("operation", req.ReservationType),
-			zap.Int("processed_count", len(processedIPs)))
+			zap.Int("processed_count", len(processedIPs)),
+			zap.Int("attempt", attempt))
+		var reserved []models.IPAllocation
 		if req.ReservationType == "reserve" {
-			err = s.addReservedIPs(ctx, req.Region, req.Zone, req.SubZone, processedIPs)
+			exceeded, err := s.quotas.Check(ctx, req.Region, req.Zone, subZone, index.heldCounts(), req.Owner, processedIPs)
+			if err != nil {
+				index.unlock()
+				s.log(ctx).Error("Failed to check quotas",
+					zap.Error(err),
+					zap.String("region", req.Region),
+					zap.String("zone", req.Zone),
+					zap.String("subzone", req.SubZone))
+				return nil, fmt.Errorf("failed to check quotas: %w", err)
+			}
+			if exceeded != nil {
+				index.unlock()
+				s.log(ctx).Warn("Reservation rejected by quota, nothing reserved",
+					zap.String("quota", exceeded.Quota),
+					zap.String("subject", exceeded.Subject),
+					zap.Int64("used", exceeded.Used),
+					zap.Int64("requested", exceeded.Requested),
+					zap.Int64("limit", exceeded.Limit))
+				return nil, quotaExceededError(exceeded).withDetail("failed_ips", append(failedIPs, processedIPs...))
+			}
+
+			template := ipTemplate(TenantFromContext(ctx), req.Region, req.Zone, req.SubZone, models.IPStatusReserved)
+			template.IPMetadata = req.IPMetadata
+			template.CreatedBy = RequestInfoFromContext(ctx).Actor
+			reserved, err = s.addReservedIPs(ctx, template, processedIPs)
 		} else {
 			err = s.removeReservedIPs(ctx, req.Region, req.Zone, req.SubZone, processedIPs)
 		}
 
-		if err != nil {
-			s.logger.Error("Failed to update database for reservation management",
+		if err == nil {
+			s.log(ctx).Info("Database updated successfully for reservation management")
+			if len(reserved) > 0 {
+				index.inserted(reserved)
+				event.After = reserved
+			} else if len(unreserved) > 0 {
+				index.removed(ctx, s.ips.repo, unreserved)
+				event.Before = unreserved
+			}
+			index.unlock()
+			break
+		}
+
+		index.invalidate()
+		index.unlock()
+
+		if err != errAllocationConflict || attempt >= maxAllocationAttempts {
+			s.log(ctx).Error("Failed to update database for reservation management",
 				zap.Error(err),
 				zap.String("operation", req.ReservationType),
 				zap.Strings("processed_ips", processedIPs))
-			return &models.IPOperationResponse{
-				Success:   false,
-				Message:   fmt.Sprintf("Failed to update database: %v", err),
-				Timestamp: time.Now(),
-			}, nil
+			return nil, fmt.Errorf("failed to update database: %w", err)
+		}
+
+		s.log(ctx).Warn("Concurrent reservation conflict, re-evaluating IPs",
+			zap.Int("attempt", attempt),
+			zap.Strings("conflicting_ips", processedIPs))
+		if err := waitForRetry(ctx, attempt); err != nil {
+			return nil, err
 		}
-		s.logger.Info("Database updated successfully for reservation management")
 	}
 
 	success := len(processedIPs) > 0
@@ -435,7 +709,7 @@ func (s *AllocationService) ManageReservations(ctx context.Context, req *models.
 		}
 	}
 
-	s.logger.Info("IP reservation management completed",
+	s.log(ctx).Info("IP reservation management completed",
 		zap.Bool("success", success),
 		zap.String("operation", operation),
 		zap.Int("processed_count", len(processedIPs)),
@@ -451,8 +725,11 @@ func (s *AllocationService) ManageReservations(ctx context.Context, req *models.
 }
 
 // GetAvailableIPs returns available IP addresses with enhanced CIDR validation
-func (s *AllocationService) GetAvailableIPs(ctx context.Context, regionName, zoneName, subZoneName, ipVersion string, limit int) (map[string]interface{}, error) {
-	s.logger.Debug("Getting available IPs",
+func (s *AllocationService) GetAvailableIPs(ctx context.Context, regionName, zoneName, subZoneName, ipVersion string, limit int) (_ map[string]interface{}, err error) {
+	ctx, span := startSpan(ctx, "AllocationService.GetAvailableIPs", regionName, zoneName, subZoneName)
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Debug("Getting available IPs",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName),
@@ -461,50 +738,64 @@ func (s *AllocationService) GetAvailableIPs(ctx context.Context, regionName, zon
 
 	subZone, _, _, err := s.findSubZoneWithHierarchy(ctx, regionName, zoneName, subZoneName)
 	if err != nil {
-		s.logger.Error("Failed to find sub-zone for available IPs", zap.Error(err))
+		s.log(ctx).Error("Failed to find sub-zone for available IPs", zap.Error(err))
 		return nil, err
 	}
 
 	var cidr string
-	var allocated, reserved []string
+	var inUse []models.IPAllocation
 
-	// Select appropriate CIDR and lists based on IP version
+	// Select appropriate CIDR based on IP version
 	switch ipVersion {
 	case "ipv4":
 		cidr = subZone.IPv4CIDR
-		allocated = subZone.AllocatedIPv4
-		reserved = subZone.ReservedIPv4
 	case "ipv6":
 		cidr = subZone.IPv6CIDR
-		allocated = subZone.AllocatedIPv6
-		reserved = subZone.ReservedIPv6
 	default:
-		s.logger.Warn("Invalid IP version requested", zap.String("ip_version", ipVersion))
-		return map[string]interface{}{
-			"success":   false,
-			"message":   "Invalid IP version. Must be 'ipv4' or 'ipv6'",
-			"timestamp": time.Now().Format(time.RFC3339),
-		}, nil
+		s.log(ctx).Warn("Invalid IP version requested", zap.String("ip_version", ipVersion))
+		return nil, validationFailed(CodeValidationFailed, "Invalid IP version. Must be 'ipv4' or 'ipv6'")
 	}
 
+	index, err := s.free.lock(ctx, regionName, zoneName, subZone)
+	if err != nil {
+		s.log(ctx).Error("Failed to load free IPs of sub-zone", zap.Error(err))
+		return nil, err
+	}
 	var availableIPs []string
-	if cidr != "" {
-		availableIPs, err = utils.GetAvailableIPsInRange(cidr, allocated, reserved, limit)
-		if err != nil {
-			s.logger.Error("Failed to get available IPs in range",
-				zap.Error(err),
+	var freeBlocks []utils.FreeBlock
+	freeCount := "0"
+	if family := index.family(ipVersion); family != nil {
+		if family.err != nil {
+			index.unlock()
+			s.log(ctx).Error("Failed to get available IPs in range",
+				zap.Error(family.err),
 				zap.String("cidr", cidr))
-			return nil, err
+			return nil, family.err
 		}
+		availableIPs = family.available.List(limit)
+		freeBlocks = family.available.Blocks(limit)
+		freeCount = family.available.FreeCount().String()
 	}
+	index.unlock()
 
-	s.logger.Debug("Available IPs retrieved",
+	// Report who holds the addresses of this version that are not available
+	for _, doc := range subZone.IPs {
+		if doc.IPVersion == ipVersion {
+			inUse = append(inUse, doc)
+		}
+	}
+
+	s.log(ctx).Debug("Available IPs retrieved",
 		zap.Int("available_count", len(availableIPs)),
+		zap.Int("in_use_count", len(inUse)),
 		zap.String("cidr", cidr))
 
 	return map[string]interface{}{
 		"success":       true,
 		"available_ips": availableIPs,
+		"in_use_ips":    inUse,
+		"free_blocks":   freeBlocks,
+		"free_count":    freeCount,
 		"count":         len(availableIPs),
 		"ip_version":    ipVersion,
 		"limit":         limit,
@@ -513,16 +804,20 @@ func (s *AllocationService) GetAvailableIPs(ctx context.Context, regionName, zon
 	}, nil
 }
 
-// GetIPStats returns comprehensive IP statistics with enhanced information
-func (s *AllocationService) GetIPStats(ctx context.Context, regionName, zoneName, subZoneName string) (map[string]interface{}, error) {
-	s.logger.Debug("Getting IP statistics",
+// GetIPStats returns comprehensive IP statistics with enhanced information, including
+// how many leases expire within the given window
+func (s *AllocationService) GetIPStats(ctx context.Context, regionName, zoneName, subZoneName string, expiringWithin time.Duration) (_ map[string]interface{}, err error) {
+	ctx, span := startSpan(ctx, "AllocationService.GetIPStats", regionName, zoneName, subZoneName)
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Debug("Getting IP statistics",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName))
 
 	subZone, _, _, err := s.findSubZoneWithHierarchy(ctx, regionName, zoneName, subZoneName)
 	if err != nil {
-		s.logger.Error("Failed to find sub-zone for IP stats", zap.Error(err))
+		s.log(ctx).Error("Failed to find sub-zone for IP stats", zap.Error(err))
 		return nil, err
 	}
 
@@ -543,15 +838,40 @@ func (s *AllocationService) GetIPStats(ctx context.Context, regionName, zoneName
 		"timestamp":            time.Now().Format(time.RFC3339),
 	}
 
-	// Calculate available counts
-	if ipv4Total.Int64() > 0 {
-		stats["ipv4_available_count"] = ipv4Total.Int64() - int64(len(subZone.AllocatedIPv4)) - int64(len(subZone.ReservedIPv4))
+	// Count leases that will be released by the reaper soon
+	now := time.Now()
+	expiringSoon, err := s.ips.countExpiring(ctx, ipSubZoneFilter(ctx, regionName, zoneName, subZoneName), now, now.Add(expiringWithin))
+	if err != nil {
+		s.log(ctx).Error("Failed to count expiring leases", zap.Error(err))
+		return nil, err
+	}
+	stats["leases_expiring_soon_count"] = expiringSoon
+	stats["leases_expiring_soon_window"] = expiringWithin.String()
+
+	// Break usage down by owner; IPs without an owner are counted as unassigned
+	byOwner := make(map[string]int)
+	for _, doc := range subZone.IPs {
+		owner := doc.Owner
+		if owner == "" {
+			owner = "unassigned"
+		}
+		byOwner[owner]++
 	}
-	if ipv6Total.Int64() > 0 {
-		stats["ipv6_available_count"] = ipv6Total.Int64() - int64(len(subZone.AllocatedIPv6)) - int64(len(subZone.ReservedIPv6))
+	stats["ips_by_owner"] = byOwner
+	stats["ips"] = subZone.IPs
+
+	// Available counts leave out the gateways and excluded ranges; like the totals they are
+	// strings, as IPv6 counts overflow JSON numbers
+	available, err := s.AvailableIPCounts(ctx, regionName, zoneName, subZone)
+	if err != nil {
+		s.log(ctx).Error("Failed to count available IPs", zap.Error(err))
+		return nil, err
+	}
+	for version, count := range available {
+		stats[version+"_available_count"] = count.String()
 	}
 
-	s.logger.Debug("IP statistics calculated",
+	s.log(ctx).Debug("IP statistics calculated",
 		zap.Int("ipv4_allocated", len(subZone.AllocatedIPv4)),
 		zap.Int("ipv6_allocated", len(subZone.AllocatedIPv6)),
 		zap.Int("ipv4_reserved", len(subZone.ReservedIPv4)),
@@ -560,17 +880,87 @@ func (s *AllocationService) GetIPStats(ctx context.Context, regionName, zoneName
 	return stats, nil
 }
 
+// SubZoneUsage returns the address counts of every sub-zone of every tenant, per address
+// family, counted the same way as GetIPStats
+func (s *AllocationService) SubZoneUsage(ctx context.Context) (_ []models.SubZoneUsage, err error) {
+	ctx, span := startSpan(ctx, "AllocationService.SubZoneUsage", "", "", "")
+	defer func() { endSpan(span, err) }()
+
+	regions, err := s.repo.ListRegions(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var usages []models.SubZoneUsage
+	for _, region := range regions {
+		tenant := region.Tenant
+		if tenant == "" {
+			tenant = models.DefaultTenant
+		}
+		tenantCtx := WithRequestInfo(ctx, RequestInfo{Tenant: tenant})
+		for _, zone := range region.Zones {
+			for i := range zone.SubZones {
+				subZone := &zone.SubZones[i]
+				index, err := s.free.lock(tenantCtx, region.Name, zone.Name, subZone)
+				if err != nil {
+					return nil, err
+				}
+				allocated := map[string]int{"ipv4": index.allocated["ipv4"], "ipv6": index.allocated["ipv6"]}
+				reserved := map[string]int{"ipv4": index.reserved["ipv4"], "ipv6": index.reserved["ipv6"]}
+				available, err := index.availableCounts()
+				index.unlock()
+				if err != nil {
+					return nil, err
+				}
+
+				for _, family := range []struct{ version, cidr string }{{"ipv4", subZone.IPv4CIDR}, {"ipv6", subZone.IPv6CIDR}} {
+					if family.cidr == "" {
+						continue
+					}
+					total, err := utils.CountIPsInCIDR(family.cidr)
+					if err != nil {
+						return nil, err
+					}
+					usage := models.SubZoneUsage{
+						Tenant:    tenant,
+						Region:    region.Name,
+						Zone:      zone.Name,
+						SubZone:   subZone.Name,
+						IPVersion: family.version,
+						Allocated: allocated[family.version],
+						Reserved:  reserved[family.version],
+					}
+					usage.Total, _ = new(big.Float).SetInt(total).Float64()
+					usage.Available, _ = new(big.Float).SetInt(available[family.version]).Float64()
+					usages = append(usages, usage)
+				}
+			}
+		}
+	}
+	return usages, nil
+}
+
 // Enhanced helper methods
 
-// findSubZoneWithHierarchy finds sub-zone and returns full hierarchy for validation
+// findSubZoneWithHierarchy finds sub-zone and returns full hierarchy for validation, with
+// the sub-zone's IP lists loaded
 func (s *AllocationService) findSubZoneWithHierarchy(ctx context.Context, regionName, zoneName, subZoneName string) (*models.SubZone, *models.Region, *models.Zone, error) {
-	var region models.Region
+	subZone, region, zone, err := s.findSubZone(ctx, regionName, zoneName, subZoneName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := s.ips.loadSubZone(ctx, regionName, zoneName, subZone); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to load IP state for sub-zone '%s': %v", subZoneName, err)
+	}
+	return subZone, region, zone, nil
+}
 
-	filter := bson.M{"name": regionName}
-	err := s.collection.FindOne(ctx, filter).Decode(&region)
+// findSubZone finds a sub-zone and its hierarchy without reading its IPs
+func (s *AllocationService) findSubZone(ctx context.Context, regionName, zoneName, subZoneName string) (*models.SubZone, *models.Region, *models.Zone, error) {
+	region, err := s.repo.GetRegion(ctx, TenantFromContext(ctx), regionName)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, nil, nil, fmt.Errorf("region '%s' not found", regionName)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil, nil, notFound(CodeRegionNotFound, "Region '%s' not found", regionName)
 		}
 		return nil, nil, nil, err
 	}
@@ -584,7 +974,7 @@ func (s *AllocationService) findSubZoneWithHierarchy(ctx context.Context, region
 		}
 	}
 	if targetZone == nil {
-		return nil, nil, nil, fmt.Errorf("zone '%s' not found in region '%s'", zoneName, regionName)
+		return nil, nil, nil, notFound(CodeZoneNotFound, "Zone '%s' not found in region '%s'", zoneName, regionName)
 	}
 
 	// Find sub-zone
@@ -594,7 +984,7 @@ func (s *AllocationService) findSubZoneWithHierarchy(ctx context.Context, region
 		}
 	}
 
-	return nil, nil, nil, fmt.Errorf("sub-zone '%s' not found in zone '%s'", subZoneName, zoneName)
+	return nil, nil, nil, notFound(CodeSubZoneNotFound, "Sub-zone '%s' not found in zone '%s'", subZoneName, zoneName)
 }
 
 // validateCIDRHierarchy validates CIDR hierarchy across Region -> Zone -> SubZone
@@ -641,42 +1031,213 @@ func (s *AllocationService) validateIPInSubZoneCIDR(ip string, subZone *models.S
 	return nil
 }
 
-// allocateIPsForVersionEnhanced allocates IPs with enhanced CIDR validation
-func (s *AllocationService) allocateIPsForVersionEnhanced(ctx context.Context, subZone *models.SubZone, preferredIPs []string, count int, version string) ([]string, error) {
-	var cidr string
-	var allocatedList, reservedList []string
+// selectIPsForRequest picks candidate IPs for a request from the locked index of the sub-zone,
+// reporting why each preferred IP or missing IP could not be selected
+func (s *AllocationService) selectIPsForRequest(ctx context.Context, req *models.AllocationRequest, subZone *models.SubZone, index *subZoneIndex, strategy *allocationStrategy) ([]string, []string, []models.IPRejection) {
+	var allocatedIPs []string
+	var errors []string
+	var rejections []models.IPRejection
 
-	if version == "ipv4" {
-		cidr = subZone.IPv4CIDR
-		allocatedList = subZone.AllocatedIPv4
-		reservedList = subZone.ReservedIPv4
-	} else {
+	// Handle different IP version requirements with enhanced validation
+	switch req.IPVersion {
+	case "ipv4":
+		ips, rejected, err := s.allocateIPsForVersionEnhanced(ctx, subZone, index, strategy, req.PreferredIPs, req.Count, "ipv4")
+		rejections = append(rejections, rejected...)
+		if err != nil {
+			s.log(ctx).Error("IPv4 allocation failed", zap.Error(err))
+			errors = append(errors, fmt.Sprintf("IPv4 allocation failed: %v", err))
+		} else {
+			allocatedIPs = append(allocatedIPs, ips...)
+			s.log(ctx).Info("IPv4 allocation successful",
+				zap.Int("allocated_count", len(ips)),
+				zap.Strings("allocated_ips", ips))
+		}
+	case "ipv6":
+		ips, rejected, err := s.allocateIPsForVersionEnhanced(ctx, subZone, index, strategy, req.PreferredIPs, req.Count, "ipv6")
+		rejections = append(rejections, rejected...)
+		if err != nil {
+			s.log(ctx).Error("IPv6 allocation failed", zap.Error(err))
+			errors = append(errors, fmt.Sprintf("IPv6 allocation failed: %v", err))
+		} else {
+			allocatedIPs = append(allocatedIPs, ips...)
+			s.log(ctx).Info("IPv6 allocation successful",
+				zap.Int("allocated_count", len(ips)),
+				zap.Strings("allocated_ips", ips))
+		}
+	case "both":
+		// Enhanced dual-stack allocation
+		ipv4Count, ipv6Count := dualStackCounts(req)
+
+		s.log(ctx).Debug("Dual-stack allocation requested",
+			zap.Int("ipv4_count", ipv4Count),
+			zap.Int("ipv6_count", ipv6Count))
+
+		ipv4Preferred, ipv6Preferred, err := utils.SplitIPsByVersion(req.PreferredIPs)
+		if err != nil {
+			s.log(ctx).Error("Failed to split preferred IPs by version", zap.Error(err))
+			errors = append(errors, fmt.Sprintf("Failed to split preferred IPs: %v", err))
+			for _, ip := range req.PreferredIPs {
+				rejections = append(rejections, models.IPRejection{IP: ip, Reason: models.RejectionInvalidIP, Detail: err.Error()})
+			}
+			break
+		}
+
+		if ipv4Count > 0 {
+			ips, rejected, err := s.allocateIPsForVersionEnhanced(ctx, subZone, index, strategy, ipv4Preferred, ipv4Count, "ipv4")
+			rejections = append(rejections, rejected...)
+			if err != nil {
+				s.log(ctx).Error("IPv4 allocation in dual-stack failed", zap.Error(err))
+				errors = append(errors, fmt.Sprintf("IPv4 allocation failed: %v", err))
+			} else {
+				allocatedIPs = append(allocatedIPs, ips...)
+				s.log(ctx).Info("IPv4 allocation in dual-stack successful",
+					zap.Int("allocated_count", len(ips)))
+			}
+		} else {
+			for _, ip := range ipv4Preferred {
+				rejections = append(rejections, models.IPRejection{IP: ip, IPVersion: "ipv4", Reason: models.RejectionCountExceeded,
+					Detail: "no IPv4 addresses were requested"})
+			}
+		}
+
+		if ipv6Count > 0 {
+			ips, rejected, err := s.allocateIPsForVersionEnhanced(ctx, subZone, index, strategy, ipv6Preferred, ipv6Count, "ipv6")
+			rejections = append(rejections, rejected...)
+			if err != nil {
+				s.log(ctx).Error("IPv6 allocation in dual-stack failed", zap.Error(err))
+				errors = append(errors, fmt.Sprintf("IPv6 allocation failed: %v", err))
+			} else {
+				allocatedIPs = append(allocatedIPs, ips...)
+				s.log(ctx).Info("IPv6 allocation in dual-stack successful",
+					zap.Int("allocated_count", len(ips)))
+			}
+		} else {
+			for _, ip := range ipv6Preferred {
+				rejections = append(rejections, models.IPRejection{IP: ip, IPVersion: "ipv6", Reason: models.RejectionCountExceeded,
+					Detail: "no IPv6 addresses were requested"})
+			}
+		}
+	}
+
+	return allocatedIPs, errors, rejections
+}
+
+// dualStackCounts returns how many IPv4 and IPv6 addresses a dual-stack request asks for. Explicit
+// counts win; host pairs need one of each per host; otherwise Count is split in half as before.
+func dualStackCounts(req *models.AllocationRequest) (int, int) {
+	switch {
+	case req.IPv4Count > 0 || req.IPv6Count > 0:
+		return req.IPv4Count, req.IPv6Count
+	case req.HostPairs:
+		return req.Count, req.Count
+	default:
+		ipv4Count := req.Count / 2
+		return ipv4Count, req.Count - ipv4Count
+	}
+}
+
+// requestedIPCount returns the total number of IPs a request asks for
+func requestedIPCount(req *models.AllocationRequest) int {
+	if req.IPVersion == "both" {
+		ipv4Count, ipv6Count := dualStackCounts(req)
+		return ipv4Count + ipv6Count
+	}
+	return req.Count
+}
+
+// pairHosts links selected IPv4 and IPv6 addresses in order, one pair per host. Addresses
+// left over because one family ran short are dropped and reported as rejections.
+func pairHosts(selected []string, rejections []models.IPRejection) ([]string, []models.HostPair, []models.IPRejection) {
+	var ipv4s, ipv6s []string
+	for _, ip := range selected {
+		if utils.IsIPv4(net.ParseIP(ip)) {
+			ipv4s = append(ipv4s, ip)
+		} else {
+			ipv6s = append(ipv6s, ip)
+		}
+	}
+
+	pairCount := len(ipv4s)
+	if len(ipv6s) < pairCount {
+		pairCount = len(ipv6s)
+	}
+
+	ips := make([]string, 0, pairCount*2)
+	pairs := make([]models.HostPair, 0, pairCount)
+	for i := 0; i < pairCount; i++ {
+		pairs = append(pairs, models.HostPair{
+			PairID: primitive.NewObjectID().Hex(),
+			IPv4:   ipv4s[i],
+			IPv6:   ipv6s[i],
+		})
+		ips = append(ips, ipv4s[i], ipv6s[i])
+	}
+
+	for _, ip := range ipv4s[pairCount:] {
+		rejections = append(rejections, models.IPRejection{IP: ip, IPVersion: "ipv4", Reason: models.RejectionUnpaired,
+			Detail: "no IPv6 address is available to pair with"})
+	}
+	for _, ip := range ipv6s[pairCount:] {
+		rejections = append(rejections, models.IPRejection{IP: ip, IPVersion: "ipv6", Reason: models.RejectionUnpaired,
+			Detail: "no IPv4 address is available to pair with"})
+	}
+
+	return ips, pairs, rejections
+}
+
+// allocateIPsForVersionEnhanced allocates IPs with enhanced CIDR validation. Preferred IPs are
+// granted first and the rest is picked in the order of the strategy. Every preferred IP that is
+// skipped, and any shortfall against count, is reported as a rejection.
+func (s *AllocationService) allocateIPsForVersionEnhanced(ctx context.Context, subZone *models.SubZone, index *subZoneIndex, strategy *allocationStrategy, preferredIPs []string, count int, version string) ([]string, []models.IPRejection, error) {
+	var rejections []models.IPRejection
+
+	cidr := subZone.IPv4CIDR
+	if version == "ipv6" {
 		cidr = subZone.IPv6CIDR
-		allocatedList = subZone.AllocatedIPv6
-		reservedList = subZone.ReservedIPv6
 	}
 
 	if cidr == "" {
-		return nil, fmt.Errorf("no %s CIDR configured for sub-zone", version)
+		err := fmt.Errorf("no %s CIDR configured for sub-zone", version)
+		for _, ip := range preferredIPs {
+			rejections = append(rejections, models.IPRejection{IP: ip, IPVersion: version, Reason: models.RejectionNoCIDR, Detail: err.Error()})
+		}
+		rejections = append(rejections, models.IPRejection{IPVersion: version, Reason: models.RejectionNoCIDR, Detail: err.Error()})
+		return nil, rejections, err
 	}
 
-	s.logger.Debug("Starting IP allocation for version",
+	s.log(ctx).Debug("Starting IP allocation for version",
 		zap.String("version", version),
 		zap.String("cidr", cidr),
+		zap.String("strategy", strategy.name),
 		zap.Int("requested_count", count),
 		zap.Int("preferred_count", len(preferredIPs)))
 
+	// The kept free intervals of the range, without the gateways and excluded ranges; what is
+	// taken here is claimed until the write or the unlock
+	family := index.family(version)
+	if family.err != nil {
+		return nil, nil, family.err
+	}
+	freeIPs := family.available
+
 	var allocatedIPs []string
+	selected := make(map[string]bool, len(preferredIPs))
+	reject := func(ip, reason, detail string) {
+		rejections = append(rejections, models.IPRejection{IP: ip, IPVersion: version, Reason: reason, Detail: detail})
+	}
 
 	// Enhanced preferred IP processing with CIDR validation
 	for _, ip := range preferredIPs {
 		if len(allocatedIPs) >= count {
-			break
+			s.log(ctx).Debug("Preferred IP exceeds requested count", zap.String("ip", ip))
+			reject(ip, models.RejectionCountExceeded, fmt.Sprintf("only %d %s IPs were requested", count, version))
+			continue
 		}
 
 		parsedIP := net.ParseIP(ip)
 		if parsedIP == nil {
-			s.logger.Warn("Invalid IP in preferred list", zap.String("ip", ip))
+			s.log(ctx).Warn("Invalid IP in preferred list", zap.String("ip", ip))
+			reject(ip, models.RejectionInvalidIP, "not a valid IP address")
 			continue
 		}
 
@@ -684,355 +1245,287 @@ func (s *AllocationService) allocateIPsForVersionEnhanced(ctx context.Context, s
 
 		// Validate IP version matches
 		if (version == "ipv4" && !utils.IsIPv4(parsedIP)) || (version == "ipv6" && !utils.IsIPv6(parsedIP)) {
-			s.logger.Warn("IP version mismatch in preferred list",
+			s.log(ctx).Warn("IP version mismatch in preferred list",
 				zap.String("ip", ip),
 				zap.String("expected_version", version))
+			reject(normalizedIP, models.RejectionVersionMismatch, "expected an "+version+" address")
 			continue
 		}
 
 		// Enhanced CIDR validation: check if IP is in CIDR range
 		inRange, err := utils.IsIPInCIDR(normalizedIP, cidr)
 		if err != nil || !inRange {
-			s.logger.Warn("Preferred IP not in CIDR range",
+			s.log(ctx).Warn("Preferred IP not in CIDR range",
 				zap.String("ip", normalizedIP),
 				zap.String("cidr", cidr),
 				zap.Error(err))
+			reject(normalizedIP, models.RejectionOutOfRange, fmt.Sprintf("not a usable address in %s", cidr))
 			continue
 		}
 
 		// Check if IP is already allocated or reserved
-		if s.isIPUsed(normalizedIP, allocatedList, reservedList) {
-			s.logger.Debug("Preferred IP already in use", zap.String("ip", normalizedIP))
+		if index.held(version, normalizedIP) {
+			s.log(ctx).Debug("Preferred IP already in use", zap.String("ip", normalizedIP))
+			reject(normalizedIP, models.RejectionInUse, "already allocated or reserved")
+			continue
+		}
+
+		// The same address may be listed more than once
+		if selected[normalizedIP] {
+			s.log(ctx).Debug("Preferred IP listed more than once", zap.String("ip", normalizedIP))
+			reject(normalizedIP, models.RejectionDuplicate, "listed more than once in preferred_ips")
+			continue
+		}
+
+		if !freeIPs.IsFree(normalizedIP) {
+			s.log(ctx).Debug("Preferred IP is a gateway or excluded", zap.String("ip", normalizedIP))
+			reject(normalizedIP, models.RejectionExcluded, "gateway or excluded range of the sub-zone")
 			continue
 		}
 
 		allocatedIPs = append(allocatedIPs, normalizedIP)
-		s.logger.Debug("Preferred IP allocated", zap.String("ip", normalizedIP))
+		selected[normalizedIP] = true
+		freeIPs.Take(normalizedIP)
+		s.log(ctx).Debug("Preferred IP allocated", zap.String("ip", normalizedIP))
 	}
 
 	// If we need more IPs, allocate from available range
 	remaining := count - len(allocatedIPs)
 	if remaining > 0 {
-		s.logger.Debug("Allocating additional IPs from available range",
-			zap.Int("remaining", remaining))
-
-		for i := 0; i < remaining; i++ {
-			nextIP, err := utils.GetNextAvailableIP(cidr, append(allocatedList, allocatedIPs...), reservedList)
-			if err != nil {
-				s.logger.Warn("No more available IPs in range",
+		s.log(ctx).Debug("Allocating additional IPs from available range",
+			zap.Int("remaining", remaining),
+			zap.String("strategy", strategy.name))
+
+		if strategy.contiguous {
+			run, reason := strategy.takeRun(freeIPs, version, remaining)
+			if run == nil {
+				s.log(ctx).Warn("No contiguous run of free IPs in range",
 					zap.String("cidr", cidr),
-					zap.Error(err))
-				break
+					zap.Int("length", remaining),
+					zap.Int("align_prefix", strategy.alignPrefix))
+				reject("", models.RejectionNoContiguousRun, reason)
+			} else {
+				allocatedIPs = append(allocatedIPs, run...)
+				s.log(ctx).Debug("Auto-allocated contiguous run",
+					zap.String("first_ip", run[0]),
+					zap.String("last_ip", run[len(run)-1]))
+			}
+		} else {
+			for i := 0; i < remaining; i++ {
+				nextIP, ok := strategy.take(freeIPs, version)
+				if !ok {
+					s.log(ctx).Warn("No more available IPs in range",
+						zap.String("cidr", cidr))
+					reject("", models.RejectionRangeExhausted,
+						fmt.Sprintf("%d of %d requested %s IPs are not available in %s", remaining-i, count, version, cidr))
+					break
+				}
+				allocatedIPs = append(allocatedIPs, nextIP)
+				s.log(ctx).Debug("Auto-allocated IP", zap.String("ip", nextIP))
 			}
-			allocatedIPs = append(allocatedIPs, nextIP)
-			s.logger.Debug("Auto-allocated IP", zap.String("ip", nextIP))
 		}
 	}
 
-	s.logger.Info("IP allocation for version completed",
+	s.log(ctx).Info("IP allocation for version completed",
 		zap.String("version", version),
 		zap.Int("allocated_count", len(allocatedIPs)),
-		zap.Int("requested_count", count))
+		zap.Int("requested_count", count),
+		zap.Int("rejection_count", len(rejections)))
 
-	return allocatedIPs, nil
+	index.claim(version, allocatedIPs)
+	return allocatedIPs, rejections, nil
 }
 
-// updateAllocatedIPs updates the allocated IPs in the database
-func (s *AllocationService) updateAllocatedIPs(ctx context.Context, regionName, zoneName, subZoneName string, newIPs []string) error {
-	// Split IPs by version
-	ipv4s, ipv6s, err := utils.SplitIPsByVersion(newIPs)
-	if err != nil {
-		return err
-	}
-
-	s.logger.Debug("Updating allocated IPs in database",
-		zap.String("region", regionName),
-		zap.String("zone", zoneName),
-		zap.String("subzone", subZoneName),
-		zap.Int("ipv4_count", len(ipv4s)),
-		zap.Int("ipv6_count", len(ipv6s)))
-
-	// Prepare update operations
-	update := bson.M{}
-	if len(ipv4s) > 0 {
-		update["$push"] = bson.M{
-			"zones.$[zone].sub_zones.$[subzone].allocated_ipv4": bson.M{"$each": ipv4s},
+// updateAllocatedIPs records newly allocated IPs in the ip_allocations collection, linking
+// the two addresses of every host pair
+func (s *AllocationService) updateAllocatedIPs(ctx context.Context, template models.IPAllocation, newIPs []string, pairs []models.HostPair) ([]models.IPAllocation, error) {
+	s.log(ctx).Debug("Recording allocated IPs in database",
+		zap.String("region", template.Region),
+		zap.String("zone", template.Zone),
+		zap.String("subzone", template.SubZone),
+		zap.Int("ip_count", len(newIPs)),
+		zap.Int("host_pair_count", len(pairs)))
+
+	docs := newIPAllocations(template, newIPs, time.Now())
+	if len(pairs) > 0 {
+		pairByIP := make(map[string]models.HostPair, len(pairs)*2)
+		for _, pair := range pairs {
+			pairByIP[pair.IPv4] = pair
+			pairByIP[pair.IPv6] = pair
 		}
-	}
-	if len(ipv6s) > 0 {
-		if update["$push"] == nil {
-			update["$push"] = bson.M{}
+		for i := range docs {
+			pair, ok := pairByIP[docs[i].IPAddress]
+			if !ok {
+				continue
+			}
+			docs[i].PairID = pair.PairID
+			docs[i].PairedIP = pair.IPv6
+			if docs[i].IPAddress == pair.IPv6 {
+				docs[i].PairedIP = pair.IPv4
+			}
 		}
-		update["$push"].(bson.M)["zones.$[zone].sub_zones.$[subzone].allocated_ipv6"] = bson.M{"$each": ipv6s}
-	}
-
-	// Set updated timestamp
-	update["$set"] = bson.M{
-		"zones.$[zone].sub_zones.$[subzone].updated_at": time.Now(),
-		"updated_at": time.Now(),
-	}
-
-	// Array filters for nested update
-	arrayFilters := options.ArrayFilters{
-		Filters: []interface{}{
-			bson.M{"zone.name": zoneName},
-			bson.M{"subzone.name": subZoneName},
-		},
-	}
-
-	opts := options.Update().SetArrayFilters(arrayFilters)
-	filter := bson.M{"name": regionName}
-	result, err := s.collection.UpdateOne(ctx, filter, update, opts)
-	if err != nil {
-		return err
 	}
 
-	if result.MatchedCount == 0 {
-		return fmt.Errorf("no matching document found for region %s", regionName)
+	if err := s.ips.insertDocs(ctx, docs); err != nil {
+		return nil, err
 	}
-
-	return nil
+	return docs, nil
 }
 
-// removeAllocatedIPs removes IPs from allocated lists
+// removeAllocatedIPs removes allocated IPs from the ip_allocations collection
 func (s *AllocationService) removeAllocatedIPs(ctx context.Context, regionName, zoneName, subZoneName string, ipv4s, ipv6s []string) error {
-	s.logger.Debug("Removing allocated IPs from database",
+	s.log(ctx).Debug("Removing allocated IPs from database",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName),
 		zap.Int("ipv4_count", len(ipv4s)),
 		zap.Int("ipv6_count", len(ipv6s)))
 
-	update := bson.M{}
-
-	if len(ipv4s) > 0 {
-		update["$pullAll"] = bson.M{
-			"zones.$[zone].sub_zones.$[subzone].allocated_ipv4": ipv4s,
-		}
-	}
-
-	if len(ipv6s) > 0 {
-		if update["$pullAll"] == nil {
-			update["$pullAll"] = bson.M{}
-		}
-		update["$pullAll"].(bson.M)["zones.$[zone].sub_zones.$[subzone].allocated_ipv6"] = ipv6s
-	}
-
-	update["$set"] = bson.M{
-		"zones.$[zone].sub_zones.$[subzone].updated_at": time.Now(),
-		"updated_at": time.Now(),
-	}
-
-	arrayFilters := options.ArrayFilters{
-		Filters: []interface{}{
-			bson.M{"zone.name": zoneName},
-			bson.M{"subzone.name": subZoneName},
-		},
-	}
-
-	opts := options.Update().SetArrayFilters(arrayFilters)
-	filter := bson.M{"name": regionName}
-	result, err := s.collection.UpdateOne(ctx, filter, update, opts)
-	if err != nil {
-		return err
-	}
-
-	if result.MatchedCount == 0 {
-		return fmt.Errorf("no matching document found for region %s", regionName)
-	}
-
-	return nil
+	ips := append(append([]string{}, ipv4s...), ipv6s...)
+	return s.ips.remove(ctx, regionName, zoneName, subZoneName, models.IPStatusAllocated, ips)
 }
 
-// addReservedIPs adds IPs to reserved lists
-func (s *AllocationService) addReservedIPs(ctx context.Context, regionName, zoneName, subZoneName string, ips []string) error {
-	ipv4s, ipv6s, err := utils.SplitIPsByVersion(ips)
-	if err != nil {
-		return err
-	}
-
-	s.logger.Debug("Adding reserved IPs to database",
-		zap.String("region", regionName),
-		zap.String("zone", zoneName),
-		zap.String("subzone", subZoneName),
-		zap.Int("ipv4_count", len(ipv4s)),
-		zap.Int("ipv6_count", len(ipv6s)))
-
-	update := bson.M{}
-	if len(ipv4s) > 0 {
-		update["$push"] = bson.M{
-			"zones.$[zone].sub_zones.$[subzone].reserved_ipv4": bson.M{"$each": ipv4s},
-		}
-	}
-	if len(ipv6s) > 0 {
-		if update["$push"] == nil {
-			update["$push"] = bson.M{}
-		}
-		update["$push"].(bson.M)["zones.$[zone].sub_zones.$[subzone].reserved_ipv6"] = bson.M{"$each": ipv6s}
-	}
-
-	update["$set"] = bson.M{
-		"zones.$[zone].sub_zones.$[subzone].updated_at": time.Now(),
-		"updated_at": time.Now(),
-	}
+// addReservedIPs records reserved IPs in the ip_allocations collection
+func (s *AllocationService) addReservedIPs(ctx context.Context, template models.IPAllocation, ips []string) ([]models.IPAllocation, error) {
+	s.log(ctx).Debug("Recording reserved IPs in database",
+		zap.String("region", template.Region),
+		zap.String("zone", template.Zone),
+		zap.String("subzone", template.SubZone),
+		zap.Int("ip_count", len(ips)))
 
-	arrayFilters := options.ArrayFilters{
-		Filters: []interface{}{
-			bson.M{"zone.name": zoneName},
-			bson.M{"subzone.name": subZoneName},
-		},
-	}
-
-	opts := options.Update().SetArrayFilters(arrayFilters)
-	filter := bson.M{"name": regionName}
-	result, err := s.collection.UpdateOne(ctx, filter, update, opts)
-	if err != nil {
-		return err
-	}
-
-	if result.MatchedCount == 0 {
-		return fmt.Errorf("no matching document found for region %s", regionName)
+	docs := newIPAllocations(template, ips, time.Now())
+	if err := s.ips.insertDocs(ctx, docs); err != nil {
+		return nil, err
 	}
-
-	return nil
+	return docs, nil
 }
 
-// removeReservedIPs removes IPs from reserved lists
+// removeReservedIPs removes reserved IPs from the ip_allocations collection
 func (s *AllocationService) removeReservedIPs(ctx context.Context, regionName, zoneName, subZoneName string, ips []string) error {
-	ipv4s, ipv6s, err := utils.SplitIPsByVersion(ips)
-	if err != nil {
-		return err
-	}
-
-	s.logger.Debug("Removing reserved IPs from database",
+	s.log(ctx).Debug("Removing reserved IPs from database",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName),
-		zap.Int("ipv4_count", len(ipv4s)),
-		zap.Int("ipv6_count", len(ipv6s)))
+		zap.Int("ip_count", len(ips)))
 
-	update := bson.M{}
-	if len(ipv4s) > 0 {
-		update["$pullAll"] = bson.M{
-			"zones.$[zone].sub_zones.$[subzone].reserved_ipv4": ipv4s,
-		}
-	}
-	if len(ipv6s) > 0 {
-		if update["$pullAll"] == nil {
-			update["$pullAll"] = bson.M{}
-		}
-		update["$pullAll"].(bson.M)["zones.$[zone].sub_zones.$[subzone].reserved_ipv6"] = ipv6s
-	}
-
-	update["$set"] = bson.M{
-		"zones.$[zone].sub_zones.$[subzone].updated_at": time.Now(),
-		"updated_at": time.Now(),
-	}
-
-	arrayFilters := options.ArrayFilters{
-		Filters: []interface{}{
-			bson.M{"zone.name": zoneName},
-			bson.M{"subzone.name": subZoneName},
-		},
-	}
-
-	opts := options.Update().SetArrayFilters(arrayFilters)
-	filter := bson.M{"name": regionName}
-	result, err := s.collection.UpdateOne(ctx, filter, update, opts)
-	if err != nil {
-		return err
-	}
+	return s.ips.remove(ctx, regionName, zoneName, subZoneName, models.IPStatusReserved, ips)
+}
 
-	if result.MatchedCount == 0 {
-		return fmt.Errorf("no matching document found for region %s", regionName)
-	}
+// waitForRetry sleeps with jittered backoff before the next conflicting attempt
+func waitForRetry(ctx context.Context, attempt int) error {
+	backoff := time.Duration(attempt*attempt)*10*time.Millisecond +
+		time.Duration(rand.Int63n(int64(10*time.Millisecond)))
 
-	return nil
-}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
 
-// isIPUsed checks if an IP is already in use (allocated or reserved)
-func (s *AllocationService) isIPUsed(ip string, allocated, reserved []string) bool {
-	for _, allocatedIP := range allocated {
-		if allocatedIP == ip {
-			return true
-		}
-	}
-	for _, reservedIP := range reserved {
-		if reservedIP == ip {
-			return true
-		}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
-	return false
 }
 
 // Existing methods maintained for backward compatibility
 
 // GetRegionHierarchy returns the complete hierarchy for a region
-func (s *AllocationService) GetRegionHierarchy(ctx context.Context, regionName string) (*models.Region, error) {
-	s.logger.Debug("Getting region hierarchy", zap.String("region", regionName))
+func (s *AllocationService) GetRegionHierarchy(ctx context.Context, regionName string) (_ *models.Region, err error) {
+	ctx, span := startSpan(ctx, "AllocationService.GetRegionHierarchy", regionName, "", "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Debug("Getting region hierarchy", zap.String("region", regionName))
 
-	var region models.Region
-	filter := bson.M{"name": regionName}
-	err := s.collection.FindOne(ctx, filter).Decode(&region)
+	region, err := s.repo.GetRegion(ctx, TenantFromContext(ctx), regionName)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			s.logger.Warn("Region not found", zap.String("region", regionName))
-			return nil, fmt.Errorf("region '%s' not found", regionName)
+		if errors.Is(err, storage.ErrNotFound) {
+			s.log(ctx).Warn("Region not found", zap.String("region", regionName))
+			return nil, notFound(CodeRegionNotFound, "Region '%s' not found", regionName)
 		}
-		s.logger.Error("Error retrieving region", zap.Error(err), zap.String("region", regionName))
+		s.log(ctx).Error("Error retrieving region", zap.Error(err), zap.String("region", regionName))
 		return nil, err
 	}
 
-	s.logger.Debug("Region hierarchy retrieved successfully",
+	regions := []models.Region{region}
+	if err := s.ips.loadRegions(ctx, regions); err != nil {
+		s.log(ctx).Error("Error loading IP state for region", zap.Error(err), zap.String("region", regionName))
+		return nil, err
+	}
+	region = regions[0]
+
+	s.log(ctx).Debug("Region hierarchy retrieved successfully",
 		zap.String("region", regionName),
 		zap.Int("zones_count", len(region.Zones)))
 
 	return &region, nil
 }
 
-// GetAllRegions returns all regions
-func (s *AllocationService) GetAllRegions(ctx context.Context) ([]models.Region, error) {
-	s.logger.Debug("Getting all regions")
+// GetAllRegions returns all regions of the request's tenant
+func (s *AllocationService) GetAllRegions(ctx context.Context) (_ []models.Region, err error) {
+	ctx, span := startSpan(ctx, "AllocationService.GetAllRegions", "", "", "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Debug("Getting all regions", zap.String("tenant", TenantFromContext(ctx)))
 
-	var regions []models.Region
-	cursor, err := s.collection.Find(ctx, bson.M{})
+	regions, err := s.repo.ListRegions(ctx, TenantFromContext(ctx))
 	if err != nil {
-		s.logger.Error("Error retrieving regions", zap.Error(err))
+		s.log(ctx).Error("Error retrieving regions", zap.Error(err))
 		return nil, err
 	}
-	defer cursor.Close(ctx)
 
-	if err = cursor.All(ctx, &regions); err != nil {
-		s.logger.Error("Error decoding regions", zap.Error(err))
+	if err = s.ips.loadRegions(ctx, regions); err != nil {
+		s.log(ctx).Error("Error loading IP state for regions", zap.Error(err))
 		return nil, err
 	}
 
-	s.logger.Debug("All regions retrieved successfully", zap.Int("count", len(regions)))
+	s.log(ctx).Debug("All regions retrieved successfully", zap.Int("count", len(regions)))
 	return regions, nil
 }
 
-// CreateRegion creates a new region with enhanced validation
-func (s *AllocationService) CreateRegion(ctx context.Context, region *models.Region) error {
-	s.logger.Info("Creating new region",
+// CreateRegion creates a new region with enhanced validation in the request's tenant
+func (s *AllocationService) CreateRegion(ctx context.Context, region *models.Region) (err error) {
+	ctx, span := startSpan(ctx, "AllocationService.CreateRegion", region.Name, "", "")
+	defer func() { endSpan(span, err) }()
+
+	region.Tenant = TenantFromContext(ctx)
+	s.log(ctx).Info("Creating new region",
+		zap.String("tenant", region.Tenant),
 		zap.String("region", region.Name),
 		zap.String("ipv4_cidr", region.IPv4CIDR),
 		zap.String("ipv6_cidr", region.IPv6CIDR))
 
+	event := newAuditEvent(models.AuditActionCreate, models.AuditResourceRegion, regionPath(region.Name))
+	defer func() {
+		if err == nil {
+			event.After = *region
+		}
+		s.audit.recordOutcome(ctx, event, err == nil, "Region created successfully", err)
+	}()
+
+	exists, err := tenantExists(ctx, s.repo, region.Tenant)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return notFound(CodeTenantNotFound, "Tenant not found: %s", region.Tenant)
+	}
+
 	// Set timestamps
 	region.CreatedAt = time.Now()
 	region.UpdatedAt = time.Now()
 
 	// Set timestamps for zones and sub-zones
+	var ipDocs []models.IPAllocation
 	for i := range region.Zones {
 		region.Zones[i].CreatedAt = time.Now()
 		region.Zones[i].UpdatedAt = time.Now()
 
 		// Validate zone CIDR against region CIDR
 		if err := utils.ValidateZoneCIDRHierarchy(region.IPv4CIDR, region.IPv6CIDR, region.Zones[i].IPv4CIDR, region.Zones[i].IPv6CIDR); err != nil {
-			s.logger.Error("Zone CIDR validation failed",
+			s.log(ctx).Error("Zone CIDR validation failed",
 				zap.Error(err),
 				zap.String("zone", region.Zones[i].Name))
-			return fmt.Errorf("zone CIDR validation failed for zone %s: %v", region.Zones[i].Name, err)
+			return cidrOutOfRange("Zone CIDR validation failed for zone %s: %v", region.Zones[i].Name, err)
 		}
 
 		for j := range region.Zones[i].SubZones {
@@ -1041,37 +1534,42 @@ func (s *AllocationService) CreateRegion(ctx context.Context, region *models.Reg
 
 			// Validate sub-zone CIDR against zone CIDR
 			if err := utils.ValidateSubZoneCIDRHierarchy(region.Zones[i].IPv4CIDR, region.Zones[i].IPv6CIDR, region.Zones[i].SubZones[j].IPv4CIDR, region.Zones[i].SubZones[j].IPv6CIDR); err != nil {
-				s.logger.Error("Sub-zone CIDR validation failed",
+				s.log(ctx).Error("Sub-zone CIDR validation failed",
 					zap.Error(err),
 					zap.String("subzone", region.Zones[i].SubZones[j].Name))
-				return fmt.Errorf("sub-zone CIDR validation failed for sub-zone %s: %v", region.Zones[i].SubZones[j].Name, err)
+				return cidrOutOfRange("Sub-zone CIDR validation failed for sub-zone %s: %v", region.Zones[i].SubZones[j].Name, err)
 			}
 
-			// Initialize empty slices for IP lists
-			if region.Zones[i].SubZones[j].AllocatedIPv4 == nil {
-				region.Zones[i].SubZones[j].AllocatedIPv4 = []string{}
-			}
-			if region.Zones[i].SubZones[j].AllocatedIPv6 == nil {
-				region.Zones[i].SubZones[j].AllocatedIPv6 = []string{}
-			}
-			if region.Zones[i].SubZones[j].ReservedIPv4 == nil {
-				region.Zones[i].SubZones[j].ReservedIPv4 = []string{}
-			}
-			if region.Zones[i].SubZones[j].ReservedIPv6 == nil {
-				region.Zones[i].SubZones[j].ReservedIPv6 = []string{}
-			}
+			// IP lists supplied with the hierarchy are stored as per-IP documents
+			ipDocs = append(ipDocs, embeddedIPAllocations(region.Tenant, region.Name, region.Zones[i].Name, &region.Zones[i].SubZones[j], time.Now())...)
+			resetIPLists(&region.Zones[i].SubZones[j])
 		}
 	}
 
-	result, err := s.collection.InsertOne(ctx, region)
-	if err != nil {
-		s.logger.Error("Failed to create region", zap.Error(err), zap.String("region", region.Name))
+	if err := s.repo.CreateRegion(ctx, region); err != nil {
+		if errors.Is(err, storage.ErrDuplicate) {
+			return conflict(CodeRegionExists, "Region with this name already exists")
+		}
+		s.log(ctx).Error("Failed to create region", zap.Error(err), zap.String("region", region.Name))
 		return err
 	}
 
-	s.logger.Info("Region created successfully",
+	if len(ipDocs) > 0 {
+		if err := s.ips.insertDocs(ctx, ipDocs); err != nil {
+			s.log(ctx).Error("Failed to store IPs for new region", zap.Error(err), zap.String("region", region.Name))
+			return err
+		}
+
+		regions := []models.Region{*region}
+		if err := s.ips.loadRegions(ctx, regions); err != nil {
+			return err
+		}
+		*region = regions[0]
+	}
+
+	s.log(ctx).Info("Region created successfully",
 		zap.String("region", region.Name),
-		zap.Any("id", result.InsertedID))
+		zap.String("id", region.ID.Hex()))
 
 	return nil
 }
@@ -0,0 +1,435 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// createSubZone stores region r1 of the tenant with zone z1 and sub-zone s1 covering cidr
+func createSubZone(t testing.TB, repo storage.Repository, tenant, cidr string) {
+	t.Helper()
+	createDualStackSubZone(t, repo, tenant, cidr, "")
+}
+
+// createDualStackSubZone stores sub-zone s1 like createSubZone, with an IPv6 range as well
+func createDualStackSubZone(t testing.TB, repo storage.Repository, tenant, ipv4CIDR, ipv6CIDR string) {
+	t.Helper()
+	now := time.Now()
+	region := models.Region{
+		Name:     "r1",
+		Tenant:   tenant,
+		IPv4CIDR: "10.0.0.0/8",
+		Zones: []models.Zone{{
+			Name:     "z1",
+			IPv4CIDR: "10.0.0.0/16",
+			SubZones: []models.SubZone{{
+				Name:      "s1",
+				IPv4CIDR:  ipv4CIDR,
+				IPv6CIDR:  ipv6CIDR,
+				CreatedAt: now,
+				UpdatedAt: now,
+			}},
+			CreatedAt: now,
+			UpdatedAt: now,
+		}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := repo.CreateRegion(context.Background(), &region); err != nil {
+		t.Fatalf("CreateRegion: %v", err)
+	}
+}
+
+// tenantContext returns a context acting for the tenant
+func tenantContext(tenant string) context.Context {
+	return WithRequestInfo(context.Background(), RequestInfo{Tenant: tenant, Actor: "test"})
+}
+
+func allocationRequest(count int) *models.AllocationRequest {
+	return &models.AllocationRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPVersion: "ipv4", Count: count}
+}
+
+func TestConcurrentAllocationsNeverShareAnAddress(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/24")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+
+	const workers, count = 24, 3
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var granted []string
+	var failures []error
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := service.AllocateIPs(tenantContext(models.DefaultTenant), allocationRequest(count))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures = append(failures, err)
+				return
+			}
+			granted = append(granted, response.AllocatedIPs...)
+		}()
+	}
+	wg.Wait()
+
+	// Giving up after repeated conflicts is allowed, anything else is not
+	for _, err := range failures {
+		if !errors.Is(err, ErrConflict) {
+			t.Fatalf("AllocateIPs failed with %v, want only concurrent-update conflicts", err)
+		}
+	}
+	if len(granted) != (workers-len(failures))*count {
+		t.Fatalf("granted %d IPs to %d successful requests of %d", len(granted), workers-len(failures), count)
+	}
+
+	seen := make(map[string]bool, len(granted))
+	for _, ip := range granted {
+		if seen[ip] {
+			t.Fatalf("%s was handed out twice", ip)
+		}
+		seen[ip] = true
+	}
+
+	stored, err := repo.CountIPs(context.Background(), storage.IPFilter{Tenant: models.DefaultTenant})
+	if err != nil {
+		t.Fatalf("CountIPs: %v", err)
+	}
+	if stored != int64(len(granted)) {
+		t.Fatalf("stored %d IP documents, granted %d IPs", stored, len(granted))
+	}
+}
+
+// claimingRepository lets a concurrent request win the first insert: it stores the first
+// candidate for another owner and reports the duplicate
+type claimingRepository struct {
+	storage.Repository
+	mu      sync.Mutex
+	claimed string
+	inserts int
+}
+
+func (r *claimingRepository) InsertIPs(ctx context.Context, docs []models.IPAllocation) error {
+	r.mu.Lock()
+	r.inserts++
+	first := r.inserts == 1
+	r.mu.Unlock()
+
+	if first {
+		rival := docs[0]
+		rival.Owner = "rival"
+		if err := r.Repository.InsertIPs(ctx, []models.IPAllocation{rival}); err != nil {
+			return err
+		}
+		r.claimed = rival.IPAddress
+		return storage.ErrDuplicate
+	}
+	return r.Repository.InsertIPs(ctx, docs)
+}
+
+func TestAllocationReselectsAfterConflict(t *testing.T) {
+	repo := &claimingRepository{Repository: storage.NewMemoryRepository()}
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/29")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+
+	response, err := service.AllocateIPs(tenantContext(models.DefaultTenant), allocationRequest(2))
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if repo.inserts != 2 {
+		t.Fatalf("inserted %d times, want a single retry", repo.inserts)
+	}
+	if repo.claimed != "10.0.1.1" {
+		t.Fatalf("rival claimed %q, want the first candidate", repo.claimed)
+	}
+
+	want := []string{"10.0.1.2", "10.0.1.3"}
+	if len(response.AllocatedIPs) != len(want) || response.AllocatedIPs[0] != want[0] || response.AllocatedIPs[1] != want[1] {
+		t.Fatalf("allocated %v after the conflict, want %v", response.AllocatedIPs, want)
+	}
+}
+
+// loadCountingRepository counts the reads of every document of a sub-zone, which only rebuilding
+// its free index does
+type loadCountingRepository struct {
+	storage.Repository
+	mu    sync.Mutex
+	loads int
+}
+
+func (r *loadCountingRepository) FindIPs(ctx context.Context, filter storage.IPFilter) ([]models.IPAllocation, error) {
+	if filter.SubZone != "" && len(filter.IPAddresses) == 0 && filter.Status == "" && filter.Owner == "" {
+		r.mu.Lock()
+		r.loads++
+		r.mu.Unlock()
+	}
+	return r.Repository.FindIPs(ctx, filter)
+}
+
+func TestFreeIndexIsKeptBetweenRequests(t *testing.T) {
+	repo := &loadCountingRepository{Repository: storage.NewMemoryRepository()}
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/24")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	ctx := tenantContext(models.DefaultTenant)
+
+	allocate := func(want ...string) {
+		t.Helper()
+		response, err := service.AllocateIPs(ctx, allocationRequest(len(want)))
+		if err != nil {
+			t.Fatalf("AllocateIPs: %v", err)
+		}
+		if len(response.AllocatedIPs) != len(want) || response.AllocatedIPs[0] != want[0] {
+			t.Fatalf("allocated %v, want %v", response.AllocatedIPs, want)
+		}
+	}
+
+	allocate("10.0.1.1", "10.0.1.2")
+	allocate("10.0.1.3", "10.0.1.4")
+	if _, err := service.DeallocateIPs(ctx, &models.DeallocationRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPAddresses: []string{"10.0.1.1"}}); err != nil {
+		t.Fatalf("DeallocateIPs: %v", err)
+	}
+	allocate("10.0.1.1")
+	if repo.loads != 1 {
+		t.Fatalf("read the sub-zone %d times, want its index built once and kept", repo.loads)
+	}
+
+	// A write from elsewhere, e.g. another replica, is picked up by rebuilding the index
+	template := ipTemplate(models.DefaultTenant, "r1", "z1", "s1", models.IPStatusAllocated)
+	if err := repo.InsertIPs(ctx, newIPAllocations(template, []string{"10.0.1.5"}, time.Now().Add(time.Second))); err != nil {
+		t.Fatalf("InsertIPs: %v", err)
+	}
+	allocate("10.0.1.6")
+	if repo.loads != 2 {
+		t.Fatalf("read the sub-zone %d times, want one rebuild after the outside write", repo.loads)
+	}
+}
+
+// BenchmarkAllocateIPs allocates one address at a time in a /16 with every other address held,
+// the worst case for the free index. The index is built before the timer starts and each
+// address is released again with the timer stopped.
+func BenchmarkAllocateIPs(b *testing.B) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(b, repo, models.DefaultTenant, "10.0.0.0/16")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	ctx := tenantContext(models.DefaultTenant)
+
+	var held []string
+	for i := 2; i < 1<<16-1; i += 2 {
+		held = append(held, fmt.Sprintf("10.0.%d.%d", i>>8, i&0xff))
+	}
+	template := ipTemplate(models.DefaultTenant, "r1", "z1", "s1", models.IPStatusAllocated)
+	if err := repo.InsertIPs(ctx, newIPAllocations(template, held, time.Now())); err != nil {
+		b.Fatalf("InsertIPs: %v", err)
+	}
+
+	req := &models.AllocationRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPVersion: "ipv4", Count: 1, AllocationStrategy: models.AllocationStrategyRandom}
+	allocateAndRelease := func() {
+		response, err := service.AllocateIPs(ctx, req)
+		if err != nil {
+			b.Fatalf("AllocateIPs: %v", err)
+		}
+		b.StopTimer()
+		release := &models.DeallocationRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPAddresses: response.AllocatedIPs}
+		if _, err := service.DeallocateIPs(ctx, release); err != nil {
+			b.Fatalf("DeallocateIPs: %v", err)
+		}
+		b.StartTimer()
+	}
+
+	allocateAndRelease()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		allocateAndRelease()
+	}
+}
+
+// storedIPs counts the IP documents of the default tenant
+func storedIPs(t *testing.T, repo storage.Repository) int64 {
+	t.Helper()
+	stored, err := repo.CountIPs(context.Background(), storage.IPFilter{Tenant: models.DefaultTenant})
+	if err != nil {
+		t.Fatalf("CountIPs: %v", err)
+	}
+	return stored
+}
+
+// rejectionReasons returns the reason of every rejection, keyed by IP
+func rejectionReasons(rejections []models.IPRejection) map[string]string {
+	reasons := make(map[string]string, len(rejections))
+	for _, rejection := range rejections {
+		reasons[rejection.IP] = rejection.Reason
+	}
+	return reasons
+}
+
+func TestAtomicAllocationWritesNothingWhenShort(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/29")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	ctx := tenantContext(models.DefaultTenant)
+
+	// Six usable addresses cannot satisfy eight
+	req := allocationRequest(8)
+	req.Atomic = true
+	_, err := service.AllocateIPs(ctx, req)
+	if domainErr, ok := AsError(err); !ok || domainErr.Code != CodeAddressesExhausted {
+		t.Fatalf("atomic AllocateIPs = %v, want %s", err, CodeAddressesExhausted)
+	}
+	rejections, _ := errorDetail(err, "rejections").([]models.IPRejection)
+	if reasons := rejectionReasons(rejections); reasons[""] != models.RejectionRangeExhausted {
+		t.Fatalf("rejections = %+v, want the shortfall as %s", rejections, models.RejectionRangeExhausted)
+	}
+	if stored := storedIPs(t, repo); stored != 0 {
+		t.Fatalf("stored %d IPs after a failed atomic request, want none", stored)
+	}
+
+	// Without atomic the same request commits what it got and reports the shortfall
+	response, err := service.AllocateIPs(ctx, allocationRequest(8))
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if len(response.AllocatedIPs) != 6 || rejectionReasons(response.Rejections)[""] != models.RejectionRangeExhausted {
+		t.Fatalf("allocated %v with rejections %+v, want 6 IPs and the shortfall", response.AllocatedIPs, response.Rejections)
+	}
+}
+
+func TestStrictPreferredRejectsUnavailablePreferredIPs(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/29")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	ctx := tenantContext(models.DefaultTenant)
+
+	if _, err := service.AllocateIPs(ctx, allocationRequest(1)); err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+
+	tests := []struct {
+		preferred string
+		reason    string
+	}{
+		{"10.0.1.1", models.RejectionInUse},
+		{"10.0.2.1", models.RejectionOutOfRange},
+		{"not-an-ip", models.RejectionInvalidIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			req := allocationRequest(2)
+			req.PreferredIPs = []string{"10.0.1.5", tt.preferred}
+			req.StrictPreferred = true
+			_, err := service.AllocateIPs(ctx, req)
+			if domainErr, ok := AsError(err); !ok || domainErr.Code != CodePreferredIPUnavailable || !errors.Is(err, ErrConflict) {
+				t.Fatalf("strict AllocateIPs = %v, want %s", err, CodePreferredIPUnavailable)
+			}
+			rejections, _ := errorDetail(err, "rejections").([]models.IPRejection)
+			if reason := rejectionReasons(rejections)[tt.preferred]; reason != tt.reason {
+				t.Fatalf("%s rejected as %q, want %q", tt.preferred, reason, tt.reason)
+			}
+			if stored := storedIPs(t, repo); stored != 1 {
+				t.Fatalf("stored %d IPs, want only the first allocation", stored)
+			}
+		})
+	}
+
+	// Without strict_preferred the unavailable preferred IP is skipped and reported
+	req := allocationRequest(2)
+	req.PreferredIPs = []string{"10.0.1.5", "10.0.1.1"}
+	response, err := service.AllocateIPs(ctx, req)
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if len(response.AllocatedIPs) != 2 || response.AllocatedIPs[0] != "10.0.1.5" {
+		t.Fatalf("allocated %v, want 10.0.1.5 and a replacement", response.AllocatedIPs)
+	}
+	if reason := rejectionReasons(response.Rejections)["10.0.1.1"]; reason != models.RejectionInUse {
+		t.Fatalf("10.0.1.1 rejected as %q, want %q", reason, models.RejectionInUse)
+	}
+}
+
+func TestHostPairsWhenOneFamilyRunsOut(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	// Two usable IPv4 addresses, plenty of IPv6
+	createDualStackSubZone(t, repo, models.DefaultTenant, "10.0.1.0/30", "fd00::/64")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	ctx := tenantContext(models.DefaultTenant)
+
+	pairsRequest := func(count int) *models.AllocationRequest {
+		return &models.AllocationRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPVersion: "both", Count: count, HostPairs: true}
+	}
+
+	// An atomic request for more hosts than IPv4 addresses pairs nothing
+	req := pairsRequest(3)
+	req.Atomic = true
+	if _, err := service.AllocateIPs(ctx, req); !errors.Is(err, ErrExhausted) {
+		t.Fatalf("atomic AllocateIPs = %v, want exhausted", err)
+	}
+	if stored := storedIPs(t, repo); stored != 0 {
+		t.Fatalf("stored %d IPs after a failed atomic request, want none", stored)
+	}
+
+	response, err := service.AllocateIPs(ctx, pairsRequest(3))
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	wantPairs := [][2]string{{"10.0.1.1", "fd00::1"}, {"10.0.1.2", "fd00::2"}}
+	if len(response.HostPairs) != len(wantPairs) {
+		t.Fatalf("host pairs = %+v, want %v", response.HostPairs, wantPairs)
+	}
+	for i, want := range wantPairs {
+		if pair := response.HostPairs[i]; pair.IPv4 != want[0] || pair.IPv6 != want[1] || pair.PairID == "" {
+			t.Fatalf("host pair %d = %+v, want %v", i, pair, want)
+		}
+	}
+	// The third IPv6 address has no IPv4 partner: it is reported and not stored
+	if reason := rejectionReasons(response.Rejections)["fd00::3"]; reason != models.RejectionUnpaired {
+		t.Fatalf("fd00::3 rejected as %q, want %q in %+v", reason, models.RejectionUnpaired, response.Rejections)
+	}
+	if stored := storedIPs(t, repo); stored != 4 {
+		t.Fatalf("stored %d IPs, want the 4 paired ones", stored)
+	}
+	v6 := &models.AllocationRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPVersion: "ipv6", Count: 1}
+	if response, err := service.AllocateIPs(ctx, v6); err != nil || response.AllocatedIPs[0] != "fd00::3" {
+		t.Fatalf("next IPv6 allocation = %v, %v, want the dropped fd00::3", response, err)
+	}
+
+	docs, err := repo.FindIPs(context.Background(), storage.IPFilter{Tenant: models.DefaultTenant, IPAddresses: []string{"10.0.1.1", "fd00::1"}})
+	if err != nil {
+		t.Fatalf("FindIPs: %v", err)
+	}
+	for _, doc := range docs {
+		if doc.PairID != response.HostPairs[0].PairID {
+			t.Fatalf("%s stored with pair %q, want %q", doc.IPAddress, doc.PairID, response.HostPairs[0].PairID)
+		}
+	}
+
+	// Releasing one side with release_paired releases its partner too
+	release := &models.DeallocationRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPAddresses: []string{"10.0.1.1"}, ReleasePaired: true}
+	released, err := service.DeallocateIPs(ctx, release)
+	if err != nil {
+		t.Fatalf("DeallocateIPs: %v", err)
+	}
+	if len(released.ProcessedIPs) != 2 || released.ProcessedIPs[1] != "fd00::1" {
+		t.Fatalf("released %v, want 10.0.1.1 and its partner fd00::1", released.ProcessedIPs)
+	}
+
+	// Without it the partner stays allocated and loses the link
+	release = &models.DeallocationRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPAddresses: []string{"10.0.1.2"}}
+	if _, err := service.DeallocateIPs(ctx, release); err != nil {
+		t.Fatalf("DeallocateIPs: %v", err)
+	}
+	docs, err = repo.FindIPs(context.Background(), storage.IPFilter{Tenant: models.DefaultTenant, IPAddresses: []string{"fd00::2"}})
+	if err != nil || len(docs) != 1 || docs[0].PairedIP != "" || docs[0].PairID != "" {
+		t.Fatalf("partner left behind = %+v, %v, want fd00::2 allocated without a pair", docs, err)
+	}
+}
@@ -0,0 +1,294 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+const (
+	// apiKeyPrefix marks API key secrets so they are recognizable in configs and secret scanners
+	apiKeyPrefix      = "ipa_"
+	apiKeySecretBytes = 32
+	// apiKeyDisplayLength is the length of the key prefix kept in clear to tell keys apart
+	apiKeyDisplayLength = len(apiKeyPrefix) + 8
+
+	// apiKeyTouchInterval bounds how often last_used_at is written for a busy key
+	apiKeyTouchInterval = time.Minute
+
+	// BootstrapKeyName names the admin key created from the configured bootstrap secret
+	BootstrapKeyName = "bootstrap"
+	// BootstrapActor is recorded as the creator of the bootstrap key
+	BootstrapActor = "system:bootstrap"
+)
+
+var (
+	// ErrNoCredentials is returned by authenticators when the request carries no credentials
+	// they understand
+	ErrNoCredentials = errors.New("no credentials supplied")
+	// ErrInvalidCredentials is returned when the credentials are unknown, malformed or expired
+	ErrInvalidCredentials = errors.New("invalid or expired credentials")
+)
+
+// APIKeyService manages API keys and authenticates the callers presenting them
+type APIKeyService struct {
+	repo   storage.Repository
+	audit  *AuditService
+	logger *zap.Logger
+}
+
+func NewAPIKeyService(repo storage.Repository, logger *zap.Logger) *APIKeyService {
+	return &APIKeyService{
+		repo:   repo,
+		audit:  NewAuditService(repo, logger),
+		logger: logger,
+	}
+}
+
+// log returns the request-scoped logger of ctx, falling back to the service logger
+func (s *APIKeyService) log(ctx context.Context) *zap.Logger {
+	return LoggerFromContext(ctx, s.logger)
+}
+
+// hashAPIKey returns the stored form of a key. Keys carry 256 random bits, so a plain SHA-256
+// is enough and keeps lookups by hash possible.
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateAPIKey() (string, error) {
+	secret := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func apiKeyPath(id primitive.ObjectID) string {
+	return "api_keys/" + id.Hex()
+}
+
+// boundTenant returns the tenant the caller is bound to, or "" for platform callers and when
+// authentication is disabled
+func boundTenant(ctx context.Context) string {
+	if principal := RequestInfoFromContext(ctx).Principal; principal != nil {
+		return principal.Tenant
+	}
+	return ""
+}
+
+// redacted returns a copy of the key without its hash, for the audit trail
+func redacted(key models.APIKey) models.APIKey {
+	key.KeyHash = ""
+	return key
+}
+
+// CreateKey generates a key for the request and stores its hash; the secret is only returned here.
+// Tenant-bound callers can only create keys of their own tenant.
+func (s *APIKeyService) CreateKey(ctx context.Context, req *models.CreateAPIKeyRequest) (response *models.APIKeyResponse, err error) {
+	s.log(ctx).Info("Creating API key",
+		zap.String("name", req.Name),
+		zap.String("role", req.Role),
+		zap.String("tenant", req.Tenant),
+		zap.String("region", req.Region),
+		zap.String("zone", req.Zone))
+
+	id := primitive.NewObjectID()
+	event := newAuditEvent(models.AuditActionCreate, models.AuditResourceAPIKey, apiKeyPath(id))
+	event.Tenant = req.Tenant
+	defer func() { s.audit.recordAPIKey(ctx, event, response, err) }()
+
+	if tenant := boundTenant(ctx); tenant != "" {
+		if req.Tenant != "" && req.Tenant != tenant {
+			return nil, forbidden(CodeTenantMismatch, "Keys can only be created for your own tenant")
+		}
+		req.Tenant = tenant
+		event.Tenant = tenant
+	}
+
+	// A region scope refers to a region of the tenant the request operates on
+	if req.Tenant == "" && req.Region != "" {
+		req.Tenant = TenantFromContext(ctx)
+		event.Tenant = req.Tenant
+	}
+
+	if req.Tenant != "" {
+		exists, err := tenantExists(ctx, s.repo, req.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, notFound(CodeTenantNotFound, "Tenant not found: %s", req.Tenant)
+		}
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return nil, validationFailed(CodeInvalidLease, "expires_at must be in the future")
+	}
+
+	if req.Region != "" {
+		region, err := s.repo.GetRegion(ctx, req.Tenant, req.Region)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		if err != nil || (req.Zone != "" && findZone(&region, req.Zone) == nil) {
+			return nil, notFound(CodeScopeNotFound, "Scope not found: %s", scopePath(req.Region, req.Zone))
+		}
+	}
+
+	secret, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	key := models.APIKey{
+		ID:        id,
+		Name:      req.Name,
+		Prefix:    secret[:apiKeyDisplayLength],
+		KeyHash:   hashAPIKey(secret),
+		Role:      req.Role,
+		Tenant:    req.Tenant,
+		Region:    req.Region,
+		Zone:      req.Zone,
+		CreatedBy: RequestInfoFromContext(ctx).Actor,
+		CreatedAt: time.Now(),
+		ExpiresAt: req.ExpiresAt,
+	}
+	if key.CreatedBy == "" {
+		key.CreatedBy = AnonymousActor
+	}
+
+	if err := s.repo.CreateAPIKey(ctx, &key); err != nil {
+		if errors.Is(err, storage.ErrDuplicate) {
+			return nil, conflict(CodeAPIKeyExists, "An API key named %s already exists", req.Name)
+		}
+		s.log(ctx).Error("Failed to insert API key",
+			zap.Error(err),
+			zap.String("name", req.Name))
+		return nil, err
+	}
+	event.After = redacted(key)
+
+	s.log(ctx).Info("API key created successfully",
+		zap.String("id", id.Hex()),
+		zap.String("name", key.Name),
+		zap.String("prefix", key.Prefix))
+
+	return &models.APIKeyResponse{
+		Success:   true,
+		Key:       secret,
+		Data:      &key,
+		Message:   "API key created successfully. Store the key now, it cannot be retrieved again",
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// ListKeys returns every key, oldest first, without secrets or hashes. Tenant-bound callers
+// only see the keys of their tenant.
+func (s *APIKeyService) ListKeys(ctx context.Context) ([]models.APIKey, error) {
+	keys, err := s.repo.ListAPIKeys(ctx, boundTenant(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		keys = []models.APIKey{}
+	}
+	return keys, nil
+}
+
+// DeleteKey revokes a key; requests presenting it are rejected from then on
+func (s *APIKeyService) DeleteKey(ctx context.Context, id string) (response *models.APIKeyResponse, err error) {
+	s.log(ctx).Info("Deleting API key", zap.String("id", id))
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, validationFailed(CodeInvalidID, "Invalid API key id: %s", id)
+	}
+
+	event := newAuditEvent(models.AuditActionDelete, models.AuditResourceAPIKey, apiKeyPath(objectID))
+	defer func() { s.audit.recordAPIKey(ctx, event, response, err) }()
+
+	// Tenant-bound callers can only revoke the keys of their tenant
+	before, err := s.repo.DeleteAPIKey(ctx, objectID, boundTenant(ctx))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeAPIKeyNotFound, "API key not found")
+	}
+	if err != nil {
+		s.log(ctx).Error("Failed to delete API key",
+			zap.Error(err),
+			zap.String("id", id))
+		return nil, err
+	}
+	event.Before = redacted(before)
+	event.Tenant = before.Tenant
+
+	s.log(ctx).Info("API key deleted successfully",
+		zap.String("id", id),
+		zap.String("name", before.Name))
+
+	return &models.APIKeyResponse{
+		Success:   true,
+		Data:      &before,
+		Message:   "API key deleted successfully",
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// Authenticate returns the principal of the key, or ErrInvalidCredentials when the key is
+// unknown or expired
+func (s *APIKeyService) Authenticate(ctx context.Context, secret string) (*models.Principal, error) {
+	key, err := s.repo.FindAPIKeyByHash(ctx, hashAPIKey(secret))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(now) {
+		return nil, ErrInvalidCredentials
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.repo.TouchAPIKey(ctx, key.ID, now); err != nil {
+			s.log(ctx).Warn("Failed to record API key use",
+				zap.Error(err),
+				zap.String("name", key.Name))
+		}
+	}
+
+	return key.Principal(), nil
+}
+
+// EnsureBootstrapKey stores secret as the unscoped platform admin key named bootstrap, replacing
+// the previous bootstrap secret, so that the first tenants and keys can be created through the API
+func (s *APIKeyService) EnsureBootstrapKey(ctx context.Context, secret string) error {
+	return s.repo.UpsertAPIKey(ctx, models.APIKey{
+		Name:      BootstrapKeyName,
+		Prefix:    secret[:min(len(secret), apiKeyDisplayLength)],
+		KeyHash:   hashAPIKey(secret),
+		Role:      models.RoleAdmin,
+		CreatedBy: BootstrapActor,
+		CreatedAt: time.Now(),
+	})
+}
+
+// scopePath renders a key scope for messages
+func scopePath(regionName, zoneName string) string {
+	if zoneName == "" {
+		return regionPath(regionName)
+	}
+	return zonePath(regionName, zoneName)
+}
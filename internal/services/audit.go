@@ -0,0 +1,244 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"ip-allocator-api/internal/metrics"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.uber.org/zap"
+)
+
+const (
+	// auditWriteTimeout bounds the write of an audit event, which also runs when the
+	// request context has already expired
+	auditWriteTimeout = 5 * time.Second
+
+	// auditIPBatchSize bounds the IP documents snapshotted in one event
+	auditIPBatchSize = 500
+
+	defaultAuditQueryLimit = 100
+	maxAuditQueryLimit     = 1000
+)
+
+// AuditService appends audit events for every IPAM mutation and queries them
+type AuditService struct {
+	repo   storage.AuditRepository
+	logger *zap.Logger
+}
+
+func NewAuditService(repo storage.AuditRepository, logger *zap.Logger) *AuditService {
+	return &AuditService{
+		repo:   repo,
+		logger: logger,
+	}
+}
+
+// log returns the request-scoped logger of ctx, falling back to the service logger
+func (s *AuditService) log(ctx context.Context) *zap.Logger {
+	return LoggerFromContext(ctx, s.logger)
+}
+
+// newAuditEvent starts an event for a mutation of the resource at path
+func newAuditEvent(action, resourceType, path string) *models.AuditEvent {
+	return &models.AuditEvent{
+		Action:       action,
+		ResourceType: resourceType,
+		ResourcePath: path,
+	}
+}
+
+// regionPath, zonePath and subZonePath build resource paths matching the API routes
+func regionPath(regionName string) string {
+	return "regions/" + regionName
+}
+
+func zonePath(regionName, zoneName string) string {
+	return regionPath(regionName) + "/zones/" + zoneName
+}
+
+func subZonePath(regionName, zoneName, subZoneName string) string {
+	return zonePath(regionName, zoneName) + "/subzones/" + subZoneName
+}
+
+// Record stamps the event with the caller from the context and appends it. Events belong to the
+// request's tenant unless the caller set another one. A failed write is logged rather than
+// returned so that auditing never changes the outcome of the mutation.
+func (s *AuditService) Record(ctx context.Context, event *models.AuditEvent) {
+	info := RequestInfoFromContext(ctx)
+	event.Timestamp = time.Now()
+	if event.Tenant == "" {
+		event.Tenant = TenantFromContext(ctx)
+	}
+	event.Actor = info.Actor
+	if event.Actor == "" {
+		event.Actor = AnonymousActor
+	}
+	event.ClientIP = info.ClientIP
+	event.RequestID = info.RequestID
+
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), auditWriteTimeout)
+	defer cancel()
+
+	if err := s.repo.InsertAuditEvent(writeCtx, event); err != nil {
+		s.log(ctx).Error("Failed to record audit event",
+			zap.Error(err),
+			zap.String("action", event.Action),
+			zap.String("tenant", event.Tenant),
+			zap.String("resource_path", event.ResourcePath),
+			zap.String("actor", event.Actor),
+			zap.String("outcome", event.Outcome))
+		return
+	}
+
+	s.log(ctx).Debug("Audit event recorded",
+		zap.String("action", event.Action),
+		zap.String("resource_path", event.ResourcePath),
+		zap.String("actor", event.Actor),
+		zap.String("outcome", event.Outcome))
+}
+
+// recordOutcome sets the outcome of the event from the result of the mutation and records it.
+// Domain errors mean the mutation was rejected rather than failed.
+func (s *AuditService) recordOutcome(ctx context.Context, event *models.AuditEvent, success bool, message string, err error) {
+	_, rejected := AsError(err)
+	switch {
+	case rejected:
+		event.Outcome = models.AuditOutcomeRejected
+		event.Message = err.Error()
+	case err != nil:
+		event.Outcome = models.AuditOutcomeError
+		event.Message = err.Error()
+	case success:
+		event.Outcome = models.AuditOutcomeSuccess
+		event.Message = message
+	default:
+		event.Outcome = models.AuditOutcomeRejected
+		event.Message = message
+	}
+	s.Record(ctx, event)
+}
+
+// recordCRUD records the outcome of a region, zone or sub-zone mutation
+func (s *AuditService) recordCRUD(ctx context.Context, event *models.AuditEvent, response *models.CRUDResponse, err error) {
+	if response == nil {
+		s.recordOutcome(ctx, event, false, "", err)
+		return
+	}
+	s.recordOutcome(ctx, event, response.Success, response.Message, err)
+}
+
+// recordIPOperation records the outcome of a deallocation, reservation or renewal
+func (s *AuditService) recordIPOperation(ctx context.Context, event *models.AuditEvent, response *models.IPOperationResponse, err error) {
+	if response == nil {
+		if failedIPs, ok := errorDetail(err, "failed_ips").([]string); ok {
+			event.IPAddresses = append(event.IPAddresses, failedIPs...)
+		}
+		s.recordOutcome(ctx, event, false, "", err)
+		metrics.ObserveIPOperation(event.Action, event.Outcome, 0)
+		return
+	}
+	event.IPAddresses = append(event.IPAddresses, response.ProcessedIPs...)
+	event.IPAddresses = append(event.IPAddresses, response.FailedIPs...)
+	s.recordOutcome(ctx, event, response.Success, response.Message, err)
+	metrics.ObserveIPOperation(event.Action, event.Outcome, len(response.ProcessedIPs))
+}
+
+// recordAllocation records the outcome of an allocation
+func (s *AuditService) recordAllocation(ctx context.Context, event *models.AuditEvent, response *models.AllocationResponse, err error) {
+	if response == nil {
+		rejections, _ := errorDetail(err, "rejections").([]models.IPRejection)
+		event.IPAddresses = append(event.IPAddresses, rejectedIPs(rejections)...)
+		s.recordOutcome(ctx, event, false, "", err)
+		metrics.ObserveIPOperation(event.Action, event.Outcome, 0)
+		return
+	}
+	event.IPAddresses = append(event.IPAddresses, response.AllocatedIPs...)
+	event.IPAddresses = append(event.IPAddresses, rejectedIPs(response.Rejections)...)
+	s.recordOutcome(ctx, event, response.Success, response.Message, err)
+	metrics.ObserveIPOperation(event.Action, event.Outcome, len(response.AllocatedIPs))
+}
+
+// rejectedIPs returns the addresses named by rejections
+func rejectedIPs(rejections []models.IPRejection) []string {
+	var ips []string
+	for _, rejection := range rejections {
+		if rejection.IP != "" {
+			ips = append(ips, rejection.IP)
+		}
+	}
+	return ips
+}
+
+// recordAPIKey records the outcome of an API key creation or deletion
+func (s *AuditService) recordAPIKey(ctx context.Context, event *models.AuditEvent, response *models.APIKeyResponse, err error) {
+	if response == nil {
+		s.recordOutcome(ctx, event, false, "", err)
+		return
+	}
+	s.recordOutcome(ctx, event, response.Success, response.Message, err)
+}
+
+// recordTenant records the outcome of a tenant creation, update or deletion
+func (s *AuditService) recordTenant(ctx context.Context, event *models.AuditEvent, response *models.TenantResponse, err error) {
+	if response == nil {
+		s.recordOutcome(ctx, event, false, "", err)
+		return
+	}
+	s.recordOutcome(ctx, event, response.Success, response.Message, err)
+}
+
+// Query returns the events of the request's tenant matching the query, newest first
+func (s *AuditService) Query(ctx context.Context, query *models.AuditQuery) ([]models.AuditEvent, error) {
+	raws, err := s.repo.FindAuditEvents(ctx, auditFilter(ctx, query))
+	if err != nil {
+		return nil, err
+	}
+
+	events := []models.AuditEvent{}
+	for _, raw := range raws {
+		var event models.AuditEvent
+		if err := decodeAuditEvent(raw, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// auditFilter selects the events of the request's tenant matching the query, capped at the
+// query limit
+func auditFilter(ctx context.Context, query *models.AuditQuery) storage.AuditFilter {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultAuditQueryLimit
+	}
+	if limit > maxAuditQueryLimit {
+		limit = maxAuditQueryLimit
+	}
+
+	return storage.AuditFilter{
+		Tenant:       TenantFromContext(ctx),
+		ResourcePath: query.ResourcePath,
+		IPAddress:    query.IPAddress,
+		Actor:        query.Actor,
+		Since:        query.Since,
+		Until:        query.Until,
+		Limit:        int64(limit),
+	}
+}
+
+// decodeAuditEvent decodes an event with the before and after snapshots as maps, which
+// render as JSON objects rather than key/value lists
+func decodeAuditEvent(raw bson.Raw, event *models.AuditEvent) error {
+	decoder, err := bson.NewDecoder(bsonrw.NewBSONDocumentReader(raw))
+	if err != nil {
+		return err
+	}
+	decoder.DefaultDocumentM()
+	return decoder.Decode(event)
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+// recordedIPEvent is a stored IP audit event with its snapshots decoded as IP documents
+type recordedIPEvent struct {
+	ipAuditEvent `bson:"-"`
+	IPAddresses  []string `bson:"ip_addresses"`
+	Outcome      string   `bson:"outcome"`
+}
+
+// recordedIPEvents returns the stored events of the action, newest first
+func recordedIPEvents(t *testing.T, repo storage.AuditRepository, action string) []recordedIPEvent {
+	t.Helper()
+	raws, err := repo.FindAuditEvents(context.Background(), storage.AuditFilter{Tenant: models.DefaultTenant, ResourceType: models.AuditResourceIP})
+	if err != nil {
+		t.Fatalf("FindAuditEvents: %v", err)
+	}
+
+	var events []recordedIPEvent
+	for _, raw := range raws {
+		var event recordedIPEvent
+		if err := bson.Unmarshal(raw, &event); err != nil {
+			t.Fatalf("decode audit event: %v", err)
+		}
+		if err := bson.Unmarshal(raw, &event.ipAuditEvent); err != nil {
+			t.Fatalf("decode audit event snapshots: %v", err)
+		}
+		if event.Action == action {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// snapshotIPs returns the addresses of the documents in an audit snapshot
+func snapshotIPs(docs []models.IPAllocation) []string {
+	var ips []string
+	for _, doc := range docs {
+		ips = append(ips, doc.IPAddress)
+	}
+	return ips
+}
+
+func TestDeallocationAuditRecordsReleasedDocuments(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/24")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	ctx := WithRequestInfo(context.Background(), RequestInfo{Tenant: models.DefaultTenant, Actor: "alice", ClientIP: "192.0.2.7", RequestID: "req-1"})
+
+	req := allocationRequest(2)
+	req.Owner = "web"
+	if _, err := service.AllocateIPs(ctx, req); err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+
+	release := &models.DeallocationRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPAddresses: []string{"10.0.1.1", "10.0.1.9"}}
+	if _, err := service.DeallocateIPs(ctx, release); err != nil {
+		t.Fatalf("DeallocateIPs: %v", err)
+	}
+
+	events := recordedIPEvents(t, repo, models.AuditActionDeallocate)
+	if len(events) != 1 {
+		t.Fatalf("recorded %d deallocation events, want 1", len(events))
+	}
+	event := events[0]
+	if event.Outcome != models.AuditOutcomeSuccess || event.Actor != "alice" || event.ClientIP != "192.0.2.7" || event.RequestID != "req-1" {
+		t.Fatalf("event = %+v, want a success by alice from 192.0.2.7 in req-1", event)
+	}
+	// Both the released and the failed address name the event
+	if !reflect.DeepEqual(event.IPAddresses, []string{"10.0.1.1", "10.0.1.9"}) {
+		t.Fatalf("event IPs = %v, want the released and the failed address", event.IPAddresses)
+	}
+	// Before holds the released document as it was; nothing exists after a release
+	if len(event.Before) != 1 || event.Before[0].IPAddress != "10.0.1.1" || event.Before[0].Status != models.IPStatusAllocated || event.Before[0].Owner != "web" {
+		t.Fatalf("before = %+v, want the allocated document of 10.0.1.1 owned by web", event.Before)
+	}
+	if len(event.After) != 0 {
+		t.Fatalf("after = %+v, want nothing", event.After)
+	}
+
+	// Releasing nothing is a rejection without a snapshot
+	release.IPAddresses = []string{"10.0.1.9"}
+	if _, err := service.DeallocateIPs(ctx, release); err != nil {
+		t.Fatalf("DeallocateIPs: %v", err)
+	}
+	events = recordedIPEvents(t, repo, models.AuditActionDeallocate)
+	if len(events) != 2 || events[0].Outcome != models.AuditOutcomeRejected || len(events[0].Before) != 0 {
+		t.Fatalf("latest event = %+v, want a rejection without snapshots", events[0])
+	}
+}
@@ -2,69 +2,78 @@ package services
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"time"
 
 	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
 	"ip-allocator-api/internal/utils"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.uber.org/zap"
 )
 
 type CRUDService struct {
-	collection *mongo.Collection
-	logger     *zap.Logger
+	repo   storage.Repository
+	ips    *ipAllocationStore
+	audit  *AuditService
+	logger *zap.Logger
 }
 
-func NewCRUDService(db *mongo.Database, logger *zap.Logger) *CRUDService {
+func NewCRUDService(repo storage.Repository, logger *zap.Logger) *CRUDService {
 	return &CRUDService{
-		collection: db.Collection(models.RegionCollection),
-		logger:     logger,
+		repo:   repo,
+		ips:    newIPAllocationStore(repo, logger),
+		audit:  NewAuditService(repo, logger),
+		logger: logger,
 	}
 }
 
+// log returns the request-scoped logger of ctx, falling back to the service logger
+func (s *CRUDService) log(ctx context.Context) *zap.Logger {
+	return LoggerFromContext(ctx, s.logger)
+}
+
 // CreateRegion creates a new region with enhanced validation
-func (s *CRUDService) CreateRegion(ctx context.Context, req *models.CreateRegionRequest) (*models.CRUDResponse, error) {
-	s.logger.Info("Creating new region",
+func (s *CRUDService) CreateRegion(ctx context.Context, req *models.CreateRegionRequest) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.CreateRegion", req.Name, "", "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Creating new region",
 		zap.String("name", req.Name),
 		zap.String("ipv4_cidr", req.IPv4CIDR),
 		zap.String("ipv6_cidr", req.IPv6CIDR))
 
-	// Check if region already exists
-	filter := bson.M{"name": req.Name}
-	count, err := s.collection.CountDocuments(ctx, filter)
+	event := newAuditEvent(models.AuditActionCreate, models.AuditResourceRegion, regionPath(req.Name))
+	defer func() { s.audit.recordCRUD(ctx, event, response, err) }()
+
+	tenant := TenantFromContext(ctx)
+	exists, err := tenantExists(ctx, s.repo, tenant)
 	if err != nil {
 		return nil, err
 	}
-	if count > 0 {
-		return &models.CRUDResponse{
-			Success:   false,
-			Message:   "Region with this name already exists",
-			Timestamp: time.Now(),
-		}, nil
+	if !exists {
+		return nil, notFound(CodeTenantNotFound, "Tenant not found: %s", tenant)
+	}
+
+	// Check if region already exists in the tenant
+	_, err = s.repo.GetRegion(ctx, tenant, req.Name)
+	if err == nil {
+		return nil, conflict(CodeRegionExists, "Region with this name already exists")
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
 	}
 
 	// Validate CIDR blocks if provided
 	if req.IPv4CIDR != "" {
 		if _, err := utils.ParseCIDR(req.IPv4CIDR); err != nil {
-			return &models.CRUDResponse{
-				Success:   false,
-				Message:   "Invalid IPv4 CIDR: " + err.Error(),
-				Timestamp: time.Now(),
-			}, nil
+			return nil, validationFailed(CodeInvalidCIDR, "Invalid IPv4 CIDR: %v", err)
 		}
 	}
 	if req.IPv6CIDR != "" {
 		if _, err := utils.ParseCIDR(req.IPv6CIDR); err != nil {
-			return &models.CRUDResponse{
-				Success:   false,
-				Message:   "Invalid IPv6 CIDR: " + err.Error(),
-				Timestamp: time.Now(),
-			}, nil
+			return nil, validationFailed(CodeInvalidCIDR, "Invalid IPv6 CIDR: %v", err)
 		}
 	}
 
@@ -72,6 +81,7 @@ func (s *CRUDService) CreateRegion(ctx context.Context, req *models.CreateRegion
 	region := models.Region{
 		ID:        primitive.NewObjectID(),
 		Name:      req.Name,
+		Tenant:    tenant,
 		IPv4CIDR:  req.IPv4CIDR,
 		IPv6CIDR:  req.IPv6CIDR,
 		Zones:     []models.Zone{},
@@ -79,17 +89,21 @@ func (s *CRUDService) CreateRegion(ctx context.Context, req *models.CreateRegion
 		UpdatedAt: time.Now(),
 	}
 
-	_, err = s.collection.InsertOne(ctx, region)
+	err = s.repo.CreateRegion(ctx, &region)
+	if errors.Is(err, storage.ErrDuplicate) {
+		return nil, conflict(CodeRegionExists, "Region with this name already exists")
+	}
 	if err != nil {
-		s.logger.Error("Failed to create region",
+		s.log(ctx).Error("Failed to create region",
 			zap.Error(err),
 			zap.String("name", req.Name))
 		return nil, err
 	}
 
-	s.logger.Info("Region created successfully",
+	s.log(ctx).Info("Region created successfully",
 		zap.String("name", req.Name),
 		zap.String("id", region.ID.Hex()))
+	event.After = region
 
 	return &models.CRUDResponse{
 		Success:   true,
@@ -100,61 +114,63 @@ func (s *CRUDService) CreateRegion(ctx context.Context, req *models.CreateRegion
 }
 
 // UpdateRegion updates an existing region
-func (s *CRUDService) UpdateRegion(ctx context.Context, regionName string, req *models.UpdateRegionRequest) (*models.CRUDResponse, error) {
-	s.logger.Info("Updating region",
+func (s *CRUDService) UpdateRegion(ctx context.Context, regionName string, req *models.UpdateRegionRequest) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.UpdateRegion", regionName, "", "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Updating region",
 		zap.String("name", regionName),
 		zap.Any("update", req))
 
-	update := bson.M{
-		"$set": bson.M{
-			"updated_at": time.Now(),
-		},
-	}
+	event := newAuditEvent(models.AuditActionUpdate, models.AuditResourceRegion, regionPath(regionName))
+	defer func() { s.audit.recordCRUD(ctx, event, response, err) }()
 
-	if req.Name != "" {
-		update["$set"].(bson.M)["name"] = req.Name
+	now := time.Now()
+	changes, err := hierarchyChanges(req.Name, req.IPv4CIDR, req.IPv6CIDR, now)
+	if err != nil {
+		return nil, err
 	}
-	if req.IPv4CIDR != "" {
-		// Validate CIDR
-		if _, err := utils.ParseCIDR(req.IPv4CIDR); err != nil {
-			return &models.CRUDResponse{
-				Success:   false,
-				Message:   "Invalid IPv4 CIDR: " + err.Error(),
-				Timestamp: time.Now(),
-			}, nil
-		}
-		update["$set"].(bson.M)["ipv4_cidr"] = req.IPv4CIDR
+
+	// The region is returned as it was before the update for the audit trail
+	before, err := s.repo.UpdateRegion(ctx, TenantFromContext(ctx), regionName, changes)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeRegionNotFound, "Region not found")
 	}
-	if req.IPv6CIDR != "" {
-		// Validate CIDR
-		if _, err := utils.ParseCIDR(req.IPv6CIDR); err != nil {
-			return &models.CRUDResponse{
-				Success:   false,
-				Message:   "Invalid IPv6 CIDR: " + err.Error(),
-				Timestamp: time.Now(),
-			}, nil
-		}
-		update["$set"].(bson.M)["ipv6_cidr"] = req.IPv6CIDR
+	if errors.Is(err, storage.ErrDuplicate) {
+		return nil, conflict(CodeRegionExists, "Region with this name already exists")
 	}
-
-	filter := bson.M{"name": regionName}
-	result, err := s.collection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		s.logger.Error("Failed to update region",
+		s.log(ctx).Error("Failed to update region",
 			zap.Error(err),
 			zap.String("name", regionName))
 		return nil, err
 	}
 
-	if result.MatchedCount == 0 {
-		return &models.CRUDResponse{
-			Success:   false,
-			Message:   "Region not found",
-			Timestamp: time.Now(),
-		}, nil
+	after := before
+	if req.Name != "" {
+		after.Name = req.Name
+	}
+	if req.IPv4CIDR != "" {
+		after.IPv4CIDR = req.IPv4CIDR
+	}
+	if req.IPv6CIDR != "" {
+		after.IPv6CIDR = req.IPv6CIDR
+	}
+	after.UpdatedAt = now
+	event.Before = before
+	event.After = after
+
+	if req.Name != "" && req.Name != regionName {
+		filter := storage.IPFilter{Tenant: TenantFromContext(ctx), Region: regionName}
+		if err := s.ips.renameMatching(ctx, filter, storage.IPLocation{Region: req.Name}); err != nil {
+			s.log(ctx).Error("Failed to rename region in IP documents",
+				zap.Error(err),
+				zap.String("name", regionName))
+			return nil, err
+		}
 	}
 
-	s.logger.Info("Region updated successfully",
+	s.log(ctx).Info("Region updated successfully",
 		zap.String("name", regionName))
 
 	return &models.CRUDResponse{
@@ -165,27 +181,35 @@ func (s *CRUDService) UpdateRegion(ctx context.Context, regionName string, req *
 }
 
 // DeleteRegion deletes a region
-func (s *CRUDService) DeleteRegion(ctx context.Context, regionName string) (*models.CRUDResponse, error) {
-	s.logger.Info("Deleting region", zap.String("name", regionName))
+func (s *CRUDService) DeleteRegion(ctx context.Context, regionName string) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.DeleteRegion", regionName, "", "")
+	defer func() { endSpan(span, err) }()
 
-	filter := bson.M{"name": regionName}
-	result, err := s.collection.DeleteOne(ctx, filter)
+	s.log(ctx).Info("Deleting region", zap.String("name", regionName))
+
+	event := newAuditEvent(models.AuditActionDelete, models.AuditResourceRegion, regionPath(regionName))
+	defer func() { s.audit.recordCRUD(ctx, event, response, err) }()
+
+	before, err := s.repo.DeleteRegion(ctx, TenantFromContext(ctx), regionName)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeRegionNotFound, "Region not found")
+	}
 	if err != nil {
-		s.logger.Error("Failed to delete region",
+		s.log(ctx).Error("Failed to delete region",
 			zap.Error(err),
 			zap.String("name", regionName))
 		return nil, err
 	}
+	event.Before = before
 
-	if result.DeletedCount == 0 {
-		return &models.CRUDResponse{
-			Success:   false,
-			Message:   "Region not found",
-			Timestamp: time.Now(),
-		}, nil
+	if err := s.deleteIPDocuments(ctx, regionPath(regionName), storage.IPFilter{Tenant: TenantFromContext(ctx), Region: regionName}); err != nil {
+		s.log(ctx).Error("Failed to delete IP documents for region",
+			zap.Error(err),
+			zap.String("name", regionName))
+		return nil, err
 	}
 
-	s.logger.Info("Region deleted successfully",
+	s.log(ctx).Info("Region deleted successfully",
 		zap.String("name", regionName))
 
 	return &models.CRUDResponse{
@@ -196,68 +220,52 @@ func (s *CRUDService) DeleteRegion(ctx context.Context, regionName string) (*mod
 }
 
 // CreateZone creates a new zone with enhanced CIDR validation
-func (s *CRUDService) CreateZone(ctx context.Context, regionName string, req *models.CreateZoneRequest) (*models.CRUDResponse, error) {
-	s.logger.Info("Creating new zone",
+func (s *CRUDService) CreateZone(ctx context.Context, regionName string, req *models.CreateZoneRequest) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.CreateZone", regionName, req.Name, "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Creating new zone",
 		zap.String("region", regionName),
 		zap.String("zone", req.Name),
 		zap.String("ipv4_cidr", req.IPv4CIDR),
 		zap.String("ipv6_cidr", req.IPv6CIDR))
 
+	event := newAuditEvent(models.AuditActionCreate, models.AuditResourceZone, zonePath(regionName, req.Name))
+	defer func() { s.audit.recordCRUD(ctx, event, response, err) }()
+
 	// Get the region
-	var region models.Region
-	filter := bson.M{"name": regionName}
-	err := s.collection.FindOne(ctx, filter).Decode(&region)
+	region, err := s.repo.GetRegion(ctx, TenantFromContext(ctx), regionName)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return &models.CRUDResponse{
-				Success:   false,
-				Message:   "Region not found",
-				Timestamp: time.Now(),
-			}, nil
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, notFound(CodeRegionNotFound, "Region not found")
 		}
 		return nil, err
 	}
 
 	// Enhanced CIDR validation against region CIDRs
 	if err := utils.ValidateZoneCIDRHierarchy(region.IPv4CIDR, region.IPv6CIDR, req.IPv4CIDR, req.IPv6CIDR); err != nil {
-		s.logger.Warn("Zone CIDR validation failed",
+		s.log(ctx).Warn("Zone CIDR validation failed",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.String("zone", req.Name))
-		return &models.CRUDResponse{
-			Success:   false,
-			Message:   "CIDR validation failed: " + err.Error(),
-			Timestamp: time.Now(),
-		}, nil
+		return nil, cidrOutOfRange("CIDR validation failed: %v", err)
 	}
 
 	// Check for zone name conflicts
 	for _, existingZone := range region.Zones {
 		if existingZone.Name == req.Name {
-			return &models.CRUDResponse{
-				Success:   false,
-				Message:   "Zone with this name already exists in the region",
-				Timestamp: time.Now(),
-			}, nil
+			return nil, conflict(CodeZoneExists, "Zone with this name already exists in the region")
 		}
 
 		// Check for CIDR overlaps with existing zones
 		if req.IPv4CIDR != "" && existingZone.IPv4CIDR != "" {
 			if overlap, err := utils.CheckCIDROverlap(req.IPv4CIDR, existingZone.IPv4CIDR); err == nil && overlap {
-				return &models.CRUDResponse{
-					Success:   false,
-					Message:   fmt.Sprintf("IPv4 CIDR overlaps with existing zone '%s'", existingZone.Name),
-					Timestamp: time.Now(),
-				}, nil
+				return nil, conflict(CodeCIDROverlap, "IPv4 CIDR overlaps with existing zone '%s'", existingZone.Name)
 			}
 		}
 		if req.IPv6CIDR != "" && existingZone.IPv6CIDR != "" {
 			if overlap, err := utils.CheckCIDROverlap(req.IPv6CIDR, existingZone.IPv6CIDR); err == nil && overlap {
-				return &models.CRUDResponse{
-					Success:   false,
-					Message:   fmt.Sprintf("IPv6 CIDR overlaps with existing zone '%s'", existingZone.Name),
-					Timestamp: time.Now(),
-				}, nil
+				return nil, conflict(CodeCIDROverlap, "IPv6 CIDR overlaps with existing zone '%s'", existingZone.Name)
 			}
 		}
 	}
@@ -274,28 +282,23 @@ func (s *CRUDService) CreateZone(ctx context.Context, regionName string, req *mo
 	}
 
 	// Update region with new zone
-	update := bson.M{
-		"$push": bson.M{
-			"zones": newZone,
-		},
-		"$set": bson.M{
-			"updated_at": time.Now(),
-		},
+	err = s.repo.AddZone(ctx, region.Tenant, regionName, newZone, time.Time{})
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeRegionNotFound, "Region not found")
 	}
-
-	_, err = s.collection.UpdateOne(ctx, filter, update)
 	if err != nil {
-		s.logger.Error("Failed to create zone",
+		s.log(ctx).Error("Failed to create zone",
 			zap.Error(err),
 			zap.String("region", regionName),
 			zap.String("zone", req.Name))
 		return nil, err
 	}
 
-	s.logger.Info("Zone created successfully",
+	s.log(ctx).Info("Zone created successfully",
 		zap.String("region", regionName),
 		zap.String("zone", req.Name),
 		zap.String("id", newZone.ID.Hex()))
+	event.After = newZone
 
 	return &models.CRUDResponse{
 		Success:   true,
@@ -306,25 +309,28 @@ func (s *CRUDService) CreateZone(ctx context.Context, regionName string, req *mo
 }
 
 // GetZone retrieves a specific zone
-func (s *CRUDService) GetZone(ctx context.Context, regionName, zoneName string) (*models.CRUDResponse, error) {
-	s.logger.Debug("Getting zone",
+func (s *CRUDService) GetZone(ctx context.Context, regionName, zoneName string) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.GetZone", regionName, zoneName, "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Debug("Getting zone",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName))
 
-	var region models.Region
-	filter := bson.M{"name": regionName}
-	err := s.collection.FindOne(ctx, filter).Decode(&region)
+	region, err := s.repo.GetRegion(ctx, TenantFromContext(ctx), regionName)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return &models.CRUDResponse{
-				Success:   false,
-				Message:   "Region not found",
-				Timestamp: time.Now(),
-			}, nil
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, notFound(CodeRegionNotFound, "Region not found")
 		}
 		return nil, err
 	}
 
+	regions := []models.Region{region}
+	if err := s.ips.loadRegions(ctx, regions); err != nil {
+		return nil, err
+	}
+	region = regions[0]
+
 	// Find the zone
 	for _, zone := range region.Zones {
 		if zone.Name == zoneName {
@@ -337,70 +343,61 @@ func (s *CRUDService) GetZone(ctx context.Context, regionName, zoneName string)
 		}
 	}
 
-	return &models.CRUDResponse{
-		Success:   false,
-		Message:   "Zone not found",
-		Timestamp: time.Now(),
-	}, nil
+	return nil, notFound(CodeZoneNotFound, "Zone not found")
 }
 
 // UpdateZone updates an existing zone
-func (s *CRUDService) UpdateZone(ctx context.Context, regionName, zoneName string, req *models.UpdateZoneRequest) (*models.CRUDResponse, error) {
-	s.logger.Info("Updating zone",
+func (s *CRUDService) UpdateZone(ctx context.Context, regionName, zoneName string, req *models.UpdateZoneRequest) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.UpdateZone", regionName, zoneName, "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Updating zone",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.Any("update", req))
 
-	update := bson.M{
-		"$set": bson.M{
-			"zones.$[zone].updated_at": time.Now(),
-			"updated_at":               time.Now(),
-		},
-	}
+	event := newAuditEvent(models.AuditActionUpdate, models.AuditResourceZone, zonePath(regionName, zoneName))
+	defer func() { s.audit.recordCRUD(ctx, event, response, err) }()
 
-	if req.Name != "" {
-		update["$set"].(bson.M)["zones.$[zone].name"] = req.Name
-	}
-	if req.IPv4CIDR != "" {
-		if _, err := utils.ParseCIDR(req.IPv4CIDR); err != nil {
-			return &models.CRUDResponse{
-				Success:   false,
-				Message:   "Invalid IPv4 CIDR: " + err.Error(),
-				Timestamp: time.Now(),
-			}, nil
-		}
-		update["$set"].(bson.M)["zones.$[zone].ipv4_cidr"] = req.IPv4CIDR
-	}
-	if req.IPv6CIDR != "" {
-		if _, err := utils.ParseCIDR(req.IPv6CIDR); err != nil {
-			return &models.CRUDResponse{
-				Success:   false,
-				Message:   "Invalid IPv6 CIDR: " + err.Error(),
-				Timestamp: time.Now(),
-			}, nil
-		}
-		update["$set"].(bson.M)["zones.$[zone].ipv6_cidr"] = req.IPv6CIDR
+	now := time.Now()
+	changes, err := hierarchyChanges(req.Name, req.IPv4CIDR, req.IPv6CIDR, now)
+	if err != nil {
+		return nil, err
 	}
 
-	arrayFilters := options.ArrayFilters{
-		Filters: []interface{}{
-			bson.M{"zone.name": zoneName},
-		},
+	before, err := s.repo.UpdateZone(ctx, TenantFromContext(ctx), regionName, zoneName, changes)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeZoneNotFound, "Zone not found")
 	}
-
-	opts := options.Update().SetArrayFilters(arrayFilters)
-	filter := bson.M{"name": regionName}
-	result, err := s.collection.UpdateOne(ctx, filter, update, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	if result.MatchedCount == 0 {
-		return &models.CRUDResponse{
-			Success:   false,
-			Message:   "Zone not found",
-			Timestamp: time.Now(),
-		}, nil
+	if zone := findZone(&before, zoneName); zone != nil {
+		after := *zone
+		if req.Name != "" {
+			after.Name = req.Name
+		}
+		if req.IPv4CIDR != "" {
+			after.IPv4CIDR = req.IPv4CIDR
+		}
+		if req.IPv6CIDR != "" {
+			after.IPv6CIDR = req.IPv6CIDR
+		}
+		after.UpdatedAt = now
+		event.Before = *zone
+		event.After = after
+	}
+
+	if req.Name != "" && req.Name != zoneName {
+		filter := storage.IPFilter{Tenant: TenantFromContext(ctx), Region: regionName, Zone: zoneName}
+		if err := s.ips.renameMatching(ctx, filter, storage.IPLocation{Zone: req.Name}); err != nil {
+			s.log(ctx).Error("Failed to rename zone in IP documents",
+				zap.Error(err),
+				zap.String("region", regionName),
+				zap.String("zone", zoneName))
+			return nil, err
+		}
 	}
 
 	return &models.CRUDResponse{
@@ -411,32 +408,35 @@ func (s *CRUDService) UpdateZone(ctx context.Context, regionName, zoneName strin
 }
 
 // DeleteZone deletes a zone
-func (s *CRUDService) DeleteZone(ctx context.Context, regionName, zoneName string) (*models.CRUDResponse, error) {
-	s.logger.Info("Deleting zone",
+func (s *CRUDService) DeleteZone(ctx context.Context, regionName, zoneName string) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.DeleteZone", regionName, zoneName, "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Deleting zone",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName))
 
-	update := bson.M{
-		"$pull": bson.M{
-			"zones": bson.M{"name": zoneName},
-		},
-		"$set": bson.M{
-			"updated_at": time.Now(),
-		},
-	}
+	event := newAuditEvent(models.AuditActionDelete, models.AuditResourceZone, zonePath(regionName, zoneName))
+	defer func() { s.audit.recordCRUD(ctx, event, response, err) }()
 
-	filter := bson.M{"name": regionName}
-	result, err := s.collection.UpdateOne(ctx, filter, update)
+	before, err := s.repo.DeleteZone(ctx, TenantFromContext(ctx), regionName, zoneName)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeZoneNotFound, "Zone not found")
+	}
 	if err != nil {
 		return nil, err
 	}
+	if zone := findZone(&before, zoneName); zone != nil {
+		event.Before = *zone
+	}
 
-	if result.MatchedCount == 0 {
-		return &models.CRUDResponse{
-			Success:   false,
-			Message:   "Region not found",
-			Timestamp: time.Now(),
-		}, nil
+	filter := storage.IPFilter{Tenant: TenantFromContext(ctx), Region: regionName, Zone: zoneName}
+	if err := s.deleteIPDocuments(ctx, zonePath(regionName, zoneName), filter); err != nil {
+		s.log(ctx).Error("Failed to delete IP documents for zone",
+			zap.Error(err),
+			zap.String("region", regionName),
+			zap.String("zone", zoneName))
+		return nil, err
 	}
 
 	return &models.CRUDResponse{
@@ -447,56 +447,51 @@ func (s *CRUDService) DeleteZone(ctx context.Context, regionName, zoneName strin
 }
 
 // CreateSubZone creates a new sub-zone
-func (s *CRUDService) CreateSubZone(ctx context.Context, regionName, zoneName string, req *models.CreateSubZoneRequest) (*models.CRUDResponse, error) {
-	s.logger.Info("Creating sub-zone",
+func (s *CRUDService) CreateSubZone(ctx context.Context, regionName, zoneName string, req *models.CreateSubZoneRequest) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.CreateSubZone", regionName, zoneName, req.Name)
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Creating sub-zone",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", req.Name))
 
+	event := newAuditEvent(models.AuditActionCreate, models.AuditResourceSubZone, subZonePath(regionName, zoneName, req.Name))
+	defer func() { s.audit.recordCRUD(ctx, event, response, err) }()
+
 	// Create new sub-zone
 	newSubZone := models.SubZone{
-		ID:            primitive.NewObjectID(),
-		Name:          req.Name,
-		IPv4CIDR:      req.IPv4CIDR,
-		IPv6CIDR:      req.IPv6CIDR,
-		AllocatedIPv4: []string{},
-		AllocatedIPv6: []string{},
-		ReservedIPv4:  []string{},
-		ReservedIPv6:  []string{},
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
-	}
-
-	update := bson.M{
-		"$push": bson.M{
-			"zones.$[zone].sub_zones": newSubZone,
-		},
-		"$set": bson.M{
-			"zones.$[zone].updated_at": time.Now(),
-			"updated_at":               time.Now(),
-		},
-	}
-
-	arrayFilters := options.ArrayFilters{
-		Filters: []interface{}{
-			bson.M{"zone.name": zoneName},
-		},
-	}
-
-	opts := options.Update().SetArrayFilters(arrayFilters)
-	filter := bson.M{"name": regionName}
-	result, err := s.collection.UpdateOne(ctx, filter, update, opts)
-	if err != nil {
+		ID:                 primitive.NewObjectID(),
+		Name:               req.Name,
+		IPv4CIDR:           req.IPv4CIDR,
+		IPv6CIDR:           req.IPv6CIDR,
+		AllocationStrategy: req.AllocationStrategy,
+		AllocatedIPv4:      []string{},
+		AllocatedIPv6:      []string{},
+		ReservedIPv4:       []string{},
+		ReservedIPv6:       []string{},
+		CreatedAt:          time.Now(),
+		UpdatedAt:          time.Now(),
+	}
+
+	if err := setSubZoneExclusions(&newSubZone, req.GatewayIPv4, req.GatewayIPv6, req.NoGateway, req.ExcludedRanges); err != nil {
+		s.log(ctx).Warn("Sub-zone gateway or excluded range validation failed",
+			zap.Error(err),
+			zap.String("region", regionName),
+			zap.String("zone", zoneName),
+			zap.String("subzone", req.Name),
+			zap.Strings("excluded_ranges", req.ExcludedRanges))
 		return nil, err
 	}
 
-	if result.MatchedCount == 0 {
-		return &models.CRUDResponse{
-			Success:   false,
-			Message:   "Zone not found",
-			Timestamp: time.Now(),
-		}, nil
+	err = s.repo.AddSubZone(ctx, TenantFromContext(ctx), regionName, zoneName, newSubZone, time.Time{})
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeZoneNotFound, "Zone not found")
 	}
+	if err != nil {
+		return nil, err
+	}
+	event.After = newSubZone
 
 	return &models.CRUDResponse{
 		Success:   true,
@@ -507,64 +502,61 @@ func (s *CRUDService) CreateSubZone(ctx context.Context, regionName, zoneName st
 }
 
 // UpdateSubZone updates an existing sub-zone
-func (s *CRUDService) UpdateSubZone(ctx context.Context, regionName, zoneName, subZoneName string, req *models.UpdateSubZoneRequest) (*models.CRUDResponse, error) {
-	s.logger.Info("Updating sub-zone",
+func (s *CRUDService) UpdateSubZone(ctx context.Context, regionName, zoneName, subZoneName string, req *models.UpdateSubZoneRequest) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.UpdateSubZone", regionName, zoneName, subZoneName)
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Updating sub-zone",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName))
 
-	update := bson.M{
-		"$set": bson.M{
-			"zones.$[zone].sub_zones.$[subzone].updated_at": time.Now(),
-			"zones.$[zone].updated_at":                      time.Now(),
-			"updated_at":                                    time.Now(),
-		},
-	}
+	event := newAuditEvent(models.AuditActionUpdate, models.AuditResourceSubZone, subZonePath(regionName, zoneName, subZoneName))
+	defer func() { s.audit.recordCRUD(ctx, event, response, err) }()
 
-	if req.Name != "" {
-		update["$set"].(bson.M)["zones.$[zone].sub_zones.$[subzone].name"] = req.Name
-	}
-	if req.IPv4CIDR != "" {
-		if _, err := utils.ParseCIDR(req.IPv4CIDR); err != nil {
-			return &models.CRUDResponse{
-				Success:   false,
-				Message:   "Invalid IPv4 CIDR: " + err.Error(),
-				Timestamp: time.Now(),
-			}, nil
-		}
-		update["$set"].(bson.M)["zones.$[zone].sub_zones.$[subzone].ipv4_cidr"] = req.IPv4CIDR
-	}
-	if req.IPv6CIDR != "" {
-		if _, err := utils.ParseCIDR(req.IPv6CIDR); err != nil {
-			return &models.CRUDResponse{
-				Success:   false,
-				Message:   "Invalid IPv6 CIDR: " + err.Error(),
-				Timestamp: time.Now(),
-			}, nil
-		}
-		update["$set"].(bson.M)["zones.$[zone].sub_zones.$[subzone].ipv6_cidr"] = req.IPv6CIDR
+	now := time.Now()
+	changes, err := hierarchyChanges(req.Name, req.IPv4CIDR, req.IPv6CIDR, now)
+	if err != nil {
+		return nil, err
 	}
+	changes.AllocationStrategy = req.AllocationStrategy
 
-	arrayFilters := options.ArrayFilters{
-		Filters: []interface{}{
-			bson.M{"zone.name": zoneName},
-			bson.M{"subzone.name": subZoneName},
-		},
+	before, err := s.repo.UpdateSubZone(ctx, TenantFromContext(ctx), regionName, zoneName, subZoneName, changes)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeSubZoneNotFound, "Sub-zone not found")
 	}
-
-	opts := options.Update().SetArrayFilters(arrayFilters)
-	filter := bson.M{"name": regionName}
-	result, err := s.collection.UpdateOne(ctx, filter, update, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	if result.MatchedCount == 0 {
-		return &models.CRUDResponse{
-			Success:   false,
-			Message:   "Sub-zone not found",
-			Timestamp: time.Now(),
-		}, nil
+	if subZone := findSubZone(findZone(&before, zoneName), subZoneName); subZone != nil {
+		after := *subZone
+		if req.Name != "" {
+			after.Name = req.Name
+		}
+		if req.IPv4CIDR != "" {
+			after.IPv4CIDR = req.IPv4CIDR
+		}
+		if req.IPv6CIDR != "" {
+			after.IPv6CIDR = req.IPv6CIDR
+		}
+		if req.AllocationStrategy != "" {
+			after.AllocationStrategy = req.AllocationStrategy
+		}
+		after.UpdatedAt = now
+		event.Before = *subZone
+		event.After = after
+	}
+
+	if req.Name != "" && req.Name != subZoneName {
+		if err := s.ips.renameMatching(ctx, ipSubZoneFilter(ctx, regionName, zoneName, subZoneName), storage.IPLocation{SubZone: req.Name}); err != nil {
+			s.log(ctx).Error("Failed to rename sub-zone in IP documents",
+				zap.Error(err),
+				zap.String("region", regionName),
+				zap.String("zone", zoneName),
+				zap.String("subzone", subZoneName))
+			return nil, err
+		}
 	}
 
 	return &models.CRUDResponse{
@@ -575,41 +567,36 @@ func (s *CRUDService) UpdateSubZone(ctx context.Context, regionName, zoneName, s
 }
 
 // DeleteSubZone deletes a sub-zone
-func (s *CRUDService) DeleteSubZone(ctx context.Context, regionName, zoneName, subZoneName string) (*models.CRUDResponse, error) {
-	s.logger.Info("Deleting sub-zone",
+func (s *CRUDService) DeleteSubZone(ctx context.Context, regionName, zoneName, subZoneName string) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.DeleteSubZone", regionName, zoneName, subZoneName)
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Deleting sub-zone",
 		zap.String("region", regionName),
 		zap.String("zone", zoneName),
 		zap.String("subzone", subZoneName))
 
-	update := bson.M{
-		"$pull": bson.M{
-			"zones.$[zone].sub_zones": bson.M{"name": subZoneName},
-		},
-		"$set": bson.M{
-			"zones.$[zone].updated_at": time.Now(),
-			"updated_at":               time.Now(),
-		},
-	}
+	event := newAuditEvent(models.AuditActionDelete, models.AuditResourceSubZone, subZonePath(regionName, zoneName, subZoneName))
+	defer func() { s.audit.recordCRUD(ctx, event, response, err) }()
 
-	arrayFilters := options.ArrayFilters{
-		Filters: []interface{}{
-			bson.M{"zone.name": zoneName},
-		},
+	before, err := s.repo.DeleteSubZone(ctx, TenantFromContext(ctx), regionName, zoneName, subZoneName)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeSubZoneNotFound, "Sub-zone not found")
 	}
-
-	opts := options.Update().SetArrayFilters(arrayFilters)
-	filter := bson.M{"name": regionName}
-	result, err := s.collection.UpdateOne(ctx, filter, update, opts)
 	if err != nil {
 		return nil, err
 	}
+	if subZone := findSubZone(findZone(&before, zoneName), subZoneName); subZone != nil {
+		event.Before = *subZone
+	}
 
-	if result.MatchedCount == 0 {
-		return &models.CRUDResponse{
-			Success:   false,
-			Message:   "Sub-zone not found",
-			Timestamp: time.Now(),
-		}, nil
+	if err := s.deleteIPDocuments(ctx, subZonePath(regionName, zoneName, subZoneName), ipSubZoneFilter(ctx, regionName, zoneName, subZoneName)); err != nil {
+		s.log(ctx).Error("Failed to delete IP documents for sub-zone",
+			zap.Error(err),
+			zap.String("region", regionName),
+			zap.String("zone", zoneName),
+			zap.String("subzone", subZoneName))
+		return nil, err
 	}
 
 	return &models.CRUDResponse{
@@ -618,3 +605,70 @@ func (s *CRUDService) DeleteSubZone(ctx context.Context, regionName, zoneName, s
 		Timestamp: time.Now(),
 	}, nil
 }
+
+// deleteIPDocuments removes the IP documents of a deleted region, zone or sub-zone and records
+// their release in the audit trail, so that the history of each address stays complete
+func (s *CRUDService) deleteIPDocuments(ctx context.Context, path string, filter storage.IPFilter) error {
+	docs, err := s.ips.find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if err := s.ips.deleteMatching(ctx, filter); err != nil {
+		return err
+	}
+
+	// Split large releases so every event stays well below the document size limit
+	for start := 0; start < len(docs); start += auditIPBatchSize {
+		batch := docs[start:min(start+auditIPBatchSize, len(docs))]
+		event := newAuditEvent(models.AuditActionDelete, models.AuditResourceIP, path)
+		event.Before = batch
+		for _, doc := range batch {
+			event.IPAddresses = append(event.IPAddresses, doc.IPAddress)
+		}
+		s.audit.recordOutcome(ctx, event, true, "Released by deleting "+path, nil)
+	}
+	return nil
+}
+
+// hierarchyChanges validates the CIDRs of an update request and returns the changes to store
+func hierarchyChanges(name, ipv4CIDR, ipv6CIDR string, now time.Time) (storage.HierarchyChanges, error) {
+	if ipv4CIDR != "" {
+		if _, err := utils.ParseCIDR(ipv4CIDR); err != nil {
+			return storage.HierarchyChanges{}, validationFailed(CodeInvalidCIDR, "Invalid IPv4 CIDR: %v", err)
+		}
+	}
+	if ipv6CIDR != "" {
+		if _, err := utils.ParseCIDR(ipv6CIDR); err != nil {
+			return storage.HierarchyChanges{}, validationFailed(CodeInvalidCIDR, "Invalid IPv6 CIDR: %v", err)
+		}
+	}
+	return storage.HierarchyChanges{
+		Name:      name,
+		IPv4CIDR:  ipv4CIDR,
+		IPv6CIDR:  ipv6CIDR,
+		UpdatedAt: now,
+	}, nil
+}
+
+// findZone returns the named zone of a region, or nil
+func findZone(region *models.Region, zoneName string) *models.Zone {
+	for i := range region.Zones {
+		if region.Zones[i].Name == zoneName {
+			return &region.Zones[i]
+		}
+	}
+	return nil
+}
+
+// findSubZone returns the named sub-zone of a zone, or nil when either does not exist
+func findSubZone(zone *models.Zone, subZoneName string) *models.SubZone {
+	if zone == nil {
+		return nil
+	}
+	for i := range zone.SubZones {
+		if zone.SubZones[i].Name == subZoneName {
+			return &zone.SubZones[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"ip-allocator-api/internal/utils"
+)
+
+// Kinds of domain failures. Every *Error wraps one of them, so callers can test the kind with
+// errors.Is, and the HTTP layer maps each kind to a status.
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrConflict         = errors.New("conflict")
+	ErrCIDROutOfRange   = errors.New("CIDR out of range")
+	ErrExhausted        = errors.New("address space exhausted")
+	ErrValidationFailed = errors.New("validation failed")
+	ErrQuotaExceeded    = errors.New("quota exceeded")
+	ErrForbidden        = errors.New("forbidden")
+)
+
+// Error codes identify a domain failure to clients. They are part of the API: codes may be
+// added, but an existing code never changes its meaning.
+const (
+	CodeRegionNotFound  = "region_not_found"
+	CodeZoneNotFound    = "zone_not_found"
+	CodeSubZoneNotFound = "sub_zone_not_found"
+	CodeTenantNotFound  = "tenant_not_found"
+	CodeAPIKeyNotFound  = "api_key_not_found"
+	CodeScopeNotFound   = "scope_not_found"
+	CodeNoMatchingIPs   = "no_matching_ips"
+
+	CodeRegionExists           = "region_exists"
+	CodeZoneExists             = "zone_exists"
+	CodeSubZoneExists          = "sub_zone_exists"
+	CodeTenantExists           = "tenant_exists"
+	CodeAPIKeyExists           = "api_key_exists"
+	CodeTenantNotEmpty         = "tenant_not_empty"
+	CodeDefaultTenant          = "default_tenant_protected"
+	CodeCIDROverlap            = "cidr_overlap"
+	CodePreferredIPUnavailable = "preferred_ip_unavailable"
+	CodeConcurrentUpdate       = "concurrent_update"
+
+	CodeCIDROutOfRange = "cidr_out_of_range"
+
+	CodeAddressesExhausted = "addresses_exhausted"
+	CodeSubnetsExhausted   = "subnets_exhausted"
+	CodeNoContiguousRun    = "no_contiguous_run"
+
+	CodeInvalidCIDR  = "invalid_cidr"
+	CodeInvalidIP    = "invalid_ip"
+	CodeInvalidLease = "invalid_lease"
+	CodeInvalidID    = "invalid_id"
+	// CodeValidationFailed is shared with the handlers' own request validation
+	CodeValidationFailed = utils.CodeValidationFailed
+
+	CodeQuotaExceeded = "quota_exceeded"
+
+	CodeTenantMismatch = "tenant_mismatch"
+
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeIdempotencyKeyInUse  = "idempotency_key_in_use"
+)
+
+// Error is a domain failure: the request was understood but cannot be carried out in the
+// current state. Anything else a service returns is an internal error.
+type Error struct {
+	kind    error
+	Code    string
+	Message string
+	// Details are machine-readable specifics of the failure, such as the rejected IPs
+	Details map[string]interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.kind
+}
+
+// Kind returns the kind of the failure, one of the Err variables
+func (e *Error) Kind() error {
+	return e.kind
+}
+
+// AsError returns the domain error in err's chain, if any
+func AsError(err error) (*Error, bool) {
+	var domainErr *Error
+	if errors.As(err, &domainErr) {
+		return domainErr, true
+	}
+	return nil, false
+}
+
+func newError(kind error, code, format string, args ...interface{}) *Error {
+	return &Error{kind: kind, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// withDetail adds a machine-readable detail to the error
+func (e *Error) withDetail(key string, value interface{}) *Error {
+	if e.Details == nil {
+		e.Details = map[string]interface{}{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+func notFound(code, format string, args ...interface{}) *Error {
+	return newError(ErrNotFound, code, format, args...)
+}
+
+func conflict(code, format string, args ...interface{}) *Error {
+	return newError(ErrConflict, code, format, args...)
+}
+
+func cidrOutOfRange(format string, args ...interface{}) *Error {
+	return newError(ErrCIDROutOfRange, CodeCIDROutOfRange, format, args...)
+}
+
+func exhausted(code, format string, args ...interface{}) *Error {
+	return newError(ErrExhausted, code, format, args...)
+}
+
+func validationFailed(code, format string, args ...interface{}) *Error {
+	return newError(ErrValidationFailed, code, format, args...)
+}
+
+func forbidden(code, format string, args ...interface{}) *Error {
+	return newError(ErrForbidden, code, format, args...)
+}
+
+// errorDetail returns the detail stored under key by the domain error in err's chain
+func errorDetail(err error, key string) interface{} {
+	if domainErr, ok := AsError(err); ok {
+		return domainErr.Details[key]
+	}
+	return nil
+}
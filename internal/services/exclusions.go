@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"math/big"
+	"net"
+	"net/netip"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/utils"
+)
+
+// setSubZoneExclusions sets the gateways and excluded ranges of a new sub-zone after checking
+// them against its CIDRs. Excluded ranges are stored as start-end ranges or single IPs.
+func setSubZoneExclusions(subZone *models.SubZone, gatewayIPv4, gatewayIPv6 string, noGateway bool, excluded []string) error {
+	if noGateway && (gatewayIPv4 != "" || gatewayIPv6 != "") {
+		return validationFailed(CodeValidationFailed, "no_gateway cannot be combined with gateway_ipv4 or gateway_ipv6")
+	}
+
+	families := []struct {
+		version string
+		cidr    string
+		gateway string
+		target  *string
+		ranges  []string
+	}{
+		{version: "ipv4", cidr: subZone.IPv4CIDR, gateway: gatewayIPv4, target: &subZone.GatewayIPv4},
+		{version: "ipv6", cidr: subZone.IPv6CIDR, gateway: gatewayIPv6, target: &subZone.GatewayIPv6},
+	}
+
+	// Split the excluded ranges by version, as start and end pairs
+	var normalized []string
+	for _, ipRange := range excluded {
+		start, end, err := utils.ParseIPRange(ipRange)
+		if err != nil {
+			return validationFailed(CodeInvalidIP, "Invalid excluded range %s: %v", ipRange, err)
+		}
+		family := &families[1]
+		if utils.IsIPv4(net.ParseIP(start)) {
+			family = &families[0]
+		}
+		if family.cidr == "" {
+			return cidrOutOfRange("Excluded range %s is %s but the sub-zone has no %s CIDR", ipRange, family.version, family.version)
+		}
+		family.ranges = append(family.ranges, start, end)
+		if start == end {
+			normalized = append(normalized, start)
+		} else {
+			normalized = append(normalized, start+"-"+end)
+		}
+	}
+
+	for _, family := range families {
+		if family.gateway != "" {
+			if family.cidr == "" {
+				return cidrOutOfRange("Gateway %s requires a %s CIDR", family.gateway, family.version)
+			}
+			if err := utils.ValidateIPRangeInCIDRString(family.gateway, family.gateway, family.cidr); err != nil {
+				return cidrOutOfRange("Gateway validation failed: %v", err)
+			}
+			*family.target = utils.NormalizeIP(family.gateway)
+		} else if !noGateway {
+			*family.target = defaultGateway(family.cidr)
+		}
+
+		if err := utils.ValidateMultipleCIDRRanges(family.ranges, family.cidr); err != nil {
+			return cidrOutOfRange("Excluded range validation failed: %v", err)
+		}
+	}
+
+	subZone.ExcludedRanges = normalized
+	return nil
+}
+
+// defaultGateway returns the first usable address of cidr, or "" when there is no CIDR or it
+// is too small to give up an address, like a point-to-point /31
+func defaultGateway(cidr string) string {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil || prefix.Addr().BitLen()-prefix.Bits() < 2 {
+		return ""
+	}
+	gateway, err := utils.GetNextAvailableIP(cidr, nil, nil, nil)
+	if err != nil {
+		return ""
+	}
+	return gateway
+}
+
+// excludedRanges returns the addresses of a sub-zone that are never allocated, in the forms
+// utils.ParseIPRange accepts
+func excludedRanges(subZone *models.SubZone) []string {
+	ranges := make([]string, 0, len(subZone.ExcludedRanges)+2)
+	for _, gateway := range []string{subZone.GatewayIPv4, subZone.GatewayIPv6} {
+		if gateway != "" {
+			ranges = append(ranges, gateway)
+		}
+	}
+	return append(ranges, subZone.ExcludedRanges...)
+}
+
+// AvailableIPCounts counts the addresses of a sub-zone's IPv4 and IPv6 ranges that can still
+// be allocated: usable addresses that are neither allocated, reserved nor excluded. A version
+// the sub-zone has no range of counts 0.
+func (s *AllocationService) AvailableIPCounts(ctx context.Context, regionName, zoneName string, subZone *models.SubZone) (map[string]*big.Int, error) {
+	index, err := s.free.lock(ctx, regionName, zoneName, subZone)
+	if err != nil {
+		return nil, err
+	}
+	defer index.unlock()
+	return index.availableCounts()
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+func TestSetSubZoneExclusions(t *testing.T) {
+	tests := []struct {
+		name                     string
+		ipv4CIDR, ipv6CIDR       string
+		gatewayIPv4, gatewayIPv6 string
+		noGateway                bool
+		excluded                 []string
+		// wantCode is the error code expected, or "" for success
+		wantCode           string
+		wantGW4, wantGW6   string
+		wantExcludedRanges []string
+	}{
+		{name: "default gateways", ipv4CIDR: "10.0.1.0/24", ipv6CIDR: "fd00::/64",
+			wantGW4: "10.0.1.1", wantGW6: "fd00::1"},
+		{name: "start-end range", ipv4CIDR: "10.0.1.0/24", excluded: []string{"10.0.1.200 - 10.0.1.210"},
+			wantGW4: "10.0.1.1", wantExcludedRanges: []string{"10.0.1.200-10.0.1.210"}},
+		{name: "CIDR", ipv4CIDR: "10.0.1.0/24", excluded: []string{"10.0.1.66/30"},
+			wantGW4: "10.0.1.1", wantExcludedRanges: []string{"10.0.1.64-10.0.1.67"}},
+		{name: "single IPs", ipv4CIDR: "10.0.1.0/24", ipv6CIDR: "fd00::/64", excluded: []string{"10.0.1.9", "fd00::0009", "::ffff:10.0.1.10"},
+			wantGW4: "10.0.1.1", wantGW6: "fd00::1", wantExcludedRanges: []string{"10.0.1.9", "fd00::9", "10.0.1.10"}},
+		{name: "range outside the CIDR", ipv4CIDR: "10.0.1.0/24", excluded: []string{"10.0.1.250-10.0.2.5"},
+			wantCode: CodeCIDROutOfRange},
+		{name: "CIDR wider than the sub-zone", ipv4CIDR: "10.0.1.0/24", excluded: []string{"10.0.0.0/16"},
+			wantCode: CodeCIDROutOfRange},
+		{name: "version without a CIDR", ipv4CIDR: "10.0.1.0/24", excluded: []string{"fd00::1"},
+			wantCode: CodeCIDROutOfRange},
+		{name: "invalid range", ipv4CIDR: "10.0.1.0/24", excluded: []string{"10.0.1.9-bogus"},
+			wantCode: CodeInvalidIP},
+		{name: "reversed range", ipv4CIDR: "10.0.1.0/24", excluded: []string{"10.0.1.9-10.0.1.1"},
+			wantCode: CodeInvalidIP},
+		{name: "explicit gateways", ipv4CIDR: "10.0.1.0/24", ipv6CIDR: "fd00::/64", gatewayIPv4: "10.0.1.254", gatewayIPv6: "fd00::fe",
+			wantGW4: "10.0.1.254", wantGW6: "fd00::fe"},
+		{name: "gateway outside the CIDR", ipv4CIDR: "10.0.1.0/24", gatewayIPv4: "10.0.2.1",
+			wantCode: CodeCIDROutOfRange},
+		{name: "gateway without a CIDR", ipv4CIDR: "10.0.1.0/24", gatewayIPv6: "fd00::1",
+			wantCode: CodeCIDROutOfRange},
+		{name: "no gateway", ipv4CIDR: "10.0.1.0/24", ipv6CIDR: "fd00::/64", noGateway: true, excluded: []string{"10.0.1.1"},
+			wantExcludedRanges: []string{"10.0.1.1"}},
+		{name: "no gateway with a gateway", ipv4CIDR: "10.0.1.0/24", noGateway: true, gatewayIPv4: "10.0.1.1",
+			wantCode: CodeValidationFailed},
+		{name: "point-to-point", ipv4CIDR: "10.0.1.0/31", ipv6CIDR: "fd00::/127"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subZone := &models.SubZone{Name: "s1", IPv4CIDR: tt.ipv4CIDR, IPv6CIDR: tt.ipv6CIDR}
+			err := setSubZoneExclusions(subZone, tt.gatewayIPv4, tt.gatewayIPv6, tt.noGateway, tt.excluded)
+			if tt.wantCode != "" {
+				domainErr, ok := AsError(err)
+				if !ok || domainErr.Code != tt.wantCode {
+					t.Fatalf("setSubZoneExclusions = %v, want code %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setSubZoneExclusions: %v", err)
+			}
+			if subZone.GatewayIPv4 != tt.wantGW4 || subZone.GatewayIPv6 != tt.wantGW6 {
+				t.Fatalf("gateways = %q, %q, want %q, %q", subZone.GatewayIPv4, subZone.GatewayIPv6, tt.wantGW4, tt.wantGW6)
+			}
+			if !reflect.DeepEqual(subZone.ExcludedRanges, tt.wantExcludedRanges) {
+				t.Fatalf("excluded ranges = %q, want %q", subZone.ExcludedRanges, tt.wantExcludedRanges)
+			}
+		})
+	}
+}
+
+func TestAvailableIPCounts(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/24")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	ctx := tenantContext(models.DefaultTenant)
+
+	held := []struct {
+		status string
+		ips    []string
+	}{
+		{models.IPStatusAllocated, []string{"10.0.1.2", "10.0.1.3", "10.0.1.210", "fd00::2"}},
+		{models.IPStatusReserved, []string{"10.0.1.4"}},
+	}
+	for _, h := range held {
+		template := ipTemplate(models.DefaultTenant, "r1", "z1", "s1", h.status)
+		if err := repo.InsertIPs(ctx, newIPAllocations(template, h.ips, time.Now())); err != nil {
+			t.Fatalf("InsertIPs: %v", err)
+		}
+	}
+
+	subZone := &models.SubZone{
+		Name:           "s1",
+		IPv4CIDR:       "10.0.1.0/24",
+		IPv6CIDR:       "fd00::/64",
+		GatewayIPv4:    "10.0.1.1",
+		GatewayIPv6:    "fd00::1",
+		ExcludedRanges: []string{"10.0.1.200-10.0.1.254", "10.0.1.2", "fd00::ff00-fd00::ffff"},
+	}
+	available, err := service.AvailableIPCounts(ctx, "r1", "z1", subZone)
+	if err != nil {
+		t.Fatalf("AvailableIPCounts: %v", err)
+	}
+
+	tests := []struct {
+		version string
+		want    string
+	}{
+		// 254 usable, less the gateway, .2-.4 held or excluded and .200-.254
+		{"ipv4", "195"},
+		// 2^64 less the subnet-router anycast address, the gateway, one allocated and 256 excluded:
+		// more than an int64 holds
+		{"ipv6", "18446744073709551357"},
+	}
+	for _, tt := range tests {
+		if available[tt.version].String() != tt.want {
+			t.Fatalf("AvailableIPCounts()[%s] = %s, want %s", tt.version, available[tt.version], tt.want)
+		}
+	}
+
+	available, err = service.AvailableIPCounts(ctx, "r1", "z1", &models.SubZone{Name: "s1", IPv4CIDR: "10.0.1.0/24"})
+	if err != nil || available["ipv6"].Sign() != 0 {
+		t.Fatalf("AvailableIPCounts without an IPv6 CIDR = %v, %v, want 0 IPv6 addresses", available, err)
+	}
+}
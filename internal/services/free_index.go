@@ -0,0 +1,342 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/utils"
+)
+
+// maxCachedSubZones bounds how many sub-zones keep their free addresses in memory; beyond it
+// the sub-zone used least recently is dropped and rebuilt when it is used again
+const maxCachedSubZones = 1024
+
+// freeIndexCache keeps the free addresses of every sub-zone the service works on between
+// requests, so an allocation no longer reads and sorts every IP document of the sub-zone.
+//
+// An entry is only trusted while the stored documents are still in the state it was built
+// from: every use first reads the sub-zone's storage.IPStateVersion, two indexed queries, and
+// rebuilds the entry when it moved. Writes made through the cache hold the entry's lock and
+// move the version they expect along with them, so only writes from elsewhere, another
+// replica or a sub-zone rename, cost a rebuild. A write the version cannot tell apart, see
+// storage.IPStateVersion, leaves the entry stale; the unique index still rejects an address
+// handed out twice and the conflict rebuilds the entry.
+type freeIndexCache struct {
+	repo    storage.IPRepository
+	mu      sync.Mutex
+	entries map[subZoneKey]*subZoneIndex
+	// used counts lock calls, ordering the entries by their last use
+	used uint64
+}
+
+// subZoneKey addresses a sub-zone of a tenant
+type subZoneKey struct {
+	tenant  string
+	region  string
+	zone    string
+	subZone string
+}
+
+// subZoneIndex holds the free addresses and the held counts of one sub-zone. Everything but
+// lastUsed is guarded by mu, which callers hold from lock until unlock.
+type subZoneIndex struct {
+	mu  sync.Mutex
+	key subZoneKey
+	// layout identifies the ranges and exclusions the index was built for
+	layout   string
+	built    bool
+	version  storage.IPStateVersion
+	families map[string]*familyIndex
+	// allocated and reserved count the held documents per version
+	allocated map[string]int
+	reserved  map[string]int
+	// claims are the addresses selected under the lock that are not written yet
+	claims []claim
+
+	lastUsed uint64 // guarded by the cache's mu
+}
+
+// familyIndex tracks one address family of a sub-zone. unheld holds the addresses of the
+// range without a document and available also leaves out the gateways and excluded ranges,
+// which layout holds on their own. err is why the family could not be indexed, e.g. an
+// invalid CIDR; it fails allocations of that version only.
+type familyIndex struct {
+	cidr      string
+	unheld    *utils.FreeRangeIndex
+	available *utils.FreeRangeIndex
+	layout    *utils.FreeRangeIndex
+	err       error
+}
+
+type claim struct {
+	version string
+	ip      string
+}
+
+func newFreeIndexCache(repo storage.IPRepository) *freeIndexCache {
+	return &freeIndexCache{
+		repo:    repo,
+		entries: make(map[subZoneKey]*subZoneIndex),
+	}
+}
+
+// lock returns the locked index of a sub-zone of the request's tenant, up to date with the
+// stored documents. The caller must unlock it.
+func (c *freeIndexCache) lock(ctx context.Context, regionName, zoneName string, subZone *models.SubZone) (*subZoneIndex, error) {
+	index := c.entry(subZoneKey{TenantFromContext(ctx), regionName, zoneName, subZone.Name})
+	index.mu.Lock()
+	if err := index.refresh(ctx, c.repo, subZone); err != nil {
+		index.mu.Unlock()
+		return nil, err
+	}
+	return index, nil
+}
+
+// entry returns the cached index of the sub-zone, adding an empty one and dropping the least
+// recently used when needed. A dropped index stays usable by whoever holds it.
+func (c *freeIndexCache) entry(key subZoneKey) *subZoneIndex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.used++
+	if index, ok := c.entries[key]; ok {
+		index.lastUsed = c.used
+		return index
+	}
+
+	if len(c.entries) >= maxCachedSubZones {
+		var oldest *subZoneIndex
+		for _, index := range c.entries {
+			if oldest == nil || index.lastUsed < oldest.lastUsed {
+				oldest = index
+			}
+		}
+		delete(c.entries, oldest.key)
+	}
+
+	index := &subZoneIndex{key: key, lastUsed: c.used}
+	c.entries[key] = index
+	return index
+}
+
+// subZoneLayout identifies the ranges and exclusions of a sub-zone
+func subZoneLayout(subZone *models.SubZone) string {
+	return strings.Join(append([]string{subZone.IPv4CIDR, subZone.IPv6CIDR}, excludedRanges(subZone)...), ",")
+}
+
+// filter matches the documents of the sub-zone
+func (index *subZoneIndex) filter() storage.IPFilter {
+	return storage.IPFilter{
+		Tenant:  index.key.tenant,
+		Region:  index.key.region,
+		Zone:    index.key.zone,
+		SubZone: index.key.subZone,
+	}
+}
+
+// refresh rebuilds the index unless it was built for the same layout and the stored
+// documents are still in the state it tracks. The version is read before the documents, so
+// a write landing in between only costs another rebuild.
+func (index *subZoneIndex) refresh(ctx context.Context, repo storage.IPRepository, subZone *models.SubZone) error {
+	version, err := repo.IPStateVersion(ctx, index.filter())
+	if err != nil {
+		return fmt.Errorf("failed to read IP state of sub-zone '%s': %w", subZone.Name, err)
+	}
+	layout := subZoneLayout(subZone)
+	if index.built && index.layout == layout && sameVersion(index.version, version) {
+		return nil
+	}
+
+	docs, err := repo.FindIPs(ctx, index.filter())
+	if err != nil {
+		return fmt.Errorf("failed to load IP state for sub-zone '%s': %w", subZone.Name, err)
+	}
+
+	held := map[string][]string{}
+	index.allocated = map[string]int{}
+	index.reserved = map[string]int{}
+	for _, doc := range docs {
+		held[doc.IPVersion] = append(held[doc.IPVersion], doc.IPAddress)
+		index.count(doc, 1)
+	}
+
+	index.families = map[string]*familyIndex{}
+	for version, cidr := range map[string]string{"ipv4": subZone.IPv4CIDR, "ipv6": subZone.IPv6CIDR} {
+		if cidr != "" {
+			index.families[version] = newFamilyIndex(version, cidr, held[version], excludedRanges(subZone))
+		}
+	}
+	index.layout = layout
+	index.version = version
+	index.built = true
+	index.claims = nil
+	return nil
+}
+
+func newFamilyIndex(version, cidr string, held, excluded []string) *familyIndex {
+	family := &familyIndex{cidr: cidr}
+	var err error
+	if family.unheld, err = utils.NewFreeRangeIndex(cidr, held); err != nil {
+		family.err = fmt.Errorf("invalid %s CIDR %s: %v", version, cidr, err)
+		return family
+	}
+	family.available, _ = utils.NewFreeRangeIndex(cidr, held)
+	family.layout, _ = utils.NewFreeRangeIndex(cidr)
+	// The gateways and excluded ranges are never handed out, not even when preferred
+	if err := family.available.Exclude(excluded); err != nil {
+		family.err = fmt.Errorf("invalid excluded range in sub-zone: %v", err)
+		return family
+	}
+	family.layout.Exclude(excluded)
+	return family
+}
+
+// sameVersion compares versions at the millisecond precision the documents are stored with
+func sameVersion(a, b storage.IPStateVersion) bool {
+	return a.Count == b.Count && a.UpdatedAt.Truncate(time.Millisecond).Equal(b.UpdatedAt.Truncate(time.Millisecond))
+}
+
+// count adds delta to the held counts of the document's status and version
+func (index *subZoneIndex) count(doc models.IPAllocation, delta int) {
+	switch doc.Status {
+	case models.IPStatusAllocated:
+		index.allocated[doc.IPVersion] += delta
+	case models.IPStatusReserved:
+		index.reserved[doc.IPVersion] += delta
+	}
+}
+
+// family returns the index of an address family, or nil when the sub-zone has no range of
+// that version
+func (index *subZoneIndex) family(version string) *familyIndex {
+	return index.families[version]
+}
+
+// held reports whether a document holds the address
+func (index *subZoneIndex) held(version, ip string) bool {
+	family := index.family(version)
+	return family != nil && family.unheld != nil && family.unheld.Usable(ip) && !family.unheld.IsFree(ip)
+}
+
+// heldCounts returns the number of held documents per version
+func (index *subZoneIndex) heldCounts() map[string]int {
+	counts := map[string]int{}
+	for _, version := range []string{"ipv4", "ipv6"} {
+		counts[version] = index.allocated[version] + index.reserved[version]
+	}
+	return counts
+}
+
+// availableCounts returns how many addresses of each version can still be allocated, 0 for a
+// version the sub-zone has no range of
+func (index *subZoneIndex) availableCounts() (map[string]*big.Int, error) {
+	counts := map[string]*big.Int{}
+	for _, version := range []string{"ipv4", "ipv6"} {
+		family := index.family(version)
+		switch {
+		case family == nil:
+			counts[version] = new(big.Int)
+		case family.err != nil:
+			return nil, family.err
+		default:
+			counts[version] = family.available.FreeCount()
+		}
+	}
+	return counts, nil
+}
+
+// claim records addresses selected from the available ones of a version. They count as held
+// until the lock is released; unless inserted writes them, unlock frees them again.
+func (index *subZoneIndex) claim(version string, ips []string) {
+	family := index.family(version)
+	for _, ip := range ips {
+		family.unheld.Take(ip)
+		index.claims = append(index.claims, claim{version: version, ip: ip})
+	}
+}
+
+// inserted records documents written under the lock. Addresses claimed but not written, e.g.
+// left over from host pairing, are freed again.
+func (index *subZoneIndex) inserted(docs []models.IPAllocation) {
+	written := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		written[doc.IPAddress] = true
+		index.count(doc, 1)
+		index.version.Count++
+		if updatedAt := doc.UpdatedAt.Truncate(time.Millisecond); updatedAt.After(index.version.UpdatedAt) {
+			index.version.UpdatedAt = updatedAt
+		}
+		if family := index.family(doc.IPVersion); family != nil && family.err == nil {
+			family.unheld.Take(doc.IPAddress)
+			family.available.Take(doc.IPAddress)
+		}
+	}
+
+	claims := index.claims
+	index.claims = nil
+	for _, c := range claims {
+		if !written[c.ip] {
+			index.free(c.version, c.ip)
+		}
+	}
+}
+
+// removed records documents deleted under the lock. The version read afterwards must show
+// exactly these deletions and nothing newer, otherwise the index is rebuilt on its next use.
+func (index *subZoneIndex) removed(ctx context.Context, repo storage.IPRepository, docs []models.IPAllocation) {
+	if len(docs) == 0 {
+		return
+	}
+	version, err := repo.IPStateVersion(ctx, index.filter())
+	if err != nil || version.Count != index.version.Count-int64(len(docs)) || version.UpdatedAt.After(index.version.UpdatedAt) {
+		index.built = false
+		return
+	}
+
+	for _, doc := range docs {
+		index.count(doc, -1)
+		index.free(doc.IPVersion, doc.IPAddress)
+	}
+	index.version = version
+}
+
+// renewed records leases renewed under the lock at now
+func (index *subZoneIndex) renewed(now time.Time) {
+	if now = now.Truncate(time.Millisecond); now.After(index.version.UpdatedAt) {
+		index.version.UpdatedAt = now
+	}
+}
+
+// invalidate makes the next use rebuild the index, after a write it cannot account for such
+// as a conflict with a concurrent request
+func (index *subZoneIndex) invalidate() {
+	index.built = false
+	index.claims = nil
+}
+
+// free returns an address to the unheld ones and, unless it is excluded, to the available ones
+func (index *subZoneIndex) free(version, ip string) {
+	family := index.family(version)
+	if family == nil || family.err != nil {
+		return
+	}
+	family.unheld.Release(ip)
+	if family.layout.IsFree(ip) {
+		family.available.Release(ip)
+	}
+}
+
+// unlock frees the addresses claimed but not written and releases the lock
+func (index *subZoneIndex) unlock() {
+	for _, c := range index.claims {
+		index.free(c.version, c.ip)
+	}
+	index.claims = nil
+	index.mu.Unlock()
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+// ipAuditEvent is an IP audit event with the before and after snapshots decoded as IP documents
+type ipAuditEvent struct {
+	Timestamp time.Time             `bson:"timestamp"`
+	Action    string                `bson:"action"`
+	Actor     string                `bson:"actor"`
+	ClientIP  string                `bson:"client_ip"`
+	RequestID string                `bson:"request_id"`
+	Message   string                `bson:"message"`
+	Before    []models.IPAllocation `bson:"before"`
+	After     []models.IPAllocation `bson:"after"`
+}
+
+// GetIPHistory returns the current holders of an address and its lifecycle, newest first.
+// The history comes from the audit trail, so it outlives the sub-zones the address belonged to.
+func (s *AllocationService) GetIPHistory(ctx context.Context, ip string, query *models.AuditQuery) (_ map[string]interface{}, err error) {
+	ctx, span := startSpan(ctx, "AllocationService.GetIPHistory", "", "", "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Debug("Getting IP history",
+		zap.String("ip", ip),
+		zap.Time("since", query.Since),
+		zap.Time("until", query.Until))
+
+	current, err := s.ips.find(ctx, storage.IPFilter{Tenant: TenantFromContext(ctx), IPAddresses: []string{ip}})
+	if err != nil {
+		s.log(ctx).Error("Failed to find current holders of IP", zap.Error(err), zap.String("ip", ip))
+		return nil, err
+	}
+	if current == nil {
+		current = []models.IPAllocation{}
+	}
+
+	history, err := s.audit.ipHistory(ctx, ip, query)
+	if err != nil {
+		s.log(ctx).Error("Failed to read IP history from audit trail", zap.Error(err), zap.String("ip", ip))
+		return nil, err
+	}
+
+	s.log(ctx).Debug("IP history retrieved",
+		zap.String("ip", ip),
+		zap.Int("current_count", len(current)),
+		zap.Int("history_count", len(history)))
+
+	return map[string]interface{}{
+		"success":    true,
+		"ip_address": ip,
+		"current":    current,
+		"history":    history,
+		"count":      len(history),
+		"timestamp":  time.Now().Format(time.RFC3339),
+	}, nil
+}
+
+// ipHistory turns the successful IP events touching the address into history entries,
+// one per sub-zone the event changed the address in
+func (s *AuditService) ipHistory(ctx context.Context, ip string, query *models.AuditQuery) ([]models.IPHistoryEntry, error) {
+	filter := auditFilter(ctx, &models.AuditQuery{Since: query.Since, Until: query.Until, Limit: query.Limit})
+	filter.IPAddress = ip
+	filter.ResourceType = models.AuditResourceIP
+	filter.Outcome = models.AuditOutcomeSuccess
+	raws, err := s.repo.FindAuditEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []models.IPHistoryEntry{}
+	for _, raw := range raws {
+		var event ipAuditEvent
+		if err := bson.Unmarshal(raw, &event); err != nil {
+			return nil, err
+		}
+
+		// Key the snapshots by sub-zone; the after state wins when the address was changed in place
+		changes := make(map[[3]string]*models.IPHistoryEntry)
+		var order [][3]string
+		apply := func(doc models.IPAllocation, status string) {
+			key := [3]string{doc.Region, doc.Zone, doc.SubZone}
+			entry, ok := changes[key]
+			if !ok {
+				entry = &models.IPHistoryEntry{
+					Timestamp:    event.Timestamp,
+					Action:       event.Action,
+					Region:       doc.Region,
+					Zone:         doc.Zone,
+					SubZone:      doc.SubZone,
+					ResourcePath: subZonePath(doc.Region, doc.Zone, doc.SubZone),
+					Actor:        event.Actor,
+					ClientIP:     event.ClientIP,
+					RequestID:    event.RequestID,
+					Message:      event.Message,
+				}
+				changes[key] = entry
+				order = append(order, key)
+			}
+			entry.Status = status
+			entry.ExpiresAt = doc.ExpiresAt
+			entry.PairedIP = doc.PairedIP
+			entry.IPMetadata = doc.IPMetadata
+		}
+
+		for _, doc := range event.Before {
+			if doc.IPAddress == ip {
+				apply(doc, models.IPStatusReleased)
+			}
+		}
+		for _, doc := range event.After {
+			if doc.IPAddress == ip {
+				apply(doc, doc.Status)
+			}
+		}
+
+		for _, key := range order {
+			history = append(history, *changes[key])
+		}
+	}
+	return history, nil
+}
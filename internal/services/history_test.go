@@ -0,0 +1,78 @@
+package services
+
+import (
+	"testing"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+func TestIPHistoryOutlivesTheSubZone(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/24")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	crud := NewCRUDService(repo, zap.NewNop())
+	ctx := tenantContext(models.DefaultTenant)
+
+	allocate := func(owner string, ttl int64) {
+		t.Helper()
+		req := allocationRequest(1)
+		req.Owner = owner
+		req.TTL = ttl
+		if response, err := service.AllocateIPs(ctx, req); err != nil || response.AllocatedIPs[0] != "10.0.1.1" {
+			t.Fatalf("AllocateIPs = %v, %v, want 10.0.1.1", response, err)
+		}
+	}
+
+	allocate("web", 0)
+	release := &models.DeallocationRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPAddresses: []string{"10.0.1.1"}}
+	if _, err := service.DeallocateIPs(ctx, release); err != nil {
+		t.Fatalf("DeallocateIPs: %v", err)
+	}
+	allocate("db", 60)
+	renew := &models.RenewRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPAddresses: []string{"10.0.1.1"}, TTL: 3600}
+	if _, err := service.RenewLeases(ctx, renew); err != nil {
+		t.Fatalf("RenewLeases: %v", err)
+	}
+	if _, err := crud.DeleteSubZone(ctx, "r1", "z1", "s1"); err != nil {
+		t.Fatalf("DeleteSubZone: %v", err)
+	}
+
+	result, err := service.GetIPHistory(ctx, "10.0.1.1", &models.AuditQuery{})
+	if err != nil {
+		t.Fatalf("GetIPHistory: %v", err)
+	}
+	if current := result["current"].([]models.IPAllocation); len(current) != 0 {
+		t.Fatalf("current holders = %+v, want none after the sub-zone was deleted", current)
+	}
+
+	want := []struct {
+		action, status, owner string
+		leased                bool
+	}{
+		{models.AuditActionDelete, models.IPStatusReleased, "db", true},
+		{models.AuditActionRenew, models.IPStatusAllocated, "db", true},
+		{models.AuditActionAllocate, models.IPStatusAllocated, "db", true},
+		{models.AuditActionDeallocate, models.IPStatusReleased, "web", false},
+		{models.AuditActionAllocate, models.IPStatusAllocated, "web", false},
+	}
+	history := result["history"].([]models.IPHistoryEntry)
+	if len(history) != len(want) {
+		t.Fatalf("history has %d entries, want %d: %+v", len(history), len(want), history)
+	}
+	for i, w := range want {
+		entry := history[i]
+		if entry.Action != w.action || entry.Status != w.status || entry.Owner != w.owner || (entry.ExpiresAt != nil) != w.leased {
+			t.Fatalf("history[%d] = %s %s by %s (expires %v), want %s %s by %s", i, entry.Action, entry.Status, entry.Owner, entry.ExpiresAt, w.action, w.status, w.owner)
+		}
+		if entry.ResourcePath != "regions/r1/zones/z1/subzones/s1" || entry.Actor != "test" {
+			t.Fatalf("history[%d] at %s by %s, want the sub-zone path and the test actor", i, entry.ResourcePath, entry.Actor)
+		}
+	}
+	if !history[1].ExpiresAt.After(*history[2].ExpiresAt) {
+		t.Fatalf("renewal moved the expiry from %v to %v, want it later", history[2].ExpiresAt, history[1].ExpiresAt)
+	}
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// idempotencyLockTimeout is how long a pending key blocks retries before it is considered
+// abandoned, e.g. because the instance handling it crashed. It must exceed the handler timeouts.
+const idempotencyLockTimeout = 2 * time.Minute
+
+// IdempotencyService persists Idempotency-Key records so retried requests replay the original response
+type IdempotencyService struct {
+	repo   storage.IdempotencyRepository
+	window time.Duration
+	logger *zap.Logger
+}
+
+func NewIdempotencyService(repo storage.IdempotencyRepository, window time.Duration, logger *zap.Logger) *IdempotencyService {
+	return &IdempotencyService{
+		repo:   repo,
+		window: window,
+		logger: logger,
+	}
+}
+
+// log returns the request-scoped logger of ctx, falling back to the service logger
+func (s *IdempotencyService) log(ctx context.Context) *zap.Logger {
+	return LoggerFromContext(ctx, s.logger)
+}
+
+// Begin claims the key for a new request. When the key was already used it returns the existing
+// record and false; the caller decides whether to replay it or reject the request.
+func (s *IdempotencyService) Begin(ctx context.Context, key, operation, requestHash string) (*models.IdempotencyRecord, bool, error) {
+	now := time.Now()
+	record := &models.IdempotencyRecord{
+		Key:         key,
+		Operation:   operation,
+		RequestHash: requestHash,
+		State:       models.IdempotencyStatePending,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.window),
+	}
+
+	err := s.repo.InsertIdempotencyRecord(ctx, record)
+	if err == nil {
+		s.log(ctx).Debug("Idempotency key claimed",
+			zap.String("key", key),
+			zap.String("operation", operation))
+		return record, true, nil
+	}
+	if !errors.Is(err, storage.ErrDuplicate) {
+		return nil, false, err
+	}
+
+	existing, err := s.repo.GetIdempotencyRecord(ctx, key, operation)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			// The record expired between the insert and the read; let the client retry
+			return nil, false, errors.New("idempotency key expired while being read, retry the request")
+		}
+		return nil, false, err
+	}
+
+	// Reuse a key whose record outlived the window but was not yet removed, or take over a
+	// pending key whose request never completed
+	expired := now.After(existing.ExpiresAt)
+	abandoned := existing.State == models.IdempotencyStatePending && existing.RequestHash == requestHash &&
+		now.Sub(existing.CreatedAt) > idempotencyLockTimeout
+	if expired || abandoned {
+		reclaimed, err := s.repo.ReclaimIdempotencyRecord(ctx, existing, *record)
+		if err != nil {
+			return nil, false, err
+		}
+		if reclaimed {
+			s.log(ctx).Warn("Reclaimed idempotency key",
+				zap.String("key", key),
+				zap.String("operation", operation),
+				zap.Bool("expired", expired),
+				zap.Time("original_created_at", existing.CreatedAt))
+			record.ID = existing.ID
+			return record, true, nil
+		}
+	}
+
+	return &existing, false, nil
+}
+
+// Complete stores the response of the request that claimed the key
+func (s *IdempotencyService) Complete(ctx context.Context, record *models.IdempotencyRecord, statusCode int, contentType string, body []byte) error {
+	return s.repo.CompleteIdempotencyRecord(ctx, record.Key, record.Operation, statusCode, contentType, body)
+}
+
+// Release forgets a claimed key so the request can be retried, used when it failed server-side
+func (s *IdempotencyService) Release(ctx context.Context, record *models.IdempotencyRecord) error {
+	return s.repo.ReleaseIdempotencyRecord(ctx, record.Key, record.Operation)
+}
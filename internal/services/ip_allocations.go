@@ -0,0 +1,330 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/utils"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// ipAllocationStore adapts the IP repository to the services: it scopes every query to the
+// request's tenant and fills sub-zone IP lists from the stored documents. The repository
+// guarantees that an address can only be claimed once.
+type ipAllocationStore struct {
+	repo   storage.IPRepository
+	logger *zap.Logger
+}
+
+func newIPAllocationStore(repo storage.IPRepository, logger *zap.Logger) *ipAllocationStore {
+	return &ipAllocationStore{
+		repo:   repo,
+		logger: logger,
+	}
+}
+
+// log returns the request-scoped logger of ctx, falling back to the service logger
+func (st *ipAllocationStore) log(ctx context.Context) *zap.Logger {
+	return LoggerFromContext(ctx, st.logger)
+}
+
+// ipSubZoneFilter matches every IP document that belongs to a sub-zone of the request's tenant
+func ipSubZoneFilter(ctx context.Context, regionName, zoneName, subZoneName string) storage.IPFilter {
+	return storage.IPFilter{
+		Tenant:  TenantFromContext(ctx),
+		Region:  regionName,
+		Zone:    zoneName,
+		SubZone: subZoneName,
+	}
+}
+
+// find returns IP documents in the order they were created
+func (st *ipAllocationStore) find(ctx context.Context, filter storage.IPFilter) ([]models.IPAllocation, error) {
+	return st.repo.FindIPs(ctx, filter)
+}
+
+// loadSubZone replaces the sub-zone's IP lists with the stored state
+func (st *ipAllocationStore) loadSubZone(ctx context.Context, regionName, zoneName string, subZone *models.SubZone) error {
+	docs, err := st.find(ctx, ipSubZoneFilter(ctx, regionName, zoneName, subZone.Name))
+	if err != nil {
+		return err
+	}
+
+	resetIPLists(subZone)
+	for _, doc := range docs {
+		appendIPToSubZone(subZone, doc)
+	}
+	return nil
+}
+
+// loadRegions replaces the IP lists of every sub-zone in the given regions, which all belong
+// to the request's tenant
+func (st *ipAllocationStore) loadRegions(ctx context.Context, regions []models.Region) error {
+	if len(regions) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(regions))
+	subZones := make(map[[3]string]*models.SubZone)
+	for i := range regions {
+		names = append(names, regions[i].Name)
+		for j := range regions[i].Zones {
+			zone := &regions[i].Zones[j]
+			for k := range zone.SubZones {
+				resetIPLists(&zone.SubZones[k])
+				subZones[[3]string{regions[i].Name, zone.Name, zone.SubZones[k].Name}] = &zone.SubZones[k]
+			}
+		}
+	}
+
+	docs, err := st.find(ctx, storage.IPFilter{Tenant: TenantFromContext(ctx), Regions: names})
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		if subZone, ok := subZones[[3]string{doc.Region, doc.Zone, doc.SubZone}]; ok {
+			appendIPToSubZone(subZone, doc)
+		}
+	}
+	return nil
+}
+
+// insert stores one document per IP, copying every other field from the template. If any
+// IP already has a document nothing is stored and errAllocationConflict is returned.
+func (st *ipAllocationStore) insert(ctx context.Context, template models.IPAllocation, ips []string) error {
+	return st.insertDocs(ctx, newIPAllocations(template, ips, time.Now()))
+}
+
+// insertDocs stores the given IP documents all-or-nothing, see insert
+func (st *ipAllocationStore) insertDocs(ctx context.Context, allocations []models.IPAllocation) error {
+	err := st.repo.InsertIPs(ctx, allocations)
+	if errors.Is(err, storage.ErrDuplicate) {
+		return errAllocationConflict
+	}
+	return err
+}
+
+// remove deletes the documents for the given IPs when they are in the given status
+func (st *ipAllocationStore) remove(ctx context.Context, regionName, zoneName, subZoneName, status string, ips []string) error {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	filter := ipSubZoneFilter(ctx, regionName, zoneName, subZoneName)
+	filter.Status = status
+	filter.IPAddresses = ips
+
+	if _, err := st.repo.DeleteIPs(ctx, filter); err != nil {
+		return err
+	}
+	st.recordReleased(ctx, filter.Tenant, storage.IPLocation{Region: regionName, Zone: zoneName, SubZone: subZoneName}, ips)
+	return nil
+}
+
+// recordReleased remembers when addresses were released, for the least-recently-used strategy.
+// Losing the record only makes the addresses look unused, so failures are logged rather than
+// failing the release.
+func (st *ipAllocationStore) recordReleased(ctx context.Context, tenant string, at storage.IPLocation, ips []string) {
+	now := time.Now()
+	released := make([]models.ReleasedIP, 0, len(ips))
+	for _, ip := range ips {
+		released = append(released, models.ReleasedIP{IPAddress: ip, ReleasedAt: now})
+	}
+
+	if err := st.repo.RecordReleasedIPs(ctx, tenant, at, released, releaseHistorySize); err != nil {
+		st.log(ctx).Warn("Failed to record released IPs",
+			zap.Error(err),
+			zap.String("region", at.Region),
+			zap.String("zone", at.Zone),
+			zap.String("subzone", at.SubZone),
+			zap.Int("ip_count", len(ips)))
+	}
+}
+
+// renew moves the expiry of an allocated IP whose lease has not yet run out at now
+func (st *ipAllocationStore) renew(ctx context.Context, regionName, zoneName, subZoneName, ip string, expiresAt, now time.Time) (bool, error) {
+	filter := ipSubZoneFilter(ctx, regionName, zoneName, subZoneName)
+	filter.IPAddresses = []string{ip}
+
+	renewed, err := st.repo.RenewLeases(ctx, filter, expiresAt, now)
+	if err != nil {
+		return false, err
+	}
+	return renewed > 0, nil
+}
+
+// unpair removes the host pair link from IPs whose partner is one of the given IPs and
+// returns how many were unlinked
+func (st *ipAllocationStore) unpair(ctx context.Context, regionName, zoneName, subZoneName string, partners []string) (int64, error) {
+	if len(partners) == 0 {
+		return 0, nil
+	}
+
+	filter := ipSubZoneFilter(ctx, regionName, zoneName, subZoneName)
+	filter.PairedIPs = partners
+
+	return st.repo.UnpairIPs(ctx, filter)
+}
+
+// findBySelector returns the allocated IPs of a sub-zone held by the owner and carrying all of the labels
+func (st *ipAllocationStore) findBySelector(ctx context.Context, regionName, zoneName, subZoneName, owner string, labels map[string]string) ([]models.IPAllocation, error) {
+	filter := ipSubZoneFilter(ctx, regionName, zoneName, subZoneName)
+	filter.Status = models.IPStatusAllocated
+	filter.Owner = owner
+	filter.Labels = labels
+	return st.find(ctx, filter)
+}
+
+// findHeld returns the documents of a sub-zone holding any of the given IPs in the given status
+func (st *ipAllocationStore) findHeld(ctx context.Context, regionName, zoneName, subZoneName, status string, ips []string) ([]models.IPAllocation, error) {
+	if len(ips) == 0 {
+		return nil, nil
+	}
+
+	filter := ipSubZoneFilter(ctx, regionName, zoneName, subZoneName)
+	filter.Status = status
+	filter.IPAddresses = ips
+	return st.find(ctx, filter)
+}
+
+// countExpiring counts allocated IPs matching the filter whose lease ends between from and until
+func (st *ipAllocationStore) countExpiring(ctx context.Context, filter storage.IPFilter, from, until time.Time) (int64, error) {
+	filter.Status = models.IPStatusAllocated
+	filter.ExpiresAfter = from
+	filter.ExpiresBy = until
+	return st.repo.CountIPs(ctx, filter)
+}
+
+// findExpired returns up to limit allocated IPs whose lease ended before now
+func (st *ipAllocationStore) findExpired(ctx context.Context, now time.Time, limit int64) ([]models.IPAllocation, error) {
+	return st.repo.FindExpiredIPs(ctx, now, limit)
+}
+
+// releaseExpired deletes an expired lease unless it was renewed after it was read
+func (st *ipAllocationStore) releaseExpired(ctx context.Context, doc models.IPAllocation, now time.Time) (bool, error) {
+	released, err := st.repo.ReleaseExpiredIP(ctx, doc.ID, now)
+	if err != nil || !released {
+		return released, err
+	}
+	st.recordReleased(ctx, doc.Tenant, storage.IPLocation{Region: doc.Region, Zone: doc.Zone, SubZone: doc.SubZone}, []string{doc.IPAddress})
+	return true, nil
+}
+
+// deleteMatching removes all IP documents matching the filter, used when a region, zone or sub-zone is deleted
+func (st *ipAllocationStore) deleteMatching(ctx context.Context, filter storage.IPFilter) error {
+	deleted, err := st.repo.DeleteIPs(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	st.log(ctx).Debug("Removed IP documents",
+		zap.Any("filter", filter),
+		zap.Int64("deleted_count", deleted))
+
+	// A stale cursor would only skew the order of a sub-zone later created under the same name
+	if err := st.repo.DeleteAllocationCursors(ctx, filter); err != nil {
+		st.log(ctx).Warn("Failed to remove allocation cursors",
+			zap.Error(err),
+			zap.Any("filter", filter))
+	}
+	return nil
+}
+
+// renameMatching rewrites the hierarchy fields of IP documents after a region, zone or sub-zone is renamed
+func (st *ipAllocationStore) renameMatching(ctx context.Context, filter storage.IPFilter, to storage.IPLocation) error {
+	moved, err := st.repo.MoveIPs(ctx, filter, to)
+	if err != nil {
+		return err
+	}
+
+	st.log(ctx).Debug("Renamed IP documents",
+		zap.Any("filter", filter),
+		zap.Int64("modified_count", moved))
+
+	// A cursor left behind only costs the renamed sub-zone its allocation order
+	if err := st.repo.MoveAllocationCursors(ctx, filter, to); err != nil {
+		st.log(ctx).Warn("Failed to rename allocation cursors",
+			zap.Error(err),
+			zap.Any("filter", filter))
+	}
+	return nil
+}
+
+// ipVersion returns the version stored with a valid address
+func ipVersion(ip string) string {
+	if utils.IsIPv4(net.ParseIP(ip)) {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// newIPAllocations builds one document per IP from the template
+func newIPAllocations(template models.IPAllocation, ips []string, now time.Time) []models.IPAllocation {
+	docs := make([]models.IPAllocation, 0, len(ips))
+	for _, ip := range ips {
+		doc := template
+		doc.ID = primitive.NewObjectID()
+		doc.IPAddress = ip
+		doc.IPVersion = ipVersion(ip)
+		doc.CreatedAt = now
+		doc.UpdatedAt = now
+
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// ipTemplate returns the document fields shared by every IP written to a sub-zone in one operation
+func ipTemplate(tenant, regionName, zoneName, subZoneName, status string) models.IPAllocation {
+	return models.IPAllocation{
+		Tenant:  tenant,
+		Region:  regionName,
+		Zone:    zoneName,
+		SubZone: subZoneName,
+		Status:  status,
+	}
+}
+
+// embeddedIPAllocations converts the legacy arrays embedded in a sub-zone into IP documents
+func embeddedIPAllocations(tenant, regionName, zoneName string, subZone *models.SubZone, now time.Time) []models.IPAllocation {
+	allocated := ipTemplate(tenant, regionName, zoneName, subZone.Name, models.IPStatusAllocated)
+	reserved := ipTemplate(tenant, regionName, zoneName, subZone.Name, models.IPStatusReserved)
+
+	var docs []models.IPAllocation
+	docs = append(docs, newIPAllocations(allocated, subZone.AllocatedIPv4, now)...)
+	docs = append(docs, newIPAllocations(allocated, subZone.AllocatedIPv6, now)...)
+	docs = append(docs, newIPAllocations(reserved, subZone.ReservedIPv4, now)...)
+	docs = append(docs, newIPAllocations(reserved, subZone.ReservedIPv6, now)...)
+	return docs
+}
+
+// resetIPLists clears a sub-zone's IP lists before they are filled from the stored documents
+func resetIPLists(subZone *models.SubZone) {
+	subZone.AllocatedIPv4 = []string{}
+	subZone.AllocatedIPv6 = []string{}
+	subZone.ReservedIPv4 = []string{}
+	subZone.ReservedIPv6 = []string{}
+	subZone.IPs = nil
+}
+
+// appendIPToSubZone adds an IP document to the matching list of the sub-zone
+func appendIPToSubZone(subZone *models.SubZone, doc models.IPAllocation) {
+	subZone.IPs = append(subZone.IPs, doc)
+	switch {
+	case doc.Status == models.IPStatusAllocated && doc.IPVersion == "ipv4":
+		subZone.AllocatedIPv4 = append(subZone.AllocatedIPv4, doc.IPAddress)
+	case doc.Status == models.IPStatusAllocated && doc.IPVersion == "ipv6":
+		subZone.AllocatedIPv6 = append(subZone.AllocatedIPv6, doc.IPAddress)
+	case doc.Status == models.IPStatusReserved && doc.IPVersion == "ipv4":
+		subZone.ReservedIPv4 = append(subZone.ReservedIPv4, doc.IPAddress)
+	case doc.Status == models.IPStatusReserved && doc.IPVersion == "ipv6":
+		subZone.ReservedIPv6 = append(subZone.ReservedIPv6, doc.IPAddress)
+	}
+}
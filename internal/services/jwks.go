@@ -0,0 +1,342 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// jwksMinRefetchInterval bounds how often an unknown key id triggers a reload, so tokens
+	// with made-up key ids cannot hammer the JWKS endpoint
+	jwksMinRefetchInterval = time.Minute
+	defaultJWKSRefresh     = 15 * time.Minute
+	jwksFetchTimeout       = 10 * time.Second
+	jwksMaxBodySize        = 1 << 20
+)
+
+var (
+	// errKeySetUnavailable is returned when no key set could be loaded at all
+	errKeySetUnavailable = errors.New("JWKS unavailable")
+	// errUnknownSigningKey is returned for a key id the key set does not contain
+	errUnknownSigningKey = errors.New("unknown signing key")
+)
+
+// JSONWebKey is the subset of RFC 7517 needed for RS256 and ES256 verification keys
+type JSONWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid,omitempty"`
+	Use     string `json:"use,omitempty"`
+	Alg     string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is a JWKS document
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS serves token verification keys loaded from a JWKS file or URL. Keys are cached and
+// reloaded once the refresh interval has passed, or sooner when a token names an unknown key
+// id, which is how issuers roll keys. No lock is held while loading, so lookups of cached
+// keys go ahead during a reload, and callers needing a reload at the same time share one.
+type JWKS struct {
+	file    string
+	url     string
+	refresh time.Duration
+	client  *http.Client
+	logger  *zap.Logger
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+	// last is the latest reload, possibly still running; its start time is the age of the keys
+	last *jwksLoad
+}
+
+// jwksLoad is one reload of the key set; done is closed once err is set
+type jwksLoad struct {
+	startedAt time.Time
+	done      chan struct{}
+	err       error
+}
+
+func (l *jwksLoad) running() bool {
+	select {
+	case <-l.done:
+		return false
+	default:
+		return true
+	}
+}
+
+func NewJWKS(file, url string, refresh time.Duration, logger *zap.Logger) (*JWKS, error) {
+	if (file == "") == (url == "") {
+		return nil, errors.New("exactly one of the JWKS file and URL must be set")
+	}
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	return &JWKS{
+		file:    file,
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: jwksFetchTimeout},
+		logger:  logger,
+	}, nil
+}
+
+// Key returns the verification key with the given id. An empty id selects the only key of a
+// single-key set.
+func (j *JWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	keys, loadedAt := j.snapshot()
+	if keys == nil || time.Since(loadedAt) >= j.refresh {
+		err := j.reload(ctx, loadedAt)
+		if keys, loadedAt = j.snapshot(); keys == nil {
+			return nil, fmt.Errorf("%w: %v", errKeySetUnavailable, err)
+		}
+	}
+
+	if key, ok := lookupKey(keys, kid); ok {
+		return key, nil
+	}
+
+	if time.Since(loadedAt) >= jwksMinRefetchInterval {
+		if err := j.reload(ctx, loadedAt); err == nil {
+			keys, _ = j.snapshot()
+			if key, ok := lookupKey(keys, kid); ok {
+				return key, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", errUnknownSigningKey, kid)
+}
+
+// snapshot returns the cached keys and when their last reload started. The map is never
+// modified once loaded, so it can be read without the lock.
+func (j *JWKS) snapshot() (map[string]crypto.PublicKey, time.Time) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if j.last == nil {
+		return j.keys, time.Time{}
+	}
+	return j.keys, j.last.startedAt
+}
+
+func lookupKey(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+// reload waits for a reload of the key set that started after stale, the age of the keys the
+// caller found wanting, and starts one if there is none. On failure the previous keys stay in
+// use.
+func (j *JWKS) reload(ctx context.Context, stale time.Time) error {
+	j.mu.Lock()
+	load := j.last
+	if load == nil || (!load.running() && !load.startedAt.After(stale)) {
+		// Failed loads also count, so an unreachable endpoint is not retried on every request
+		load = &jwksLoad{startedAt: time.Now(), done: make(chan struct{})}
+		j.last = load
+		// The reload is shared, so it must not be cut short when this caller gives up
+		go j.load(context.WithoutCancel(ctx), load)
+	}
+	j.mu.Unlock()
+
+	select {
+	case <-load.done:
+		return load.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (j *JWKS) load(ctx context.Context, load *jwksLoad) {
+	defer close(load.done)
+
+	data, err := j.read(ctx)
+	if err != nil {
+		j.logger.Error("Failed to load JWKS",
+			zap.Error(err),
+			zap.String("file", j.file),
+			zap.String("url", j.url))
+		load.err = err
+		return
+	}
+
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		j.logger.Error("Failed to parse JWKS",
+			zap.Error(err),
+			zap.String("file", j.file),
+			zap.String("url", j.url))
+		load.err = err
+		return
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	j.logger.Info("JWKS loaded",
+		zap.Int("key_count", len(keys)),
+		zap.String("file", j.file),
+		zap.String("url", j.url))
+}
+
+func (j *JWKS) read(ctx context.Context) ([]byte, error) {
+	if j.file != "" {
+		return os.ReadFile(j.file)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, jwksFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, jwksMaxBodySize))
+}
+
+// ParseJWKS decodes the RSA and P-256 signing keys of a JWKS document, keyed by key id. Keys
+// of other types or meant for encryption are skipped.
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set JSONWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		var key crypto.PublicKey
+		var err error
+		switch jwk.KeyType {
+		case "RSA":
+			key, err = jwk.rsaPublicKey()
+		case "EC":
+			key, err = jwk.ecdsaPublicKey()
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %v", jwk.KeyID, err)
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS contains no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k *JSONWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %v", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %v", err)
+	}
+
+	exponent := new(big.Int).SetBytes(e)
+	if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA key parameters")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+func (k *JSONWebKey) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	if k.Curve != "P-256" {
+		return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x coordinate: %v", err)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("invalid y coordinate: %v", err)
+	}
+
+	key := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(x),
+		Y:     new(big.Int).SetBytes(y),
+	}
+	if !key.Curve.IsOnCurve(key.X, key.Y) {
+		return nil, errors.New("point is not on curve P-256")
+	}
+	return key, nil
+}
+
+// NewJSONWebKey returns the JWKS form of an RSA or P-256 public key, for publishing locally
+// generated keys
+func NewJSONWebKey(kid string, key crypto.PublicKey) (JSONWebKey, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			KeyType: "RSA",
+			KeyID:   kid,
+			Use:     "sig",
+			Alg:     "RS256",
+			N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return JSONWebKey{}, errors.New("only P-256 keys are supported")
+		}
+		coordinate := func(v *big.Int) string {
+			return base64.RawURLEncoding.EncodeToString(v.FillBytes(make([]byte, 32)))
+		}
+		return JSONWebKey{
+			KeyType: "EC",
+			KeyID:   kid,
+			Use:     "sig",
+			Alg:     "ES256",
+			Curve:   "P-256",
+			X:       coordinate(key.X),
+			Y:       coordinate(key.Y),
+		}, nil
+	}
+	return JSONWebKey{}, fmt.Errorf("unsupported key type %T", key)
+}
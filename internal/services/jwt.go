@@ -0,0 +1,155 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+// SigningKeySource provides token verification keys by key id
+type SigningKeySource interface {
+	Key(ctx context.Context, kid string) (crypto.PublicKey, error)
+}
+
+// StaticKeySet is a fixed SigningKeySource, for locally generated keys
+type StaticKeySet map[string]crypto.PublicKey
+
+func (s StaticKeySet) Key(_ context.Context, kid string) (crypto.PublicKey, error) {
+	if kid == "" && len(s) == 1 {
+		for _, key := range s {
+			return key, nil
+		}
+	}
+	if key, ok := s[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: %q", errUnknownSigningKey, kid)
+}
+
+// TokenVerifier validates RS256 and ES256 bearer tokens and maps their claims to a principal
+type TokenVerifier struct {
+	keys         SigningKeySource
+	parser       *jwt.Parser
+	subjectClaim string
+	rolesClaim   string
+	mappings     []config.JWTRoleMapping
+	logger       *zap.Logger
+}
+
+func NewTokenVerifier(cfg config.JWTConfig, keys SigningKeySource, logger *zap.Logger) (*TokenVerifier, error) {
+	mappings := make([]config.JWTRoleMapping, len(cfg.RoleMappings))
+	for i, mapping := range cfg.RoleMappings {
+		switch {
+		case mapping.Value == "":
+			return nil, fmt.Errorf("role mapping %d: value is required", i)
+		case !models.IsValidRole(mapping.Role):
+			return nil, fmt.Errorf("role mapping %d: unknown role %q", i, mapping.Role)
+		case mapping.Zone != "" && mapping.Region == "":
+			return nil, fmt.Errorf("role mapping %d: zone requires region", i)
+		}
+		// Region scopes predate tenants and refer to the default tenant's regions
+		if mapping.Region != "" && mapping.Tenant == "" {
+			mapping.Tenant = models.DefaultTenant
+		}
+		mappings[i] = mapping
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.Leeway),
+	}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		options = append(options, jwt.WithAudience(cfg.Audience))
+	}
+
+	subjectClaim := cfg.SubjectClaim
+	if subjectClaim == "" {
+		subjectClaim = "sub"
+	}
+
+	return &TokenVerifier{
+		keys:         keys,
+		parser:       jwt.NewParser(options...),
+		subjectClaim: subjectClaim,
+		rolesClaim:   cfg.RolesClaim,
+		mappings:     mappings,
+		logger:       logger,
+	}, nil
+}
+
+// Verify checks the token's signature, expiry, issuer and audience and returns its principal.
+// A token matching no role mapping yields a principal without a role, which is authenticated
+// but not authorized for anything.
+func (v *TokenVerifier) Verify(ctx context.Context, raw string) (*models.Principal, error) {
+	claims := jwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.keys.Key(ctx, kid)
+	})
+	if errors.Is(err, errKeySetUnavailable) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	subject, _ := claims[v.subjectClaim].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: token has no %s claim", ErrInvalidCredentials, v.subjectClaim)
+	}
+
+	principal := &models.Principal{
+		Subject: models.AuthMethodJWT + ":" + subject,
+		Method:  models.AuthMethodJWT,
+	}
+
+	values := claimValues(claims[v.rolesClaim])
+	for _, mapping := range v.mappings {
+		if slices.Contains(values, mapping.Value) {
+			principal.Role = mapping.Role
+			principal.Tenant = mapping.Tenant
+			principal.Region = mapping.Region
+			principal.Zone = mapping.Zone
+			break
+		}
+	}
+
+	if principal.Role == "" {
+		LoggerFromContext(ctx, v.logger).Warn("Token matched no role mapping",
+			zap.String("subject", principal.Subject),
+			zap.String("roles_claim", v.rolesClaim),
+			zap.Strings("values", values))
+	}
+	return principal, nil
+}
+
+// claimValues reads a claim holding a list of strings or a space separated string, like the
+// OAuth scope claim
+func claimValues(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Fields(claim)
+	case []interface{}:
+		values := make([]string, 0, len(claim))
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
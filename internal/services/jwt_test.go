@@ -0,0 +1,342 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	key    crypto.Signer
+}
+
+func newRSAKey(t *testing.T, kid string) signingKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	return signingKey{kid: kid, method: jwt.SigningMethodRS256, key: key}
+}
+
+func newECKey(t *testing.T, kid string) signingKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	return signingKey{kid: kid, method: jwt.SigningMethodES256, key: key}
+}
+
+func (k signingKey) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.kid
+	raw, err := token.SignedString(k.key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	return raw
+}
+
+// jwksDocument publishes the public halves of keys
+func jwksDocument(t *testing.T, keys ...signingKey) []byte {
+	t.Helper()
+	var set JSONWebKeySet
+	for _, key := range keys {
+		jwk, err := NewJSONWebKey(key.kid, key.key.Public())
+		if err != nil {
+			t.Fatalf("NewJSONWebKey: %v", err)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	return data
+}
+
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"sub":    "alice",
+		"iss":    "https://issuer.example",
+		"aud":    "ip-allocator",
+		"iat":    now.Unix(),
+		"nbf":    now.Add(-time.Minute).Unix(),
+		"exp":    now.Add(time.Hour).Unix(),
+		"groups": []string{"ops"},
+	}
+}
+
+func newVerifier(t *testing.T, keys SigningKeySource, mappings ...config.JWTRoleMapping) *TokenVerifier {
+	t.Helper()
+	if mappings == nil {
+		mappings = []config.JWTRoleMapping{{Value: "ops", Role: models.RoleAllocator, Tenant: "t1"}}
+	}
+	verifier, err := NewTokenVerifier(config.JWTConfig{
+		Issuer:       "https://issuer.example",
+		Audience:     "ip-allocator",
+		RolesClaim:   "groups",
+		RoleMappings: mappings,
+	}, keys, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewTokenVerifier: %v", err)
+	}
+	return verifier
+}
+
+func TestTokenVerifierClaims(t *testing.T) {
+	rsaKey, ecKey := newRSAKey(t, "rsa"), newECKey(t, "ec")
+	keys, err := ParseJWKS(jwksDocument(t, rsaKey, ecKey))
+	if err != nil {
+		t.Fatalf("ParseJWKS: %v", err)
+	}
+	verifier := newVerifier(t, StaticKeySet(keys))
+
+	with := func(name string, value interface{}) jwt.MapClaims {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	forged := newRSAKey(t, "rsa")
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid RS256", rsaKey.sign(t, validClaims()), true},
+		{"valid ES256", ecKey.sign(t, validClaims()), true},
+		{"bad signature", forged.sign(t, validClaims()), false},
+		{"key of the other algorithm", signingKey{kid: "ec", method: jwt.SigningMethodRS256, key: forged.key}.sign(t, validClaims()), false},
+		{"expired", rsaKey.sign(t, with("exp", time.Now().Add(-time.Minute).Unix())), false},
+		{"no expiry", rsaKey.sign(t, with("exp", nil)), false},
+		{"not yet valid", rsaKey.sign(t, with("nbf", time.Now().Add(time.Hour).Unix())), false},
+		{"other issuer", rsaKey.sign(t, with("iss", "https://other.example")), false},
+		{"other audience", rsaKey.sign(t, with("aud", "other")), false},
+		{"audience list", rsaKey.sign(t, with("aud", []string{"other", "ip-allocator"})), true},
+		{"no subject", rsaKey.sign(t, with("sub", nil)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := verifier.Verify(context.Background(), tt.token)
+			if !tt.valid {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Fatalf("Verify = %v, %v, want ErrInvalidCredentials", principal, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if principal.Subject != "jwt:alice" || principal.Role != models.RoleAllocator || principal.Tenant != "t1" {
+				t.Fatalf("Verify = %+v, want allocator jwt:alice of t1", principal)
+			}
+		})
+	}
+}
+
+func TestTokenVerifierRoleMappingOrder(t *testing.T) {
+	key := newRSAKey(t, "k1")
+	verifier := newVerifier(t, StaticKeySet{"k1": key.key.Public()},
+		config.JWTRoleMapping{Value: "admins", Role: models.RoleAdmin},
+		config.JWTRoleMapping{Value: "ops", Role: models.RoleAllocator, Tenant: "t1"},
+		config.JWTRoleMapping{Value: "ops-eu", Role: models.RoleViewer, Region: "eu"},
+	)
+
+	tests := []struct {
+		name   string
+		groups interface{}
+		want   models.Principal
+	}{
+		{"first mapping wins over claim order", []string{"ops", "admins"}, models.Principal{Role: models.RoleAdmin}},
+		{"later mapping", []string{"ops-eu", "ops"}, models.Principal{Role: models.RoleAllocator, Tenant: "t1"}},
+		{"region defaults to the default tenant", "ops-eu other", models.Principal{Role: models.RoleViewer, Tenant: models.DefaultTenant, Region: "eu"}},
+		{"no match", []string{"unknown"}, models.Principal{}},
+		{"no claim", nil, models.Principal{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			claims["groups"] = tt.groups
+			principal, err := verifier.Verify(context.Background(), key.sign(t, claims))
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if principal.Role != tt.want.Role || principal.Tenant != tt.want.Tenant || principal.Region != tt.want.Region {
+				t.Fatalf("Verify = %+v, want role %q, tenant %q, region %q", principal, tt.want.Role, tt.want.Tenant, tt.want.Region)
+			}
+		})
+	}
+}
+
+// jwksServer serves a replaceable key set and counts the fetches. While hold is set, each
+// fetch signals fetching and waits for release.
+type jwksServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	document []byte
+	fetches  atomic.Int32
+	hold     atomic.Bool
+	fetching chan struct{}
+	release  chan struct{}
+}
+
+func newJWKSServer(t *testing.T, document []byte) *jwksServer {
+	s := &jwksServer{document: document, fetching: make(chan struct{}, 16), release: make(chan struct{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		s.fetches.Add(1)
+		if s.hold.Load() {
+			s.fetching <- struct{}{}
+			<-s.release
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		w.Write(s.document)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) publish(document []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.document = document
+}
+
+func newURLJWKS(t *testing.T, url string) *JWKS {
+	t.Helper()
+	jwks, err := NewJWKS("", url, time.Hour, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewJWKS: %v", err)
+	}
+	return jwks
+}
+
+// ageKeys makes the cached keys look loaded d ago
+func ageKeys(j *JWKS, d time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.last.startedAt = j.last.startedAt.Add(-d)
+}
+
+func TestJWKSRefetchesUnknownKeyID(t *testing.T) {
+	oldKey, newKey := newRSAKey(t, "old"), newECKey(t, "new")
+	server := newJWKSServer(t, jwksDocument(t, oldKey))
+	jwks := newURLJWKS(t, server.URL)
+	verifier := newVerifier(t, jwks)
+
+	if _, err := verifier.Verify(context.Background(), oldKey.sign(t, validClaims())); err != nil {
+		t.Fatalf("Verify with the published key: %v", err)
+	}
+
+	// The issuer rolls its key; right after a load the unknown key id is not fetched again
+	server.publish(jwksDocument(t, oldKey, newKey))
+	if _, err := verifier.Verify(context.Background(), newKey.sign(t, validClaims())); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("Verify with a new key right after loading = %v, want ErrInvalidCredentials", err)
+	}
+	if n := server.fetches.Load(); n != 1 {
+		t.Fatalf("fetched the key set %d times, want once", n)
+	}
+
+	ageKeys(jwks, jwksMinRefetchInterval)
+	if _, err := verifier.Verify(context.Background(), newKey.sign(t, validClaims())); err != nil {
+		t.Fatalf("Verify with the rolled key: %v", err)
+	}
+	if n := server.fetches.Load(); n != 2 {
+		t.Fatalf("fetched the key set %d times, want a refetch for the unknown key id", n)
+	}
+}
+
+func TestJWKSSharesReloads(t *testing.T) {
+	key := newRSAKey(t, "k1")
+	server := newJWKSServer(t, jwksDocument(t, key))
+	jwks := newURLJWKS(t, server.URL)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwks.Key(context.Background(), "k1")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Key: %v", err)
+		}
+	}
+	if n := server.fetches.Load(); n != 1 {
+		t.Fatalf("concurrent lookups fetched the key set %d times, want once", n)
+	}
+}
+
+func TestJWKSServesCachedKeysDuringReload(t *testing.T) {
+	key := newRSAKey(t, "k1")
+	server := newJWKSServer(t, jwksDocument(t, key))
+	jwks := newURLJWKS(t, server.URL)
+	if _, err := jwks.Key(context.Background(), "k1"); err != nil {
+		t.Fatalf("Key: %v", err)
+	}
+
+	// An unknown key id starts a reload that hangs on the endpoint
+	ageKeys(jwks, jwksMinRefetchInterval)
+	server.hold.Store(true)
+	unknown := make(chan error, 1)
+	go func() {
+		_, err := jwks.Key(context.Background(), "unknown")
+		unknown <- err
+	}()
+	<-server.fetching
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := jwks.Key(context.Background(), "k1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Key during a reload: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("looking up a cached key waited for the reload")
+	}
+
+	close(server.release)
+	if err := <-unknown; !errors.Is(err, errUnknownSigningKey) {
+		t.Fatalf("Key of an unpublished key id = %v, want errUnknownSigningKey", err)
+	}
+	if n := server.fetches.Load(); n != 2 {
+		t.Fatalf("fetched the key set %d times, want one shared reload", n)
+	}
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"ip-allocator-api/internal/metrics"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/utils"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// reapBatchSize bounds how many expired leases are released per reaper pass
+	reapBatchSize = 500
+
+	// LeaseReaperActor is the audit actor of leases released on expiry
+	LeaseReaperActor = "system:lease-reaper"
+)
+
+// leaseExpiry converts a TTL in seconds or an absolute expiry into the time a lease ends.
+// It returns nil for allocations without a lease.
+func leaseExpiry(ttl int64, expiresAt *time.Time, now time.Time) *time.Time {
+	if expiresAt != nil {
+		expiry := expiresAt.UTC()
+		return &expiry
+	}
+	if ttl > 0 {
+		expiry := now.Add(time.Duration(ttl) * time.Second).UTC()
+		return &expiry
+	}
+	return nil
+}
+
+// RenewLeases extends the lease of allocated IPs that have not yet expired. Permanent
+// allocations have no lease to extend and are reported as failed.
+func (s *AllocationService) RenewLeases(ctx context.Context, req *models.RenewRequest) (response *models.IPOperationResponse, err error) {
+	ctx, span := startSpan(ctx, "AllocationService.RenewLeases", req.Region, req.Zone, req.SubZone)
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Starting lease renewal",
+		zap.String("region", req.Region),
+		zap.String("zone", req.Zone),
+		zap.String("subzone", req.SubZone),
+		zap.Int("ip_count", len(req.IPAddresses)),
+		zap.Int64("ttl", req.TTL))
+
+	event := newAuditEvent(models.AuditActionRenew, models.AuditResourceIP, subZonePath(req.Region, req.Zone, req.SubZone))
+	defer func() { s.audit.recordIPOperation(ctx, event, response, err) }()
+
+	subZone, _, _, err := s.findSubZone(ctx, req.Region, req.Zone, req.SubZone)
+	if err != nil {
+		s.log(ctx).Error("Failed to find sub-zone for lease renewal",
+			zap.Error(err),
+			zap.String("region", req.Region),
+			zap.String("zone", req.Zone),
+			zap.String("subzone", req.SubZone))
+		return nil, err
+	}
+
+	expiresAt := leaseExpiry(req.TTL, req.ExpiresAt, time.Now())
+	if expiresAt == nil {
+		return nil, validationFailed(CodeInvalidLease, "Either ttl or expires_at is required to renew a lease")
+	}
+
+	var processedIPs, failedIPs, candidates []string
+	for _, ip := range req.IPAddresses {
+		normalizedIP := utils.NormalizeIP(ip)
+		if normalizedIP == "" {
+			s.log(ctx).Warn("Invalid IP address format", zap.String("ip", ip))
+			failedIPs = append(failedIPs, ip)
+			continue
+		}
+
+		if err := s.validateIPInSubZoneCIDR(normalizedIP, subZone); err != nil {
+			s.log(ctx).Warn("IP not in valid CIDR range for lease renewal",
+				zap.String("ip", normalizedIP),
+				zap.Error(err))
+			failedIPs = append(failedIPs, normalizedIP)
+			continue
+		}
+		candidates = append(candidates, normalizedIP)
+	}
+
+	// Renewing moves the documents' update time, which the sub-zone's free index follows
+	index, err := s.free.lock(ctx, req.Region, req.Zone, subZone)
+	if err != nil {
+		s.log(ctx).Error("Failed to load free IPs of sub-zone", zap.Error(err), zap.String("subzone", req.SubZone))
+		return nil, err
+	}
+	defer index.unlock()
+
+	docs, err := s.ips.findHeld(ctx, req.Region, req.Zone, req.SubZone, models.IPStatusAllocated, candidates)
+	if err != nil {
+		s.log(ctx).Error("Failed to find allocated IPs for lease renewal", zap.Error(err))
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, ip := range candidates {
+		renewed, err := s.ips.renew(ctx, req.Region, req.Zone, req.SubZone, ip, *expiresAt, now)
+		if renewed {
+			index.renewed(now)
+		}
+		if err != nil {
+			index.invalidate()
+			s.log(ctx).Error("Failed to renew lease",
+				zap.Error(err),
+				zap.String("ip", ip))
+			return nil, fmt.Errorf("failed to update database: %w", err)
+		}
+
+		if !renewed {
+			s.log(ctx).Warn("IP not allocated, without a lease or lease already expired", zap.String("ip", ip))
+			failedIPs = append(failedIPs, ip)
+			continue
+		}
+		processedIPs = append(processedIPs, ip)
+	}
+
+	success := len(processedIPs) > 0
+	message := "Leases renewed successfully"
+	if len(failedIPs) > 0 {
+		if !success {
+			message = "No leases were renewed (IPs not allocated, without a lease or already expired)"
+		} else {
+			message = fmt.Sprintf("Partial renewal: %d renewed, %d failed", len(processedIPs), len(failedIPs))
+		}
+	}
+
+	s.log(ctx).Info("Lease renewal completed",
+		zap.Bool("success", success),
+		zap.Int("processed_count", len(processedIPs)),
+		zap.Int("failed_count", len(failedIPs)),
+		zap.Time("expires_at", *expiresAt))
+
+	renewed := make(map[string]bool, len(processedIPs))
+	for _, ip := range processedIPs {
+		renewed[ip] = true
+	}
+	var before, after []models.IPAllocation
+	for _, doc := range docs {
+		if renewed[doc.IPAddress] {
+			before = append(before, doc)
+			doc.ExpiresAt = expiresAt
+			after = append(after, doc)
+		}
+	}
+	if len(before) > 0 {
+		event.Before = before
+		event.After = after
+	}
+
+	response = &models.IPOperationResponse{
+		Success:      success,
+		ProcessedIPs: processedIPs,
+		FailedIPs:    failedIPs,
+		Message:      message,
+		Timestamp:    time.Now(),
+	}
+	if success {
+		response.ExpiresAt = expiresAt
+	}
+	return response, nil
+}
+
+// LeaseReaper periodically releases allocated IPs whose lease has expired
+type LeaseReaper struct {
+	ips      *ipAllocationStore
+	audit    *AuditService
+	interval time.Duration
+	logger   *zap.Logger
+}
+
+func NewLeaseReaper(repo storage.Repository, interval time.Duration, logger *zap.Logger) *LeaseReaper {
+	return &LeaseReaper{
+		ips:      newIPAllocationStore(repo, logger),
+		audit:    NewAuditService(repo, logger),
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// Run reaps expired leases every interval until the context is cancelled
+func (r *LeaseReaper) Run(ctx context.Context) {
+	if r.interval <= 0 {
+		r.logger.Warn("Lease reaper disabled, reap interval is not positive", zap.Duration("interval", r.interval))
+		return
+	}
+
+	r.logger.Info("Lease reaper started", zap.Duration("interval", r.interval))
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.logger.Info("Lease reaper stopped")
+			return
+		case <-ticker.C:
+			passCtx, cancel := context.WithTimeout(ctx, r.interval)
+			if _, err := r.ReapExpired(passCtx); err != nil {
+				r.logger.Error("Lease reaper pass failed", zap.Error(err))
+			}
+			cancel()
+		}
+	}
+}
+
+// ReapExpired releases every allocated IP whose lease ended, returning how many were released
+func (r *LeaseReaper) ReapExpired(ctx context.Context) (int, error) {
+	ctx = WithRequestInfo(ctx, RequestInfo{Actor: LeaseReaperActor})
+
+	released := 0
+	for {
+		now := time.Now()
+		expired, err := r.ips.findExpired(ctx, now, reapBatchSize)
+		if err != nil {
+			return released, err
+		}
+
+		for _, doc := range expired {
+			ok, err := r.ips.releaseExpired(ctx, doc, now)
+			if err != nil {
+				return released, err
+			}
+			if !ok {
+				continue
+			}
+
+			released++
+			event := newAuditEvent(models.AuditActionExpire, models.AuditResourceIP, subZonePath(doc.Region, doc.Zone, doc.SubZone))
+			event.Tenant = doc.Tenant
+			event.IPAddresses = []string{doc.IPAddress}
+			event.Before = []models.IPAllocation{doc}
+			r.audit.recordOutcome(ctx, event, true, "Lease expired", nil)
+			metrics.ObserveIPOperation(event.Action, event.Outcome, 1)
+
+			r.logger.Info("Released expired lease",
+				zap.String("tenant", doc.Tenant),
+				zap.String("region", doc.Region),
+				zap.String("zone", doc.Zone),
+				zap.String("subzone", doc.SubZone),
+				zap.String("ip", doc.IPAddress),
+				zap.Timep("expired_at", doc.ExpiresAt))
+		}
+
+		if len(expired) < reapBatchSize {
+			break
+		}
+	}
+
+	if released > 0 {
+		r.logger.Info("Lease reaper pass completed", zap.Int("released_count", released))
+	}
+	return released, nil
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+func TestRenewLeasesReportsPermanentIPsAsFailed(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/24")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	ctx := tenantContext(models.DefaultTenant)
+
+	leased := allocationRequest(1)
+	leased.TTL = 60
+	if _, err := service.AllocateIPs(ctx, leased); err != nil {
+		t.Fatalf("AllocateIPs with a lease: %v", err)
+	}
+	if _, err := service.AllocateIPs(ctx, allocationRequest(1)); err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+
+	response, err := service.RenewLeases(ctx, &models.RenewRequest{
+		Region: "r1", Zone: "z1", SubZone: "s1",
+		IPAddresses: []string{"10.0.1.1", "10.0.1.2"},
+		TTL:         3600,
+	})
+	if err != nil {
+		t.Fatalf("RenewLeases: %v", err)
+	}
+	if !reflect.DeepEqual(response.ProcessedIPs, []string{"10.0.1.1"}) || !reflect.DeepEqual(response.FailedIPs, []string{"10.0.1.2"}) {
+		t.Fatalf("RenewLeases processed %v and failed %v, want the lease renewed and the permanent IP failed",
+			response.ProcessedIPs, response.FailedIPs)
+	}
+
+	docs, err := repo.FindIPs(context.Background(), storage.IPFilter{Tenant: models.DefaultTenant, IPAddresses: []string{"10.0.1.2"}})
+	if err != nil || len(docs) != 1 || docs[0].ExpiresAt != nil {
+		t.Fatalf("permanent IP after renewal = %+v, %v, want it without an expiry", docs, err)
+	}
+}
+
+func TestRenewLeasesAuditRecordsOldAndNewExpiry(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/24")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	ctx := tenantContext(models.DefaultTenant)
+
+	leased := allocationRequest(1)
+	leased.TTL = 60
+	allocated, err := service.AllocateIPs(ctx, leased)
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+
+	response, err := service.RenewLeases(ctx, &models.RenewRequest{
+		Region: "r1", Zone: "z1", SubZone: "s1",
+		IPAddresses: []string{"10.0.1.1", "10.0.1.9"},
+		TTL:         3600,
+	})
+	if err != nil {
+		t.Fatalf("RenewLeases: %v", err)
+	}
+
+	events := recordedIPEvents(t, repo, models.AuditActionRenew)
+	if len(events) != 1 {
+		t.Fatalf("recorded %d renewal events, want 1", len(events))
+	}
+	event := events[0]
+	if event.Outcome != models.AuditOutcomeSuccess || !reflect.DeepEqual(event.IPAddresses, []string{"10.0.1.1", "10.0.1.9"}) {
+		t.Fatalf("event = %+v, want a success naming the renewed and the failed address", event)
+	}
+	// Only the renewed lease is snapshotted, with its expiry before and after
+	if !reflect.DeepEqual(snapshotIPs(event.Before), []string{"10.0.1.1"}) || !reflect.DeepEqual(snapshotIPs(event.After), []string{"10.0.1.1"}) {
+		t.Fatalf("snapshots = %v before and %v after, want 10.0.1.1 only", snapshotIPs(event.Before), snapshotIPs(event.After))
+	}
+	if before := event.Before[0].ExpiresAt; before == nil || !before.Equal(allocated.ExpiresAt.Truncate(time.Millisecond)) {
+		t.Fatalf("expiry before = %v, want the allocated %v", before, allocated.ExpiresAt)
+	}
+	if after := event.After[0].ExpiresAt; after == nil || !after.Equal(response.ExpiresAt.Truncate(time.Millisecond)) {
+		t.Fatalf("expiry after = %v, want the renewed %v", after, response.ExpiresAt)
+	}
+}
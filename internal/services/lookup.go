@@ -0,0 +1,262 @@
+package services
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/utils"
+
+	"go.uber.org/zap"
+)
+
+// LookupService finds the region, zone and sub-zone owning an address or CIDR using in-memory
+// prefix tries of every hierarchy CIDR, one per tenant, rebuilt from the repository when the
+// hierarchy version changes
+type LookupService struct {
+	regions storage.HierarchyRepository
+	ips     *ipAllocationStore
+	logger  *zap.Logger
+
+	mu      sync.RWMutex
+	tries   map[string]*utils.PrefixTrie[models.LookupMatch]
+	version storage.HierarchyVersion
+}
+
+func NewLookupService(repo storage.Repository, logger *zap.Logger) *LookupService {
+	return &LookupService{
+		regions: repo,
+		ips:     newIPAllocationStore(repo, logger),
+		logger:  logger,
+	}
+}
+
+// log returns the request-scoped logger of ctx, falling back to the service logger
+func (s *LookupService) log(ctx context.Context) *zap.Logger {
+	return LoggerFromContext(ctx, s.logger)
+}
+
+// LookupIP returns the hierarchy owning the address and its current status
+func (s *LookupService) LookupIP(ctx context.Context, ip string) (*models.LookupResult, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, validationFailed(CodeInvalidIP, "Invalid IP address: %v", err)
+	}
+	addr = addr.Unmap()
+
+	trie, err := s.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := s.newResult(ctx, addr.String(), trie.LookupAddr(addr))
+	if result.Owner == nil || result.Owner.Level != models.LookupLevelSubZone {
+		return result, nil
+	}
+
+	filter := ipSubZoneFilter(ctx, result.Owner.Region, result.Owner.Zone, result.Owner.SubZone)
+	filter.IPAddresses = []string{addr.String()}
+	docs, err := s.ips.find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Status = models.LookupStatusFree
+	if len(docs) > 0 {
+		result.Status = docs[0].Status
+		result.Allocation = &docs[0]
+	}
+	return result, nil
+}
+
+// LookupCIDR returns the most specific hierarchy containing the whole CIDR and how many of
+// its addresses are in use
+func (s *LookupService) LookupCIDR(ctx context.Context, cidr string) (*models.LookupResult, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, validationFailed(CodeInvalidCIDR, "Invalid CIDR: %v", err)
+	}
+	prefix = prefix.Masked()
+
+	trie, err := s.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := s.newResult(ctx, prefix.String(), trie.LookupPrefix(prefix))
+	if result.Owner == nil || result.Owner.Level != models.LookupLevelSubZone {
+		return result, nil
+	}
+
+	docs, err := s.ips.find(ctx, ipSubZoneFilter(ctx, result.Owner.Region, result.Owner.Zone, result.Owner.SubZone))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, doc := range docs {
+		addr, err := netip.ParseAddr(doc.IPAddress)
+		if err != nil || !prefix.Contains(addr.Unmap()) {
+			continue
+		}
+		switch doc.Status {
+		case models.IPStatusAllocated:
+			result.AllocatedCount++
+		case models.IPStatusReserved:
+			result.ReservedCount++
+		}
+	}
+
+	result.Status = models.LookupStatusFree
+	if result.AllocatedCount+result.ReservedCount > 0 {
+		result.Status = models.LookupStatusInUse
+	}
+	return result, nil
+}
+
+// newResult builds a lookup result from the trie matches, least specific first
+func (s *LookupService) newResult(ctx context.Context, query string, matches []utils.PrefixMatch[models.LookupMatch]) *models.LookupResult {
+	result := &models.LookupResult{
+		Success:   true,
+		Query:     query,
+		Hierarchy: []models.LookupMatch{},
+		Timestamp: time.Now(),
+	}
+	for _, match := range matches {
+		result.Hierarchy = append(result.Hierarchy, match.Values...)
+	}
+
+	if len(matches) == 0 {
+		result.Message = "No region, zone or sub-zone contains " + query
+		return result
+	}
+
+	deepest := matches[len(matches)-1]
+	if len(deepest.Values) > 1 {
+		s.log(ctx).Warn("Overlapping hierarchy CIDRs, reporting the first owner",
+			zap.String("query", query),
+			zap.String("cidr", deepest.Prefix.String()),
+			zap.Int("owner_count", len(deepest.Values)))
+	}
+
+	result.Found = true
+	result.Owner = &deepest.Values[0]
+	if result.Owner.Level != models.LookupLevelSubZone {
+		result.Status = models.LookupStatusFree
+		result.Message = "Not within any sub-zone"
+	}
+	return result
+}
+
+// index returns the prefix trie of the request's tenant, rebuilding the tries first when the
+// hierarchy changed since they were built
+func (s *LookupService) index(ctx context.Context) (*utils.PrefixTrie[models.LookupMatch], error) {
+	version, err := s.regions.HierarchyVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	tries, built := s.tries, s.version
+	s.mu.RUnlock()
+
+	if tries == nil || built != version {
+		s.mu.Lock()
+		// Another request may have rebuilt them while this one waited for the lock
+		if s.tries == nil || s.version != version {
+			tries, err = s.build(ctx)
+			if err != nil {
+				s.mu.Unlock()
+				return nil, err
+			}
+			s.tries = tries
+			s.version = version
+		}
+		tries = s.tries
+		s.mu.Unlock()
+	}
+
+	if trie, ok := tries[TenantFromContext(ctx)]; ok {
+		return trie, nil
+	}
+	return utils.NewPrefixTrie[models.LookupMatch](), nil
+}
+
+// build reads every region and inserts the CIDRs of all regions, zones and sub-zones into the
+// trie of the region's tenant
+func (s *LookupService) build(ctx context.Context) (map[string]*utils.PrefixTrie[models.LookupMatch], error) {
+	start := time.Now()
+
+	regions, err := s.regions.ListRegions(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	tries := make(map[string]*utils.PrefixTrie[models.LookupMatch])
+	var trie *utils.PrefixTrie[models.LookupMatch]
+	insert := func(cidr string, match models.LookupMatch) {
+		if cidr == "" {
+			return
+		}
+		match.CIDR = cidr
+		if err := trie.Insert(cidr, match); err != nil {
+			s.log(ctx).Warn("Skipping invalid CIDR in lookup index",
+				zap.Error(err),
+				zap.String("path", match.Path),
+				zap.String("cidr", cidr))
+		}
+	}
+
+	for _, region := range regions {
+		var ok bool
+		if trie, ok = tries[region.Tenant]; !ok {
+			trie = utils.NewPrefixTrie[models.LookupMatch]()
+			tries[region.Tenant] = trie
+		}
+
+		regionMatch := models.LookupMatch{
+			Level:  models.LookupLevelRegion,
+			Region: region.Name,
+			Path:   regionPath(region.Name),
+		}
+		insert(region.IPv4CIDR, regionMatch)
+		insert(region.IPv6CIDR, regionMatch)
+
+		for _, zone := range region.Zones {
+			zoneMatch := models.LookupMatch{
+				Level:  models.LookupLevelZone,
+				Region: region.Name,
+				Zone:   zone.Name,
+				Path:   zonePath(region.Name, zone.Name),
+			}
+			insert(zone.IPv4CIDR, zoneMatch)
+			insert(zone.IPv6CIDR, zoneMatch)
+
+			for _, subZone := range zone.SubZones {
+				subZoneMatch := models.LookupMatch{
+					Level:   models.LookupLevelSubZone,
+					Region:  region.Name,
+					Zone:    zone.Name,
+					SubZone: subZone.Name,
+					Path:    subZonePath(region.Name, zone.Name, subZone.Name),
+				}
+				insert(subZone.IPv4CIDR, subZoneMatch)
+				insert(subZone.IPv6CIDR, subZoneMatch)
+			}
+		}
+	}
+
+	cidrCount := 0
+	for _, trie := range tries {
+		cidrCount += trie.Len()
+	}
+
+	s.log(ctx).Info("Lookup index rebuilt",
+		zap.Int("region_count", len(regions)),
+		zap.Int("tenant_count", len(tries)),
+		zap.Int("cidr_count", cidrCount),
+		zap.Duration("duration", time.Since(start)))
+	return tries, nil
+}
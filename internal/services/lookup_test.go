@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// countingRepository counts the full hierarchy reads, one per lookup index build
+type countingRepository struct {
+	storage.Repository
+	builds atomic.Int32
+}
+
+func (r *countingRepository) ListRegions(ctx context.Context, tenant string) ([]models.Region, error) {
+	if tenant == "" {
+		r.builds.Add(1)
+	}
+	return r.Repository.ListRegions(ctx, tenant)
+}
+
+func lookupOwner(t *testing.T, service *LookupService, tenant, ip string) *models.LookupResult {
+	t.Helper()
+	result, err := service.LookupIP(tenantContext(tenant), ip)
+	if err != nil {
+		t.Fatalf("LookupIP(%s, %s): %v", tenant, ip, err)
+	}
+	return result
+}
+
+func TestLookupIsTenantScoped(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, "t1", "10.0.1.0/24")
+	createSubZone(t, repo, "t2", "10.0.2.0/24")
+	service := NewLookupService(repo, zap.NewNop())
+
+	tests := []struct {
+		tenant, ip string
+		level      string
+	}{
+		{"t1", "10.0.1.5", models.LookupLevelSubZone},
+		{"t1", "10.0.2.5", models.LookupLevelZone},
+		{"t2", "10.0.2.5", models.LookupLevelSubZone},
+		{"t2", "10.0.1.5", models.LookupLevelZone},
+		{"t3", "10.0.1.5", ""},
+	}
+	for _, tt := range tests {
+		result := lookupOwner(t, service, tt.tenant, tt.ip)
+		switch {
+		case tt.level == "" && result.Found:
+			t.Fatalf("tenant %s found %s in %+v, want nothing", tt.tenant, tt.ip, result.Owner)
+		case tt.level != "" && (!result.Found || result.Owner.Level != tt.level):
+			t.Fatalf("tenant %s found %s in %+v, want the %s", tt.tenant, tt.ip, result.Owner, tt.level)
+		}
+	}
+}
+
+func TestLookupStatus(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/24")
+	allocations := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	if _, err := allocations.AllocateIPs(tenantContext(models.DefaultTenant), allocationRequest(1)); err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	service := NewLookupService(repo, zap.NewNop())
+
+	if result := lookupOwner(t, service, models.DefaultTenant, "10.0.1.1"); result.Status != models.IPStatusAllocated || result.Allocation == nil {
+		t.Fatalf("LookupIP of the allocated address = %+v, want it allocated", result)
+	}
+	if result := lookupOwner(t, service, models.DefaultTenant, "::ffff:10.0.1.2"); result.Status != models.LookupStatusFree || result.Query != "10.0.1.2" {
+		t.Fatalf("LookupIP of a free address = %+v, want it free", result)
+	}
+
+	result, err := service.LookupCIDR(tenantContext(models.DefaultTenant), "10.0.1.0/30")
+	if err != nil {
+		t.Fatalf("LookupCIDR: %v", err)
+	}
+	if result.Status != models.LookupStatusInUse || result.AllocatedCount != 1 || result.Owner.SubZone != "s1" {
+		t.Fatalf("LookupCIDR = %+v, want s1 with one allocated address", result)
+	}
+}
+
+func TestLookupIndexFollowsHierarchyVersion(t *testing.T) {
+	repo := &countingRepository{Repository: storage.NewMemoryRepository()}
+	createSubZone(t, repo, "t1", "10.0.1.0/24")
+	service := NewLookupService(repo, zap.NewNop())
+
+	lookupOwner(t, service, "t1", "10.0.1.5")
+	lookupOwner(t, service, "t1", "10.0.3.5")
+	if n := repo.builds.Load(); n != 1 {
+		t.Fatalf("built the index %d times for an unchanged hierarchy, want once", n)
+	}
+
+	// A new sub-zone moves the region's updated_at
+	later := time.Now().Add(time.Second)
+	subZone := models.SubZone{Name: "s2", IPv4CIDR: "10.0.3.0/24", CreatedAt: later, UpdatedAt: later}
+	if err := repo.AddSubZone(context.Background(), "t1", "r1", "z1", subZone, time.Time{}); err != nil {
+		t.Fatalf("AddSubZone: %v", err)
+	}
+	if result := lookupOwner(t, service, "t1", "10.0.3.5"); result.Owner == nil || result.Owner.SubZone != "s2" {
+		t.Fatalf("LookupIP after adding s2 found %+v, want s2", result.Owner)
+	}
+	if n := repo.builds.Load(); n != 2 {
+		t.Fatalf("built the index %d times, want a rebuild after the change", n)
+	}
+
+	// A deleted region lowers the count
+	if _, err := repo.DeleteRegion(context.Background(), "t1", "r1"); err != nil {
+		t.Fatalf("DeleteRegion: %v", err)
+	}
+	if result := lookupOwner(t, service, "t1", "10.0.3.5"); result.Found {
+		t.Fatalf("LookupIP after deleting the region found %+v", result.Owner)
+	}
+	if n := repo.builds.Load(); n != 3 {
+		t.Fatalf("built the index %d times, want a rebuild after the deletion", n)
+	}
+}
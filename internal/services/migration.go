@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// MigrationReport summarizes a run of MigrateEmbeddedIPs
+type MigrationReport struct {
+	RegionsScanned   int  `json:"regions_scanned"`
+	SubZonesMigrated int  `json:"sub_zones_migrated"`
+	IPsMigrated      int  `json:"ips_migrated"`
+	IPsSkipped       int  `json:"ips_skipped"`
+	DryRun           bool `json:"dry_run"`
+}
+
+// MigrationService upgrades data written by earlier versions. IP arrays embedded in sub-zones
+// are moved through the repository; assigning the default tenant works on the MongoDB
+// collections directly, as data without a tenant only ever existed there.
+type MigrationService struct {
+	repo   storage.Repository
+	db     *mongo.Database
+	logger *zap.Logger
+}
+
+// NewMigrationService returns a migration service for repo. db is only needed by
+// AssignDefaultTenant and may be nil for other backends.
+func NewMigrationService(repo storage.Repository, db *mongo.Database, logger *zap.Logger) *MigrationService {
+	return &MigrationService{
+		repo:   repo,
+		db:     db,
+		logger: logger,
+	}
+}
+
+// MigrateEmbeddedIPs moves the IP arrays embedded in sub-zones into IP documents and removes
+// them from the regions. IPs that already have a document are skipped, so the migration can be
+// re-run safely, and it runs on every start of the API.
+func (s *MigrationService) MigrateEmbeddedIPs(ctx context.Context, dryRun bool) (*MigrationReport, error) {
+	s.logger.Info("Starting migration of embedded IP arrays", zap.Bool("dry_run", dryRun))
+
+	report := &MigrationReport{DryRun: dryRun}
+
+	regions, err := s.repo.ListRegions(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, region := range regions {
+		report.RegionsScanned++
+
+		tenant := region.Tenant
+		if tenant == "" {
+			tenant = models.DefaultTenant
+		}
+
+		for i := range region.Zones {
+			zone := &region.Zones[i]
+			for j := range zone.SubZones {
+				subZone := &zone.SubZones[j]
+				docs := embeddedIPAllocations(tenant, region.Name, zone.Name, subZone, time.Now())
+				if len(docs) == 0 {
+					continue
+				}
+
+				s.logger.Info("Migrating sub-zone IPs",
+					zap.String("tenant", tenant),
+					zap.String("region", region.Name),
+					zap.String("zone", zone.Name),
+					zap.String("subzone", subZone.Name),
+					zap.Int("ip_count", len(docs)))
+
+				report.SubZonesMigrated++
+				if dryRun {
+					report.IPsMigrated += len(docs)
+					continue
+				}
+
+				migrated, skipped, err := s.insertIgnoringDuplicates(ctx, docs)
+				if err != nil {
+					return nil, err
+				}
+				report.IPsMigrated += migrated
+				report.IPsSkipped += skipped
+
+				// The arrays go only once every address has a document
+				changes := storage.HierarchyChanges{ClearEmbeddedIPs: true, UpdatedAt: time.Now()}
+				if _, err := s.repo.UpdateSubZone(ctx, region.Tenant, region.Name, zone.Name, subZone.Name, changes); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	s.logger.Info("Migration of embedded IP arrays completed",
+		zap.Int("regions_scanned", report.RegionsScanned),
+		zap.Int("sub_zones_migrated", report.SubZonesMigrated),
+		zap.Int("ips_migrated", report.IPsMigrated),
+		zap.Int("ips_skipped", report.IPsSkipped),
+		zap.Bool("dry_run", dryRun))
+
+	return report, nil
+}
+
+// insertIgnoringDuplicates stores the IP documents of one sub-zone, skipping the addresses
+// that already have a document. It returns how many were stored and skipped.
+func (s *MigrationService) insertIgnoringDuplicates(ctx context.Context, docs []models.IPAllocation) (int, int, error) {
+	addresses := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		addresses = append(addresses, doc.IPAddress)
+	}
+	existing, err := s.repo.FindIPs(ctx, storage.IPFilter{
+		Tenant:      docs[0].Tenant,
+		Region:      docs[0].Region,
+		Zone:        docs[0].Zone,
+		SubZone:     docs[0].SubZone,
+		IPAddresses: addresses,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	present := make(map[string]bool, len(existing))
+	for _, doc := range existing {
+		present[doc.IPAddress] = true
+	}
+
+	missing := make([]models.IPAllocation, 0, len(docs))
+	for _, doc := range docs {
+		if present[doc.IPAddress] {
+			s.logger.Warn("IP already present in ip_allocations, skipping",
+				zap.String("ip", doc.IPAddress),
+				zap.String("status", doc.Status))
+			continue
+		}
+		// An address listed twice, or as both allocated and reserved, is migrated once
+		present[doc.IPAddress] = true
+		missing = append(missing, doc)
+	}
+
+	if len(missing) > 0 {
+		if err := s.repo.InsertIPs(ctx, missing); err != nil {
+			return 0, 0, err
+		}
+	}
+	return len(missing), len(docs) - len(missing), nil
+}
+
+// AssignDefaultTenant moves regions, IP documents and audit events stored before tenants
+// existed into the default tenant, along with API keys limited to one of its regions.
+// Unscoped keys stay platform keys. Safe to run on every start.
+func (s *MigrationService) AssignDefaultTenant(ctx context.Context) error {
+	untenanted := map[string]bson.M{
+		models.RegionCollection:       {"tenant": bson.M{"$exists": false}},
+		models.IPAllocationCollection: {"tenant": bson.M{"$exists": false}},
+		models.AuditCollection:        {"tenant": bson.M{"$exists": false}},
+		models.APIKeyCollection:       {"tenant": bson.M{"$exists": false}, "region": bson.M{"$exists": true}},
+	}
+	for name, filter := range untenanted {
+		result, err := s.db.Collection(name).UpdateMany(ctx, filter,
+			bson.M{"$set": bson.M{"tenant": models.DefaultTenant}})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			s.logger.Info("Assigned documents to the default tenant",
+				zap.String("collection", name),
+				zap.Int64("modified_count", result.ModifiedCount))
+		}
+	}
+	return nil
+}
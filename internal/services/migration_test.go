@@ -0,0 +1,117 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+func TestMigrateEmbeddedIPs(t *testing.T) {
+	ctx := context.Background()
+	repo := storage.NewMemoryRepository()
+	now := time.Now()
+	legacy := models.Region{
+		Name:   "r1",
+		Tenant: models.DefaultTenant,
+		Zones: []models.Zone{{
+			Name: "z1",
+			SubZones: []models.SubZone{{
+				Name:          "s1",
+				IPv4CIDR:      "10.0.1.0/29",
+				IPv6CIDR:      "fd00::/120",
+				AllocatedIPv4: []string{"10.0.1.1", "10.0.1.2"},
+				AllocatedIPv6: []string{"fd00::1"},
+				ReservedIPv4:  []string{"10.0.1.3"},
+				CreatedAt:     now,
+				UpdatedAt:     now,
+			}},
+			CreatedAt: now,
+			UpdatedAt: now,
+		}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := repo.CreateRegion(ctx, &legacy); err != nil {
+		t.Fatalf("CreateRegion: %v", err)
+	}
+	// An address migrated by an earlier, interrupted run already has its document
+	if err := repo.InsertIPs(ctx, []models.IPAllocation{{
+		Tenant: models.DefaultTenant, Region: "r1", Zone: "z1", SubZone: "s1",
+		IPAddress: "10.0.1.2", IPVersion: "ipv4", Status: models.IPStatusAllocated, CreatedAt: now,
+	}}); err != nil {
+		t.Fatalf("InsertIPs: %v", err)
+	}
+
+	migration := NewMigrationService(repo, nil, zap.NewNop())
+
+	report, err := migration.MigrateEmbeddedIPs(ctx, true)
+	if err != nil {
+		t.Fatalf("MigrateEmbeddedIPs dry run: %v", err)
+	}
+	if report.SubZonesMigrated != 1 || report.IPsMigrated != 4 {
+		t.Fatalf("dry run reported %+v, want 4 IPs of 1 sub-zone", report)
+	}
+	if n, _ := repo.CountIPs(ctx, storage.IPFilter{}); n != 1 {
+		t.Fatalf("dry run left %d IP documents, want only the 1 stored before", n)
+	}
+
+	report, err = migration.MigrateEmbeddedIPs(ctx, false)
+	if err != nil {
+		t.Fatalf("MigrateEmbeddedIPs: %v", err)
+	}
+	if report.RegionsScanned != 1 || report.SubZonesMigrated != 1 || report.IPsMigrated != 3 || report.IPsSkipped != 1 {
+		t.Fatalf("MigrateEmbeddedIPs reported %+v, want 3 IPs migrated and 1 skipped", report)
+	}
+
+	docs, err := repo.FindIPs(ctx, storage.IPFilter{Tenant: models.DefaultTenant, SubZone: "s1"})
+	if err != nil {
+		t.Fatalf("FindIPs: %v", err)
+	}
+	want := map[string]string{
+		"10.0.1.1": models.IPStatusAllocated,
+		"10.0.1.2": models.IPStatusAllocated,
+		"fd00::1":  models.IPStatusAllocated,
+		"10.0.1.3": models.IPStatusReserved,
+	}
+	if len(docs) != len(want) {
+		t.Fatalf("stored %d IP documents, want %d", len(docs), len(want))
+	}
+	for _, doc := range docs {
+		if want[doc.IPAddress] != doc.Status {
+			t.Fatalf("%s is stored as %q, want %q", doc.IPAddress, doc.Status, want[doc.IPAddress])
+		}
+	}
+
+	region, err := repo.GetRegion(ctx, models.DefaultTenant, "r1")
+	if err != nil {
+		t.Fatalf("GetRegion: %v", err)
+	}
+	if subZone := region.Zones[0].SubZones[0]; len(subZone.AllocatedIPv4)+len(subZone.AllocatedIPv6)+len(subZone.ReservedIPv4) != 0 {
+		t.Fatalf("sub-zone still embeds IPs after the migration: %+v", subZone)
+	}
+
+	// The migrated addresses are held: only the rest of the /29 can be allocated
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	response, err := service.AllocateIPs(tenantContext(models.DefaultTenant), allocationRequest(3))
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if got := response.AllocatedIPs; len(got) != 3 || got[0] != "10.0.1.4" || got[2] != "10.0.1.6" {
+		t.Fatalf("allocated %v after the migration, want 10.0.1.4-10.0.1.6", got)
+	}
+
+	// Running again, as every start does, finds nothing left to move
+	report, err = migration.MigrateEmbeddedIPs(ctx, false)
+	if err != nil {
+		t.Fatalf("MigrateEmbeddedIPs again: %v", err)
+	}
+	if report.SubZonesMigrated != 0 || report.IPsMigrated != 0 {
+		t.Fatalf("second run reported %+v, want nothing migrated", report)
+	}
+}
@@ -0,0 +1,255 @@
+package services
+
+import (
+	"context"
+	"math"
+	"math/big"
+	"net"
+	"time"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/utils"
+
+	"go.uber.org/zap"
+)
+
+// QuotaService counts the allocated and reserved IPs held against the configured quotas
+type QuotaService struct {
+	repo   storage.Repository
+	ips    *ipAllocationStore
+	config config.QuotaConfig
+	logger *zap.Logger
+}
+
+func NewQuotaService(repo storage.Repository, cfg config.QuotaConfig, logger *zap.Logger) *QuotaService {
+	return &QuotaService{
+		repo:   repo,
+		ips:    newIPAllocationStore(repo, logger),
+		config: cfg,
+		logger: logger,
+	}
+}
+
+// log returns the request-scoped logger of ctx, falling back to the service logger
+func (s *QuotaService) log(ctx context.Context) *zap.Logger {
+	return LoggerFromContext(ctx, s.logger)
+}
+
+// quotaActor returns the identified caller whose IPs count against the actor quota, or "" for
+// anonymous requests
+func quotaActor(ctx context.Context) string {
+	actor := RequestInfoFromContext(ctx).Actor
+	if actor == AnonymousActor {
+		return ""
+	}
+	return actor
+}
+
+// count reports the IPs matching filter against limit
+func (s *QuotaService) count(ctx context.Context, quota, subject string, filter storage.IPFilter, limit int64) (models.QuotaUsage, error) {
+	used, err := s.repo.CountIPs(ctx, filter)
+	if err != nil {
+		return models.QuotaUsage{}, err
+	}
+	return models.QuotaUsage{
+		Quota:   quota,
+		Subject: subject,
+		Used:    used,
+		Limit:   limit,
+	}, nil
+}
+
+// Check returns the first quota that holding ips in the sub-zone on behalf of owner would
+// exceed, or nil when the request fits. The sub-zone's IP lists must be loaded. Requests
+// racing each other may all pass the check before any of them stores its IPs, so a quota can
+// be overrun by at most the IPs of the other requests in flight.
+func (s *QuotaService) Check(ctx context.Context, regionName, zoneName string, subZone *models.SubZone, held map[string]int, owner string, ips []string) (*models.QuotaUsage, error) {
+	tenant := TenantFromContext(ctx)
+	requested := int64(len(ips))
+
+	var usages []models.QuotaUsage
+	if s.config.MaxIPsPerTenant > 0 {
+		usage, err := s.count(ctx, models.QuotaTenant, tenant, storage.IPFilter{Tenant: tenant}, s.config.MaxIPsPerTenant)
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	if owner != "" && s.config.MaxIPsPerOwner > 0 {
+		usage, err := s.count(ctx, models.QuotaOwner, owner, storage.IPFilter{Tenant: tenant, Owner: owner}, s.config.MaxIPsPerOwner)
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	if actor := quotaActor(ctx); actor != "" && s.config.MaxIPsPerActor > 0 {
+		usage, err := s.count(ctx, models.QuotaActor, actor, storage.IPFilter{Tenant: tenant, CreatedBy: actor}, s.config.MaxIPsPerActor)
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+
+	for i := range usages {
+		if usages[i].Exceeded(requested) {
+			usages[i].Requested = requested
+			return &usages[i], nil
+		}
+	}
+
+	if s.config.MaxSubZoneUtilization <= 0 {
+		return nil, nil
+	}
+
+	// Utilization is checked per address family against the IPs of that family requested
+	var requestedIPv4, requestedIPv6 int64
+	for _, ip := range ips {
+		if utils.IsIPv4(net.ParseIP(ip)) {
+			requestedIPv4++
+		} else {
+			requestedIPv6++
+		}
+	}
+	utilization := subZoneUtilization(subZonePath(regionName, zoneName, subZone.Name), subZone, held, s.config.MaxSubZoneUtilization)
+	for i := range utilization {
+		requested := requestedIPv4
+		if utilization[i].IPVersion == "ipv6" {
+			requested = requestedIPv6
+		}
+		if requested > 0 && utilization[i].Exceeded(requested) {
+			utilization[i].Requested = requested
+			return &utilization[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Usage reports the tenant's usage against every quota: the tenant itself, the calling actor
+// within the tenant, each owner in the tenant and the utilization of each sub-zone. Disabled quotas are reported
+// with a limit of 0.
+func (s *QuotaService) Usage(ctx context.Context) (*models.QuotaUsageResponse, error) {
+	tenant := TenantFromContext(ctx)
+	s.log(ctx).Debug("Computing quota usage", zap.String("tenant", tenant))
+
+	usage, err := s.count(ctx, models.QuotaTenant, tenant, storage.IPFilter{Tenant: tenant}, s.config.MaxIPsPerTenant)
+	if err != nil {
+		return nil, err
+	}
+	quotas := []models.QuotaUsage{usage}
+
+	if actor := quotaActor(ctx); actor != "" {
+		usage, err := s.count(ctx, models.QuotaActor, actor, storage.IPFilter{Tenant: tenant, CreatedBy: actor}, s.config.MaxIPsPerActor)
+		if err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, usage)
+	}
+
+	owners, err := s.ownerUsage(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	quotas = append(quotas, owners...)
+
+	regions, err := s.repo.ListRegions(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ips.loadRegions(ctx, regions); err != nil {
+		return nil, err
+	}
+	for _, region := range regions {
+		for _, zone := range region.Zones {
+			for i := range zone.SubZones {
+				subZone := &zone.SubZones[i]
+				path := subZonePath(region.Name, zone.Name, subZone.Name)
+				held := map[string]int{
+					"ipv4": len(subZone.AllocatedIPv4) + len(subZone.ReservedIPv4),
+					"ipv6": len(subZone.AllocatedIPv6) + len(subZone.ReservedIPv6),
+				}
+				quotas = append(quotas, subZoneUtilization(path, subZone, held, s.config.MaxSubZoneUtilization)...)
+			}
+		}
+	}
+
+	return &models.QuotaUsageResponse{
+		Success:   true,
+		Tenant:    tenant,
+		Quotas:    quotas,
+		Message:   "Quota usage retrieved successfully",
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// ownerUsage reports the IPs held by each owner of the tenant, ordered by owner
+func (s *QuotaService) ownerUsage(ctx context.Context, tenant string) ([]models.QuotaUsage, error) {
+	results, err := s.repo.CountIPsByOwner(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	usages := make([]models.QuotaUsage, 0, len(results))
+	for _, result := range results {
+		usages = append(usages, models.QuotaUsage{
+			Quota:   models.QuotaOwner,
+			Subject: result.Owner,
+			Used:    result.Count,
+			Limit:   s.config.MaxIPsPerOwner,
+		})
+	}
+	return usages, nil
+}
+
+// subZoneUtilization reports the IPs held in each address family of a sub-zone, counted per
+// version in held, limited to maxPercent of the family's range
+func subZoneUtilization(path string, subZone *models.SubZone, held map[string]int, maxPercent float64) []models.QuotaUsage {
+	families := []struct {
+		version string
+		cidr    string
+		used    int
+	}{
+		{"ipv4", subZone.IPv4CIDR, held["ipv4"]},
+		{"ipv6", subZone.IPv6CIDR, held["ipv6"]},
+	}
+
+	var usages []models.QuotaUsage
+	for _, family := range families {
+		total, err := utils.CountIPsInCIDR(family.cidr)
+		if err != nil || total.Sign() == 0 {
+			continue
+		}
+		size := new(big.Float).SetInt(total)
+
+		percent, _ := new(big.Float).Quo(big.NewFloat(float64(family.used)*100), size).Float64()
+		usage := models.QuotaUsage{
+			Quota:              models.QuotaSubZoneUtilization,
+			Subject:            path,
+			IPVersion:          family.version,
+			Used:               int64(family.used),
+			UtilizationPercent: percent,
+			LimitPercent:       maxPercent,
+		}
+		if maxPercent > 0 {
+			limit, _ := new(big.Float).Mul(size, big.NewFloat(maxPercent/100)).Int(nil)
+			if limit.IsInt64() {
+				usage.Limit = limit.Int64()
+			} else {
+				usage.Limit = math.MaxInt64
+			}
+		}
+		usages = append(usages, usage)
+	}
+	return usages
+}
+
+// quotaExceededError explains which quota rejected a request, with the usage as a detail
+func quotaExceededError(usage *models.QuotaUsage) *Error {
+	if usage.Quota == models.QuotaSubZoneUtilization {
+		return newError(ErrQuotaExceeded, CodeQuotaExceeded, "Quota exceeded: %s allows %g%% %s utilization (%d IPs), %d held and %d requested",
+			usage.Subject, usage.LimitPercent, usage.IPVersion, usage.Limit, usage.Used, usage.Requested).withDetail("quota_exceeded", usage)
+	}
+	return newError(ErrQuotaExceeded, CodeQuotaExceeded, "Quota exceeded: %s %s may hold %d IPs, %d held and %d requested",
+		usage.Quota, usage.Subject, usage.Limit, usage.Used, usage.Requested).withDetail("quota_exceeded", usage)
+}
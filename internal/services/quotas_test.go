@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// barrierRepository holds the first inserts until all of them have arrived, so every request
+// passes its quota check before any of their IPs are stored. Later inserts go straight through.
+type barrierRepository struct {
+	storage.Repository
+	pending atomic.Int32
+	release chan struct{}
+}
+
+func (r *barrierRepository) InsertIPs(ctx context.Context, docs []models.IPAllocation) error {
+	if r.pending.Add(-1) == 0 {
+		close(r.release)
+	}
+	<-r.release
+	return r.Repository.InsertIPs(ctx, docs)
+}
+
+func TestActorQuotaOvershootIsBounded(t *testing.T) {
+	const limit, workers, count = 10, 4, 3
+
+	repo := &barrierRepository{Repository: storage.NewMemoryRepository(), release: make(chan struct{})}
+	repo.pending.Store(workers)
+
+	// One sub-zone per request, so the racing requests pick disjoint addresses and all commit
+	now := time.Now()
+	region := models.Region{Name: "r1", Tenant: "t1", IPv4CIDR: "10.0.0.0/8", CreatedAt: now, UpdatedAt: now}
+	zone := models.Zone{Name: "z1", IPv4CIDR: "10.0.0.0/16", CreatedAt: now, UpdatedAt: now}
+	for _, subZone := range []models.SubZone{
+		{Name: "s0", IPv4CIDR: "10.0.0.0/24"},
+		{Name: "s1", IPv4CIDR: "10.0.1.0/24"},
+		{Name: "s2", IPv4CIDR: "10.0.2.0/24"},
+		{Name: "s3", IPv4CIDR: "10.0.3.0/24"},
+	} {
+		subZone.CreatedAt, subZone.UpdatedAt = now, now
+		zone.SubZones = append(zone.SubZones, subZone)
+	}
+	region.Zones = []models.Zone{zone}
+	if err := repo.CreateRegion(context.Background(), &region); err != nil {
+		t.Fatalf("CreateRegion: %v", err)
+	}
+	createSubZone(t, repo, "t2", "10.0.1.0/24")
+
+	service := NewAllocationService(repo, config.QuotaConfig{MaxIPsPerActor: limit}, zap.NewNop())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(subZone string) {
+			defer wg.Done()
+			req := allocationRequest(count)
+			req.SubZone = subZone
+			_, err := service.AllocateIPs(tenantContext("t1"), req)
+			errs <- err
+		}(zone.SubZones[i].Name)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("AllocateIPs: %v", err)
+		}
+	}
+
+	// Each request saw none of the others' IPs, so together they overrun the limit, but by no
+	// more than the IPs of the other requests in flight
+	held, err := repo.CountIPs(context.Background(), storage.IPFilter{Tenant: "t1", CreatedBy: "test"})
+	if err != nil {
+		t.Fatalf("CountIPs: %v", err)
+	}
+	if held != workers*count || held <= limit || held > limit+(workers-1)*count {
+		t.Fatalf("actor holds %d IPs, want %d: over the limit of %d by at most %d", held, workers*count, limit, (workers-1)*count)
+	}
+
+	// Once the race is over the quota holds again
+	_, err = service.AllocateIPs(tenantContext("t1"), allocationRequest(1))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("AllocateIPs over the quota = %v, want ErrQuotaExceeded", err)
+	}
+
+	// The same actor starts from zero in another tenant
+	if _, err := service.AllocateIPs(tenantContext("t2"), allocationRequest(count)); err != nil {
+		t.Fatalf("AllocateIPs in another tenant: %v", err)
+	}
+}
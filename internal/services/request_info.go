@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+
+	"ip-allocator-api/internal/models"
+
+	"go.uber.org/zap"
+)
+
+// AnonymousActor is recorded for mutations made without an identified caller
+const AnonymousActor = "anonymous"
+
+// RequestInfo identifies who triggered an operation, carried through the context into the services
+type RequestInfo struct {
+	Actor     string
+	ClientIP  string
+	RequestID string
+	// Principal is the authenticated caller, nil when authentication is disabled
+	Principal *models.Principal
+	// Tenant whose address space the request operates on; empty means models.DefaultTenant
+	Tenant string
+}
+
+type requestInfoKey struct{}
+
+type loggerKey struct{}
+
+// WithRequestInfo returns a copy of ctx carrying the request info
+func WithRequestInfo(ctx context.Context, info RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the request info carried by ctx, or the zero value
+func RequestInfoFromContext(ctx context.Context) RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info
+}
+
+// TenantFromContext returns the tenant the request operates on
+func TenantFromContext(ctx context.Context) string {
+	if tenant := RequestInfoFromContext(ctx).Tenant; tenant != "" {
+		return tenant
+	}
+	return models.DefaultTenant
+}
+
+// WithLogger returns a copy of ctx carrying the request-scoped logger
+func WithLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFromContext returns the request-scoped logger carried by ctx, or fallback when there is
+// none, such as for background work
+func LoggerFromContext(ctx context.Context, fallback *zap.Logger) *zap.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok && logger != nil {
+		return logger
+	}
+	return fallback
+}
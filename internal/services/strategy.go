@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/utils"
+
+	"go.uber.org/zap"
+)
+
+// releaseHistorySize bounds how many released addresses a sub-zone remembers for the
+// least-recently-used strategy; addresses released before that count as never used
+const releaseHistorySize = 1024
+
+// allocationStrategy hands out the free addresses of a sub-zone in the order of a strategy,
+// with the cursor state the round-robin and least-recently-used strategies need
+type allocationStrategy struct {
+	name string
+	// last is the address of each version round-robin allocation handed out last
+	last map[string]string
+	// advanced marks the versions whose last address changed during the selection
+	advanced map[string]bool
+	// recent holds the recently released addresses, reusable holds them oldest release first
+	// and reused counts the ones already tried
+	recent   *utils.AddrSet
+	reusable []string
+	reused   int
+	// contiguous requests take one run per version, aligned to alignPrefix when it is set;
+	// shortfall holds the largest free run of each version no run could be found in, nil when
+	// nothing at all was free
+	contiguous  bool
+	alignPrefix int
+	shortfall   map[string]*utils.FreeBlock
+}
+
+// strategyName returns the strategy of a request: its own override, else the sub-zone's, else
+// lowest_first
+func strategyName(req *models.AllocationRequest, subZone *models.SubZone) string {
+	switch {
+	case req.AllocationStrategy != "":
+		return req.AllocationStrategy
+	case subZone.AllocationStrategy != "":
+		return subZone.AllocationStrategy
+	default:
+		return models.AllocationStrategyLowestFirst
+	}
+}
+
+// loadAllocationStrategy reads the cursor of the sub-zone when the strategy of the request needs it
+func (s *AllocationService) loadAllocationStrategy(ctx context.Context, req *models.AllocationRequest, subZone *models.SubZone) (*allocationStrategy, error) {
+	strategy := &allocationStrategy{
+		name:        strategyName(req, subZone),
+		last:        map[string]string{},
+		advanced:    map[string]bool{},
+		contiguous:  req.Contiguous,
+		alignPrefix: req.AlignPrefix,
+		shortfall:   map[string]*utils.FreeBlock{},
+	}
+	if strategy.name != models.AllocationStrategyRoundRobin && strategy.name != models.AllocationStrategyLeastRecentlyUsed {
+		return strategy, nil
+	}
+
+	location := storage.IPLocation{Region: req.Region, Zone: req.Zone, SubZone: req.SubZone}
+	cursor, err := s.repo.GetAllocationCursor(ctx, TenantFromContext(ctx), location)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+
+	strategy.last["ipv4"] = cursor.LastIPv4
+	strategy.last["ipv6"] = cursor.LastIPv6
+
+	// An address released more than once counts from its latest release
+	releasedAt := make(map[string]time.Time, len(cursor.Released))
+	for _, released := range cursor.Released {
+		if released.ReleasedAt.After(releasedAt[released.IPAddress]) {
+			releasedAt[released.IPAddress] = released.ReleasedAt
+		}
+	}
+	strategy.reusable = make([]string, 0, len(releasedAt))
+	for ip := range releasedAt {
+		strategy.reusable = append(strategy.reusable, ip)
+	}
+	strategy.recent = utils.NewAddrSet(strategy.reusable)
+	sort.Slice(strategy.reusable, func(i, j int) bool {
+		return releasedAt[strategy.reusable[i]].Before(releasedAt[strategy.reusable[j]])
+	})
+
+	s.log(ctx).Debug("Allocation cursor loaded",
+		zap.String("strategy", strategy.name),
+		zap.String("last_ipv4", cursor.LastIPv4),
+		zap.String("last_ipv6", cursor.LastIPv6),
+		zap.Int("recently_released", len(strategy.reusable)))
+	return strategy, nil
+}
+
+// take marks the next free address of the strategy as used and returns it
+func (st *allocationStrategy) take(free *utils.FreeRangeIndex, version string) (string, bool) {
+	switch st.name {
+	case models.AllocationStrategyHighestFirst:
+		return free.TakeLast()
+	case models.AllocationStrategyRandom:
+		return free.TakeRandom()
+	case models.AllocationStrategyRoundRobin:
+		ip, ok := free.TakeNextAfter(st.last[version])
+		if ok {
+			st.last[version] = ip
+			st.advanced[version] = true
+		}
+		return ip, ok
+	case models.AllocationStrategyLeastRecentlyUsed:
+		if ip, ok := free.TakeNextExcluding(st.recent); ok {
+			return ip, true
+		}
+		// Every free address was released recently; reuse the one released the longest time ago
+		for st.reused < len(st.reusable) {
+			ip := st.reusable[st.reused]
+			st.reused++
+			if free.Take(ip) {
+				return ip, true
+			}
+		}
+		return "", false
+	default:
+		return free.TakeNext()
+	}
+}
+
+// takeRun marks the lowest free run of count addresses as used and returns it. Runs are picked
+// by position, so the strategy's order does not apply to them. When there is none, the reason
+// names the largest free run instead.
+func (st *allocationStrategy) takeRun(free *utils.FreeRangeIndex, version string, count int) ([]string, string) {
+	if run, ok := free.TakeRun(count, st.alignPrefix); ok {
+		return run, ""
+	}
+
+	aligned := ""
+	if st.alignPrefix > 0 {
+		aligned = fmt.Sprintf(" aligned to a /%d", st.alignPrefix)
+	}
+	largest, ok := free.LargestBlock()
+	if !ok {
+		st.shortfall[version] = nil
+		return nil, fmt.Sprintf("no free run of %d consecutive %s addresses%s in %s; no address is free",
+			count, version, aligned, free.CIDR())
+	}
+	st.shortfall[version] = &largest
+	return nil, fmt.Sprintf("no free run of %d consecutive %s addresses%s in %s; the largest free run is %s-%s (%s addresses)",
+		count, version, aligned, free.CIDR(), largest.Start, largest.End, largest.Size)
+}
+
+// noContiguousRunError fails a contiguous request with the first version no run was found in,
+// or returns nil when every version got one
+func noContiguousRunError(strategy *allocationStrategy, rejections []models.IPRejection) *Error {
+	if len(strategy.shortfall) == 0 {
+		return nil
+	}
+	for _, rejection := range rejections {
+		if rejection.Reason == models.RejectionNoContiguousRun {
+			failure := exhausted(CodeNoContiguousRun, "Allocation failed: %s; no IPs were allocated", rejection.Detail)
+			return failure.withDetail("largest_free_run", strategy.shortfall)
+		}
+	}
+	return nil
+}
+
+// advanceCursor stores where round-robin allocation continues after a committed allocation.
+// Failing to store it only makes the next allocation start from an earlier address, so it is
+// logged rather than failing the allocation.
+func (s *AllocationService) advanceCursor(ctx context.Context, req *models.AllocationRequest, strategy *allocationStrategy) {
+	location := storage.IPLocation{Region: req.Region, Zone: req.Zone, SubZone: req.SubZone}
+	for version := range strategy.advanced {
+		last := strategy.last[version]
+		if err := s.repo.AdvanceAllocationCursor(ctx, TenantFromContext(ctx), location, version, last, time.Now()); err != nil {
+			s.log(ctx).Warn("Failed to advance round-robin allocation cursor",
+				zap.Error(err),
+				zap.String("region", req.Region),
+				zap.String("zone", req.Zone),
+				zap.String("subzone", req.SubZone),
+				zap.String("version", version),
+				zap.String("last_ip", last))
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/config"
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/utils"
+
+	"go.uber.org/zap"
+)
+
+func TestRoundRobinContinuesAfterTheLastAllocation(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	// Usable addresses 10.0.1.1 to 10.0.1.6
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/29")
+	ctx := tenantContext(models.DefaultTenant)
+
+	allocate := func(service *AllocationService, want ...string) {
+		t.Helper()
+		req := allocationRequest(len(want))
+		req.AllocationStrategy = models.AllocationStrategyRoundRobin
+		response, err := service.AllocateIPs(ctx, req)
+		if err != nil {
+			t.Fatalf("AllocateIPs: %v", err)
+		}
+		if !reflect.DeepEqual(response.AllocatedIPs, want) {
+			t.Fatalf("allocated %v, want %v", response.AllocatedIPs, want)
+		}
+	}
+
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	allocate(service, "10.0.1.1", "10.0.1.2")
+	release(t, ctx, service, "10.0.1.1")
+	// The released address is lower, but the cursor moves on
+	allocate(service, "10.0.1.3")
+
+	// The cursor is stored, so another replica continues from it
+	other := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	allocate(other, "10.0.1.4")
+	// and wraps around to the start of the range
+	allocate(other, "10.0.1.5", "10.0.1.6", "10.0.1.1")
+
+	cursor, err := repo.GetAllocationCursor(ctx, models.DefaultTenant, storage.IPLocation{Region: "r1", Zone: "z1", SubZone: "s1"})
+	if err != nil {
+		t.Fatalf("GetAllocationCursor: %v", err)
+	}
+	if cursor.LastIPv4 != "10.0.1.1" {
+		t.Fatalf("cursor at %q, want the last address handed out", cursor.LastIPv4)
+	}
+}
+
+func TestLeastRecentlyUsedReusesTheOldestRelease(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/29")
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+	ctx := tenantContext(models.DefaultTenant)
+
+	allocate := func(want ...string) {
+		t.Helper()
+		req := allocationRequest(len(want))
+		req.AllocationStrategy = models.AllocationStrategyLeastRecentlyUsed
+		response, err := service.AllocateIPs(ctx, req)
+		if err != nil {
+			t.Fatalf("AllocateIPs: %v", err)
+		}
+		if !reflect.DeepEqual(response.AllocatedIPs, want) {
+			t.Fatalf("allocated %v, want %v", response.AllocatedIPs, want)
+		}
+	}
+
+	allocate("10.0.1.1", "10.0.1.2", "10.0.1.3", "10.0.1.4")
+	release(t, ctx, service, "10.0.1.2")
+	// Keep the release times apart on coarse clocks
+	time.Sleep(2 * time.Millisecond)
+	release(t, ctx, service, "10.0.1.1")
+
+	// Addresses never used come first, then the one released the longest time ago
+	allocate("10.0.1.5", "10.0.1.6", "10.0.1.2")
+	allocate("10.0.1.1")
+}
+
+func TestAlignedRunFailsWithTheLargestFreeRun(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	// Usable addresses 10.0.1.1 to 10.0.1.30; every /29 block holds an address in use or the
+	// network or broadcast address, and the longest free run is .22-.30
+	createSubZone(t, repo, models.DefaultTenant, "10.0.1.0/27")
+	ctx := tenantContext(models.DefaultTenant)
+	template := ipTemplate(models.DefaultTenant, "r1", "z1", "s1", models.IPStatusAllocated)
+	if err := repo.InsertIPs(ctx, newIPAllocations(template, []string{"10.0.1.5", "10.0.1.13", "10.0.1.21"}, time.Now())); err != nil {
+		t.Fatalf("InsertIPs: %v", err)
+	}
+	service := NewAllocationService(repo, config.QuotaConfig{}, zap.NewNop())
+
+	req := allocationRequest(8)
+	req.Contiguous = true
+	req.AlignPrefix = 29
+	_, err := service.AllocateIPs(ctx, req)
+	domainErr, ok := AsError(err)
+	if !ok || !errors.Is(err, ErrExhausted) || domainErr.Code != CodeNoContiguousRun {
+		t.Fatalf("AllocateIPs error = %v, want %s", err, CodeNoContiguousRun)
+	}
+	if !strings.Contains(domainErr.Message, "aligned to a /29") {
+		t.Fatalf("message %q does not name the alignment", domainErr.Message)
+	}
+	want := map[string]*utils.FreeBlock{"ipv4": {Start: "10.0.1.22", End: "10.0.1.30", Size: "9"}}
+	if largest := errorDetail(err, "largest_free_run"); !reflect.DeepEqual(largest, want) {
+		t.Fatalf("largest_free_run = %v, want %v", largest, want)
+	}
+	if stored := storedIPs(t, repo); stored != 3 {
+		t.Fatalf("%d IPs stored, want the failed request to write nothing", stored)
+	}
+
+	// Unaligned, the run fits in the largest free one
+	req.AlignPrefix = 0
+	response, err := service.AllocateIPs(ctx, req)
+	if err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	if first, last := response.AllocatedIPs[0], response.AllocatedIPs[len(response.AllocatedIPs)-1]; first != "10.0.1.22" || last != "10.0.1.29" {
+		t.Fatalf("allocated %v, want 10.0.1.22-10.0.1.29", response.AllocatedIPs)
+	}
+
+	// With nothing free at all there is no largest run to report
+	req.Count = 2
+	if _, err := service.AllocateIPs(ctx, allocationRequest(19)); err != nil {
+		t.Fatalf("AllocateIPs: %v", err)
+	}
+	_, err = service.AllocateIPs(ctx, req)
+	if largest := errorDetail(err, "largest_free_run"); !reflect.DeepEqual(largest, map[string]*utils.FreeBlock{"ipv4": nil}) {
+		t.Fatalf("largest_free_run = %v, want none for a full sub-zone: %v", largest, err)
+	}
+}
+
+// release deallocates addresses of sub-zone s1
+func release(t *testing.T, ctx context.Context, service *AllocationService, ips ...string) {
+	t.Helper()
+	if _, err := service.DeallocateIPs(ctx, &models.DeallocationRequest{Region: "r1", Zone: "z1", SubZone: "s1", IPAddresses: ips}); err != nil {
+		t.Fatalf("DeallocateIPs: %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/utils"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// AllocateZoneSubnet creates a zone whose CIDRs are the first free blocks of the requested
+// prefix lengths in the region CIDRs
+func (s *CRUDService) AllocateZoneSubnet(ctx context.Context, regionName string, req *models.SubnetAllocationRequest) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.AllocateZoneSubnet", regionName, "", "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Carving zone subnet from region",
+		zap.String("region", regionName),
+		zap.String("zone", req.Name),
+		zap.Int("ipv4_prefix_length", req.IPv4PrefixLength),
+		zap.Int("ipv6_prefix_length", req.IPv6PrefixLength))
+
+	event := newAuditEvent(models.AuditActionCreate, models.AuditResourceZone, zonePath(regionName, req.Name))
+	defer func() { s.audit.recordCRUD(ctx, event, response, err) }()
+
+	for attempt := 1; ; attempt++ {
+		region, err := s.repo.GetRegion(ctx, TenantFromContext(ctx), regionName)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return nil, notFound(CodeRegionNotFound, "Region not found")
+			}
+			return nil, err
+		}
+
+		var usedIPv4, usedIPv6 []string
+		for _, zone := range region.Zones {
+			if zone.Name == req.Name {
+				return nil, conflict(CodeZoneExists, "Zone with this name already exists in the region")
+			}
+			usedIPv4 = append(usedIPv4, zone.IPv4CIDR)
+			usedIPv6 = append(usedIPv6, zone.IPv6CIDR)
+		}
+
+		ipv4CIDR, ipv6CIDR, err := carveSubnets(region.IPv4CIDR, region.IPv6CIDR, usedIPv4, usedIPv6, req)
+		if err != nil {
+			s.log(ctx).Warn("No free zone subnet in region",
+				zap.Error(err),
+				zap.String("region", regionName),
+				zap.String("zone", req.Name))
+			return nil, err
+		}
+
+		now := time.Now()
+		newZone := models.Zone{
+			ID:        primitive.NewObjectID(),
+			Name:      req.Name,
+			IPv4CIDR:  ipv4CIDR,
+			IPv6CIDR:  ipv6CIDR,
+			SubZones:  []models.SubZone{},
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		// Every change to a region bumps updated_at, so the zone is only added if no other
+		// zone was added or changed since the free block was computed
+		err = s.repo.AddZone(ctx, region.Tenant, regionName, newZone, region.UpdatedAt)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, notFound(CodeRegionNotFound, "Region not found")
+		}
+		if err != nil && !errors.Is(err, storage.ErrConflict) {
+			s.log(ctx).Error("Failed to create zone from carved subnet",
+				zap.Error(err),
+				zap.String("region", regionName),
+				zap.String("zone", req.Name))
+			return nil, err
+		}
+
+		if err == nil {
+			s.log(ctx).Info("Zone created from carved subnet",
+				zap.String("region", regionName),
+				zap.String("zone", req.Name),
+				zap.String("ipv4_cidr", ipv4CIDR),
+				zap.String("ipv6_cidr", ipv6CIDR),
+				zap.Int("attempt", attempt))
+			event.After = newZone
+			return &models.CRUDResponse{
+				Success:   true,
+				Data:      newZone,
+				Message:   "Zone created successfully",
+				Timestamp: time.Now(),
+			}, nil
+		}
+
+		if retry, err := s.retrySubnetAllocation(ctx, attempt, regionName, req.Name); !retry {
+			return nil, err
+		}
+	}
+}
+
+// AllocateSubZoneSubnet creates a sub-zone whose CIDRs are the first free blocks of the requested
+// prefix lengths in the zone CIDRs
+func (s *CRUDService) AllocateSubZoneSubnet(ctx context.Context, regionName, zoneName string, req *models.SubnetAllocationRequest) (response *models.CRUDResponse, err error) {
+	ctx, span := startSpan(ctx, "CRUDService.AllocateSubZoneSubnet", regionName, zoneName, "")
+	defer func() { endSpan(span, err) }()
+
+	s.log(ctx).Info("Carving sub-zone subnet from zone",
+		zap.String("region", regionName),
+		zap.String("zone", zoneName),
+		zap.String("subzone", req.Name),
+		zap.Int("ipv4_prefix_length", req.IPv4PrefixLength),
+		zap.Int("ipv6_prefix_length", req.IPv6PrefixLength))
+
+	event := newAuditEvent(models.AuditActionCreate, models.AuditResourceSubZone, subZonePath(regionName, zoneName, req.Name))
+	defer func() { s.audit.recordCRUD(ctx, event, response, err) }()
+
+	for attempt := 1; ; attempt++ {
+		region, err := s.repo.GetRegion(ctx, TenantFromContext(ctx), regionName)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return nil, notFound(CodeRegionNotFound, "Region not found")
+			}
+			return nil, err
+		}
+
+		zone := findZone(&region, zoneName)
+		if zone == nil {
+			return nil, notFound(CodeZoneNotFound, "Zone not found")
+		}
+
+		var usedIPv4, usedIPv6 []string
+		for _, subZone := range zone.SubZones {
+			if subZone.Name == req.Name {
+				return nil, conflict(CodeSubZoneExists, "Sub-zone with this name already exists in the zone")
+			}
+			usedIPv4 = append(usedIPv4, subZone.IPv4CIDR)
+			usedIPv6 = append(usedIPv6, subZone.IPv6CIDR)
+		}
+
+		ipv4CIDR, ipv6CIDR, err := carveSubnets(zone.IPv4CIDR, zone.IPv6CIDR, usedIPv4, usedIPv6, req)
+		if err != nil {
+			s.log(ctx).Warn("No free sub-zone subnet in zone",
+				zap.Error(err),
+				zap.String("region", regionName),
+				zap.String("zone", zoneName),
+				zap.String("subzone", req.Name))
+			return nil, err
+		}
+
+		now := time.Now()
+		newSubZone := models.SubZone{
+			ID:            primitive.NewObjectID(),
+			Name:          req.Name,
+			IPv4CIDR:      ipv4CIDR,
+			IPv6CIDR:      ipv6CIDR,
+			AllocatedIPv4: []string{},
+			AllocatedIPv6: []string{},
+			ReservedIPv4:  []string{},
+			ReservedIPv6:  []string{},
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		if err := setSubZoneExclusions(&newSubZone, "", "", false, nil); err != nil {
+			return nil, err
+		}
+
+		// Conditional on the region's updated_at, see AllocateZoneSubnet
+		err = s.repo.AddSubZone(ctx, region.Tenant, regionName, zoneName, newSubZone, region.UpdatedAt)
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, notFound(CodeZoneNotFound, "Zone not found")
+		}
+		if err != nil && !errors.Is(err, storage.ErrConflict) {
+			s.log(ctx).Error("Failed to create sub-zone from carved subnet",
+				zap.Error(err),
+				zap.String("region", regionName),
+				zap.String("zone", zoneName),
+				zap.String("subzone", req.Name))
+			return nil, err
+		}
+
+		if err == nil {
+			s.log(ctx).Info("Sub-zone created from carved subnet",
+				zap.String("region", regionName),
+				zap.String("zone", zoneName),
+				zap.String("subzone", req.Name),
+				zap.String("ipv4_cidr", ipv4CIDR),
+				zap.String("ipv6_cidr", ipv6CIDR),
+				zap.Int("attempt", attempt))
+			event.After = newSubZone
+			return &models.CRUDResponse{
+				Success:   true,
+				Data:      newSubZone,
+				Message:   "Sub-zone created successfully",
+				Timestamp: time.Now(),
+			}, nil
+		}
+
+		if retry, err := s.retrySubnetAllocation(ctx, attempt, regionName, req.Name); !retry {
+			return nil, err
+		}
+	}
+}
+
+// retrySubnetAllocation waits before another attempt after the region changed concurrently.
+// It reports false with an error once the attempts are exhausted or the context is done.
+func (s *CRUDService) retrySubnetAllocation(ctx context.Context, attempt int, regionName, name string) (bool, error) {
+	if attempt >= maxAllocationAttempts {
+		s.log(ctx).Error("Giving up on subnet allocation after repeated conflicts",
+			zap.Int("attempts", attempt),
+			zap.String("region", regionName),
+			zap.String("name", name))
+		return false, conflict(CodeConcurrentUpdate, "Region '%s' is busy, gave up after %d conflicting attempts", regionName, attempt)
+	}
+
+	s.log(ctx).Warn("Region changed while carving subnet, retrying",
+		zap.Int("attempt", attempt),
+		zap.String("region", regionName),
+		zap.String("name", name))
+	if err := waitForRetry(ctx, attempt); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// carveSubnets finds the free IPv4 and IPv6 blocks requested, leaving a family empty when no
+// prefix length was given for it
+func carveSubnets(parentIPv4, parentIPv6 string, usedIPv4, usedIPv6 []string, req *models.SubnetAllocationRequest) (string, string, error) {
+	var ipv4CIDR, ipv6CIDR string
+	var err error
+
+	if req.IPv4PrefixLength > 0 {
+		if ipv4CIDR, err = carveSubnet(parentIPv4, "IPv4", req.IPv4PrefixLength, usedIPv4); err != nil {
+			return "", "", err
+		}
+	}
+
+	if req.IPv6PrefixLength > 0 {
+		if ipv6CIDR, err = carveSubnet(parentIPv6, "IPv6", req.IPv6PrefixLength, usedIPv6); err != nil {
+			return "", "", err
+		}
+	}
+
+	return ipv4CIDR, ipv6CIDR, nil
+}
+
+// carveSubnet finds a free block of one family, telling a prefix length that does not fit the
+// parent apart from a parent that is full
+func carveSubnet(parentCIDR, family string, prefixLen int, used []string) (string, error) {
+	if parentCIDR == "" {
+		return "", validationFailed(CodeValidationFailed, "Subnet allocation failed: parent has no %s CIDR configured", family)
+	}
+	if _, parentNet, err := net.ParseCIDR(parentCIDR); err == nil {
+		if ones, bits := parentNet.Mask.Size(); prefixLen < ones || prefixLen > bits {
+			return "", cidrOutOfRange("Subnet allocation failed: prefix length /%d must be between /%d and /%d for parent CIDR %s", prefixLen, ones, bits, parentCIDR)
+		}
+	}
+
+	subnet, err := utils.FindFreeSubnet(parentCIDR, prefixLen, used)
+	if errors.Is(err, utils.ErrNoFreeSubnet) {
+		return "", exhausted(CodeSubnetsExhausted, "Subnet allocation failed: %v", err)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to carve a %s subnet from %s: %w", family, parentCIDR, err)
+	}
+	return subnet, nil
+}
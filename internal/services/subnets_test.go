@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.uber.org/zap"
+)
+
+// racingRepository adds a rival sub-zone to z1 right before each of the first races sub-zone
+// adds, so the add conditioned on the region read before fails with a conflict
+type racingRepository struct {
+	storage.Repository
+	races, adds int
+}
+
+func (r *racingRepository) AddSubZone(ctx context.Context, tenant, regionName, zoneName string, subZone models.SubZone, unchangedSince time.Time) error {
+	r.adds++
+	if r.races > 0 {
+		r.races--
+		later := unchangedSince.Add(time.Second)
+		rival := models.SubZone{Name: fmt.Sprintf("rival%d", r.adds), IPv4CIDR: fmt.Sprintf("10.0.%d.0/24", r.adds), CreatedAt: later, UpdatedAt: later}
+		if err := r.Repository.AddSubZone(ctx, tenant, regionName, zoneName, rival, time.Time{}); err != nil {
+			return err
+		}
+	}
+	return r.Repository.AddSubZone(ctx, tenant, regionName, zoneName, subZone, unchangedSince)
+}
+
+func TestSubnetCarvingRetriesAfterAConflict(t *testing.T) {
+	repo := &racingRepository{Repository: storage.NewMemoryRepository(), races: 1}
+	createSubZone(t, repo, "t1", "10.0.0.0/24")
+	service := NewCRUDService(repo, zap.NewNop())
+
+	response, err := service.AllocateSubZoneSubnet(tenantContext("t1"), "r1", "z1", &models.SubnetAllocationRequest{Name: "s2", IPv4PrefixLength: 24})
+	if err != nil {
+		t.Fatalf("AllocateSubZoneSubnet: %v", err)
+	}
+	// The first attempt carved 10.0.1.0/24, which the rival took in the meantime
+	if subZone := response.Data.(models.SubZone); subZone.IPv4CIDR != "10.0.2.0/24" || repo.adds != 2 {
+		t.Fatalf("carved %s in %d attempts, want 10.0.2.0/24 on the second", subZone.IPv4CIDR, repo.adds)
+	}
+}
+
+func TestSubnetCarvingGivesUpAfterRepeatedConflicts(t *testing.T) {
+	repo := &racingRepository{Repository: storage.NewMemoryRepository(), races: maxAllocationAttempts}
+	createSubZone(t, repo, "t1", "10.0.0.0/24")
+	service := NewCRUDService(repo, zap.NewNop())
+
+	_, err := service.AllocateSubZoneSubnet(tenantContext("t1"), "r1", "z1", &models.SubnetAllocationRequest{Name: "s2", IPv4PrefixLength: 24})
+	if domainErr, ok := AsError(err); !ok || domainErr.Code != CodeConcurrentUpdate {
+		t.Fatalf("AllocateSubZoneSubnet = %v, want %s", err, CodeConcurrentUpdate)
+	}
+	if repo.adds != maxAllocationAttempts {
+		t.Fatalf("tried %d times, want %d", repo.adds, maxAllocationAttempts)
+	}
+}
+
+func TestSubnetCarvingErrors(t *testing.T) {
+	repo := storage.NewMemoryRepository()
+	createSubZone(t, repo, "t1", "10.0.0.0/24")
+	now := time.Now()
+	broken := models.Region{Name: "broken", Tenant: "t1", IPv4CIDR: "10.1.0.0/99", CreatedAt: now, UpdatedAt: now}
+	if err := repo.CreateRegion(context.Background(), &broken); err != nil {
+		t.Fatalf("CreateRegion: %v", err)
+	}
+	service := NewCRUDService(repo, zap.NewNop())
+
+	tests := []struct {
+		name   string
+		region string
+		req    models.SubnetAllocationRequest
+		// wantCode is the error code expected, or "" for an internal error
+		wantCode string
+	}{
+		{"region full", "r1", models.SubnetAllocationRequest{Name: "z2", IPv4PrefixLength: 8}, CodeSubnetsExhausted},
+		{"prefix shorter than the region", "r1", models.SubnetAllocationRequest{Name: "z2", IPv4PrefixLength: 4}, CodeCIDROutOfRange},
+		{"family without a CIDR", "r1", models.SubnetAllocationRequest{Name: "z2", IPv6PrefixLength: 64}, CodeValidationFailed},
+		{"unparseable region CIDR", "broken", models.SubnetAllocationRequest{Name: "z2", IPv4PrefixLength: 24}, ""},
+	}
+	for _, tt := range tests {
+		_, err := service.AllocateZoneSubnet(tenantContext("t1"), tt.region, &tt.req)
+		if err == nil {
+			t.Fatalf("%s: AllocateZoneSubnet succeeded", tt.name)
+		}
+		domainErr, ok := AsError(err)
+		switch {
+		case tt.wantCode == "" && ok:
+			t.Fatalf("%s: AllocateZoneSubnet = %v, want an internal error", tt.name, err)
+		case tt.wantCode != "" && (!ok || domainErr.Code != tt.wantCode):
+			t.Fatalf("%s: AllocateZoneSubnet = %v, want code %s", tt.name, err, tt.wantCode)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// TenantService manages the tenants that own isolated address spaces
+type TenantService struct {
+	repo   storage.Repository
+	audit  *AuditService
+	logger *zap.Logger
+}
+
+func NewTenantService(repo storage.Repository, logger *zap.Logger) *TenantService {
+	return &TenantService{
+		repo:   repo,
+		audit:  NewAuditService(repo, logger),
+		logger: logger,
+	}
+}
+
+// log returns the request-scoped logger of ctx, falling back to the service logger
+func (s *TenantService) log(ctx context.Context) *zap.Logger {
+	return LoggerFromContext(ctx, s.logger)
+}
+
+func tenantPath(name string) string {
+	return "tenants/" + name
+}
+
+// tenantExists reports whether a tenant with the given name has been created
+func tenantExists(ctx context.Context, tenants storage.TenantRepository, name string) (bool, error) {
+	_, err := tenants.GetTenant(ctx, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// newTenantEvent starts an audit event for a tenant, recorded in that tenant's trail
+func newTenantEvent(action, name string) *models.AuditEvent {
+	event := newAuditEvent(action, models.AuditResourceTenant, tenantPath(name))
+	event.Tenant = name
+	return event
+}
+
+// CreateTenant creates an empty tenant
+func (s *TenantService) CreateTenant(ctx context.Context, req *models.CreateTenantRequest) (response *models.TenantResponse, err error) {
+	s.log(ctx).Info("Creating tenant", zap.String("tenant", req.Name))
+
+	event := newTenantEvent(models.AuditActionCreate, req.Name)
+	defer func() { s.audit.recordTenant(ctx, event, response, err) }()
+
+	now := time.Now()
+	tenant := models.Tenant{
+		ID:          primitive.NewObjectID(),
+		Name:        req.Name,
+		Description: req.Description,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	if err := s.repo.CreateTenant(ctx, &tenant); err != nil {
+		if errors.Is(err, storage.ErrDuplicate) {
+			return nil, conflict(CodeTenantExists, "Tenant with this name already exists")
+		}
+		s.log(ctx).Error("Failed to create tenant",
+			zap.Error(err),
+			zap.String("tenant", req.Name))
+		return nil, err
+	}
+	event.After = tenant
+
+	s.log(ctx).Info("Tenant created successfully",
+		zap.String("tenant", tenant.Name),
+		zap.String("id", tenant.ID.Hex()))
+
+	return &models.TenantResponse{
+		Success:   true,
+		Data:      &tenant,
+		Message:   "Tenant created successfully",
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// ListTenants returns every tenant in name order
+func (s *TenantService) ListTenants(ctx context.Context) ([]models.Tenant, error) {
+	tenants, err := s.repo.ListTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tenants == nil {
+		tenants = []models.Tenant{}
+	}
+	return tenants, nil
+}
+
+// GetTenant returns a tenant by name
+func (s *TenantService) GetTenant(ctx context.Context, name string) (*models.TenantResponse, error) {
+	tenant, err := s.repo.GetTenant(ctx, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeTenantNotFound, "Tenant not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TenantResponse{
+		Success:   true,
+		Data:      &tenant,
+		Message:   "Tenant retrieved successfully",
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// UpdateTenant updates the description of a tenant
+func (s *TenantService) UpdateTenant(ctx context.Context, name string, req *models.UpdateTenantRequest) (response *models.TenantResponse, err error) {
+	s.log(ctx).Info("Updating tenant", zap.String("tenant", name))
+
+	event := newTenantEvent(models.AuditActionUpdate, name)
+	defer func() { s.audit.recordTenant(ctx, event, response, err) }()
+
+	now := time.Now()
+	before, err := s.repo.UpdateTenant(ctx, name, req.Description, now)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeTenantNotFound, "Tenant not found")
+	}
+	if err != nil {
+		s.log(ctx).Error("Failed to update tenant",
+			zap.Error(err),
+			zap.String("tenant", name))
+		return nil, err
+	}
+
+	after := before
+	after.Description = req.Description
+	after.UpdatedAt = now
+	event.Before = before
+	event.After = after
+
+	s.log(ctx).Info("Tenant updated successfully", zap.String("tenant", name))
+
+	return &models.TenantResponse{
+		Success:   true,
+		Data:      &after,
+		Message:   "Tenant updated successfully",
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// DeleteTenant deletes a tenant that no longer owns any regions, revoking its API keys. The
+// default tenant can not be deleted.
+func (s *TenantService) DeleteTenant(ctx context.Context, name string) (response *models.TenantResponse, err error) {
+	s.log(ctx).Info("Deleting tenant", zap.String("tenant", name))
+
+	event := newTenantEvent(models.AuditActionDelete, name)
+	defer func() { s.audit.recordTenant(ctx, event, response, err) }()
+
+	if name == models.DefaultTenant {
+		return nil, conflict(CodeDefaultTenant, "The default tenant cannot be deleted")
+	}
+
+	regionCount, err := s.repo.CountRegions(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if regionCount > 0 {
+		return nil, conflict(CodeTenantNotEmpty, "Tenant still owns regions; delete them first")
+	}
+
+	before, err := s.repo.DeleteTenant(ctx, name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, notFound(CodeTenantNotFound, "Tenant not found")
+	}
+	if err != nil {
+		s.log(ctx).Error("Failed to delete tenant",
+			zap.Error(err),
+			zap.String("tenant", name))
+		return nil, err
+	}
+	event.Before = before
+
+	revoked, err := s.repo.DeleteTenantAPIKeys(ctx, name)
+	if err != nil {
+		s.log(ctx).Error("Failed to revoke API keys of deleted tenant",
+			zap.Error(err),
+			zap.String("tenant", name))
+		return nil, err
+	}
+
+	s.log(ctx).Info("Tenant deleted successfully",
+		zap.String("tenant", name),
+		zap.Int64("revoked_api_keys", revoked))
+
+	return &models.TenantResponse{
+		Success:   true,
+		Data:      &before,
+		Message:   "Tenant deleted successfully",
+		Timestamp: time.Now(),
+	}, nil
+}
+
+// EnsureDefaultTenant creates the default tenant if it does not exist yet
+func (s *TenantService) EnsureDefaultTenant(ctx context.Context) error {
+	now := time.Now()
+	return s.repo.EnsureTenant(ctx, models.Tenant{
+		Name:        models.DefaultTenant,
+		Description: "Owns requests that name no tenant",
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+}
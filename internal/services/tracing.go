@@ -0,0 +1,36 @@
+package services
+
+import (
+	"context"
+
+	"ip-allocator-api/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startSpan starts the span of a service method, tagged with the request's tenant and the
+// region, zone and sub-zone the method operates on when given
+func startSpan(ctx context.Context, name, regionName, zoneName, subZoneName string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{attribute.String("tenant", TenantFromContext(ctx))}
+	if regionName != "" {
+		attrs = append(attrs, attribute.String("region", regionName))
+	}
+	if zoneName != "" {
+		attrs = append(attrs, attribute.String("zone", zoneName))
+	}
+	if subZoneName != "" {
+		attrs = append(attrs, attribute.String("sub_zone", subZoneName))
+	}
+	return tracing.Start(ctx, name, attrs...)
+}
+
+// endSpan ends the span of a service method. Domain errors are the caller's mistake rather than
+// a failure of the service, so they are recorded by their code instead of as span errors.
+func endSpan(span trace.Span, err error) {
+	if domainErr, ok := AsError(err); ok {
+		span.SetAttributes(attribute.String("error.code", domainErr.Code))
+		err = nil
+	}
+	tracing.End(span, err)
+}
@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.uber.org/zap"
+)
+
+const (
+	snapshotFile = "snapshot.db"
+	walFile      = "wal.log"
+
+	// compactThreshold is the write-ahead log size at which the state is snapshotted and the
+	// log started over
+	compactThreshold = 64 << 20
+	// snapshotBatchSize is the number of documents per snapshot record
+	snapshotBatchSize = 1000
+	// minRecordSize and maxRecordSize reject lengths that can only come from a torn or corrupt
+	// record header; the smallest BSON document takes five bytes
+	minRecordSize = 5
+	maxRecordSize = 1 << 30
+
+	// recordHeaderSize is the length and CRC-32C of the payload preceding every record
+	recordHeaderSize = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// batch is the payload of a record: changes that are applied together or not at all
+type batch struct {
+	Changes []change `bson:"changes"`
+}
+
+// FileRepository is a MemoryRepository whose state survives restarts in a directory. Every
+// write is appended to a write-ahead log and fsynced before it is applied, so an acknowledged
+// write is never lost and a crash never leaves half of a write behind. When the log grows
+// large the state is written to a snapshot through a temporary file and an atomic rename, and
+// the log starts over.
+//
+// The directory must not be shared by two running instances.
+type FileRepository struct {
+	*MemoryRepository
+	dir     string
+	wal     *os.File
+	walSize int64
+	// failed is set when the log can no longer be trusted to match the state; every later
+	// write is refused with it
+	failed error
+	logger *zap.Logger
+}
+
+// NewFileRepository loads the state stored in dir, creating the directory when it does not
+// exist yet. A record torn by a crash at the end of the log is discarded.
+func NewFileRepository(dir string, logger *zap.Logger) (*FileRepository, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	r := &FileRepository{
+		MemoryRepository: NewMemoryRepository(),
+		dir:              dir,
+		logger:           logger,
+	}
+
+	// A temporary snapshot is left behind by a crash during compaction; the log still holds
+	// everything it contained
+	if err := os.Remove(filepath.Join(dir, snapshotFile+".tmp")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	snapshots, err := r.loadSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	records, size, err := r.replayLog(wal)
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	r.wal = wal
+	r.walSize = size
+	r.journal = r
+
+	logger.Info("File storage loaded",
+		zap.String("path", dir),
+		zap.Int("snapshot_records", snapshots),
+		zap.Int("log_records", records),
+		zap.Int64("log_bytes", size),
+		zap.Int("regions", len(r.state.regions)),
+		zap.Int("ips", len(r.state.ips)))
+
+	if size >= compactThreshold {
+		if err := r.compact(r.state); err != nil {
+			logger.Error("Failed to compact write-ahead log", zap.Error(err), zap.String("path", dir))
+		}
+	}
+	return r, nil
+}
+
+// Close closes the write-ahead log. Writes made after Close fail.
+func (r *FileRepository) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.failed == nil {
+		r.failed = errors.New("file storage is closed")
+	}
+	return r.wal.Close()
+}
+
+// Ping reports whether writes are still accepted
+func (r *FileRepository) Ping(ctx context.Context) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.failed != nil {
+		return r.failed
+	}
+	return ctx.Err()
+}
+
+// loadSnapshot applies the snapshot, if there is one. It is only ever replaced by a complete
+// file, so a damaged snapshot is an error rather than a torn write.
+func (r *FileRepository) loadSnapshot() (int, error) {
+	path := filepath.Join(r.dir, snapshotFile)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	records, size, err := readRecords(file, r.state.applyBatch)
+	if err != nil {
+		return 0, fmt.Errorf("reading snapshot %s: %w", path, err)
+	}
+	if size != info.Size() {
+		return 0, fmt.Errorf("snapshot %s is damaged at offset %d", path, size)
+	}
+	return records, nil
+}
+
+// replayLog applies the records of the write-ahead log and cuts off a torn tail, returning the
+// number of records and the size of the intact log. Damage anywhere else fails without
+// touching the log.
+func (r *FileRepository) replayLog(wal *os.File) (int, int64, error) {
+	info, err := wal.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	records, size, err := readRecords(wal, r.state.applyBatch)
+	var corrupted *corruptionError
+	if errors.As(err, &corrupted) {
+		// Records after the damage were acknowledged, so the log is left as it is for repair
+		return 0, 0, fmt.Errorf("write-ahead log %s %w", wal.Name(), err)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("replaying %s: %w", wal.Name(), err)
+	}
+
+	if size < info.Size() {
+		r.logger.Warn("Discarding incomplete write-ahead log tail",
+			zap.String("path", wal.Name()),
+			zap.Int64("offset", size),
+			zap.Int64("discarded_bytes", info.Size()-size))
+		if err := wal.Truncate(size); err != nil {
+			return 0, 0, err
+		}
+		if err := wal.Sync(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return records, size, nil
+}
+
+// applyBatch applies the changes of a stored record
+func (st *memoryState) applyBatch(b batch) error {
+	for _, c := range b.Changes {
+		if err := st.apply(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRecords calls fn with every intact record from the start of file and returns how many
+// there were and where the last one ended. A record that is cut short or fails its checksum
+// ends the file when only zeros follow it, which is what a torn final write leaves behind; a
+// damaged record followed by anything else is corruption and returned as a corruptionError.
+func readRecords(file *os.File, fn func(b batch) error) (int, int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	reader := bufio.NewReader(file)
+
+	var records int
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, offset, nil
+			}
+			return records, offset, err
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		if length < minRecordSize || length > maxRecordSize {
+			return records, offset, checkTornTail(file, offset, offset)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return records, offset, nil
+			}
+			return records, offset, err
+		}
+		if crc32.Checksum(payload, crcTable) != checksum {
+			return records, offset, checkTornTail(file, offset, offset+recordHeaderSize+int64(length))
+		}
+
+		var b batch
+		if err := bson.Unmarshal(payload, &b); err != nil {
+			return records, offset, err
+		}
+		if err := fn(b); err != nil {
+			return records, offset, err
+		}
+		records++
+		offset += recordHeaderSize + int64(length)
+	}
+}
+
+// corruptionError reports a damaged record with intact data after it
+type corruptionError struct {
+	offset int64
+}
+
+func (e *corruptionError) Error() string {
+	return fmt.Sprintf("corrupted at offset %d: a damaged record is followed by more data", e.offset)
+}
+
+// checkTornTail accepts the damaged record at offset as a torn write when nothing but zeros
+// follows from rest on, and returns a corruptionError otherwise
+func checkTornTail(file *os.File, offset, rest int64) error {
+	if _, err := file.Seek(rest, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b != 0 {
+			return &corruptionError{offset: offset}
+		}
+	}
+}
+
+// encodeRecord frames the changes as a record
+func encodeRecord(changes []change) ([]byte, error) {
+	payload, err := bson.Marshal(batch{Changes: changes})
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > maxRecordSize {
+		return nil, fmt.Errorf("record of %d bytes exceeds the maximum of %d", len(payload), maxRecordSize)
+	}
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	return append(record, payload...), nil
+}
+
+// record appends the changes to the write-ahead log and waits until they are on disk
+func (r *FileRepository) record(changes []change) error {
+	if r.failed != nil {
+		return r.failed
+	}
+
+	data, err := encodeRecord(changes)
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.wal.Write(data); err != nil {
+		// Cut off what was written so the next record follows an intact one
+		if truncErr := r.wal.Truncate(r.walSize); truncErr != nil {
+			r.fail(fmt.Errorf("write-ahead log is unusable after a failed write: %w", truncErr))
+		}
+		return err
+	}
+	if err := r.wal.Sync(); err != nil {
+		// After a failed fsync it is unknown what reached the disk
+		r.fail(fmt.Errorf("write-ahead log could not be synced: %w", err))
+		return err
+	}
+	r.walSize += int64(len(data))
+	return nil
+}
+
+// committed compacts the log once it has grown past the threshold
+func (r *FileRepository) committed(state *memoryState) {
+	if r.walSize < compactThreshold {
+		return
+	}
+	if err := r.compact(state); err != nil {
+		r.logger.Error("Failed to compact write-ahead log",
+			zap.Error(err),
+			zap.String("path", r.dir),
+			zap.Int64("log_bytes", r.walSize))
+	}
+}
+
+// fail refuses every later write
+func (r *FileRepository) fail(err error) {
+	r.logger.Error("File storage stopped accepting writes", zap.Error(err), zap.String("path", r.dir))
+	r.failed = err
+}
+
+// compact writes the state to a new snapshot and empties the log. Until the log is emptied it
+// still holds changes the new snapshot contains, which is harmless because replaying a change
+// twice leaves the same state.
+func (r *FileRepository) compact(state *memoryState) error {
+	path := filepath.Join(r.dir, snapshotFile)
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(file, state); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := syncDir(r.dir); err != nil {
+		return err
+	}
+
+	if err := r.wal.Truncate(0); err != nil {
+		return err
+	}
+	if err := r.wal.Sync(); err != nil {
+		r.fail(fmt.Errorf("write-ahead log could not be synced: %w", err))
+		return err
+	}
+
+	r.logger.Info("Write-ahead log compacted",
+		zap.String("path", r.dir),
+		zap.Int64("log_bytes", r.walSize))
+	r.walSize = 0
+	return nil
+}
+
+// writeSnapshot writes every document of the state to file and syncs it
+func writeSnapshot(file *os.File, state *memoryState) error {
+	writer := bufio.NewWriter(file)
+	pending := make([]change, 0, snapshotBatchSize)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		data, err := encodeRecord(pending)
+		if err != nil {
+			return err
+		}
+		pending = pending[:0]
+		_, err = writer.Write(data)
+		return err
+	}
+
+	err := state.each(func(c change) error {
+		pending = append(pending, c)
+		if len(pending) == snapshotBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,33 @@
+package storage_test
+
+import (
+	"testing"
+
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/storage/storagetest"
+
+	"go.uber.org/zap"
+)
+
+// openFileRepository opens the file repository kept in dir and closes it when the test ends
+func openFileRepository(t *testing.T, dir string) *storage.FileRepository {
+	t.Helper()
+	repo, err := storage.NewFileRepository(dir, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewFileRepository: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestFileRepository(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		return openFileRepository(t, t.TempDir())
+	})
+}
+
+func TestFileRepositoryDurable(t *testing.T) {
+	storagetest.RunDurable(t, func(t *testing.T, dir string) storage.Repository {
+		return openFileRepository(t, dir)
+	})
+}
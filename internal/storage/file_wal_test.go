@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/models"
+
+	"go.uber.org/zap"
+)
+
+func openWALTestRepository(t *testing.T, dir string) *FileRepository {
+	t.Helper()
+	repo, err := NewFileRepository(dir, zap.NewNop())
+	if err != nil {
+		t.Fatalf("NewFileRepository: %v", err)
+	}
+	return repo
+}
+
+// createRegions stores one region per name, each in its own log record
+func createRegions(t *testing.T, repo *FileRepository, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		region := models.Region{Name: name, Tenant: "t1", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+		if err := repo.CreateRegion(context.Background(), &region); err != nil {
+			t.Fatalf("CreateRegion(%s): %v", name, err)
+		}
+	}
+}
+
+func expectRegions(t *testing.T, repo *FileRepository, names ...string) {
+	t.Helper()
+	regions, err := repo.ListRegions(context.Background(), "t1")
+	if err != nil {
+		t.Fatalf("ListRegions: %v", err)
+	}
+	var got []string
+	for _, region := range regions {
+		got = append(got, region.Name)
+	}
+	if strings.Join(got, ",") != strings.Join(names, ",") {
+		t.Fatalf("regions after reopening are %v, want %v", got, names)
+	}
+}
+
+func walSize(t *testing.T, dir string) int64 {
+	t.Helper()
+	info, err := os.Stat(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	return info.Size()
+}
+
+func appendToWAL(t *testing.T, dir string, data []byte) {
+	t.Helper()
+	file, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+func TestFileRepositoryDiscardsTornTail(t *testing.T) {
+	record, err := encodeRecord([]change{{Collection: "regions"}})
+	if err != nil {
+		t.Fatalf("encodeRecord: %v", err)
+	}
+
+	tails := map[string][]byte{
+		"cut short":      record[:len(record)-3],
+		"header only":    record[:recordHeaderSize-2],
+		"zero filled":    make([]byte, 4096),
+		"bad checksum":   append(append([]byte{}, record[:recordHeaderSize]...), bytes.Repeat([]byte{0xff}, len(record)-recordHeaderSize)...),
+		"zeroed payload": append(append(append([]byte{}, record[:recordHeaderSize]...), make([]byte, len(record)-recordHeaderSize)...), make([]byte, 512)...),
+	}
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			repo := openWALTestRepository(t, dir)
+			createRegions(t, repo, "r1", "r2")
+			repo.Close()
+			intact := walSize(t, dir)
+			appendToWAL(t, dir, tail)
+
+			repo = openWALTestRepository(t, dir)
+			defer repo.Close()
+			expectRegions(t, repo, "r1", "r2")
+			if size := walSize(t, dir); size != intact {
+				t.Fatalf("log is %d bytes after recovery, want the intact %d", size, intact)
+			}
+
+			// Writes continue after the intact records
+			createRegions(t, repo, "r3")
+			repo.Close()
+			repo = openWALTestRepository(t, dir)
+			defer repo.Close()
+			expectRegions(t, repo, "r1", "r2", "r3")
+		})
+	}
+}
+
+func TestFileRepositoryRefusesMidLogCorruption(t *testing.T) {
+	dir := t.TempDir()
+	repo := openWALTestRepository(t, dir)
+	createRegions(t, repo, "r1")
+	repo.Close()
+	second := walSize(t, dir)
+
+	repo = openWALTestRepository(t, dir)
+	createRegions(t, repo, "r2", "r3")
+	repo.Close()
+	size := walSize(t, dir)
+
+	// Flip a payload byte of the second record; the third is still intact after it
+	path := filepath.Join(dir, walFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	data[second+recordHeaderSize+10] ^= 0xff
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	_, err = NewFileRepository(dir, zap.NewNop())
+	if err == nil {
+		t.Fatal("NewFileRepository accepted a log with a corrupted record in the middle")
+	}
+	if want := "corrupted at offset " + strconv.FormatInt(second, 10); !strings.Contains(err.Error(), want) {
+		t.Fatalf("NewFileRepository failed with %q, want it to contain %q", err, want)
+	}
+	if walSize(t, dir) != size {
+		t.Fatalf("log was truncated to %d bytes, want it left at %d", walSize(t, dir), size)
+	}
+}
+
+func TestFileRepositoryReplaysAfterCompaction(t *testing.T) {
+	dir := t.TempDir()
+	repo := openWALTestRepository(t, dir)
+	createRegions(t, repo, "r1", "r2")
+
+	repo.mu.Lock()
+	err := repo.compact(repo.state)
+	repo.mu.Unlock()
+	if err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if size := walSize(t, dir); size != 0 {
+		t.Fatalf("log is %d bytes after compaction, want it emptied", size)
+	}
+
+	createRegions(t, repo, "r3")
+	if _, err := repo.DeleteRegion(context.Background(), "t1", "r1"); err != nil {
+		t.Fatalf("DeleteRegion: %v", err)
+	}
+	repo.Close()
+
+	// The snapshot holds r1 and r2, the log creates r3 and deletes r1
+	for i := 0; i < 2; i++ {
+		repo = openWALTestRepository(t, dir)
+		expectRegions(t, repo, "r2", "r3")
+		repo.Close()
+	}
+}
@@ -0,0 +1,815 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"ip-allocator-api/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// regionKey addresses a region within its tenant
+type regionKey struct {
+	tenant string
+	name   string
+}
+
+// subZoneKey addresses the IP documents of a sub-zone
+type subZoneKey struct {
+	tenant  string
+	region  string
+	zone    string
+	subZone string
+}
+
+// ipKey is the identity of an IP document; an address is held at most once per sub-zone
+type ipKey struct {
+	tenant  string
+	region  string
+	zone    string
+	subZone string
+	ip      string
+}
+
+// MemoryRepository keeps every document in process memory. Documents are copied through their
+// BSON encoding on every write and read, so they come back exactly as MongoDB would return
+// them, with times in UTC at millisecond precision, and callers can never alias the stored state.
+//
+// Every write is expressed as a batch of document changes that is handed to the journal, when
+// there is one, before it is applied; FileRepository uses that to make the state durable.
+type MemoryRepository struct {
+	mu      sync.RWMutex
+	state   *memoryState
+	journal journal
+	// prunedAt is when expired idempotency records were last removed
+	prunedAt time.Time
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{state: newMemoryState()}
+}
+
+// journal persists batches of changes for a MemoryRepository
+type journal interface {
+	// record makes the changes durable; they are only applied when it succeeds
+	record(changes []change) error
+	// committed runs after the changes were applied, with the write lock still held
+	committed(state *memoryState)
+}
+
+// change replaces or, without a document, removes the document with the ID in a collection.
+// Changes are idempotent, so a batch can be applied to a state that already contains it.
+type change struct {
+	Collection string             `bson:"collection"`
+	ID         primitive.ObjectID `bson:"id"`
+	Document   bson.Raw           `bson:"document,omitempty"`
+}
+
+// put returns the change storing doc
+func put(collection string, id primitive.ObjectID, doc interface{}) (change, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return change{}, err
+	}
+	return change{Collection: collection, ID: id, Document: data}, nil
+}
+
+// remove returns the change deleting a document
+func remove(collection string, id primitive.ObjectID) change {
+	return change{Collection: collection, ID: id}
+}
+
+// commit journals and applies a batch; the caller holds the write lock
+func (r *MemoryRepository) commit(changes ...change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if r.journal != nil {
+		if err := r.journal.record(changes); err != nil {
+			return err
+		}
+	}
+	for _, c := range changes {
+		if err := r.state.apply(c); err != nil {
+			return err
+		}
+	}
+	if r.journal != nil {
+		r.journal.committed(r.state)
+	}
+	return nil
+}
+
+// Ping always succeeds
+func (r *MemoryRepository) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// copyDocument copies in to out through their BSON encoding
+func copyDocument(in, out interface{}) error {
+	data, err := bson.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, out)
+}
+
+func copyRegion(region models.Region) (models.Region, error) {
+	var out models.Region
+	err := copyDocument(region, &out)
+	return out, err
+}
+
+func copyIP(doc models.IPAllocation) (models.IPAllocation, error) {
+	var out models.IPAllocation
+	err := copyDocument(doc, &out)
+	return out, err
+}
+
+// storedTime rounds a time the way it is stored, so comparisons match MongoDB's
+func storedTime(t time.Time) time.Time {
+	return primitive.NewDateTimeFromTime(t).Time()
+}
+
+// GetRegion returns a region of the tenant, or ErrNotFound
+func (r *MemoryRepository) GetRegion(ctx context.Context, tenant, name string) (models.Region, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.state.regionNames[regionKey{tenant, name}]
+	if !ok {
+		return models.Region{}, ErrNotFound
+	}
+	return copyRegion(r.state.regions[id])
+}
+
+// ListRegions returns the regions of the tenant, or of every tenant, ordered by tenant and name
+func (r *MemoryRepository) ListRegions(ctx context.Context, tenant string) ([]models.Region, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var regions []models.Region
+	for _, region := range r.state.regions {
+		if tenant != "" && region.Tenant != tenant {
+			continue
+		}
+		region, err := copyRegion(region)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, region)
+	}
+
+	sort.Slice(regions, func(i, j int) bool {
+		if regions[i].Tenant != regions[j].Tenant {
+			return regions[i].Tenant < regions[j].Tenant
+		}
+		return regions[i].Name < regions[j].Name
+	})
+	return regions, nil
+}
+
+// CountRegions counts the regions of the tenant
+func (r *MemoryRepository) CountRegions(ctx context.Context, tenant string) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var count int64
+	for key := range r.state.regionNames {
+		if key.tenant == tenant {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// HierarchyVersion returns the region count and the latest region update
+func (r *MemoryRepository) HierarchyVersion(ctx context.Context) (HierarchyVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	version := HierarchyVersion{Count: int64(len(r.state.regions))}
+	for _, region := range r.state.regions {
+		if region.UpdatedAt.After(version.UpdatedAt) {
+			version.UpdatedAt = region.UpdatedAt
+		}
+	}
+	return version, nil
+}
+
+// CreateRegion stores a new region, or returns ErrDuplicate
+func (r *MemoryRepository) CreateRegion(ctx context.Context, region *models.Region) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.state.regionNames[regionKeyOf(region)]; ok {
+		return ErrDuplicate
+	}
+	if region.ID.IsZero() {
+		region.ID = primitive.NewObjectID()
+	}
+	if _, ok := r.state.regions[region.ID]; ok {
+		return ErrDuplicate
+	}
+
+	c, err := put(models.RegionCollection, region.ID, region)
+	if err != nil {
+		return err
+	}
+	return r.commit(c)
+}
+
+// updateRegion applies update to a copy of the region and stores it, returning the region as it
+// was before. update reports ErrNotFound when the addressed zone or sub-zone does not exist.
+func (r *MemoryRepository) updateRegion(tenant, name string, update func(region *models.Region) error) (models.Region, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, ok := r.state.regionNames[regionKey{tenant, name}]
+	if !ok {
+		return models.Region{}, ErrNotFound
+	}
+	before := r.state.regions[id]
+
+	region, err := copyRegion(before)
+	if err != nil {
+		return models.Region{}, err
+	}
+	if err := update(&region); err != nil {
+		return models.Region{}, err
+	}
+
+	if other, ok := r.state.regionNames[regionKeyOf(&region)]; ok && other != id {
+		return models.Region{}, ErrDuplicate
+	}
+	c, err := put(models.RegionCollection, id, region)
+	if err != nil {
+		return models.Region{}, err
+	}
+	if err := r.commit(c); err != nil {
+		return models.Region{}, err
+	}
+	return copyRegion(before)
+}
+
+// apply sets the non-empty changed fields
+func (changes HierarchyChanges) apply(name, ipv4CIDR, ipv6CIDR *string, updatedAt *time.Time) {
+	if changes.Name != "" {
+		*name = changes.Name
+	}
+	if changes.IPv4CIDR != "" {
+		*ipv4CIDR = changes.IPv4CIDR
+	}
+	if changes.IPv6CIDR != "" {
+		*ipv6CIDR = changes.IPv6CIDR
+	}
+	*updatedAt = changes.UpdatedAt
+}
+
+// UpdateRegion applies the changes and returns the region as it was before
+func (r *MemoryRepository) UpdateRegion(ctx context.Context, tenant, name string, changes HierarchyChanges) (models.Region, error) {
+	return r.updateRegion(tenant, name, func(region *models.Region) error {
+		changes.apply(&region.Name, &region.IPv4CIDR, &region.IPv6CIDR, &region.UpdatedAt)
+		return nil
+	})
+}
+
+// DeleteRegion removes a region and returns it
+func (r *MemoryRepository) DeleteRegion(ctx context.Context, tenant, name string) (models.Region, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, ok := r.state.regionNames[regionKey{tenant, name}]
+	if !ok {
+		return models.Region{}, ErrNotFound
+	}
+	before := r.state.regions[id]
+	if err := r.commit(remove(models.RegionCollection, id)); err != nil {
+		return models.Region{}, err
+	}
+	return before, nil
+}
+
+// guard checks the precondition of AddZone and AddSubZone
+func guard(region *models.Region, unchangedSince time.Time) error {
+	if !unchangedSince.IsZero() && !region.UpdatedAt.Equal(storedTime(unchangedSince)) {
+		return ErrConflict
+	}
+	return nil
+}
+
+// AddZone appends a zone to a region, conditional on the region's updated_at when unchangedSince is set
+func (r *MemoryRepository) AddZone(ctx context.Context, tenant, regionName string, zone models.Zone, unchangedSince time.Time) error {
+	_, err := r.updateRegion(tenant, regionName, func(region *models.Region) error {
+		if err := guard(region, unchangedSince); err != nil {
+			return err
+		}
+		region.Zones = append(region.Zones, zone)
+		region.UpdatedAt = zone.UpdatedAt
+		return nil
+	})
+	return err
+}
+
+// UpdateZone applies the changes to a zone and returns its region as it was before. Like an
+// array filter, the changes apply to every zone of that name.
+func (r *MemoryRepository) UpdateZone(ctx context.Context, tenant, regionName, zoneName string, changes HierarchyChanges) (models.Region, error) {
+	return r.updateRegion(tenant, regionName, func(region *models.Region) error {
+		found := false
+		for i := range region.Zones {
+			zone := &region.Zones[i]
+			if zone.Name != zoneName {
+				continue
+			}
+			found = true
+			changes.apply(&zone.Name, &zone.IPv4CIDR, &zone.IPv6CIDR, &zone.UpdatedAt)
+		}
+		if !found {
+			return ErrNotFound
+		}
+		region.UpdatedAt = changes.UpdatedAt
+		return nil
+	})
+}
+
+// DeleteZone removes a zone and returns its region as it was before
+func (r *MemoryRepository) DeleteZone(ctx context.Context, tenant, regionName, zoneName string) (models.Region, error) {
+	return r.updateRegion(tenant, regionName, func(region *models.Region) error {
+		zones := region.Zones[:0]
+		for _, zone := range region.Zones {
+			if zone.Name != zoneName {
+				zones = append(zones, zone)
+			}
+		}
+		if len(zones) == len(region.Zones) {
+			return ErrNotFound
+		}
+		region.Zones = zones
+		region.UpdatedAt = time.Now()
+		return nil
+	})
+}
+
+// AddSubZone appends a sub-zone to a zone, conditional on the region's updated_at when unchangedSince is set
+func (r *MemoryRepository) AddSubZone(ctx context.Context, tenant, regionName, zoneName string, subZone models.SubZone, unchangedSince time.Time) error {
+	_, err := r.updateRegion(tenant, regionName, func(region *models.Region) error {
+		found := false
+		for i := range region.Zones {
+			zone := &region.Zones[i]
+			if zone.Name != zoneName {
+				continue
+			}
+			found = true
+			zone.SubZones = append(zone.SubZones, subZone)
+			zone.UpdatedAt = subZone.UpdatedAt
+		}
+		if !found {
+			return ErrNotFound
+		}
+		if err := guard(region, unchangedSince); err != nil {
+			return err
+		}
+		region.UpdatedAt = subZone.UpdatedAt
+		return nil
+	})
+	return err
+}
+
+// UpdateSubZone applies the changes to a sub-zone and returns its region as it was before
+func (r *MemoryRepository) UpdateSubZone(ctx context.Context, tenant, regionName, zoneName, subZoneName string, changes HierarchyChanges) (models.Region, error) {
+	return r.updateRegion(tenant, regionName, func(region *models.Region) error {
+		found := false
+		for i := range region.Zones {
+			zone := &region.Zones[i]
+			if zone.Name != zoneName {
+				continue
+			}
+			for j := range zone.SubZones {
+				subZone := &zone.SubZones[j]
+				if subZone.Name != subZoneName {
+					continue
+				}
+				found = true
+				changes.apply(&subZone.Name, &subZone.IPv4CIDR, &subZone.IPv6CIDR, &subZone.UpdatedAt)
+				if changes.AllocationStrategy != "" {
+					subZone.AllocationStrategy = changes.AllocationStrategy
+				}
+				if changes.ClearEmbeddedIPs {
+					subZone.AllocatedIPv4, subZone.AllocatedIPv6 = nil, nil
+					subZone.ReservedIPv4, subZone.ReservedIPv6 = nil, nil
+				}
+				zone.UpdatedAt = changes.UpdatedAt
+			}
+		}
+		if !found {
+			return ErrNotFound
+		}
+		region.UpdatedAt = changes.UpdatedAt
+		return nil
+	})
+}
+
+// DeleteSubZone removes a sub-zone and returns its region as it was before
+func (r *MemoryRepository) DeleteSubZone(ctx context.Context, tenant, regionName, zoneName, subZoneName string) (models.Region, error) {
+	now := time.Now()
+	return r.updateRegion(tenant, regionName, func(region *models.Region) error {
+		found := false
+		for i := range region.Zones {
+			zone := &region.Zones[i]
+			if zone.Name != zoneName {
+				continue
+			}
+			subZones := zone.SubZones[:0]
+			for _, subZone := range zone.SubZones {
+				if subZone.Name != subZoneName {
+					subZones = append(subZones, subZone)
+				}
+			}
+			if len(subZones) < len(zone.SubZones) {
+				found = true
+			}
+			zone.SubZones = subZones
+			zone.UpdatedAt = now
+		}
+		if !found {
+			return ErrNotFound
+		}
+		region.UpdatedAt = now
+		return nil
+	})
+}
+
+// matches reports whether a stored document satisfies the filter
+func (filter IPFilter) matches(doc *models.IPAllocation) bool {
+	if filter.Tenant != "" && doc.Tenant != filter.Tenant {
+		return false
+	}
+	if filter.Region != "" && doc.Region != filter.Region {
+		return false
+	}
+	if len(filter.Regions) > 0 && !contains(filter.Regions, doc.Region) {
+		return false
+	}
+	if filter.Zone != "" && doc.Zone != filter.Zone {
+		return false
+	}
+	if filter.SubZone != "" && doc.SubZone != filter.SubZone {
+		return false
+	}
+	if len(filter.IPAddresses) > 0 && !contains(filter.IPAddresses, doc.IPAddress) {
+		return false
+	}
+	if filter.Status != "" && doc.Status != filter.Status {
+		return false
+	}
+	if filter.Owner != "" && doc.Owner != filter.Owner {
+		return false
+	}
+	for key, value := range filter.Labels {
+		if label, ok := doc.Labels[key]; !ok || label != value {
+			return false
+		}
+	}
+	if filter.CreatedBy != "" && doc.CreatedBy != filter.CreatedBy {
+		return false
+	}
+	if len(filter.PairedIPs) > 0 && !contains(filter.PairedIPs, doc.PairedIP) {
+		return false
+	}
+	if !filter.ExpiresAfter.IsZero() && (doc.ExpiresAt == nil || !doc.ExpiresAt.After(storedTime(filter.ExpiresAfter))) {
+		return false
+	}
+	if !filter.ExpiresBy.IsZero() && (doc.ExpiresAt == nil || doc.ExpiresAt.After(storedTime(filter.ExpiresBy))) {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func keyOf(doc *models.IPAllocation) ipKey {
+	return ipKey{doc.Tenant, doc.Region, doc.Zone, doc.SubZone, doc.IPAddress}
+}
+
+func subZoneOf(doc *models.IPAllocation) subZoneKey {
+	return subZoneKey{doc.Tenant, doc.Region, doc.Zone, doc.SubZone}
+}
+
+// matching returns the IDs of the stored documents matching the filter; the caller holds the
+// lock. A filter naming a whole sub-zone is served from the indexes, like MongoDB would.
+func (r *MemoryRepository) matching(filter IPFilter) []primitive.ObjectID {
+	var ids []primitive.ObjectID
+	if filter.Tenant == "" || filter.Region == "" || filter.Zone == "" || filter.SubZone == "" {
+		for id, doc := range r.state.ips {
+			if filter.matches(&doc) {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+
+	if len(filter.IPAddresses) > 0 {
+		seen := make(map[primitive.ObjectID]bool, len(filter.IPAddresses))
+		for _, ip := range filter.IPAddresses {
+			id, ok := r.state.held[ipKey{filter.Tenant, filter.Region, filter.Zone, filter.SubZone, ip}]
+			if !ok || seen[id] {
+				continue
+			}
+			seen[id] = true
+			if doc := r.state.ips[id]; filter.matches(&doc) {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+
+	docs := r.state.subZoneIPs[subZoneKey{filter.Tenant, filter.Region, filter.Zone, filter.SubZone}]
+	if docs == nil {
+		return nil
+	}
+	for id := range docs.ids {
+		if doc := r.state.ips[id]; filter.matches(&doc) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// copyIPs returns copies of the documents with the given IDs
+func (r *MemoryRepository) copyIPs(ids []primitive.ObjectID) ([]models.IPAllocation, error) {
+	var docs []models.IPAllocation
+	for _, id := range ids {
+		doc, err := copyIP(r.state.ips[id])
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// FindIPs returns the documents matching the filter in the order they were created
+func (r *MemoryRepository) FindIPs(ctx context.Context, filter IPFilter) ([]models.IPAllocation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	docs, err := r.copyIPs(r.matching(filter))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if !docs[i].CreatedAt.Equal(docs[j].CreatedAt) {
+			return docs[i].CreatedAt.Before(docs[j].CreatedAt)
+		}
+		return bytes.Compare(docs[i].ID[:], docs[j].ID[:]) < 0
+	})
+	return docs, nil
+}
+
+// CountIPs counts the documents matching the filter
+func (r *MemoryRepository) CountIPs(ctx context.Context, filter IPFilter) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return int64(len(r.matching(filter))), nil
+}
+
+// IPStateVersion counts the documents matching the filter and finds the latest update among them
+func (r *MemoryRepository) IPStateVersion(ctx context.Context, filter IPFilter) (IPStateVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// A whole sub-zone is counted from its index, like MongoDB would
+	key := subZoneKey{filter.Tenant, filter.Region, filter.Zone, filter.SubZone}
+	whole := IPFilter{Tenant: key.tenant, Region: key.region, Zone: key.zone, SubZone: key.subZone}
+	if key.tenant != "" && key.region != "" && key.zone != "" && key.subZone != "" && reflect.DeepEqual(filter, whole) {
+		docs := r.state.subZoneIPs[key]
+		if docs == nil {
+			return IPStateVersion{}, nil
+		}
+		return IPStateVersion{Count: int64(len(docs.ids)), UpdatedAt: docs.updated[len(docs.updated)-1]}, nil
+	}
+
+	var version IPStateVersion
+	for _, id := range r.matching(filter) {
+		version.Count++
+		if updatedAt := r.state.ips[id].UpdatedAt; updatedAt.After(version.UpdatedAt) {
+			version.UpdatedAt = updatedAt
+		}
+	}
+	return version, nil
+}
+
+// CountIPsByOwner counts the documents of each owner of the tenant, ordered by owner
+func (r *MemoryRepository) CountIPsByOwner(ctx context.Context, tenant string) ([]OwnerCount, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	byOwner := make(map[string]int64)
+	for _, doc := range r.state.ips {
+		if doc.Tenant == tenant && doc.Owner != "" {
+			byOwner[doc.Owner]++
+		}
+	}
+
+	counts := make([]OwnerCount, 0, len(byOwner))
+	for owner, count := range byOwner {
+		counts = append(counts, OwnerCount{Owner: owner, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Owner < counts[j].Owner })
+	return counts, nil
+}
+
+// InsertIPs stores the documents all-or-nothing, or returns ErrDuplicate
+func (r *MemoryRepository) InsertIPs(ctx context.Context, docs []models.IPAllocation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changes := make([]change, 0, len(docs))
+	claimed := make(map[ipKey]bool, len(docs))
+	ids := make(map[primitive.ObjectID]bool, len(docs))
+	for i := range docs {
+		if docs[i].ID.IsZero() {
+			docs[i].ID = primitive.NewObjectID()
+		}
+		doc := &docs[i]
+
+		key := keyOf(doc)
+		if _, ok := r.state.held[key]; ok || claimed[key] {
+			return ErrDuplicate
+		}
+		if _, ok := r.state.ips[doc.ID]; ok || ids[doc.ID] {
+			return ErrDuplicate
+		}
+		claimed[key] = true
+		ids[doc.ID] = true
+
+		c, err := put(models.IPAllocationCollection, doc.ID, doc)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, c)
+	}
+	return r.commit(changes...)
+}
+
+// DeleteIPs removes the documents matching the filter
+func (r *MemoryRepository) DeleteIPs(ctx context.Context, filter IPFilter) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := r.matching(filter)
+	changes := make([]change, 0, len(ids))
+	for _, id := range ids {
+		changes = append(changes, remove(models.IPAllocationCollection, id))
+	}
+	if err := r.commit(changes...); err != nil {
+		return 0, err
+	}
+	return int64(len(ids)), nil
+}
+
+// updateIPs replaces the documents matching the filter with their changed copies, returning
+// ErrDuplicate without changing anything when two documents would hold the same address
+func (r *MemoryRepository) updateIPs(filter IPFilter, update func(doc *models.IPAllocation)) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := r.matching(filter)
+	changes := make([]change, 0, len(ids))
+	// released holds the identities the matching documents give up, claimed the ones they take
+	released := make(map[ipKey]bool, len(ids))
+	claimed := make(map[ipKey]bool, len(ids))
+	for _, id := range ids {
+		doc := r.state.ips[id]
+		released[keyOf(&doc)] = true
+	}
+	for _, id := range ids {
+		doc, err := copyIP(r.state.ips[id])
+		if err != nil {
+			return 0, err
+		}
+		update(&doc)
+
+		key := keyOf(&doc)
+		if _, ok := r.state.held[key]; (ok && !released[key]) || claimed[key] {
+			return 0, ErrDuplicate
+		}
+		claimed[key] = true
+
+		c, err := put(models.IPAllocationCollection, id, doc)
+		if err != nil {
+			return 0, err
+		}
+		changes = append(changes, c)
+	}
+
+	if err := r.commit(changes...); err != nil {
+		return 0, err
+	}
+	return int64(len(changes)), nil
+}
+
+// MoveIPs rewrites the hierarchy fields of the documents matching the filter
+func (r *MemoryRepository) MoveIPs(ctx context.Context, filter IPFilter, to IPLocation) (int64, error) {
+	now := time.Now()
+	return r.updateIPs(filter, func(doc *models.IPAllocation) {
+		if to.Region != "" {
+			doc.Region = to.Region
+		}
+		if to.Zone != "" {
+			doc.Zone = to.Zone
+		}
+		if to.SubZone != "" {
+			doc.SubZone = to.SubZone
+		}
+		doc.UpdatedAt = now
+	})
+}
+
+// UnpairIPs removes the host pair link of the documents matching the filter
+func (r *MemoryRepository) UnpairIPs(ctx context.Context, filter IPFilter) (int64, error) {
+	now := time.Now()
+	return r.updateIPs(filter, func(doc *models.IPAllocation) {
+		doc.PairID = ""
+		doc.PairedIP = ""
+		doc.UpdatedAt = now
+	})
+}
+
+// RenewLeases moves the expiry of allocated documents whose lease has not yet run out.
+// Permanent allocations have no expiry and never match.
+func (r *MemoryRepository) RenewLeases(ctx context.Context, filter IPFilter, expiresAt, now time.Time) (int64, error) {
+	filter.Status = models.IPStatusAllocated
+	filter.ExpiresAfter = now
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var changes []change
+	for _, id := range r.matching(filter) {
+		doc := r.state.ips[id]
+		expiry := expiresAt
+		doc.ExpiresAt = &expiry
+		doc.UpdatedAt = now
+		c, err := put(models.IPAllocationCollection, id, doc)
+		if err != nil {
+			return 0, err
+		}
+		changes = append(changes, c)
+	}
+
+	if err := r.commit(changes...); err != nil {
+		return 0, err
+	}
+	return int64(len(changes)), nil
+}
+
+// FindExpiredIPs returns up to limit allocated documents whose lease ended, the longest expired first
+func (r *MemoryRepository) FindExpiredIPs(ctx context.Context, now time.Time, limit int64) ([]models.IPAllocation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	docs, err := r.copyIPs(r.matching(IPFilter{Status: models.IPStatusAllocated, ExpiresBy: now}))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		if !docs[i].ExpiresAt.Equal(*docs[j].ExpiresAt) {
+			return docs[i].ExpiresAt.Before(*docs[j].ExpiresAt)
+		}
+		return bytes.Compare(docs[i].ID[:], docs[j].ID[:]) < 0
+	})
+	if limit > 0 && int64(len(docs)) > limit {
+		docs = docs[:limit]
+	}
+	return docs, nil
+}
+
+// ReleaseExpiredIP deletes an expired lease unless it was renewed after it was read
+func (r *MemoryRepository) ReleaseExpiredIP(ctx context.Context, id primitive.ObjectID, now time.Time) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	doc, ok := r.state.ips[id]
+	if !ok || !(IPFilter{Status: models.IPStatusAllocated, ExpiresBy: now}).matches(&doc) {
+		return false, nil
+	}
+	if err := r.commit(remove(models.IPAllocationCollection, id)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,606 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"ip-allocator-api/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// idempotencyPruneInterval bounds how often expired idempotency records are removed, the way
+// the TTL monitor of MongoDB does
+const idempotencyPruneInterval = time.Minute
+
+func copyTenant(tenant models.Tenant) (models.Tenant, error) {
+	var out models.Tenant
+	err := copyDocument(tenant, &out)
+	return out, err
+}
+
+func copyAPIKey(key models.APIKey) (models.APIKey, error) {
+	var out models.APIKey
+	err := copyDocument(key, &out)
+	return out, err
+}
+
+// GetTenant returns a tenant, or ErrNotFound
+func (r *MemoryRepository) GetTenant(ctx context.Context, name string) (models.Tenant, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.state.tenantNames[name]
+	if !ok {
+		return models.Tenant{}, ErrNotFound
+	}
+	return copyTenant(r.state.tenants[id])
+}
+
+// ListTenants returns every tenant ordered by name
+func (r *MemoryRepository) ListTenants(ctx context.Context) ([]models.Tenant, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var tenants []models.Tenant
+	for _, tenant := range r.state.tenants {
+		tenant, err := copyTenant(tenant)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	return tenants, nil
+}
+
+// CreateTenant stores a new tenant, or returns ErrDuplicate
+func (r *MemoryRepository) CreateTenant(ctx context.Context, tenant *models.Tenant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if tenant.ID.IsZero() {
+		tenant.ID = primitive.NewObjectID()
+	}
+	return r.createTenant(tenant)
+}
+
+// createTenant stores a tenant with its ID set; the caller holds the write lock
+func (r *MemoryRepository) createTenant(tenant *models.Tenant) error {
+	if _, ok := r.state.tenantNames[tenant.Name]; ok {
+		return ErrDuplicate
+	}
+	if _, ok := r.state.tenants[tenant.ID]; ok {
+		return ErrDuplicate
+	}
+
+	c, err := put(models.TenantCollection, tenant.ID, tenant)
+	if err != nil {
+		return err
+	}
+	return r.commit(c)
+}
+
+// EnsureTenant stores the tenant unless one with its name already exists
+func (r *MemoryRepository) EnsureTenant(ctx context.Context, tenant models.Tenant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.state.tenantNames[tenant.Name]; ok {
+		return nil
+	}
+	if tenant.ID.IsZero() {
+		tenant.ID = primitive.NewObjectID()
+	}
+	return r.createTenant(&tenant)
+}
+
+// UpdateTenant sets the description and returns the tenant as it was before
+func (r *MemoryRepository) UpdateTenant(ctx context.Context, name, description string, updatedAt time.Time) (models.Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, ok := r.state.tenantNames[name]
+	if !ok {
+		return models.Tenant{}, ErrNotFound
+	}
+	before := r.state.tenants[id]
+
+	tenant := before
+	tenant.Description = description
+	tenant.UpdatedAt = updatedAt
+	c, err := put(models.TenantCollection, id, tenant)
+	if err != nil {
+		return models.Tenant{}, err
+	}
+	if err := r.commit(c); err != nil {
+		return models.Tenant{}, err
+	}
+	return before, nil
+}
+
+// DeleteTenant removes a tenant and returns it
+func (r *MemoryRepository) DeleteTenant(ctx context.Context, name string) (models.Tenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, ok := r.state.tenantNames[name]
+	if !ok {
+		return models.Tenant{}, ErrNotFound
+	}
+	before := r.state.tenants[id]
+	if err := r.commit(remove(models.TenantCollection, id)); err != nil {
+		return models.Tenant{}, err
+	}
+	return before, nil
+}
+
+// FindAPIKeyByHash returns the key with the hash, or ErrNotFound
+func (r *MemoryRepository) FindAPIKeyByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.state.keyHashes[keyHash]
+	if !ok {
+		return models.APIKey{}, ErrNotFound
+	}
+	return copyAPIKey(r.state.apiKeys[id])
+}
+
+// ListAPIKeys returns the keys of the tenant, or every key, oldest first
+func (r *MemoryRepository) ListAPIKeys(ctx context.Context, tenant string) ([]models.APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var keys []models.APIKey
+	for _, key := range r.state.apiKeys {
+		if tenant != "" && key.Tenant != tenant {
+			continue
+		}
+		key, err := copyAPIKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return bytes.Compare(keys[i].ID[:], keys[j].ID[:]) < 0
+	})
+	return keys, nil
+}
+
+// CreateAPIKey stores a new key, or returns ErrDuplicate
+func (r *MemoryRepository) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if key.ID.IsZero() {
+		key.ID = primitive.NewObjectID()
+	}
+	return r.putAPIKey(key)
+}
+
+// putAPIKey stores a key unless another key has its ID, name or hash; the caller holds the write lock
+func (r *MemoryRepository) putAPIKey(key *models.APIKey) error {
+	taken := func(index map[string]primitive.ObjectID, value string) bool {
+		id, ok := index[value]
+		return ok && id != key.ID
+	}
+	if taken(r.state.keyNames, key.Name) || taken(r.state.keyHashes, key.KeyHash) {
+		return ErrDuplicate
+	}
+
+	c, err := put(models.APIKeyCollection, key.ID, key)
+	if err != nil {
+		return err
+	}
+	return r.commit(c)
+}
+
+// UpsertAPIKey replaces the key of the same name, keeping its identity and history
+func (r *MemoryRepository) UpsertAPIKey(ctx context.Context, key models.APIKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id, ok := r.state.keyNames[key.Name]; ok {
+		existing := r.state.apiKeys[id]
+		key.ID = existing.ID
+		key.CreatedBy = existing.CreatedBy
+		key.CreatedAt = existing.CreatedAt
+		key.LastUsedAt = existing.LastUsedAt
+	} else {
+		key.ID = primitive.NewObjectID()
+		key.LastUsedAt = nil
+	}
+	return r.putAPIKey(&key)
+}
+
+// TouchAPIKey records the last use of a key
+func (r *MemoryRepository) TouchAPIKey(ctx context.Context, id primitive.ObjectID, usedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, ok := r.state.apiKeys[id]
+	if !ok {
+		return nil
+	}
+	key.LastUsedAt = &usedAt
+	c, err := put(models.APIKeyCollection, id, key)
+	if err != nil {
+		return err
+	}
+	return r.commit(c)
+}
+
+// DeleteAPIKey removes a key, limited to the tenant when one is given, and returns it
+func (r *MemoryRepository) DeleteAPIKey(ctx context.Context, id primitive.ObjectID, tenant string) (models.APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	before, ok := r.state.apiKeys[id]
+	if !ok || (tenant != "" && before.Tenant != tenant) {
+		return models.APIKey{}, ErrNotFound
+	}
+	if err := r.commit(remove(models.APIKeyCollection, id)); err != nil {
+		return models.APIKey{}, err
+	}
+	return before, nil
+}
+
+// DeleteTenantAPIKeys removes the keys of a tenant
+func (r *MemoryRepository) DeleteTenantAPIKeys(ctx context.Context, tenant string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var changes []change
+	for id, key := range r.state.apiKeys {
+		if key.Tenant == tenant {
+			changes = append(changes, remove(models.APIKeyCollection, id))
+		}
+	}
+	if err := r.commit(changes...); err != nil {
+		return 0, err
+	}
+	return int64(len(changes)), nil
+}
+
+// InsertAuditEvent appends an event
+func (r *MemoryRepository) InsertAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if event.ID.IsZero() {
+		event.ID = primitive.NewObjectID()
+	}
+	if _, ok := r.state.audit[event.ID]; ok {
+		return ErrDuplicate
+	}
+
+	c, err := put(models.AuditCollection, event.ID, event)
+	if err != nil {
+		return err
+	}
+	return r.commit(c)
+}
+
+// matches reports whether a stored event satisfies the filter
+func (filter AuditFilter) matches(entry *auditEntry) bool {
+	if filter.Tenant != "" && entry.Tenant != filter.Tenant {
+		return false
+	}
+	if filter.ResourcePath != "" && entry.ResourcePath != filter.ResourcePath &&
+		!strings.HasPrefix(entry.ResourcePath, filter.ResourcePath+"/") {
+		return false
+	}
+	if filter.ResourceType != "" && entry.ResourceType != filter.ResourceType {
+		return false
+	}
+	if filter.IPAddress != "" && !contains(entry.IPAddresses, filter.IPAddress) {
+		return false
+	}
+	if filter.Actor != "" && entry.Actor != filter.Actor {
+		return false
+	}
+	if filter.Outcome != "" && entry.Outcome != filter.Outcome {
+		return false
+	}
+	if !filter.Since.IsZero() && entry.Timestamp.Before(storedTime(filter.Since)) {
+		return false
+	}
+	if !filter.Until.IsZero() && entry.Timestamp.After(storedTime(filter.Until)) {
+		return false
+	}
+	return true
+}
+
+// FindAuditEvents returns the events matching the filter, newest first
+func (r *MemoryRepository) FindAuditEvents(ctx context.Context, filter AuditFilter) ([]bson.Raw, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	type match struct {
+		id    primitive.ObjectID
+		entry *auditEntry
+	}
+	var matches []match
+	for id := range r.state.audit {
+		entry := r.state.audit[id]
+		if filter.matches(&entry) {
+			matches = append(matches, match{id, &entry})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].entry.Timestamp.Equal(matches[j].entry.Timestamp) {
+			return matches[i].entry.Timestamp.After(matches[j].entry.Timestamp)
+		}
+		return bytes.Compare(matches[i].id[:], matches[j].id[:]) > 0
+	})
+	if filter.Limit > 0 && int64(len(matches)) > filter.Limit {
+		matches = matches[:filter.Limit]
+	}
+
+	events := make([]bson.Raw, 0, len(matches))
+	for _, m := range matches {
+		// Stored documents are never modified in place, but callers get their own copy
+		events = append(events, append(bson.Raw(nil), m.entry.raw...))
+	}
+	return events, nil
+}
+
+// GetIdempotencyRecord returns the record of the key, or ErrNotFound
+func (r *MemoryRepository) GetIdempotencyRecord(ctx context.Context, key, operation string) (models.IdempotencyRecord, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.state.recordKeys[recordKey{key, operation}]
+	if !ok {
+		return models.IdempotencyRecord{}, ErrNotFound
+	}
+	var record models.IdempotencyRecord
+	err := copyDocument(r.state.idempotency[id], &record)
+	return record, err
+}
+
+// InsertIdempotencyRecord stores a new record, or returns ErrDuplicate. Records that expired
+// are removed along the way.
+func (r *MemoryRepository) InsertIdempotencyRecord(ctx context.Context, record *models.IdempotencyRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if record.ID.IsZero() {
+		record.ID = primitive.NewObjectID()
+	}
+	if _, ok := r.state.recordKeys[recordKey{record.Key, record.Operation}]; ok {
+		return ErrDuplicate
+	}
+	if _, ok := r.state.idempotency[record.ID]; ok {
+		return ErrDuplicate
+	}
+
+	c, err := put(models.IdempotencyCollection, record.ID, record)
+	if err != nil {
+		return err
+	}
+	changes := []change{c}
+
+	now := time.Now()
+	if now.Sub(r.prunedAt) >= idempotencyPruneInterval {
+		for id, stored := range r.state.idempotency {
+			if now.After(stored.ExpiresAt) {
+				changes = append(changes, remove(models.IdempotencyCollection, id))
+			}
+		}
+		r.prunedAt = now
+	}
+	return r.commit(changes...)
+}
+
+// updateIdempotencyRecord changes the record of the key when it is in state; the caller holds
+// the write lock
+func (r *MemoryRepository) updateIdempotencyRecord(key, operation, state string, update func(record *models.IdempotencyRecord)) error {
+	id, ok := r.state.recordKeys[recordKey{key, operation}]
+	if !ok || r.state.idempotency[id].State != state {
+		return nil
+	}
+	record := r.state.idempotency[id]
+	update(&record)
+	c, err := put(models.IdempotencyCollection, id, record)
+	if err != nil {
+		return err
+	}
+	return r.commit(c)
+}
+
+// ReclaimIdempotencyRecord hands a stale record to a new request unless it changed since it was read
+func (r *MemoryRepository) ReclaimIdempotencyRecord(ctx context.Context, stale, claim models.IdempotencyRecord) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record, ok := r.state.idempotency[stale.ID]
+	if !ok || record.State != stale.State || !record.CreatedAt.Equal(storedTime(stale.CreatedAt)) {
+		return false, nil
+	}
+
+	record.RequestHash = claim.RequestHash
+	record.State = claim.State
+	record.CreatedAt = claim.CreatedAt
+	record.ExpiresAt = claim.ExpiresAt
+	record.StatusCode = 0
+	record.ContentType = ""
+	record.Body = nil
+	c, err := put(models.IdempotencyCollection, stale.ID, record)
+	if err != nil {
+		return false, err
+	}
+	if err := r.commit(c); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CompleteIdempotencyRecord stores the response of a pending record
+func (r *MemoryRepository) CompleteIdempotencyRecord(ctx context.Context, key, operation string, statusCode int, contentType string, body []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.updateIdempotencyRecord(key, operation, models.IdempotencyStatePending, func(record *models.IdempotencyRecord) {
+		record.State = models.IdempotencyStateCompleted
+		record.StatusCode = statusCode
+		record.ContentType = contentType
+		record.Body = body
+	})
+}
+
+// ReleaseIdempotencyRecord removes a pending record
+func (r *MemoryRepository) ReleaseIdempotencyRecord(ctx context.Context, key, operation string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, ok := r.state.recordKeys[recordKey{key, operation}]
+	if !ok || r.state.idempotency[id].State != models.IdempotencyStatePending {
+		return nil
+	}
+	return r.commit(remove(models.IdempotencyCollection, id))
+}
+
+// GetAllocationCursor returns the allocation cursor of a sub-zone, or ErrNotFound
+func (r *MemoryRepository) GetAllocationCursor(ctx context.Context, tenant string, at IPLocation) (models.AllocationCursor, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, ok := r.state.cursorKeys[cursorKey{tenant, at.Region, at.Zone, at.SubZone}]
+	if !ok {
+		return models.AllocationCursor{}, ErrNotFound
+	}
+	var cursor models.AllocationCursor
+	err := copyDocument(r.state.cursors[id], &cursor)
+	return cursor, err
+}
+
+// updateCursor changes the cursor of a sub-zone, creating it when it does not exist yet
+func (r *MemoryRepository) updateCursor(tenant string, at IPLocation, now time.Time, update func(cursor *models.AllocationCursor)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, ok := r.state.cursorKeys[cursorKey{tenant, at.Region, at.Zone, at.SubZone}]
+	cursor := r.state.cursors[id]
+	if !ok {
+		id = primitive.NewObjectID()
+		cursor = models.AllocationCursor{
+			ID:      id,
+			Tenant:  tenant,
+			Region:  at.Region,
+			Zone:    at.Zone,
+			SubZone: at.SubZone,
+		}
+	}
+	update(&cursor)
+	cursor.UpdatedAt = now
+
+	c, err := put(models.AllocationCursorCollection, id, cursor)
+	if err != nil {
+		return err
+	}
+	return r.commit(c)
+}
+
+// AdvanceAllocationCursor records the address round-robin allocation handed out last
+func (r *MemoryRepository) AdvanceAllocationCursor(ctx context.Context, tenant string, at IPLocation, version, last string, now time.Time) error {
+	return r.updateCursor(tenant, at, now, func(cursor *models.AllocationCursor) {
+		if version == "ipv4" {
+			cursor.LastIPv4 = last
+		} else {
+			cursor.LastIPv6 = last
+		}
+	})
+}
+
+// RecordReleasedIPs appends released addresses to the cursor, keeping the newest keep entries
+func (r *MemoryRepository) RecordReleasedIPs(ctx context.Context, tenant string, at IPLocation, released []models.ReleasedIP, keep int) error {
+	if len(released) == 0 {
+		return nil
+	}
+	now := time.Now()
+	return r.updateCursor(tenant, at, now, func(cursor *models.AllocationCursor) {
+		cursor.Released = append(cursor.Released, released...)
+		if len(cursor.Released) > keep {
+			cursor.Released = cursor.Released[len(cursor.Released)-keep:]
+		}
+	})
+}
+
+// cursorIDs returns the IDs of the cursors of the sub-zones matching the filter; the caller
+// holds the lock
+func (r *MemoryRepository) cursorIDs(filter IPFilter) []primitive.ObjectID {
+	filter = filter.hierarchy()
+	var ids []primitive.ObjectID
+	for id, cursor := range r.state.cursors {
+		doc := models.IPAllocation{Tenant: cursor.Tenant, Region: cursor.Region, Zone: cursor.Zone, SubZone: cursor.SubZone}
+		if filter.matches(&doc) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// MoveAllocationCursors renames the cursors of the sub-zones matching the filter
+func (r *MemoryRepository) MoveAllocationCursors(ctx context.Context, filter IPFilter, to IPLocation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := r.cursorIDs(filter)
+	moving := make(map[cursorKey]bool, len(ids))
+	for _, id := range ids {
+		cursor := r.state.cursors[id]
+		moving[cursorKeyOf(&cursor)] = true
+	}
+
+	now := time.Now()
+	changes := make([]change, 0, len(ids))
+	claimed := make(map[cursorKey]bool, len(ids))
+	for _, id := range ids {
+		cursor := r.state.cursors[id]
+		if to.Region != "" {
+			cursor.Region = to.Region
+		}
+		if to.Zone != "" {
+			cursor.Zone = to.Zone
+		}
+		if to.SubZone != "" {
+			cursor.SubZone = to.SubZone
+		}
+		cursor.UpdatedAt = now
+
+		key := cursorKeyOf(&cursor)
+		if _, ok := r.state.cursorKeys[key]; (ok && !moving[key]) || claimed[key] {
+			return ErrDuplicate
+		}
+		claimed[key] = true
+
+		c, err := put(models.AllocationCursorCollection, id, cursor)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, c)
+	}
+	return r.commit(changes...)
+}
+
+// DeleteAllocationCursors removes the cursors of the sub-zones matching the filter
+func (r *MemoryRepository) DeleteAllocationCursors(ctx context.Context, filter IPFilter) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var changes []change
+	for _, id := range r.cursorIDs(filter) {
+		changes = append(changes, remove(models.AllocationCursorCollection, id))
+	}
+	return r.commit(changes...)
+}
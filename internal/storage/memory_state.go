@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"ip-allocator-api/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryState holds the documents of a MemoryRepository by collection and ID, with the
+// indexes that enforce the same uniqueness as the MongoDB indexes
+type memoryState struct {
+	regions     map[primitive.ObjectID]models.Region
+	regionNames map[regionKey]primitive.ObjectID
+
+	ips map[primitive.ObjectID]models.IPAllocation
+	// held indexes the ips by identity, like the unique index of the ip_allocations collection
+	held map[ipKey]primitive.ObjectID
+	// subZoneIPs indexes the ips by sub-zone, so reading one sub-zone does not scan them all
+	subZoneIPs map[subZoneKey]*subZoneDocs
+
+	tenants     map[primitive.ObjectID]models.Tenant
+	tenantNames map[string]primitive.ObjectID
+
+	apiKeys   map[primitive.ObjectID]models.APIKey
+	keyNames  map[string]primitive.ObjectID
+	keyHashes map[string]primitive.ObjectID
+
+	audit map[primitive.ObjectID]auditEntry
+
+	idempotency map[primitive.ObjectID]models.IdempotencyRecord
+	recordKeys  map[recordKey]primitive.ObjectID
+
+	cursors    map[primitive.ObjectID]models.AllocationCursor
+	cursorKeys map[cursorKey]primitive.ObjectID
+}
+
+// subZoneDocs indexes the ips of one sub-zone, with their update times in ascending order for
+// IPStateVersion
+type subZoneDocs struct {
+	ids     map[primitive.ObjectID]struct{}
+	updated []time.Time
+}
+
+func (docs *subZoneDocs) add(id primitive.ObjectID, updatedAt time.Time) {
+	docs.ids[id] = struct{}{}
+	i := sort.Search(len(docs.updated), func(i int) bool { return docs.updated[i].After(updatedAt) })
+	docs.updated = slices.Insert(docs.updated, i, updatedAt)
+}
+
+func (docs *subZoneDocs) remove(id primitive.ObjectID, updatedAt time.Time) {
+	delete(docs.ids, id)
+	i := sort.Search(len(docs.updated), func(i int) bool { return !docs.updated[i].Before(updatedAt) })
+	if i < len(docs.updated) && docs.updated[i].Equal(updatedAt) {
+		docs.updated = slices.Delete(docs.updated, i, i+1)
+	}
+}
+
+// recordKey addresses an idempotency record
+type recordKey struct {
+	key       string
+	operation string
+}
+
+// cursorKey addresses the allocation cursor of a sub-zone
+type cursorKey struct {
+	tenant  string
+	region  string
+	zone    string
+	subZone string
+}
+
+func cursorKeyOf(cursor *models.AllocationCursor) cursorKey {
+	return cursorKey{cursor.Tenant, cursor.Region, cursor.Zone, cursor.SubZone}
+}
+
+// auditEntry is a stored audit event with the fields it is filtered on decoded
+type auditEntry struct {
+	Timestamp    time.Time `bson:"timestamp"`
+	Tenant       string    `bson:"tenant"`
+	ResourceType string    `bson:"resource_type"`
+	ResourcePath string    `bson:"resource_path"`
+	IPAddresses  []string  `bson:"ip_addresses"`
+	Actor        string    `bson:"actor"`
+	Outcome      string    `bson:"outcome"`
+	raw          bson.Raw
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{
+		regions:     make(map[primitive.ObjectID]models.Region),
+		regionNames: make(map[regionKey]primitive.ObjectID),
+		ips:         make(map[primitive.ObjectID]models.IPAllocation),
+		held:        make(map[ipKey]primitive.ObjectID),
+		subZoneIPs:  make(map[subZoneKey]*subZoneDocs),
+		tenants:     make(map[primitive.ObjectID]models.Tenant),
+		tenantNames: make(map[string]primitive.ObjectID),
+		apiKeys:     make(map[primitive.ObjectID]models.APIKey),
+		keyNames:    make(map[string]primitive.ObjectID),
+		keyHashes:   make(map[string]primitive.ObjectID),
+		audit:       make(map[primitive.ObjectID]auditEntry),
+		idempotency: make(map[primitive.ObjectID]models.IdempotencyRecord),
+		recordKeys:  make(map[recordKey]primitive.ObjectID),
+		cursors:     make(map[primitive.ObjectID]models.AllocationCursor),
+		cursorKeys:  make(map[cursorKey]primitive.ObjectID),
+	}
+}
+
+// unindex removes an index entry unless another document took the key over
+func unindex[K comparable](index map[K]primitive.ObjectID, key K, id primitive.ObjectID) {
+	if index[key] == id {
+		delete(index, key)
+	}
+}
+
+func regionKeyOf(region *models.Region) regionKey {
+	return regionKey{region.Tenant, region.Name}
+}
+
+// apply stores or removes the document of a change and updates the indexes
+func (st *memoryState) apply(c change) error {
+	switch c.Collection {
+	case models.RegionCollection:
+		if old, ok := st.regions[c.ID]; ok {
+			unindex(st.regionNames, regionKeyOf(&old), c.ID)
+			delete(st.regions, c.ID)
+		}
+		if c.Document == nil {
+			return nil
+		}
+		var region models.Region
+		if err := bson.Unmarshal(c.Document, &region); err != nil {
+			return err
+		}
+		st.regions[c.ID] = region
+		st.regionNames[regionKeyOf(&region)] = c.ID
+
+	case models.IPAllocationCollection:
+		if old, ok := st.ips[c.ID]; ok {
+			unindex(st.held, keyOf(&old), c.ID)
+			if docs := st.subZoneIPs[subZoneOf(&old)]; docs != nil {
+				docs.remove(c.ID, old.UpdatedAt)
+				if len(docs.ids) == 0 {
+					delete(st.subZoneIPs, subZoneOf(&old))
+				}
+			}
+			delete(st.ips, c.ID)
+		}
+		if c.Document == nil {
+			return nil
+		}
+		var doc models.IPAllocation
+		if err := bson.Unmarshal(c.Document, &doc); err != nil {
+			return err
+		}
+		st.ips[c.ID] = doc
+		st.held[keyOf(&doc)] = c.ID
+		docs := st.subZoneIPs[subZoneOf(&doc)]
+		if docs == nil {
+			docs = &subZoneDocs{ids: make(map[primitive.ObjectID]struct{})}
+			st.subZoneIPs[subZoneOf(&doc)] = docs
+		}
+		docs.add(c.ID, doc.UpdatedAt)
+
+	case models.TenantCollection:
+		if old, ok := st.tenants[c.ID]; ok {
+			unindex(st.tenantNames, old.Name, c.ID)
+			delete(st.tenants, c.ID)
+		}
+		if c.Document == nil {
+			return nil
+		}
+		var tenant models.Tenant
+		if err := bson.Unmarshal(c.Document, &tenant); err != nil {
+			return err
+		}
+		st.tenants[c.ID] = tenant
+		st.tenantNames[tenant.Name] = c.ID
+
+	case models.APIKeyCollection:
+		if old, ok := st.apiKeys[c.ID]; ok {
+			unindex(st.keyNames, old.Name, c.ID)
+			unindex(st.keyHashes, old.KeyHash, c.ID)
+			delete(st.apiKeys, c.ID)
+		}
+		if c.Document == nil {
+			return nil
+		}
+		var key models.APIKey
+		if err := bson.Unmarshal(c.Document, &key); err != nil {
+			return err
+		}
+		st.apiKeys[c.ID] = key
+		st.keyNames[key.Name] = c.ID
+		st.keyHashes[key.KeyHash] = c.ID
+
+	case models.AuditCollection:
+		delete(st.audit, c.ID)
+		if c.Document == nil {
+			return nil
+		}
+		var entry auditEntry
+		if err := bson.Unmarshal(c.Document, &entry); err != nil {
+			return err
+		}
+		entry.raw = c.Document
+		st.audit[c.ID] = entry
+
+	case models.IdempotencyCollection:
+		if old, ok := st.idempotency[c.ID]; ok {
+			unindex(st.recordKeys, recordKey{old.Key, old.Operation}, c.ID)
+			delete(st.idempotency, c.ID)
+		}
+		if c.Document == nil {
+			return nil
+		}
+		var record models.IdempotencyRecord
+		if err := bson.Unmarshal(c.Document, &record); err != nil {
+			return err
+		}
+		st.idempotency[c.ID] = record
+		st.recordKeys[recordKey{record.Key, record.Operation}] = c.ID
+
+	case models.AllocationCursorCollection:
+		if old, ok := st.cursors[c.ID]; ok {
+			unindex(st.cursorKeys, cursorKeyOf(&old), c.ID)
+			delete(st.cursors, c.ID)
+		}
+		if c.Document == nil {
+			return nil
+		}
+		var cursor models.AllocationCursor
+		if err := bson.Unmarshal(c.Document, &cursor); err != nil {
+			return err
+		}
+		st.cursors[c.ID] = cursor
+		st.cursorKeys[cursorKeyOf(&cursor)] = c.ID
+
+	default:
+		return fmt.Errorf("unknown collection %q", c.Collection)
+	}
+	return nil
+}
+
+// each calls fn with a change storing every document, e.g. to write a snapshot
+func (st *memoryState) each(fn func(c change) error) error {
+	emit := func(collection string, id primitive.ObjectID, doc interface{}) error {
+		c, err := put(collection, id, doc)
+		if err != nil {
+			return err
+		}
+		return fn(c)
+	}
+
+	for id, region := range st.regions {
+		if err := emit(models.RegionCollection, id, region); err != nil {
+			return err
+		}
+	}
+	for id, doc := range st.ips {
+		if err := emit(models.IPAllocationCollection, id, doc); err != nil {
+			return err
+		}
+	}
+	for id, tenant := range st.tenants {
+		if err := emit(models.TenantCollection, id, tenant); err != nil {
+			return err
+		}
+	}
+	for id, key := range st.apiKeys {
+		if err := emit(models.APIKeyCollection, id, key); err != nil {
+			return err
+		}
+	}
+	for id, entry := range st.audit {
+		if err := fn(change{Collection: models.AuditCollection, ID: id, Document: entry.raw}); err != nil {
+			return err
+		}
+	}
+	for id, record := range st.idempotency {
+		if err := emit(models.IdempotencyCollection, id, record); err != nil {
+			return err
+		}
+	}
+	for id, cursor := range st.cursors {
+		if err := emit(models.AllocationCursorCollection, id, cursor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
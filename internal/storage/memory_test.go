@@ -0,0 +1,14 @@
+package storage_test
+
+import (
+	"testing"
+
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/storage/storagetest"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		return storage.NewMemoryRepository()
+	})
+}
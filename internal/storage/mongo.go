@@ -0,0 +1,615 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"ip-allocator-api/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// MongoRepository stores every kind of document in its own collection, regions in regions
+// and IPs in ip_allocations. The unique indexes created by database.EnsureIndexes enforce
+// names, key hashes and single IP ownership; the TTL index on idempotency_keys removes
+// expired records.
+type MongoRepository struct {
+	regions     *mongo.Collection
+	ips         *mongo.Collection
+	tenants     *mongo.Collection
+	apiKeys     *mongo.Collection
+	audit       *mongo.Collection
+	idempotency *mongo.Collection
+	cursors     *mongo.Collection
+	logger      *zap.Logger
+
+	// transactions caches whether the deployment supports transactions
+	transactions atomic.Pointer[bool]
+}
+
+func NewMongoRepository(db *mongo.Database, logger *zap.Logger) *MongoRepository {
+	return &MongoRepository{
+		regions:     db.Collection(models.RegionCollection),
+		ips:         db.Collection(models.IPAllocationCollection),
+		tenants:     db.Collection(models.TenantCollection),
+		apiKeys:     db.Collection(models.APIKeyCollection),
+		audit:       db.Collection(models.AuditCollection),
+		idempotency: db.Collection(models.IdempotencyCollection),
+		cursors:     db.Collection(models.AllocationCursorCollection),
+		logger:      logger,
+	}
+}
+
+// Ping checks the connection to the primary
+func (r *MongoRepository) Ping(ctx context.Context) error {
+	return r.regions.Database().Client().Ping(ctx, nil)
+}
+
+// regionFilter matches a region by name within a tenant
+func regionFilter(tenant, name string) bson.M {
+	return bson.M{
+		"tenant": tenant,
+		"name":   name,
+	}
+}
+
+// GetRegion returns a region of the tenant, or ErrNotFound
+func (r *MongoRepository) GetRegion(ctx context.Context, tenant, name string) (models.Region, error) {
+	var region models.Region
+	err := r.regions.FindOne(ctx, regionFilter(tenant, name)).Decode(&region)
+	if err == mongo.ErrNoDocuments {
+		return models.Region{}, ErrNotFound
+	}
+	return region, err
+}
+
+// ListRegions returns the regions of the tenant, or of every tenant, ordered by tenant and name
+func (r *MongoRepository) ListRegions(ctx context.Context, tenant string) ([]models.Region, error) {
+	filter := bson.M{}
+	if tenant != "" {
+		filter["tenant"] = tenant
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "tenant", Value: 1}, {Key: "name", Value: 1}})
+	cursor, err := r.regions.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var regions []models.Region
+	if err := cursor.All(ctx, &regions); err != nil {
+		return nil, err
+	}
+	return regions, nil
+}
+
+// CountRegions counts the regions of the tenant
+func (r *MongoRepository) CountRegions(ctx context.Context, tenant string) (int64, error) {
+	return r.regions.CountDocuments(ctx, bson.M{"tenant": tenant})
+}
+
+// HierarchyVersion reads the region count and the latest region update, both served from
+// collection metadata and the updated_at index rather than by reading every region
+func (r *MongoRepository) HierarchyVersion(ctx context.Context) (HierarchyVersion, error) {
+	count, err := r.regions.EstimatedDocumentCount(ctx)
+	if err != nil {
+		return HierarchyVersion{}, err
+	}
+
+	var latest struct {
+		UpdatedAt time.Time `bson:"updated_at"`
+	}
+	opts := options.FindOne().
+		SetSort(bson.D{{Key: "updated_at", Value: -1}}).
+		SetProjection(bson.M{"updated_at": 1})
+	err = r.regions.FindOne(ctx, bson.M{}, opts).Decode(&latest)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return HierarchyVersion{}, err
+	}
+
+	return HierarchyVersion{Count: count, UpdatedAt: latest.UpdatedAt}, nil
+}
+
+// CreateRegion stores a new region, or returns ErrDuplicate
+func (r *MongoRepository) CreateRegion(ctx context.Context, region *models.Region) error {
+	if region.ID.IsZero() {
+		region.ID = primitive.NewObjectID()
+	}
+
+	_, err := r.regions.InsertOne(ctx, region)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// UpdateRegion applies the changes and returns the region as it was before
+func (r *MongoRepository) UpdateRegion(ctx context.Context, tenant, name string, changes HierarchyChanges) (models.Region, error) {
+	set := changes.set("")
+	set["updated_at"] = changes.UpdatedAt
+
+	return r.findOneAndUpdate(ctx, regionFilter(tenant, name), bson.M{"$set": set})
+}
+
+// DeleteRegion removes a region and returns it
+func (r *MongoRepository) DeleteRegion(ctx context.Context, tenant, name string) (models.Region, error) {
+	var before models.Region
+	err := r.regions.FindOneAndDelete(ctx, regionFilter(tenant, name)).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return models.Region{}, ErrNotFound
+	}
+	return before, err
+}
+
+// AddZone appends a zone to a region, conditional on the region's updated_at when unchangedSince is set
+func (r *MongoRepository) AddZone(ctx context.Context, tenant, regionName string, zone models.Zone, unchangedSince time.Time) error {
+	filter := regionFilter(tenant, regionName)
+	update := bson.M{
+		"$push": bson.M{"zones": zone},
+		"$set":  bson.M{"updated_at": zone.UpdatedAt},
+	}
+	return r.updateGuarded(ctx, filter, update, unchangedSince)
+}
+
+// UpdateZone applies the changes to a zone and returns its region as it was before
+func (r *MongoRepository) UpdateZone(ctx context.Context, tenant, regionName, zoneName string, changes HierarchyChanges) (models.Region, error) {
+	filter := regionFilter(tenant, regionName)
+	filter["zones.name"] = zoneName
+
+	set := changes.set("zones.$[zone].")
+	set["zones.$[zone].updated_at"] = changes.UpdatedAt
+	set["updated_at"] = changes.UpdatedAt
+
+	return r.findOneAndUpdate(ctx, filter, bson.M{"$set": set}, bson.M{"zone.name": zoneName})
+}
+
+// DeleteZone removes a zone and returns its region as it was before
+func (r *MongoRepository) DeleteZone(ctx context.Context, tenant, regionName, zoneName string) (models.Region, error) {
+	filter := regionFilter(tenant, regionName)
+	filter["zones.name"] = zoneName
+
+	return r.findOneAndUpdate(ctx, filter, bson.M{
+		"$pull": bson.M{"zones": bson.M{"name": zoneName}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	})
+}
+
+// AddSubZone appends a sub-zone to a zone, conditional on the region's updated_at when unchangedSince is set
+func (r *MongoRepository) AddSubZone(ctx context.Context, tenant, regionName, zoneName string, subZone models.SubZone, unchangedSince time.Time) error {
+	filter := regionFilter(tenant, regionName)
+	filter["zones.name"] = zoneName
+	update := bson.M{
+		"$push": bson.M{"zones.$[zone].sub_zones": subZone},
+		"$set": bson.M{
+			"zones.$[zone].updated_at": subZone.UpdatedAt,
+			"updated_at":               subZone.UpdatedAt,
+		},
+	}
+	return r.updateGuarded(ctx, filter, update, unchangedSince, bson.M{"zone.name": zoneName})
+}
+
+// UpdateSubZone applies the changes to a sub-zone and returns its region as it was before
+func (r *MongoRepository) UpdateSubZone(ctx context.Context, tenant, regionName, zoneName, subZoneName string, changes HierarchyChanges) (models.Region, error) {
+	set := changes.set("zones.$[zone].sub_zones.$[subzone].")
+	if changes.AllocationStrategy != "" {
+		set["zones.$[zone].sub_zones.$[subzone].allocation_strategy"] = changes.AllocationStrategy
+	}
+	set["zones.$[zone].sub_zones.$[subzone].updated_at"] = changes.UpdatedAt
+	set["zones.$[zone].updated_at"] = changes.UpdatedAt
+	set["updated_at"] = changes.UpdatedAt
+
+	update := bson.M{"$set": set}
+	if changes.ClearEmbeddedIPs {
+		update["$unset"] = bson.M{
+			"zones.$[zone].sub_zones.$[subzone].allocated_ipv4": "",
+			"zones.$[zone].sub_zones.$[subzone].allocated_ipv6": "",
+			"zones.$[zone].sub_zones.$[subzone].reserved_ipv4":  "",
+			"zones.$[zone].sub_zones.$[subzone].reserved_ipv6":  "",
+		}
+	}
+	return r.findOneAndUpdate(ctx, subZoneFilter(tenant, regionName, zoneName, subZoneName), update,
+		bson.M{"zone.name": zoneName}, bson.M{"subzone.name": subZoneName})
+}
+
+// DeleteSubZone removes a sub-zone and returns its region as it was before
+func (r *MongoRepository) DeleteSubZone(ctx context.Context, tenant, regionName, zoneName, subZoneName string) (models.Region, error) {
+	now := time.Now()
+	return r.findOneAndUpdate(ctx, subZoneFilter(tenant, regionName, zoneName, subZoneName), bson.M{
+		"$pull": bson.M{"zones.$[zone].sub_zones": bson.M{"name": subZoneName}},
+		"$set": bson.M{
+			"zones.$[zone].updated_at": now,
+			"updated_at":               now,
+		},
+	}, bson.M{"zone.name": zoneName})
+}
+
+// subZoneFilter matches the region holding the named sub-zone
+func subZoneFilter(tenant, regionName, zoneName, subZoneName string) bson.M {
+	filter := regionFilter(tenant, regionName)
+	filter["zones"] = bson.M{"$elemMatch": bson.M{"name": zoneName, "sub_zones.name": subZoneName}}
+	return filter
+}
+
+// set returns the $set fields of the changes, each prefixed with the path of the changed level
+func (changes HierarchyChanges) set(prefix string) bson.M {
+	set := bson.M{}
+	if changes.Name != "" {
+		set[prefix+"name"] = changes.Name
+	}
+	if changes.IPv4CIDR != "" {
+		set[prefix+"ipv4_cidr"] = changes.IPv4CIDR
+	}
+	if changes.IPv6CIDR != "" {
+		set[prefix+"ipv6_cidr"] = changes.IPv6CIDR
+	}
+	return set
+}
+
+// findOneAndUpdate updates the region matching the filter and returns it as it was before
+func (r *MongoRepository) findOneAndUpdate(ctx context.Context, filter, update bson.M, arrayFilters ...interface{}) (models.Region, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	if len(arrayFilters) > 0 {
+		opts.SetArrayFilters(options.ArrayFilters{Filters: arrayFilters})
+	}
+
+	var before models.Region
+	err := r.regions.FindOneAndUpdate(ctx, filter, update, opts).Decode(&before)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		return models.Region{}, ErrNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return models.Region{}, ErrDuplicate
+	}
+	return before, err
+}
+
+// updateGuarded updates the region matching the filter while its updated_at equals
+// unchangedSince, telling a changed region apart from a missing one
+func (r *MongoRepository) updateGuarded(ctx context.Context, filter, update bson.M, unchangedSince time.Time, arrayFilters ...interface{}) error {
+	guarded := bson.M{}
+	for key, value := range filter {
+		guarded[key] = value
+	}
+	if !unchangedSince.IsZero() {
+		guarded["updated_at"] = unchangedSince
+	}
+
+	opts := options.Update()
+	if len(arrayFilters) > 0 {
+		opts.SetArrayFilters(options.ArrayFilters{Filters: arrayFilters})
+	}
+	result, err := r.regions.UpdateOne(ctx, guarded, update, opts)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+	if unchangedSince.IsZero() {
+		return ErrNotFound
+	}
+
+	count, err := r.regions.CountDocuments(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return ErrConflict
+}
+
+// ipFilterDocument converts an IP filter into a query on the ip_allocations collection
+func ipFilterDocument(filter IPFilter) bson.M {
+	doc := bson.M{}
+	if filter.Tenant != "" {
+		doc["tenant"] = filter.Tenant
+	}
+	switch {
+	case filter.Region != "" && len(filter.Regions) > 0:
+		doc["$and"] = bson.A{bson.M{"region": filter.Region}, bson.M{"region": bson.M{"$in": filter.Regions}}}
+	case filter.Region != "":
+		doc["region"] = filter.Region
+	case len(filter.Regions) > 0:
+		doc["region"] = bson.M{"$in": filter.Regions}
+	}
+	if filter.Zone != "" {
+		doc["zone"] = filter.Zone
+	}
+	if filter.SubZone != "" {
+		doc["sub_zone"] = filter.SubZone
+	}
+	if len(filter.IPAddresses) > 0 {
+		doc["ip_address"] = bson.M{"$in": filter.IPAddresses}
+	}
+	if filter.Status != "" {
+		doc["status"] = filter.Status
+	}
+	if filter.Owner != "" {
+		doc["owner"] = filter.Owner
+	}
+	for key, value := range filter.Labels {
+		doc["labels."+key] = value
+	}
+	if filter.CreatedBy != "" {
+		doc["created_by"] = filter.CreatedBy
+	}
+	if len(filter.PairedIPs) > 0 {
+		doc["paired_ip"] = bson.M{"$in": filter.PairedIPs}
+	}
+
+	expiry := bson.M{}
+	if !filter.ExpiresAfter.IsZero() {
+		expiry["$gt"] = filter.ExpiresAfter
+	}
+	if !filter.ExpiresBy.IsZero() {
+		expiry["$lte"] = filter.ExpiresBy
+	}
+	if len(expiry) > 0 {
+		doc["expires_at"] = expiry
+	}
+	return doc
+}
+
+// FindIPs returns the documents matching the filter in the order they were created
+func (r *MongoRepository) FindIPs(ctx context.Context, filter IPFilter) ([]models.IPAllocation, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	return r.findIPs(ctx, ipFilterDocument(filter), opts)
+}
+
+func (r *MongoRepository) findIPs(ctx context.Context, filter bson.M, opts *options.FindOptions) ([]models.IPAllocation, error) {
+	cursor, err := r.ips.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var docs []models.IPAllocation
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// CountIPs counts the documents matching the filter
+func (r *MongoRepository) CountIPs(ctx context.Context, filter IPFilter) (int64, error) {
+	return r.ips.CountDocuments(ctx, ipFilterDocument(filter))
+}
+
+// IPStateVersion counts the documents matching the filter and reads the latest update among
+// them; for a sub-zone both are served from the sub-zone's updated_at index
+func (r *MongoRepository) IPStateVersion(ctx context.Context, filter IPFilter) (IPStateVersion, error) {
+	match := ipFilterDocument(filter)
+	count, err := r.ips.CountDocuments(ctx, match)
+	if err != nil {
+		return IPStateVersion{}, err
+	}
+
+	var latest struct {
+		UpdatedAt time.Time `bson:"updated_at"`
+	}
+	opts := options.FindOne().
+		SetSort(bson.D{{Key: "updated_at", Value: -1}}).
+		SetProjection(bson.M{"updated_at": 1})
+	err = r.ips.FindOne(ctx, match, opts).Decode(&latest)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return IPStateVersion{}, err
+	}
+
+	return IPStateVersion{Count: count, UpdatedAt: latest.UpdatedAt}, nil
+}
+
+// CountIPsByOwner counts the documents of each owner of the tenant, ordered by owner
+func (r *MongoRepository) CountIPsByOwner(ctx context.Context, tenant string) ([]OwnerCount, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"tenant": tenant, "owner": bson.M{"$exists": true, "$ne": ""}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$owner", "count": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	cursor, err := r.ips.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []struct {
+		Owner string `bson:"_id"`
+		Count int64  `bson:"count"`
+	}
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	counts := make([]OwnerCount, 0, len(results))
+	for _, result := range results {
+		counts = append(counts, OwnerCount{Owner: result.Owner, Count: result.Count})
+	}
+	return counts, nil
+}
+
+// InsertIPs stores the documents all-or-nothing, relying on the unique index to reject
+// addresses that are already held. On replica sets and sharded clusters the documents are
+// inserted in one transaction. A standalone server has no transactions, so the documents
+// written before a failure are deleted again; should that rollback fail too, the error says
+// so rather than ErrDuplicate, as retrying would find the leftovers held. Multi-IP batches are
+// therefore not atomic on a standalone server: between the insert and the rollback, readers
+// see part of a failed batch and concurrent allocations skip its addresses. Production
+// deployments should run a replica set, even a single-member one.
+func (r *MongoRepository) InsertIPs(ctx context.Context, docs []models.IPAllocation) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	items := make([]interface{}, 0, len(docs))
+	ids := make([]primitive.ObjectID, 0, len(docs))
+	for i := range docs {
+		if docs[i].ID.IsZero() {
+			docs[i].ID = primitive.NewObjectID()
+		}
+		items = append(items, docs[i])
+		ids = append(ids, docs[i].ID)
+	}
+
+	transactions, err := r.supportsTransactions(ctx)
+	if err != nil {
+		return err
+	}
+	if transactions {
+		err = r.insertInTransaction(ctx, items)
+	} else {
+		err = r.insertAndRollBack(ctx, items, ids)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// insertInTransaction inserts the documents in a transaction, which writes all or none of them
+func (r *MongoRepository) insertInTransaction(ctx context.Context, items []interface{}) error {
+	session, err := r.ips.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return r.ips.InsertMany(sc, items)
+	})
+	return err
+}
+
+// insertAndRollBack inserts the documents and, when any of them fails, deletes those that
+// were written so the caller can retry the whole selection
+func (r *MongoRepository) insertAndRollBack(ctx context.Context, items []interface{}, ids []primitive.ObjectID) error {
+	_, err := r.ips.InsertMany(ctx, items, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return nil
+	}
+
+	if _, rollbackErr := r.ips.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); rollbackErr != nil {
+		doc := items[0].(models.IPAllocation)
+		r.logger.Error("Failed to roll back partially inserted IP documents",
+			zap.Error(rollbackErr),
+			zap.NamedError("insert_error", err),
+			zap.String("tenant", doc.Tenant),
+			zap.String("region", doc.Region),
+			zap.String("zone", doc.Zone),
+			zap.String("subzone", doc.SubZone),
+			zap.Int("ip_count", len(items)))
+		return fmt.Errorf("inserting IP documents failed (%v) and some may remain: rollback failed: %w", err, rollbackErr)
+	}
+	return err
+}
+
+// supportsTransactions reports whether the deployment is a replica set or sharded cluster,
+// the deployments with multi-document transactions. The answer is kept once known.
+func (r *MongoRepository) supportsTransactions(ctx context.Context) (bool, error) {
+	if known := r.transactions.Load(); known != nil {
+		return *known, nil
+	}
+
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := r.ips.Database().RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return false, err
+	}
+	supported := hello.SetName != "" || hello.Msg == "isdbgrid"
+	r.transactions.Store(&supported)
+
+	if !supported {
+		r.logger.Warn("MongoDB runs standalone without transactions; multi-IP inserts are not atomic and are rolled back by deleting partial writes, run a replica set to avoid this")
+	}
+	return supported, nil
+}
+
+// DeleteIPs removes the documents matching the filter
+func (r *MongoRepository) DeleteIPs(ctx context.Context, filter IPFilter) (int64, error) {
+	result, err := r.ips.DeleteMany(ctx, ipFilterDocument(filter))
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// MoveIPs rewrites the hierarchy fields of the documents matching the filter
+func (r *MongoRepository) MoveIPs(ctx context.Context, filter IPFilter, to IPLocation) (int64, error) {
+	set := bson.M{"updated_at": time.Now()}
+	if to.Region != "" {
+		set["region"] = to.Region
+	}
+	if to.Zone != "" {
+		set["zone"] = to.Zone
+	}
+	if to.SubZone != "" {
+		set["sub_zone"] = to.SubZone
+	}
+
+	result, err := r.ips.UpdateMany(ctx, ipFilterDocument(filter), bson.M{"$set": set})
+	if mongo.IsDuplicateKeyError(err) {
+		return 0, ErrDuplicate
+	}
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// UnpairIPs removes the host pair link of the documents matching the filter
+func (r *MongoRepository) UnpairIPs(ctx context.Context, filter IPFilter) (int64, error) {
+	result, err := r.ips.UpdateMany(ctx, ipFilterDocument(filter), bson.M{
+		"$unset": bson.M{"pair_id": "", "paired_ip": ""},
+		"$set":   bson.M{"updated_at": time.Now()},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// RenewLeases moves the expiry of allocated documents whose lease has not yet run out.
+// Permanent allocations have no expires_at and never match.
+func (r *MongoRepository) RenewLeases(ctx context.Context, filter IPFilter, expiresAt, now time.Time) (int64, error) {
+	filter.Status = models.IPStatusAllocated
+	filter.ExpiresAfter = now
+
+	result, err := r.ips.UpdateMany(ctx, ipFilterDocument(filter), bson.M{
+		"$set": bson.M{
+			"expires_at": expiresAt,
+			"updated_at": now,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.MatchedCount, nil
+}
+
+// FindExpiredIPs returns up to limit allocated documents whose lease ended
+func (r *MongoRepository) FindExpiredIPs(ctx context.Context, now time.Time, limit int64) ([]models.IPAllocation, error) {
+	filter := ipFilterDocument(IPFilter{Status: models.IPStatusAllocated, ExpiresBy: now})
+	opts := options.Find().SetSort(bson.D{{Key: "expires_at", Value: 1}, {Key: "_id", Value: 1}}).SetLimit(limit)
+	return r.findIPs(ctx, filter, opts)
+}
+
+// ReleaseExpiredIP deletes an expired lease unless it was renewed after it was read
+func (r *MongoRepository) ReleaseExpiredIP(ctx context.Context, id primitive.ObjectID, now time.Time) (bool, error) {
+	result, err := r.ips.DeleteOne(ctx, bson.M{
+		"_id":        id,
+		"status":     models.IPStatusAllocated,
+		"expires_at": bson.M{"$lte": now},
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount > 0, nil
+}
@@ -0,0 +1,409 @@
+package storage
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"ip-allocator-api/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GetTenant returns a tenant, or ErrNotFound
+func (r *MongoRepository) GetTenant(ctx context.Context, name string) (models.Tenant, error) {
+	var tenant models.Tenant
+	err := r.tenants.FindOne(ctx, bson.M{"name": name}).Decode(&tenant)
+	if err == mongo.ErrNoDocuments {
+		return models.Tenant{}, ErrNotFound
+	}
+	return tenant, err
+}
+
+// ListTenants returns every tenant ordered by name
+func (r *MongoRepository) ListTenants(ctx context.Context) ([]models.Tenant, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	cursor, err := r.tenants.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var tenants []models.Tenant
+	if err := cursor.All(ctx, &tenants); err != nil {
+		return nil, err
+	}
+	return tenants, nil
+}
+
+// CreateTenant stores a new tenant, or returns ErrDuplicate
+func (r *MongoRepository) CreateTenant(ctx context.Context, tenant *models.Tenant) error {
+	if tenant.ID.IsZero() {
+		tenant.ID = primitive.NewObjectID()
+	}
+
+	_, err := r.tenants.InsertOne(ctx, tenant)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// EnsureTenant upserts the tenant without touching an existing one
+func (r *MongoRepository) EnsureTenant(ctx context.Context, tenant models.Tenant) error {
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"name":        tenant.Name,
+			"description": tenant.Description,
+			"created_at":  tenant.CreatedAt,
+			"updated_at":  tenant.UpdatedAt,
+		},
+	}
+	opts := options.Update().SetUpsert(true)
+	_, err := r.tenants.UpdateOne(ctx, bson.M{"name": tenant.Name}, update, opts)
+	return err
+}
+
+// UpdateTenant sets the description and returns the tenant as it was before
+func (r *MongoRepository) UpdateTenant(ctx context.Context, name, description string, updatedAt time.Time) (models.Tenant, error) {
+	update := bson.M{
+		"$set": bson.M{
+			"description": description,
+			"updated_at":  updatedAt,
+		},
+	}
+
+	var before models.Tenant
+	err := r.tenants.FindOneAndUpdate(ctx, bson.M{"name": name}, update).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return models.Tenant{}, ErrNotFound
+	}
+	return before, err
+}
+
+// DeleteTenant removes a tenant and returns it
+func (r *MongoRepository) DeleteTenant(ctx context.Context, name string) (models.Tenant, error) {
+	var before models.Tenant
+	err := r.tenants.FindOneAndDelete(ctx, bson.M{"name": name}).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return models.Tenant{}, ErrNotFound
+	}
+	return before, err
+}
+
+// FindAPIKeyByHash returns the key with the hash, or ErrNotFound
+func (r *MongoRepository) FindAPIKeyByHash(ctx context.Context, keyHash string) (models.APIKey, error) {
+	var key models.APIKey
+	err := r.apiKeys.FindOne(ctx, bson.M{"key_hash": keyHash}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return models.APIKey{}, ErrNotFound
+	}
+	return key, err
+}
+
+// ListAPIKeys returns the keys of the tenant, or every key, oldest first
+func (r *MongoRepository) ListAPIKeys(ctx context.Context, tenant string) ([]models.APIKey, error) {
+	filter := bson.M{}
+	if tenant != "" {
+		filter["tenant"] = tenant
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	cursor, err := r.apiKeys.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var keys []models.APIKey
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// CreateAPIKey stores a new key, or returns ErrDuplicate
+func (r *MongoRepository) CreateAPIKey(ctx context.Context, key *models.APIKey) error {
+	if key.ID.IsZero() {
+		key.ID = primitive.NewObjectID()
+	}
+
+	_, err := r.apiKeys.InsertOne(ctx, key)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// UpsertAPIKey replaces the key of the same name, keeping its identity and history
+func (r *MongoRepository) UpsertAPIKey(ctx context.Context, key models.APIKey) error {
+	set := bson.M{
+		"prefix":   key.Prefix,
+		"key_hash": key.KeyHash,
+		"role":     key.Role,
+	}
+	unset := bson.M{}
+	optional := map[string]string{"tenant": key.Tenant, "region": key.Region, "zone": key.Zone}
+	for field, value := range optional {
+		if value != "" {
+			set[field] = value
+		} else {
+			unset[field] = ""
+		}
+	}
+	if key.ExpiresAt != nil {
+		set["expires_at"] = key.ExpiresAt
+	} else {
+		unset["expires_at"] = ""
+	}
+
+	update := bson.M{
+		"$set": set,
+		"$setOnInsert": bson.M{
+			"created_by": key.CreatedBy,
+			"created_at": key.CreatedAt,
+		},
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	opts := options.Update().SetUpsert(true)
+	_, err := r.apiKeys.UpdateOne(ctx, bson.M{"name": key.Name}, update, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// TouchAPIKey records the last use of a key
+func (r *MongoRepository) TouchAPIKey(ctx context.Context, id primitive.ObjectID, usedAt time.Time) error {
+	_, err := r.apiKeys.UpdateByID(ctx, id, bson.M{"$set": bson.M{"last_used_at": usedAt}})
+	return err
+}
+
+// DeleteAPIKey removes a key, limited to the tenant when one is given, and returns it
+func (r *MongoRepository) DeleteAPIKey(ctx context.Context, id primitive.ObjectID, tenant string) (models.APIKey, error) {
+	filter := bson.M{"_id": id}
+	if tenant != "" {
+		filter["tenant"] = tenant
+	}
+
+	var before models.APIKey
+	err := r.apiKeys.FindOneAndDelete(ctx, filter).Decode(&before)
+	if err == mongo.ErrNoDocuments {
+		return models.APIKey{}, ErrNotFound
+	}
+	return before, err
+}
+
+// DeleteTenantAPIKeys removes the keys of a tenant
+func (r *MongoRepository) DeleteTenantAPIKeys(ctx context.Context, tenant string) (int64, error) {
+	result, err := r.apiKeys.DeleteMany(ctx, bson.M{"tenant": tenant})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// InsertAuditEvent appends an event
+func (r *MongoRepository) InsertAuditEvent(ctx context.Context, event *models.AuditEvent) error {
+	if event.ID.IsZero() {
+		event.ID = primitive.NewObjectID()
+	}
+	_, err := r.audit.InsertOne(ctx, event)
+	return err
+}
+
+// FindAuditEvents returns the events matching the filter, newest first
+func (r *MongoRepository) FindAuditEvents(ctx context.Context, filter AuditFilter) ([]bson.Raw, error) {
+	query := bson.M{}
+	if filter.Tenant != "" {
+		query["tenant"] = filter.Tenant
+	}
+	if filter.ResourcePath != "" {
+		query["resource_path"] = bson.M{"$regex": "^" + regexp.QuoteMeta(filter.ResourcePath) + "(/|$)"}
+	}
+	if filter.ResourceType != "" {
+		query["resource_type"] = filter.ResourceType
+	}
+	if filter.IPAddress != "" {
+		query["ip_addresses"] = filter.IPAddress
+	}
+	if filter.Actor != "" {
+		query["actor"] = filter.Actor
+	}
+	if filter.Outcome != "" {
+		query["outcome"] = filter.Outcome
+	}
+	timeRange := bson.M{}
+	if !filter.Since.IsZero() {
+		timeRange["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		timeRange["$lte"] = filter.Until
+	}
+	if len(timeRange) > 0 {
+		query["timestamp"] = timeRange
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+	cursor, err := r.audit.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var events []bson.Raw
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// idempotencyFilter matches the record of a key
+func idempotencyFilter(key, operation string) bson.M {
+	return bson.M{"key": key, "operation": operation}
+}
+
+// GetIdempotencyRecord returns the record of the key, or ErrNotFound
+func (r *MongoRepository) GetIdempotencyRecord(ctx context.Context, key, operation string) (models.IdempotencyRecord, error) {
+	var record models.IdempotencyRecord
+	err := r.idempotency.FindOne(ctx, idempotencyFilter(key, operation)).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return models.IdempotencyRecord{}, ErrNotFound
+	}
+	return record, err
+}
+
+// InsertIdempotencyRecord stores a new record, or returns ErrDuplicate
+func (r *MongoRepository) InsertIdempotencyRecord(ctx context.Context, record *models.IdempotencyRecord) error {
+	if record.ID.IsZero() {
+		record.ID = primitive.NewObjectID()
+	}
+
+	_, err := r.idempotency.InsertOne(ctx, record)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// ReclaimIdempotencyRecord hands a stale record to a new request unless it changed since it was read
+func (r *MongoRepository) ReclaimIdempotencyRecord(ctx context.Context, stale, claim models.IdempotencyRecord) (bool, error) {
+	result, err := r.idempotency.UpdateOne(ctx,
+		bson.M{"_id": stale.ID, "state": stale.State, "created_at": stale.CreatedAt},
+		bson.M{
+			"$set": bson.M{
+				"request_hash": claim.RequestHash,
+				"state":        claim.State,
+				"created_at":   claim.CreatedAt,
+				"expires_at":   claim.ExpiresAt,
+			},
+			"$unset": bson.M{"status_code": "", "content_type": "", "body": ""},
+		})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// CompleteIdempotencyRecord stores the response of a pending record
+func (r *MongoRepository) CompleteIdempotencyRecord(ctx context.Context, key, operation string, statusCode int, contentType string, body []byte) error {
+	filter := idempotencyFilter(key, operation)
+	filter["state"] = models.IdempotencyStatePending
+	_, err := r.idempotency.UpdateOne(ctx, filter,
+		bson.M{"$set": bson.M{
+			"state":        models.IdempotencyStateCompleted,
+			"status_code":  statusCode,
+			"content_type": contentType,
+			"body":         body,
+		}})
+	return err
+}
+
+// ReleaseIdempotencyRecord removes a pending record
+func (r *MongoRepository) ReleaseIdempotencyRecord(ctx context.Context, key, operation string) error {
+	filter := idempotencyFilter(key, operation)
+	filter["state"] = models.IdempotencyStatePending
+	_, err := r.idempotency.DeleteOne(ctx, filter)
+	return err
+}
+
+// cursorFilter matches the allocation cursor of a sub-zone
+func cursorFilter(tenant string, at IPLocation) bson.M {
+	return bson.M{
+		"tenant":   tenant,
+		"region":   at.Region,
+		"zone":     at.Zone,
+		"sub_zone": at.SubZone,
+	}
+}
+
+// GetAllocationCursor returns the allocation cursor of a sub-zone, or ErrNotFound
+func (r *MongoRepository) GetAllocationCursor(ctx context.Context, tenant string, at IPLocation) (models.AllocationCursor, error) {
+	var cursor models.AllocationCursor
+	err := r.cursors.FindOne(ctx, cursorFilter(tenant, at)).Decode(&cursor)
+	if err == mongo.ErrNoDocuments {
+		return models.AllocationCursor{}, ErrNotFound
+	}
+	return cursor, err
+}
+
+// AdvanceAllocationCursor records the address round-robin allocation handed out last
+func (r *MongoRepository) AdvanceAllocationCursor(ctx context.Context, tenant string, at IPLocation, version, last string, now time.Time) error {
+	field := "last_ipv6"
+	if version == "ipv4" {
+		field = "last_ipv4"
+	}
+
+	opts := options.Update().SetUpsert(true)
+	_, err := r.cursors.UpdateOne(ctx, cursorFilter(tenant, at),
+		bson.M{"$set": bson.M{field: last, "updated_at": now}}, opts)
+	return err
+}
+
+// RecordReleasedIPs appends released addresses to the cursor, keeping the newest keep entries
+func (r *MongoRepository) RecordReleasedIPs(ctx context.Context, tenant string, at IPLocation, released []models.ReleasedIP, keep int) error {
+	if len(released) == 0 {
+		return nil
+	}
+
+	opts := options.Update().SetUpsert(true)
+	_, err := r.cursors.UpdateOne(ctx, cursorFilter(tenant, at), bson.M{
+		"$push": bson.M{"released": bson.M{"$each": released, "$slice": -keep}},
+		"$set":  bson.M{"updated_at": time.Now()},
+	}, opts)
+	return err
+}
+
+// MoveAllocationCursors renames the cursors of the sub-zones matching the filter
+func (r *MongoRepository) MoveAllocationCursors(ctx context.Context, filter IPFilter, to IPLocation) error {
+	set := bson.M{"updated_at": time.Now()}
+	if to.Region != "" {
+		set["region"] = to.Region
+	}
+	if to.Zone != "" {
+		set["zone"] = to.Zone
+	}
+	if to.SubZone != "" {
+		set["sub_zone"] = to.SubZone
+	}
+
+	_, err := r.cursors.UpdateMany(ctx, ipFilterDocument(filter.hierarchy()), bson.M{"$set": set})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// DeleteAllocationCursors removes the cursors of the sub-zones matching the filter
+func (r *MongoRepository) DeleteAllocationCursors(ctx context.Context, filter IPFilter) error {
+	_, err := r.cursors.DeleteMany(ctx, ipFilterDocument(filter.hierarchy()))
+	return err
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/database"
+	"ip-allocator-api/internal/models"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// TestMongoInsertRollsBackPartialBatch inserts a batch with a held address in the middle
+// through the standalone path, whatever the server at MONGODB_TEST_URI supports, so the
+// unordered insert writes the addresses around it and the rollback has to delete them
+func TestMongoInsertRollsBackPartialBatch(t *testing.T) {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(fmt.Sprintf("ip_allocator_rollback_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() { db.Drop(context.Background()) })
+	if err := database.EnsureIndexes(ctx, db); err != nil {
+		t.Fatalf("EnsureIndexes: %v", err)
+	}
+
+	repo := NewMongoRepository(db, zap.NewNop())
+	supported := false
+	repo.transactions.Store(&supported)
+
+	newIP := func(ip string) models.IPAllocation {
+		now := time.Now()
+		return models.IPAllocation{
+			Tenant: "t1", Region: "r1", Zone: "z1", SubZone: "s1",
+			IPAddress: ip, IPVersion: "ipv4", Status: models.IPStatusAllocated,
+			CreatedAt: now, UpdatedAt: now,
+		}
+	}
+
+	held := []models.IPAllocation{newIP("10.0.0.3")}
+	if err := repo.InsertIPs(ctx, held); err != nil {
+		t.Fatalf("InsertIPs: %v", err)
+	}
+
+	batch := []models.IPAllocation{newIP("10.0.0.1"), newIP("10.0.0.2"), newIP("10.0.0.3"), newIP("10.0.0.4"), newIP("10.0.0.5")}
+	if err := repo.InsertIPs(ctx, batch); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("InsertIPs of a batch with a held address = %v, want ErrDuplicate", err)
+	}
+
+	docs, err := repo.FindIPs(ctx, IPFilter{Tenant: "t1"})
+	if err != nil {
+		t.Fatalf("FindIPs: %v", err)
+	}
+	if len(docs) != 1 || docs[0].ID != held[0].ID {
+		t.Fatalf("after the rollback the sub-zone holds %+v, want only the address held before", docs)
+	}
+
+	// Nothing left behind, so the same addresses can be taken right away
+	if err := repo.InsertIPs(ctx, []models.IPAllocation{newIP("10.0.0.1"), newIP("10.0.0.2"), newIP("10.0.0.4")}); err != nil {
+		t.Fatalf("InsertIPs after the rollback: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/database"
+	"ip-allocator-api/internal/storage"
+	"ip-allocator-api/internal/storage/storagetest"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// TestMongoRepository runs the conformance suite against the MongoDB at MONGODB_TEST_URI, one
+// throwaway database per subtest
+func TestMongoRepository(t *testing.T) {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer client.Disconnect(context.Background())
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	var databases int
+	storagetest.Run(t, func(t *testing.T) storage.Repository {
+		databases++
+		db := client.Database(fmt.Sprintf("ip_allocator_test_%d_%d", time.Now().UnixNano(), databases))
+		t.Cleanup(func() { db.Drop(context.Background()) })
+
+		if err := database.EnsureIndexes(context.Background(), db); err != nil {
+			t.Fatalf("EnsureIndexes: %v", err)
+		}
+		return storage.NewMongoRepository(db, zap.NewNop())
+	})
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"ip-allocator-api/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrNotFound is returned when the addressed document does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned when a write would store a unique name, key or IP twice
+	ErrDuplicate = errors.New("duplicate")
+	// ErrConflict is returned when a conditional write finds the region changed since it was read
+	ErrConflict = errors.New("changed concurrently")
+)
+
+// Repository keeps the region hierarchy, the state of every allocated or reserved IP and the
+// tenants, API keys, audit trail and idempotency records around them. Implementations are safe
+// for concurrent use.
+type Repository interface {
+	HierarchyRepository
+	IPRepository
+	TenantRepository
+	APIKeyRepository
+	AuditRepository
+	IdempotencyRepository
+
+	// Ping checks that the backend is reachable
+	Ping(ctx context.Context) error
+}
+
+// HierarchyRepository stores regions with their zones and sub-zones embedded. Regions are
+// addressed by tenant and name, zones and sub-zones by name within their parent. Every change
+// to a zone or sub-zone also moves the updated_at of its region.
+type HierarchyRepository interface {
+	// GetRegion returns a region of the tenant, or ErrNotFound
+	GetRegion(ctx context.Context, tenant, name string) (models.Region, error)
+	// ListRegions returns the regions of the tenant, or of every tenant when tenant is empty,
+	// ordered by tenant and name
+	ListRegions(ctx context.Context, tenant string) ([]models.Region, error)
+	// CountRegions counts the regions of the tenant
+	CountRegions(ctx context.Context, tenant string) (int64, error)
+	// HierarchyVersion identifies the current state of all regions
+	HierarchyVersion(ctx context.Context) (HierarchyVersion, error)
+
+	// CreateRegion stores a new region, assigning its ID when unset. It returns ErrDuplicate
+	// when the tenant already has a region with that name.
+	CreateRegion(ctx context.Context, region *models.Region) error
+	// UpdateRegion applies the changes and returns the region as it was before, or ErrNotFound.
+	// Renaming onto another region of the tenant returns ErrDuplicate.
+	UpdateRegion(ctx context.Context, tenant, name string, changes HierarchyChanges) (models.Region, error)
+	// DeleteRegion removes a region and returns it, or ErrNotFound
+	DeleteRegion(ctx context.Context, tenant, name string) (models.Region, error)
+
+	// AddZone appends a zone to a region, or returns ErrNotFound. With a non-zero
+	// unchangedSince the zone is only added while the region's updated_at still equals it,
+	// otherwise ErrConflict is returned.
+	AddZone(ctx context.Context, tenant, regionName string, zone models.Zone, unchangedSince time.Time) error
+	// UpdateZone applies the changes to a zone and returns its region as it was before, or ErrNotFound
+	UpdateZone(ctx context.Context, tenant, regionName, zoneName string, changes HierarchyChanges) (models.Region, error)
+	// DeleteZone removes a zone and returns its region as it was before, or ErrNotFound
+	DeleteZone(ctx context.Context, tenant, regionName, zoneName string) (models.Region, error)
+
+	// AddSubZone appends a sub-zone to a zone, or returns ErrNotFound. unchangedSince
+	// guards the region as for AddZone.
+	AddSubZone(ctx context.Context, tenant, regionName, zoneName string, subZone models.SubZone, unchangedSince time.Time) error
+	// UpdateSubZone applies the changes to a sub-zone and returns its region as it was before, or ErrNotFound
+	UpdateSubZone(ctx context.Context, tenant, regionName, zoneName, subZoneName string, changes HierarchyChanges) (models.Region, error)
+	// DeleteSubZone removes a sub-zone and returns its region as it was before, or ErrNotFound
+	DeleteSubZone(ctx context.Context, tenant, regionName, zoneName, subZoneName string) (models.Region, error)
+}
+
+// IPRepository stores one document per allocated or reserved IP. An address can only be held
+// once per sub-zone of a tenant.
+type IPRepository interface {
+	// FindIPs returns the documents matching the filter in the order they were created
+	FindIPs(ctx context.Context, filter IPFilter) ([]models.IPAllocation, error)
+	// CountIPs counts the documents matching the filter
+	CountIPs(ctx context.Context, filter IPFilter) (int64, error)
+	// IPStateVersion identifies the current state of the documents matching the filter
+	IPStateVersion(ctx context.Context, filter IPFilter) (IPStateVersion, error)
+	// CountIPsByOwner counts the documents of each owner of the tenant, ordered by owner.
+	// Documents without an owner are left out.
+	CountIPsByOwner(ctx context.Context, tenant string) ([]OwnerCount, error)
+
+	// InsertIPs stores the documents all-or-nothing. If any address is already held in its
+	// sub-zone nothing is stored and ErrDuplicate is returned. Backends without multi-document
+	// transactions, a standalone MongoDB, undo a failed batch by deleting what was written, so
+	// until then readers can see part of it and other allocators find those addresses held.
+	InsertIPs(ctx context.Context, docs []models.IPAllocation) error
+	// DeleteIPs removes the documents matching the filter and returns how many were removed
+	DeleteIPs(ctx context.Context, filter IPFilter) (int64, error)
+	// MoveIPs rewrites the region, zone or sub-zone of the documents matching the filter after
+	// one of them was renamed; empty fields of to are kept
+	MoveIPs(ctx context.Context, filter IPFilter, to IPLocation) (int64, error)
+	// UnpairIPs removes the host pair link of the documents matching the filter
+	UnpairIPs(ctx context.Context, filter IPFilter) (int64, error)
+
+	// RenewLeases moves the expiry of the allocated documents matching the filter whose lease
+	// has not run out at now, and returns how many were renewed. Permanent allocations, which
+	// have no expiry, are never renewed.
+	RenewLeases(ctx context.Context, filter IPFilter, expiresAt, now time.Time) (int64, error)
+	// FindExpiredIPs returns up to limit allocated documents whose lease ended at or before now,
+	// the longest expired first
+	FindExpiredIPs(ctx context.Context, now time.Time, limit int64) ([]models.IPAllocation, error)
+	// ReleaseExpiredIP removes an expired document unless its lease was renewed after it was read
+	ReleaseExpiredIP(ctx context.Context, id primitive.ObjectID, now time.Time) (bool, error)
+
+	// GetAllocationCursor returns the allocation cursor of a sub-zone, or ErrNotFound
+	GetAllocationCursor(ctx context.Context, tenant string, at IPLocation) (models.AllocationCursor, error)
+	// AdvanceAllocationCursor records the address of the version that round-robin allocation
+	// handed out last, creating the cursor when needed
+	AdvanceAllocationCursor(ctx context.Context, tenant string, at IPLocation, version, last string, now time.Time) error
+	// RecordReleasedIPs appends released addresses to the cursor of a sub-zone, creating it
+	// when needed, and keeps only the newest keep entries
+	RecordReleasedIPs(ctx context.Context, tenant string, at IPLocation, released []models.ReleasedIP, keep int) error
+	// MoveAllocationCursors renames the cursors matching the hierarchy fields of the filter,
+	// like MoveIPs
+	MoveAllocationCursors(ctx context.Context, filter IPFilter, to IPLocation) error
+	// DeleteAllocationCursors removes the cursors matching the hierarchy fields of the filter
+	DeleteAllocationCursors(ctx context.Context, filter IPFilter) error
+}
+
+// TenantRepository stores the tenants, addressed by their unique name
+type TenantRepository interface {
+	// GetTenant returns a tenant, or ErrNotFound
+	GetTenant(ctx context.Context, name string) (models.Tenant, error)
+	// ListTenants returns every tenant ordered by name
+	ListTenants(ctx context.Context) ([]models.Tenant, error)
+	// CreateTenant stores a new tenant, assigning its ID when unset, or returns ErrDuplicate
+	CreateTenant(ctx context.Context, tenant *models.Tenant) error
+	// EnsureTenant stores the tenant unless one with its name already exists
+	EnsureTenant(ctx context.Context, tenant models.Tenant) error
+	// UpdateTenant sets the description and returns the tenant as it was before, or ErrNotFound
+	UpdateTenant(ctx context.Context, name, description string, updatedAt time.Time) (models.Tenant, error)
+	// DeleteTenant removes a tenant and returns it, or ErrNotFound
+	DeleteTenant(ctx context.Context, name string) (models.Tenant, error)
+}
+
+// APIKeyRepository stores API keys. Both the name and the key hash are unique.
+type APIKeyRepository interface {
+	// FindAPIKeyByHash returns the key with the hash, or ErrNotFound
+	FindAPIKeyByHash(ctx context.Context, keyHash string) (models.APIKey, error)
+	// ListAPIKeys returns the keys of the tenant, or every key when tenant is empty, oldest first
+	ListAPIKeys(ctx context.Context, tenant string) ([]models.APIKey, error)
+	// CreateAPIKey stores a new key, or returns ErrDuplicate when its name or hash is taken
+	CreateAPIKey(ctx context.Context, key *models.APIKey) error
+	// UpsertAPIKey stores the key under its name. A key of that name keeps its ID, creator,
+	// creation time and last use; every other field is replaced.
+	UpsertAPIKey(ctx context.Context, key models.APIKey) error
+	// TouchAPIKey records the last use of a key
+	TouchAPIKey(ctx context.Context, id primitive.ObjectID, usedAt time.Time) error
+	// DeleteAPIKey removes a key and returns it, or ErrNotFound. A non-empty tenant only
+	// matches keys of that tenant.
+	DeleteAPIKey(ctx context.Context, id primitive.ObjectID, tenant string) (models.APIKey, error)
+	// DeleteTenantAPIKeys removes the keys of a tenant and returns how many were removed
+	DeleteTenantAPIKeys(ctx context.Context, tenant string) (int64, error)
+}
+
+// AuditRepository appends audit events and reads them back. Events are returned undecoded
+// because their before and after snapshots have no fixed type.
+type AuditRepository interface {
+	// InsertAuditEvent appends an event, assigning its ID when unset
+	InsertAuditEvent(ctx context.Context, event *models.AuditEvent) error
+	// FindAuditEvents returns the events matching the filter, newest first
+	FindAuditEvents(ctx context.Context, filter AuditFilter) ([]bson.Raw, error)
+}
+
+// IdempotencyRepository stores one record per Idempotency-Key and operation. Records past
+// their expires_at may be removed at any time.
+type IdempotencyRepository interface {
+	// GetIdempotencyRecord returns the record of the key, or ErrNotFound
+	GetIdempotencyRecord(ctx context.Context, key, operation string) (models.IdempotencyRecord, error)
+	// InsertIdempotencyRecord stores a new record, assigning its ID when unset, or returns
+	// ErrDuplicate when the key was already used for the operation
+	InsertIdempotencyRecord(ctx context.Context, record *models.IdempotencyRecord) error
+	// ReclaimIdempotencyRecord hands the record read as stale to a new request: it takes the
+	// request hash, state and times of claim and drops the stored response. It reports false
+	// when the record changed state or was reclaimed since it was read.
+	ReclaimIdempotencyRecord(ctx context.Context, stale, claim models.IdempotencyRecord) (bool, error)
+	// CompleteIdempotencyRecord stores the response of a pending record
+	CompleteIdempotencyRecord(ctx context.Context, key, operation string, statusCode int, contentType string, body []byte) error
+	// ReleaseIdempotencyRecord removes a pending record
+	ReleaseIdempotencyRecord(ctx context.Context, key, operation string) error
+}
+
+// HierarchyVersion identifies a state of the stored regions. Every region, zone and sub-zone
+// change bumps the region's updated_at and deletions lower the count, so a different version
+// means the hierarchy changed.
+type HierarchyVersion struct {
+	Count     int64
+	UpdatedAt time.Time
+}
+
+// IPStateVersion identifies a state of a set of IP documents, typically those of a sub-zone.
+// Every write stores the documents it touches with a new updated_at and deletions lower the
+// count, so a different version means the documents changed. A delete and an insert landing
+// within the same millisecond, or an insert stamped earlier than the latest update by a skewed
+// clock, can go unnoticed.
+type IPStateVersion struct {
+	Count     int64
+	UpdatedAt time.Time
+}
+
+// HierarchyChanges are the fields to change on a region, zone or sub-zone. Empty fields are
+// left as they are; UpdatedAt is always written, to the changed level and every level above it.
+type HierarchyChanges struct {
+	Name     string
+	IPv4CIDR string
+	IPv6CIDR string
+	// AllocationStrategy only applies to sub-zones
+	AllocationStrategy string
+	// ClearEmbeddedIPs removes the IP arrays that sub-zones held before IPs were stored as
+	// documents; it only applies to sub-zones
+	ClearEmbeddedIPs bool
+	UpdatedAt        time.Time
+}
+
+// IPFilter selects IP documents. Every set field must match; an empty filter matches every
+// document of every tenant.
+type IPFilter struct {
+	Tenant  string
+	Region  string
+	Zone    string
+	SubZone string
+	// Regions matches documents in any of the named regions
+	Regions []string
+	// IPAddresses matches documents holding any of the addresses
+	IPAddresses []string
+	Status      string
+	Owner       string
+	// Labels matches documents carrying every one of the labels
+	Labels    map[string]string
+	CreatedBy string
+	// PairedIPs matches documents paired with any of the addresses
+	PairedIPs []string
+	// ExpiresAfter and ExpiresBy bound the lease expiry, exclusive and inclusive. Documents
+	// without a lease never match a bound.
+	ExpiresAfter time.Time
+	ExpiresBy    time.Time
+}
+
+// hierarchy keeps only the fields of the filter that select sub-zones
+func (filter IPFilter) hierarchy() IPFilter {
+	return IPFilter{
+		Tenant:  filter.Tenant,
+		Region:  filter.Region,
+		Regions: filter.Regions,
+		Zone:    filter.Zone,
+		SubZone: filter.SubZone,
+	}
+}
+
+// IPLocation names a sub-zone. As the target of a move it is the region, zone and sub-zone
+// documents are moved to, and empty fields are kept.
+type IPLocation struct {
+	Region  string
+	Zone    string
+	SubZone string
+}
+
+// OwnerCount is the number of IPs held by an owner
+type OwnerCount struct {
+	Owner string
+	Count int64
+}
+
+// AuditFilter selects audit events. Every set field must match.
+type AuditFilter struct {
+	Tenant string
+	// ResourcePath matches the resource itself and everything below it
+	ResourcePath string
+	ResourceType string
+	// IPAddress matches events naming the address
+	IPAddress string
+	Actor     string
+	Outcome   string
+	// Since and Until bound the timestamp, both inclusive
+	Since time.Time
+	Until time.Time
+	// Limit caps the number of events returned; zero returns all of them
+	Limit int64
+}
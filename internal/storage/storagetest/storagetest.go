@@ -0,0 +1,1207 @@
+// Package storagetest checks that a storage.Repository implementation behaves like the
+// MongoDB one the services were written against.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"ip-allocator-api/internal/models"
+	"ip-allocator-api/internal/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Run runs the conformance suite. newRepository must return an empty repository for every call.
+func Run(t *testing.T, newRepository func(t *testing.T) storage.Repository) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, repo storage.Repository)
+	}{
+		{"Ping", testPing},
+		{"RegionLifecycle", testRegionLifecycle},
+		{"RegionsAreTenantScoped", testRegionsAreTenantScoped},
+		{"ZoneLifecycle", testZoneLifecycle},
+		{"SubZoneLifecycle", testSubZoneLifecycle},
+		{"GuardedAdds", testGuardedAdds},
+		{"HierarchyVersion", testHierarchyVersion},
+		{"InsertIsAllOrNothing", testInsertIsAllOrNothing},
+		{"ConcurrentInsertsClaimOnce", testConcurrentInsertsClaimOnce},
+		{"IPStateVersion", testIPStateVersion},
+		{"IPFilters", testIPFilters},
+		{"MoveAndUnpair", testMoveAndUnpair},
+		{"Leases", testLeases},
+		{"RenewSkipsPermanentIPs", testRenewSkipsPermanentIPs},
+		{"CountByOwner", testCountByOwner},
+		{"Tenants", testTenants},
+		{"APIKeys", testAPIKeys},
+		{"AuditTrail", testAuditTrail},
+		{"Idempotency", testIdempotency},
+		{"AllocationCursors", testAllocationCursors},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newRepository(t))
+		})
+	}
+}
+
+// now is a fixed time at millisecond precision, as every backend stores times
+var now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func newRegion(tenant, name string) models.Region {
+	return models.Region{
+		Name:      name,
+		Tenant:    tenant,
+		IPv4CIDR:  "10.0.0.0/8",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func newIP(tenant, subZone, ip string) models.IPAllocation {
+	return models.IPAllocation{
+		Tenant:    tenant,
+		Region:    "r1",
+		Zone:      "z1",
+		SubZone:   subZone,
+		IPAddress: ip,
+		IPVersion: "ipv4",
+		Status:    models.IPStatusAllocated,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func mustCreateRegion(t *testing.T, repo storage.Repository, region models.Region) models.Region {
+	t.Helper()
+	if err := repo.CreateRegion(context.Background(), &region); err != nil {
+		t.Fatalf("CreateRegion(%s/%s): %v", region.Tenant, region.Name, err)
+	}
+	return region
+}
+
+func mustInsert(t *testing.T, repo storage.Repository, docs ...models.IPAllocation) {
+	t.Helper()
+	if err := repo.InsertIPs(context.Background(), docs); err != nil {
+		t.Fatalf("InsertIPs: %v", err)
+	}
+}
+
+func expectErr(t *testing.T, op string, err, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Fatalf("%s: got error %v, want %v", op, err, want)
+	}
+}
+
+func addresses(docs []models.IPAllocation) []string {
+	ips := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		ips = append(ips, doc.IPAddress)
+	}
+	return ips
+}
+
+func expectIPs(t *testing.T, op string, docs []models.IPAllocation, want ...string) {
+	t.Helper()
+	got := addresses(docs)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("%s: got %v, want %v", op, got, want)
+	}
+}
+
+func testPing(t *testing.T, repo storage.Repository) {
+	if err := repo.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+}
+
+func testRegionLifecycle(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	created := mustCreateRegion(t, repo, newRegion("t1", "r1"))
+	if created.ID.IsZero() {
+		t.Fatal("CreateRegion did not assign an ID")
+	}
+	duplicate := newRegion("t1", "r1")
+	expectErr(t, "CreateRegion duplicate", repo.CreateRegion(ctx, &duplicate), storage.ErrDuplicate)
+
+	region, err := repo.GetRegion(ctx, "t1", "r1")
+	if err != nil {
+		t.Fatalf("GetRegion: %v", err)
+	}
+	if region.ID != created.ID || region.IPv4CIDR != "10.0.0.0/8" || !region.UpdatedAt.Equal(now) {
+		t.Fatalf("GetRegion returned %+v", region)
+	}
+	_, err = repo.GetRegion(ctx, "t1", "missing")
+	expectErr(t, "GetRegion missing", err, storage.ErrNotFound)
+
+	later := now.Add(time.Minute)
+	before, err := repo.UpdateRegion(ctx, "t1", "r1", storage.HierarchyChanges{Name: "r2", IPv6CIDR: "fd00::/48", UpdatedAt: later})
+	if err != nil {
+		t.Fatalf("UpdateRegion: %v", err)
+	}
+	if before.Name != "r1" || before.IPv6CIDR != "" {
+		t.Fatalf("UpdateRegion returned %+v, want the region before the change", before)
+	}
+	region, err = repo.GetRegion(ctx, "t1", "r2")
+	if err != nil {
+		t.Fatalf("GetRegion renamed: %v", err)
+	}
+	if region.IPv4CIDR != "10.0.0.0/8" || region.IPv6CIDR != "fd00::/48" || !region.UpdatedAt.Equal(later) {
+		t.Fatalf("UpdateRegion stored %+v", region)
+	}
+	_, err = repo.GetRegion(ctx, "t1", "r1")
+	expectErr(t, "GetRegion old name", err, storage.ErrNotFound)
+
+	mustCreateRegion(t, repo, newRegion("t1", "r3"))
+	_, err = repo.UpdateRegion(ctx, "t1", "r3", storage.HierarchyChanges{Name: "r2", UpdatedAt: later})
+	expectErr(t, "UpdateRegion rename collision", err, storage.ErrDuplicate)
+	_, err = repo.UpdateRegion(ctx, "t1", "missing", storage.HierarchyChanges{UpdatedAt: later})
+	expectErr(t, "UpdateRegion missing", err, storage.ErrNotFound)
+
+	deleted, err := repo.DeleteRegion(ctx, "t1", "r2")
+	if err != nil {
+		t.Fatalf("DeleteRegion: %v", err)
+	}
+	if deleted.ID != created.ID {
+		t.Fatalf("DeleteRegion returned %+v", deleted)
+	}
+	_, err = repo.DeleteRegion(ctx, "t1", "r2")
+	expectErr(t, "DeleteRegion twice", err, storage.ErrNotFound)
+}
+
+func testRegionsAreTenantScoped(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	mustCreateRegion(t, repo, newRegion("t2", "b"))
+	mustCreateRegion(t, repo, newRegion("t1", "b"))
+	mustCreateRegion(t, repo, newRegion("t1", "a"))
+
+	regions, err := repo.ListRegions(ctx, "t1")
+	if err != nil {
+		t.Fatalf("ListRegions: %v", err)
+	}
+	if len(regions) != 2 || regions[0].Name != "a" || regions[1].Name != "b" {
+		t.Fatalf("ListRegions(t1) returned %+v", regions)
+	}
+
+	regions, err = repo.ListRegions(ctx, "")
+	if err != nil {
+		t.Fatalf("ListRegions all: %v", err)
+	}
+	var names []string
+	for _, region := range regions {
+		names = append(names, region.Tenant+"/"+region.Name)
+	}
+	if fmt.Sprint(names) != "[t1/a t1/b t2/b]" {
+		t.Fatalf("ListRegions() returned %v", names)
+	}
+
+	count, err := repo.CountRegions(ctx, "t2")
+	if err != nil || count != 1 {
+		t.Fatalf("CountRegions(t2) = %d, %v", count, err)
+	}
+	if _, err := repo.GetRegion(ctx, "t2", "a"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("GetRegion across tenants: %v", err)
+	}
+}
+
+func testZoneLifecycle(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	mustCreateRegion(t, repo, newRegion("t1", "r1"))
+
+	zone := models.Zone{Name: "z1", IPv4CIDR: "10.1.0.0/16", CreatedAt: now, UpdatedAt: now.Add(time.Second)}
+	if err := repo.AddZone(ctx, "t1", "r1", zone, time.Time{}); err != nil {
+		t.Fatalf("AddZone: %v", err)
+	}
+	expectErr(t, "AddZone missing region", repo.AddZone(ctx, "t1", "missing", zone, time.Time{}), storage.ErrNotFound)
+
+	region, _ := repo.GetRegion(ctx, "t1", "r1")
+	if len(region.Zones) != 1 || region.Zones[0].IPv4CIDR != "10.1.0.0/16" || !region.UpdatedAt.Equal(zone.UpdatedAt) {
+		t.Fatalf("AddZone stored %+v", region)
+	}
+
+	later := now.Add(time.Minute)
+	before, err := repo.UpdateZone(ctx, "t1", "r1", "z1", storage.HierarchyChanges{Name: "z2", UpdatedAt: later})
+	if err != nil {
+		t.Fatalf("UpdateZone: %v", err)
+	}
+	if before.Zones[0].Name != "z1" {
+		t.Fatalf("UpdateZone returned %+v, want the region before the change", before)
+	}
+	region, _ = repo.GetRegion(ctx, "t1", "r1")
+	if region.Zones[0].Name != "z2" || region.Zones[0].IPv4CIDR != "10.1.0.0/16" ||
+		!region.Zones[0].UpdatedAt.Equal(later) || !region.UpdatedAt.Equal(later) {
+		t.Fatalf("UpdateZone stored %+v", region)
+	}
+	_, err = repo.UpdateZone(ctx, "t1", "r1", "z1", storage.HierarchyChanges{UpdatedAt: later})
+	expectErr(t, "UpdateZone missing zone", err, storage.ErrNotFound)
+
+	_, err = repo.DeleteZone(ctx, "t1", "r1", "missing")
+	expectErr(t, "DeleteZone missing zone", err, storage.ErrNotFound)
+	if _, err := repo.DeleteZone(ctx, "t1", "r1", "z2"); err != nil {
+		t.Fatalf("DeleteZone: %v", err)
+	}
+	region, _ = repo.GetRegion(ctx, "t1", "r1")
+	if len(region.Zones) != 0 || !region.UpdatedAt.After(later) {
+		t.Fatalf("DeleteZone stored %+v", region)
+	}
+}
+
+func testSubZoneLifecycle(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	region := newRegion("t1", "r1")
+	region.Zones = []models.Zone{{Name: "z1", CreatedAt: now, UpdatedAt: now}, {Name: "z2", CreatedAt: now, UpdatedAt: now}}
+	mustCreateRegion(t, repo, region)
+
+	subZone := models.SubZone{Name: "s1", IPv4CIDR: "10.1.1.0/24", GatewayIPv4: "10.1.1.1",
+		ExcludedRanges: []string{"10.1.1.200-10.1.1.254"}, CreatedAt: now, UpdatedAt: now.Add(time.Second)}
+	if err := repo.AddSubZone(ctx, "t1", "r1", "z1", subZone, time.Time{}); err != nil {
+		t.Fatalf("AddSubZone: %v", err)
+	}
+	expectErr(t, "AddSubZone missing zone", repo.AddSubZone(ctx, "t1", "r1", "missing", subZone, time.Time{}), storage.ErrNotFound)
+
+	stored, _ := repo.GetRegion(ctx, "t1", "r1")
+	if len(stored.Zones[0].SubZones) != 1 || len(stored.Zones[1].SubZones) != 0 ||
+		stored.Zones[0].SubZones[0].GatewayIPv4 != subZone.GatewayIPv4 ||
+		!reflect.DeepEqual(stored.Zones[0].SubZones[0].ExcludedRanges, subZone.ExcludedRanges) ||
+		!stored.Zones[0].UpdatedAt.Equal(subZone.UpdatedAt) || !stored.UpdatedAt.Equal(subZone.UpdatedAt) {
+		t.Fatalf("AddSubZone stored %+v", stored)
+	}
+
+	later := now.Add(time.Minute)
+	changes := storage.HierarchyChanges{IPv6CIDR: "fd00:1::/64", AllocationStrategy: models.AllocationStrategyRandom, UpdatedAt: later}
+	if _, err := repo.UpdateSubZone(ctx, "t1", "r1", "z1", "s1", changes); err != nil {
+		t.Fatalf("UpdateSubZone: %v", err)
+	}
+	stored, _ = repo.GetRegion(ctx, "t1", "r1")
+	updated := stored.Zones[0].SubZones[0]
+	if updated.IPv4CIDR != "10.1.1.0/24" || updated.IPv6CIDR != "fd00:1::/64" ||
+		updated.AllocationStrategy != models.AllocationStrategyRandom || !updated.UpdatedAt.Equal(later) ||
+		!stored.Zones[0].UpdatedAt.Equal(later) || !stored.UpdatedAt.Equal(later) {
+		t.Fatalf("UpdateSubZone stored %+v", stored)
+	}
+	_, err := repo.UpdateSubZone(ctx, "t1", "r1", "z2", "s1", storage.HierarchyChanges{UpdatedAt: later})
+	expectErr(t, "UpdateSubZone in the wrong zone", err, storage.ErrNotFound)
+
+	// Sub-zones written before IPs were stored as documents still carry the IP arrays
+	legacy := newRegion("t1", "legacy")
+	legacy.Zones = []models.Zone{{Name: "z1", SubZones: []models.SubZone{{Name: "s1", IPv4CIDR: "10.2.1.0/24",
+		AllocatedIPv4: []string{"10.2.1.5"}, ReservedIPv4: []string{"10.2.1.6"}, CreatedAt: now, UpdatedAt: now}},
+		CreatedAt: now, UpdatedAt: now}}
+	mustCreateRegion(t, repo, legacy)
+	if _, err := repo.UpdateSubZone(ctx, "t1", "legacy", "z1", "s1", storage.HierarchyChanges{ClearEmbeddedIPs: true, UpdatedAt: later}); err != nil {
+		t.Fatalf("UpdateSubZone clearing the embedded IPs: %v", err)
+	}
+	stored, _ = repo.GetRegion(ctx, "t1", "legacy")
+	if cleared := stored.Zones[0].SubZones[0]; len(cleared.AllocatedIPv4) != 0 || len(cleared.ReservedIPv4) != 0 || cleared.IPv4CIDR != "10.2.1.0/24" {
+		t.Fatalf("UpdateSubZone clearing the embedded IPs stored %+v", cleared)
+	}
+
+	_, err = repo.DeleteSubZone(ctx, "t1", "r1", "z1", "missing")
+	expectErr(t, "DeleteSubZone missing sub-zone", err, storage.ErrNotFound)
+	before, err := repo.DeleteSubZone(ctx, "t1", "r1", "z1", "s1")
+	if err != nil {
+		t.Fatalf("DeleteSubZone: %v", err)
+	}
+	if len(before.Zones[0].SubZones) != 1 {
+		t.Fatalf("DeleteSubZone returned %+v, want the region before the change", before)
+	}
+	stored, _ = repo.GetRegion(ctx, "t1", "r1")
+	if len(stored.Zones[0].SubZones) != 0 {
+		t.Fatalf("DeleteSubZone stored %+v", stored)
+	}
+}
+
+func testGuardedAdds(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	region := newRegion("t1", "r1")
+	region.Zones = []models.Zone{{Name: "z1", CreatedAt: now, UpdatedAt: now}}
+	mustCreateRegion(t, repo, region)
+
+	first := now.Add(time.Second)
+	if err := repo.AddSubZone(ctx, "t1", "r1", "z1", models.SubZone{Name: "s1", UpdatedAt: first}, now); err != nil {
+		t.Fatalf("AddSubZone guarded: %v", err)
+	}
+	// The region moved on, so a writer that read it before must retry
+	err := repo.AddSubZone(ctx, "t1", "r1", "z1", models.SubZone{Name: "s2", UpdatedAt: first}, now)
+	expectErr(t, "AddSubZone stale", err, storage.ErrConflict)
+	err = repo.AddZone(ctx, "t1", "r1", models.Zone{Name: "z2", UpdatedAt: first}, now)
+	expectErr(t, "AddZone stale", err, storage.ErrConflict)
+	err = repo.AddZone(ctx, "t1", "missing", models.Zone{Name: "z2", UpdatedAt: first}, now)
+	expectErr(t, "AddZone guarded missing region", err, storage.ErrNotFound)
+
+	if err := repo.AddZone(ctx, "t1", "r1", models.Zone{Name: "z2", UpdatedAt: first.Add(time.Second)}, first); err != nil {
+		t.Fatalf("AddZone guarded: %v", err)
+	}
+	stored, _ := repo.GetRegion(ctx, "t1", "r1")
+	if len(stored.Zones) != 2 || len(stored.Zones[0].SubZones) != 1 {
+		t.Fatalf("guarded adds stored %+v", stored)
+	}
+}
+
+func testHierarchyVersion(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	empty, err := repo.HierarchyVersion(ctx)
+	if err != nil {
+		t.Fatalf("HierarchyVersion: %v", err)
+	}
+	if empty.Count != 0 || !empty.UpdatedAt.IsZero() {
+		t.Fatalf("HierarchyVersion of an empty repository = %+v", empty)
+	}
+
+	mustCreateRegion(t, repo, newRegion("t1", "r1"))
+	mustCreateRegion(t, repo, newRegion("t2", "r1"))
+	created, _ := repo.HierarchyVersion(ctx)
+	if created.Count != 2 || !created.UpdatedAt.Equal(now) {
+		t.Fatalf("HierarchyVersion after create = %+v", created)
+	}
+
+	later := now.Add(time.Hour)
+	if err := repo.AddZone(ctx, "t2", "r1", models.Zone{Name: "z1", UpdatedAt: later}, time.Time{}); err != nil {
+		t.Fatalf("AddZone: %v", err)
+	}
+	changed, _ := repo.HierarchyVersion(ctx)
+	if changed == created || !changed.UpdatedAt.Equal(later) {
+		t.Fatalf("HierarchyVersion did not move with a zone change: %+v", changed)
+	}
+
+	if _, err := repo.DeleteRegion(ctx, "t1", "r1"); err != nil {
+		t.Fatalf("DeleteRegion: %v", err)
+	}
+	deleted, _ := repo.HierarchyVersion(ctx)
+	if deleted.Count != 1 {
+		t.Fatalf("HierarchyVersion after delete = %+v", deleted)
+	}
+}
+
+func testInsertIsAllOrNothing(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	mustInsert(t, repo, newIP("t1", "s1", "10.0.0.1"))
+
+	err := repo.InsertIPs(ctx, []models.IPAllocation{newIP("t1", "s1", "10.0.0.2"), newIP("t1", "s1", "10.0.0.1")})
+	expectErr(t, "InsertIPs with a held address", err, storage.ErrDuplicate)
+	err = repo.InsertIPs(ctx, []models.IPAllocation{newIP("t1", "s1", "10.0.0.3"), newIP("t1", "s1", "10.0.0.3")})
+	expectErr(t, "InsertIPs with a repeated address", err, storage.ErrDuplicate)
+
+	docs, err := repo.FindIPs(ctx, storage.IPFilter{Tenant: "t1"})
+	if err != nil {
+		t.Fatalf("FindIPs: %v", err)
+	}
+	expectIPs(t, "FindIPs after rejected inserts", docs, "10.0.0.1")
+	if docs[0].ID.IsZero() {
+		t.Fatal("InsertIPs did not assign an ID")
+	}
+
+	// The same address may be held by another sub-zone or another tenant
+	mustInsert(t, repo, newIP("t1", "s2", "10.0.0.1"), newIP("t2", "s1", "10.0.0.1"))
+	if err := repo.InsertIPs(ctx, nil); err != nil {
+		t.Fatalf("InsertIPs(nil): %v", err)
+	}
+}
+
+func testConcurrentInsertsClaimOnce(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	const writers = 8
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		inserted int
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Every writer claims 10.0.0.1 plus an address of its own
+			err := repo.InsertIPs(ctx, []models.IPAllocation{
+				newIP("t1", "s1", fmt.Sprintf("10.0.1.%d", i)),
+				newIP("t1", "s1", "10.0.0.1"),
+			})
+			switch {
+			case err == nil:
+				mu.Lock()
+				inserted++
+				mu.Unlock()
+			case !errors.Is(err, storage.ErrDuplicate):
+				t.Errorf("InsertIPs: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	count, err := repo.CountIPs(ctx, storage.IPFilter{Tenant: "t1"})
+	if err != nil {
+		t.Fatalf("CountIPs: %v", err)
+	}
+	if inserted != 1 || count != 2 {
+		t.Fatalf("%d concurrent inserts succeeded leaving %d documents, want 1 and 2", inserted, count)
+	}
+}
+
+func testIPStateVersion(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	s1 := storage.IPFilter{Tenant: "t1", Region: "r1", Zone: "z1", SubZone: "s1"}
+	version := func(op string) storage.IPStateVersion {
+		t.Helper()
+		v, err := repo.IPStateVersion(ctx, s1)
+		if err != nil {
+			t.Fatalf("IPStateVersion %s: %v", op, err)
+		}
+		return v
+	}
+
+	if empty := version("of an empty sub-zone"); empty.Count != 0 || !empty.UpdatedAt.IsZero() {
+		t.Fatalf("IPStateVersion of an empty sub-zone = %+v", empty)
+	}
+
+	// Documents of other sub-zones and tenants do not count
+	a, b := newIP("t1", "s1", "10.0.0.1"), newIP("t1", "s1", "10.0.0.2")
+	b.UpdatedAt = now.Add(time.Minute)
+	other := newIP("t1", "s2", "10.0.0.3")
+	other.UpdatedAt = now.Add(time.Hour)
+	mustInsert(t, repo, a, b, other, newIP("t2", "s1", "10.0.0.1"))
+	inserted := version("after insert")
+	if inserted.Count != 2 || !inserted.UpdatedAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("IPStateVersion after insert = %+v, want 2 documents updated at %s", inserted, now.Add(time.Minute))
+	}
+
+	// A renewal moves the latest update without changing the count
+	expiry := now.Add(2 * time.Hour)
+	lease := newIP("t1", "s1", "10.0.0.4")
+	lease.ExpiresAt = &expiry
+	mustInsert(t, repo, lease)
+	renewedAt := now.Add(90 * time.Minute)
+	if _, err := repo.RenewLeases(ctx, storage.IPFilter{Tenant: "t1", IPAddresses: []string{"10.0.0.4"}}, now.Add(3*time.Hour), renewedAt); err != nil {
+		t.Fatalf("RenewLeases: %v", err)
+	}
+	if renewed := version("after renewal"); renewed.Count != 3 || !renewed.UpdatedAt.Equal(renewedAt) {
+		t.Fatalf("IPStateVersion after renewal = %+v, want 3 documents updated at %s", renewed, renewedAt)
+	}
+
+	// A deletion lowers the count
+	if _, err := repo.DeleteIPs(ctx, storage.IPFilter{Tenant: "t1", IPAddresses: []string{"10.0.0.1"}}); err != nil {
+		t.Fatalf("DeleteIPs: %v", err)
+	}
+	if deleted := version("after delete"); deleted.Count != 2 {
+		t.Fatalf("IPStateVersion after delete = %+v, want 2 documents", deleted)
+	}
+}
+
+func testIPFilters(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	a := newIP("t1", "s1", "10.0.0.1")
+	a.Owner = "alice"
+	a.Labels = map[string]string{"env": "prod", "team": "net"}
+	a.CreatedBy = "key-1"
+	b := newIP("t1", "s1", "10.0.0.2")
+	b.Status = models.IPStatusReserved
+	b.PairedIP = "10.0.0.1"
+	b.CreatedAt = now.Add(-time.Minute)
+	c := newIP("t1", "s2", "10.0.0.3")
+	c.Region = "r2"
+	c.Labels = map[string]string{"env": "prod"}
+	d := newIP("t2", "s1", "10.0.0.1")
+	mustInsert(t, repo, a, b, c, d)
+
+	tests := []struct {
+		name   string
+		filter storage.IPFilter
+		want   []string
+	}{
+		{"tenant", storage.IPFilter{Tenant: "t1"}, []string{"10.0.0.2", "10.0.0.1", "10.0.0.3"}},
+		{"sub-zone", storage.IPFilter{Tenant: "t1", Region: "r1", Zone: "z1", SubZone: "s1"}, []string{"10.0.0.2", "10.0.0.1"}},
+		{"sub-zone addresses", storage.IPFilter{Tenant: "t1", Region: "r1", Zone: "z1", SubZone: "s1", IPAddresses: []string{"10.0.0.1", "10.0.0.3", "10.0.0.1"}}, []string{"10.0.0.1"}},
+		{"sub-zone status", storage.IPFilter{Tenant: "t1", Region: "r1", Zone: "z1", SubZone: "s1", Status: models.IPStatusReserved}, []string{"10.0.0.2"}},
+		{"regions", storage.IPFilter{Tenant: "t1", Regions: []string{"r2", "r9"}}, []string{"10.0.0.3"}},
+		{"region and regions", storage.IPFilter{Tenant: "t1", Region: "r1", Regions: []string{"r2"}}, nil},
+		{"addresses", storage.IPFilter{IPAddresses: []string{"10.0.0.1"}}, []string{"10.0.0.1", "10.0.0.1"}},
+		{"status", storage.IPFilter{Tenant: "t1", Status: models.IPStatusReserved}, []string{"10.0.0.2"}},
+		{"owner", storage.IPFilter{Tenant: "t1", Owner: "alice"}, []string{"10.0.0.1"}},
+		{"one label", storage.IPFilter{Tenant: "t1", Labels: map[string]string{"env": "prod"}}, []string{"10.0.0.1", "10.0.0.3"}},
+		{"every label", storage.IPFilter{Labels: map[string]string{"env": "prod", "team": "net"}}, []string{"10.0.0.1"}},
+		{"created by", storage.IPFilter{CreatedBy: "key-1"}, []string{"10.0.0.1"}},
+		{"paired", storage.IPFilter{Tenant: "t1", PairedIPs: []string{"10.0.0.1"}}, []string{"10.0.0.2"}},
+	}
+	for _, test := range tests {
+		docs, err := repo.FindIPs(ctx, test.filter)
+		if err != nil {
+			t.Fatalf("FindIPs %s: %v", test.name, err)
+		}
+		expectIPs(t, "FindIPs "+test.name, docs, test.want...)
+
+		count, err := repo.CountIPs(ctx, test.filter)
+		if err != nil || count != int64(len(test.want)) {
+			t.Fatalf("CountIPs %s = %d, %v, want %d", test.name, count, err, len(test.want))
+		}
+	}
+
+	stored, _ := repo.FindIPs(ctx, storage.IPFilter{Tenant: "t1", Owner: "alice"})
+	if stored[0].Labels["team"] != "net" || !stored[0].CreatedAt.Equal(now) {
+		t.Fatalf("FindIPs returned %+v", stored[0])
+	}
+
+	deleted, err := repo.DeleteIPs(ctx, storage.IPFilter{Tenant: "t1", SubZone: "s1"})
+	if err != nil || deleted != 2 {
+		t.Fatalf("DeleteIPs = %d, %v, want 2", deleted, err)
+	}
+	remaining, _ := repo.FindIPs(ctx, storage.IPFilter{})
+	expectIPs(t, "FindIPs after DeleteIPs", remaining, "10.0.0.3", "10.0.0.1")
+}
+
+func testMoveAndUnpair(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	a := newIP("t1", "s1", "10.0.0.1")
+	a.PairID = "pair"
+	a.PairedIP = "10.0.0.2"
+	b := newIP("t1", "s1", "10.0.0.2")
+	b.PairID = "pair"
+	b.PairedIP = "10.0.0.1"
+	c := newIP("t1", "s2", "10.0.0.1")
+	mustInsert(t, repo, a, b, c)
+
+	unpaired, err := repo.UnpairIPs(ctx, storage.IPFilter{Tenant: "t1", PairedIPs: []string{"10.0.0.1"}})
+	if err != nil || unpaired != 1 {
+		t.Fatalf("UnpairIPs = %d, %v, want 1", unpaired, err)
+	}
+	docs, _ := repo.FindIPs(ctx, storage.IPFilter{Tenant: "t1", IPAddresses: []string{"10.0.0.2"}})
+	if docs[0].PairID != "" || docs[0].PairedIP != "" {
+		t.Fatalf("UnpairIPs left %+v", docs[0])
+	}
+
+	// Moving s1 onto s2 would hold 10.0.0.1 twice
+	_, err = repo.MoveIPs(ctx, storage.IPFilter{Tenant: "t1", SubZone: "s1"}, storage.IPLocation{SubZone: "s2"})
+	expectErr(t, "MoveIPs collision", err, storage.ErrDuplicate)
+
+	moved, err := repo.MoveIPs(ctx, storage.IPFilter{Tenant: "t1", Region: "r1"}, storage.IPLocation{Region: "r2"})
+	if err != nil || moved != 3 {
+		t.Fatalf("MoveIPs = %d, %v, want 3", moved, err)
+	}
+	count, _ := repo.CountIPs(ctx, storage.IPFilter{Tenant: "t1", Region: "r2", Zone: "z1"})
+	if count != 3 {
+		t.Fatalf("MoveIPs left %d documents in r2, want 3", count)
+	}
+	// The moved addresses are held at their new location only
+	mustInsert(t, repo, newIP("t1", "s1", "10.0.0.1"))
+}
+
+func testLeases(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	expired := now.Add(-time.Minute)
+	live := now.Add(time.Minute)
+	a := newIP("t1", "s1", "10.0.0.1")
+	a.ExpiresAt = &expired
+	b := newIP("t1", "s1", "10.0.0.2")
+	b.ExpiresAt = &live
+	c := newIP("t1", "s1", "10.0.0.3")
+	d := newIP("t1", "s1", "10.0.0.4")
+	d.Status = models.IPStatusReserved
+	d.ExpiresAt = &expired
+	e := newIP("t1", "s1", "10.0.0.5")
+	earlier := now.Add(-time.Hour)
+	e.ExpiresAt = &earlier
+	mustInsert(t, repo, a, b, c, d, e)
+
+	docs, err := repo.FindIPs(ctx, storage.IPFilter{Tenant: "t1", ExpiresAfter: now})
+	if err != nil {
+		t.Fatalf("FindIPs ExpiresAfter: %v", err)
+	}
+	expectIPs(t, "FindIPs ExpiresAfter", docs, "10.0.0.2")
+	docs, _ = repo.FindIPs(ctx, storage.IPFilter{Tenant: "t1", Status: models.IPStatusAllocated, ExpiresBy: live})
+	expectIPs(t, "FindIPs ExpiresBy", docs, "10.0.0.1", "10.0.0.2", "10.0.0.5")
+
+	docs, err = repo.FindExpiredIPs(ctx, now, 1)
+	if err != nil {
+		t.Fatalf("FindExpiredIPs: %v", err)
+	}
+	expectIPs(t, "FindExpiredIPs limited", docs, "10.0.0.5")
+	docs, _ = repo.FindExpiredIPs(ctx, now, 10)
+	expectIPs(t, "FindExpiredIPs", docs, "10.0.0.5", "10.0.0.1")
+
+	// Expired leases cannot be renewed, and permanent allocations never become leases
+	renewTo := now.Add(time.Hour)
+	renewed, err := repo.RenewLeases(ctx, storage.IPFilter{Tenant: "t1"}, renewTo, now)
+	if err != nil || renewed != 1 {
+		t.Fatalf("RenewLeases = %d, %v, want 1", renewed, err)
+	}
+	docs, _ = repo.FindIPs(ctx, storage.IPFilter{Tenant: "t1", ExpiresAfter: now})
+	expectIPs(t, "FindIPs after RenewLeases", docs, "10.0.0.2")
+	if !docs[0].ExpiresAt.Equal(renewTo) || !docs[0].UpdatedAt.Equal(now) {
+		t.Fatalf("RenewLeases stored %+v", docs[0])
+	}
+
+	released, err := repo.ReleaseExpiredIP(ctx, docs[0].ID, now)
+	if err != nil || released {
+		t.Fatalf("ReleaseExpiredIP of a live lease = %v, %v", released, err)
+	}
+	expiredDocs, _ := repo.FindExpiredIPs(ctx, now, 10)
+	for _, doc := range expiredDocs {
+		released, err := repo.ReleaseExpiredIP(ctx, doc.ID, now)
+		if err != nil || !released {
+			t.Fatalf("ReleaseExpiredIP(%s) = %v, %v", doc.IPAddress, released, err)
+		}
+	}
+	released, err = repo.ReleaseExpiredIP(ctx, expiredDocs[0].ID, now)
+	if err != nil || released {
+		t.Fatalf("ReleaseExpiredIP twice = %v, %v", released, err)
+	}
+
+	remaining, _ := repo.FindIPs(ctx, storage.IPFilter{Tenant: "t1"})
+	expectIPs(t, "FindIPs after release", remaining, "10.0.0.2", "10.0.0.3", "10.0.0.4")
+}
+
+func testRenewSkipsPermanentIPs(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	live := now.Add(time.Minute)
+	leased := newIP("t1", "s1", "10.0.0.1")
+	leased.ExpiresAt = &live
+	permanent := newIP("t1", "s1", "10.0.0.2")
+	mustInsert(t, repo, leased, permanent)
+
+	renewTo := now.Add(time.Hour)
+	renewed, err := repo.RenewLeases(ctx, storage.IPFilter{Tenant: "t1", IPAddresses: []string{"10.0.0.2"}}, renewTo, now)
+	if err != nil || renewed != 0 {
+		t.Fatalf("RenewLeases of a permanent IP = %d, %v, want 0", renewed, err)
+	}
+	renewed, err = repo.RenewLeases(ctx, storage.IPFilter{Tenant: "t1"}, renewTo, now)
+	if err != nil || renewed != 1 {
+		t.Fatalf("RenewLeases = %d, %v, want only the lease", renewed, err)
+	}
+
+	docs, _ := repo.FindIPs(ctx, storage.IPFilter{Tenant: "t1", IPAddresses: []string{"10.0.0.2"}})
+	if len(docs) != 1 || docs[0].ExpiresAt != nil {
+		t.Fatalf("permanent IP after RenewLeases = %+v, want no expiry", docs)
+	}
+
+	// Still permanent, so no reaper pass ever releases it
+	expired, _ := repo.FindExpiredIPs(ctx, renewTo.Add(time.Hour), 10)
+	expectIPs(t, "FindExpiredIPs after the renewed lease ran out", expired, "10.0.0.1")
+}
+
+func testCountByOwner(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	var docs []models.IPAllocation
+	for i, owner := range []string{"bob", "alice", "bob", "", "bob"} {
+		doc := newIP("t1", "s1", fmt.Sprintf("10.0.0.%d", i))
+		doc.Owner = owner
+		docs = append(docs, doc)
+	}
+	other := newIP("t2", "s1", "10.0.0.1")
+	other.Owner = "alice"
+	mustInsert(t, repo, append(docs, other)...)
+
+	counts, err := repo.CountIPsByOwner(ctx, "t1")
+	if err != nil {
+		t.Fatalf("CountIPsByOwner: %v", err)
+	}
+	if fmt.Sprint(counts) != "[{alice 1} {bob 3}]" {
+		t.Fatalf("CountIPsByOwner = %v", counts)
+	}
+	counts, _ = repo.CountIPsByOwner(ctx, "t3")
+	if len(counts) != 0 {
+		t.Fatalf("CountIPsByOwner of an empty tenant = %v", counts)
+	}
+}
+
+func testTenants(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	tenant := models.Tenant{Name: "acme", Description: "first", CreatedAt: now, UpdatedAt: now}
+	if err := repo.CreateTenant(ctx, &tenant); err != nil {
+		t.Fatalf("CreateTenant: %v", err)
+	}
+	if tenant.ID.IsZero() {
+		t.Fatal("CreateTenant did not assign an ID")
+	}
+	duplicate := models.Tenant{Name: "acme", CreatedAt: now, UpdatedAt: now}
+	expectErr(t, "CreateTenant duplicate", repo.CreateTenant(ctx, &duplicate), storage.ErrDuplicate)
+
+	// EnsureTenant leaves an existing tenant alone
+	if err := repo.EnsureTenant(ctx, models.Tenant{Name: "acme", Description: "second"}); err != nil {
+		t.Fatalf("EnsureTenant existing: %v", err)
+	}
+	if err := repo.EnsureTenant(ctx, models.Tenant{Name: "beta", CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatalf("EnsureTenant new: %v", err)
+	}
+
+	tenants, err := repo.ListTenants(ctx)
+	if err != nil {
+		t.Fatalf("ListTenants: %v", err)
+	}
+	if len(tenants) != 2 || tenants[0].Name != "acme" || tenants[0].Description != "first" || tenants[1].Name != "beta" {
+		t.Fatalf("ListTenants = %+v", tenants)
+	}
+
+	later := now.Add(time.Minute)
+	before, err := repo.UpdateTenant(ctx, "acme", "updated", later)
+	if err != nil {
+		t.Fatalf("UpdateTenant: %v", err)
+	}
+	if before.Description != "first" {
+		t.Fatalf("UpdateTenant returned %+v, want the tenant before the change", before)
+	}
+	got, err := repo.GetTenant(ctx, "acme")
+	if err != nil {
+		t.Fatalf("GetTenant: %v", err)
+	}
+	if got.ID != tenant.ID || got.Description != "updated" || !got.UpdatedAt.Equal(later) || !got.CreatedAt.Equal(now) {
+		t.Fatalf("UpdateTenant stored %+v", got)
+	}
+	_, err = repo.UpdateTenant(ctx, "missing", "", later)
+	expectErr(t, "UpdateTenant missing", err, storage.ErrNotFound)
+
+	deleted, err := repo.DeleteTenant(ctx, "acme")
+	if err != nil {
+		t.Fatalf("DeleteTenant: %v", err)
+	}
+	if deleted.ID != tenant.ID {
+		t.Fatalf("DeleteTenant returned %+v", deleted)
+	}
+	_, err = repo.GetTenant(ctx, "acme")
+	expectErr(t, "GetTenant deleted", err, storage.ErrNotFound)
+	_, err = repo.DeleteTenant(ctx, "acme")
+	expectErr(t, "DeleteTenant twice", err, storage.ErrNotFound)
+}
+
+func newAPIKey(name, tenant string, createdAt time.Time) models.APIKey {
+	return models.APIKey{
+		Name:      name,
+		Prefix:    "ipa_" + name,
+		KeyHash:   "hash-" + name,
+		Role:      models.RoleAdmin,
+		Tenant:    tenant,
+		CreatedBy: "test",
+		CreatedAt: createdAt,
+	}
+}
+
+func testAPIKeys(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	first := newAPIKey("first", "t1", now)
+	second := newAPIKey("second", "t2", now.Add(time.Second))
+	third := newAPIKey("third", "t1", now.Add(2*time.Second))
+	for _, key := range []*models.APIKey{&third, &first, &second} {
+		if err := repo.CreateAPIKey(ctx, key); err != nil {
+			t.Fatalf("CreateAPIKey(%s): %v", key.Name, err)
+		}
+	}
+	sameName := newAPIKey("first", "t1", now)
+	sameName.KeyHash = "other"
+	expectErr(t, "CreateAPIKey duplicate name", repo.CreateAPIKey(ctx, &sameName), storage.ErrDuplicate)
+	sameHash := newAPIKey("fourth", "t1", now)
+	sameHash.KeyHash = first.KeyHash
+	expectErr(t, "CreateAPIKey duplicate hash", repo.CreateAPIKey(ctx, &sameHash), storage.ErrDuplicate)
+
+	names := func(keys []models.APIKey) string {
+		var out []string
+		for _, key := range keys {
+			out = append(out, key.Name)
+		}
+		return fmt.Sprint(out)
+	}
+	keys, err := repo.ListAPIKeys(ctx, "")
+	if err != nil {
+		t.Fatalf("ListAPIKeys: %v", err)
+	}
+	if names(keys) != "[first second third]" {
+		t.Fatalf("ListAPIKeys = %s, want oldest first", names(keys))
+	}
+	keys, _ = repo.ListAPIKeys(ctx, "t1")
+	if names(keys) != "[first third]" {
+		t.Fatalf("ListAPIKeys(t1) = %s", names(keys))
+	}
+
+	key, err := repo.FindAPIKeyByHash(ctx, "hash-second")
+	if err != nil {
+		t.Fatalf("FindAPIKeyByHash: %v", err)
+	}
+	if key.ID != second.ID || key.LastUsedAt != nil {
+		t.Fatalf("FindAPIKeyByHash returned %+v", key)
+	}
+	_, err = repo.FindAPIKeyByHash(ctx, "unknown")
+	expectErr(t, "FindAPIKeyByHash unknown", err, storage.ErrNotFound)
+
+	usedAt := now.Add(time.Hour)
+	if err := repo.TouchAPIKey(ctx, second.ID, usedAt); err != nil {
+		t.Fatalf("TouchAPIKey: %v", err)
+	}
+	key, _ = repo.FindAPIKeyByHash(ctx, "hash-second")
+	if key.LastUsedAt == nil || !key.LastUsedAt.Equal(usedAt) {
+		t.Fatalf("TouchAPIKey stored last_used_at %v", key.LastUsedAt)
+	}
+
+	// Upserting replaces the secret and scope but keeps the identity and history
+	expires := now.Add(48 * time.Hour)
+	replacement := newAPIKey("second", "", now.Add(time.Hour))
+	replacement.KeyHash = "rotated"
+	replacement.CreatedBy = "someone else"
+	replacement.Region = "r1"
+	replacement.ExpiresAt = &expires
+	if err := repo.UpsertAPIKey(ctx, replacement); err != nil {
+		t.Fatalf("UpsertAPIKey existing: %v", err)
+	}
+	_, err = repo.FindAPIKeyByHash(ctx, "hash-second")
+	expectErr(t, "FindAPIKeyByHash replaced hash", err, storage.ErrNotFound)
+	key, err = repo.FindAPIKeyByHash(ctx, "rotated")
+	if err != nil {
+		t.Fatalf("FindAPIKeyByHash rotated: %v", err)
+	}
+	if key.ID != second.ID || key.CreatedBy != "test" || !key.CreatedAt.Equal(second.CreatedAt) ||
+		key.LastUsedAt == nil || key.Tenant != "" || key.Region != "r1" || key.ExpiresAt == nil || !key.ExpiresAt.Equal(expires) {
+		t.Fatalf("UpsertAPIKey stored %+v", key)
+	}
+	if err := repo.UpsertAPIKey(ctx, newAPIKey("fresh", "", now)); err != nil {
+		t.Fatalf("UpsertAPIKey new: %v", err)
+	}
+	if key, err := repo.FindAPIKeyByHash(ctx, "hash-fresh"); err != nil || key.ID.IsZero() {
+		t.Fatalf("UpsertAPIKey new stored %+v, %v", key, err)
+	}
+
+	_, err = repo.DeleteAPIKey(ctx, first.ID, "t2")
+	expectErr(t, "DeleteAPIKey of another tenant", err, storage.ErrNotFound)
+	deleted, err := repo.DeleteAPIKey(ctx, first.ID, "t1")
+	if err != nil {
+		t.Fatalf("DeleteAPIKey: %v", err)
+	}
+	if deleted.Name != "first" {
+		t.Fatalf("DeleteAPIKey returned %+v", deleted)
+	}
+	_, err = repo.DeleteAPIKey(ctx, first.ID, "")
+	expectErr(t, "DeleteAPIKey twice", err, storage.ErrNotFound)
+
+	revoked, err := repo.DeleteTenantAPIKeys(ctx, "t1")
+	if err != nil {
+		t.Fatalf("DeleteTenantAPIKeys: %v", err)
+	}
+	if revoked != 1 {
+		t.Fatalf("DeleteTenantAPIKeys removed %d keys, want 1", revoked)
+	}
+	keys, _ = repo.ListAPIKeys(ctx, "")
+	if names(keys) != "[fresh second]" && names(keys) != "[second fresh]" {
+		t.Fatalf("ListAPIKeys after revocation = %s", names(keys))
+	}
+}
+
+func newAuditEvent(tenant, path string, at time.Time, ips ...string) *models.AuditEvent {
+	return &models.AuditEvent{
+		Timestamp:    at,
+		Tenant:       tenant,
+		Action:       models.AuditActionCreate,
+		ResourceType: models.AuditResourceIP,
+		ResourcePath: path,
+		IPAddresses:  ips,
+		Actor:        "alice",
+		After:        map[string]interface{}{"path": path},
+		Outcome:      models.AuditOutcomeSuccess,
+	}
+}
+
+func testAuditTrail(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	events := []*models.AuditEvent{
+		newAuditEvent("t1", "regions/eu", now, "10.0.0.1"),
+		newAuditEvent("t1", "regions/eu/zones/a", now.Add(time.Second), "10.0.0.2"),
+		newAuditEvent("t1", "regions/europe", now.Add(2*time.Second)),
+		newAuditEvent("t1", "regions/eu/zones/b", now.Add(3*time.Second), "10.0.0.1"),
+		newAuditEvent("t2", "regions/eu", now.Add(4*time.Second), "10.0.0.1"),
+	}
+	events[3].Actor = "bob"
+	events[3].Outcome = models.AuditOutcomeRejected
+	for _, event := range events {
+		if err := repo.InsertAuditEvent(ctx, event); err != nil {
+			t.Fatalf("InsertAuditEvent: %v", err)
+		}
+		if event.ID.IsZero() {
+			t.Fatal("InsertAuditEvent did not assign an ID")
+		}
+	}
+
+	find := func(filter storage.AuditFilter) string {
+		t.Helper()
+		raws, err := repo.FindAuditEvents(ctx, filter)
+		if err != nil {
+			t.Fatalf("FindAuditEvents(%+v): %v", filter, err)
+		}
+		var paths []string
+		for _, raw := range raws {
+			var event models.AuditEvent
+			if err := bson.Unmarshal(raw, &event); err != nil {
+				t.Fatalf("decoding audit event: %v", err)
+			}
+			paths = append(paths, event.ResourcePath)
+		}
+		return fmt.Sprint(paths)
+	}
+
+	cases := []struct {
+		filter storage.AuditFilter
+		want   string
+	}{
+		{storage.AuditFilter{Tenant: "t1"}, "[regions/eu/zones/b regions/europe regions/eu/zones/a regions/eu]"},
+		{storage.AuditFilter{Tenant: "t1", ResourcePath: "regions/eu"}, "[regions/eu/zones/b regions/eu/zones/a regions/eu]"},
+		{storage.AuditFilter{Tenant: "t1", IPAddress: "10.0.0.1"}, "[regions/eu/zones/b regions/eu]"},
+		{storage.AuditFilter{Tenant: "t1", Actor: "bob"}, "[regions/eu/zones/b]"},
+		{storage.AuditFilter{Tenant: "t1", Outcome: models.AuditOutcomeSuccess, ResourceType: models.AuditResourceIP}, "[regions/europe regions/eu/zones/a regions/eu]"},
+		{storage.AuditFilter{Tenant: "t1", Since: now.Add(time.Second), Until: now.Add(2 * time.Second)}, "[regions/europe regions/eu/zones/a]"},
+		{storage.AuditFilter{Tenant: "t1", Limit: 2}, "[regions/eu/zones/b regions/europe]"},
+		{storage.AuditFilter{Tenant: "t3"}, "[]"},
+	}
+	for _, c := range cases {
+		if got := find(c.filter); got != c.want {
+			t.Errorf("FindAuditEvents(%+v) = %s, want %s", c.filter, got, c.want)
+		}
+	}
+
+	// The snapshots come back as stored
+	raws, _ := repo.FindAuditEvents(ctx, storage.AuditFilter{Tenant: "t2"})
+	if len(raws) != 1 || raws[0].Lookup("after", "path").StringValue() != "regions/eu" {
+		t.Fatalf("FindAuditEvents(t2) = %v", raws)
+	}
+}
+
+func testIdempotency(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+
+	record := models.IdempotencyRecord{
+		Key:         "k1",
+		Operation:   "allocate",
+		RequestHash: "h1",
+		State:       models.IdempotencyStatePending,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(time.Hour),
+	}
+	if err := repo.InsertIdempotencyRecord(ctx, &record); err != nil {
+		t.Fatalf("InsertIdempotencyRecord: %v", err)
+	}
+	again := record
+	again.ID = primitive.NilObjectID
+	expectErr(t, "InsertIdempotencyRecord duplicate", repo.InsertIdempotencyRecord(ctx, &again), storage.ErrDuplicate)
+	other := record
+	other.ID = primitive.NilObjectID
+	other.Operation = "reserve"
+	if err := repo.InsertIdempotencyRecord(ctx, &other); err != nil {
+		t.Fatalf("InsertIdempotencyRecord other operation: %v", err)
+	}
+
+	if err := repo.CompleteIdempotencyRecord(ctx, "k1", "allocate", 201, "application/json", []byte(`{"ok":true}`)); err != nil {
+		t.Fatalf("CompleteIdempotencyRecord: %v", err)
+	}
+	stored, err := repo.GetIdempotencyRecord(ctx, "k1", "allocate")
+	if err != nil {
+		t.Fatalf("GetIdempotencyRecord: %v", err)
+	}
+	if stored.ID != record.ID || stored.State != models.IdempotencyStateCompleted || stored.StatusCode != 201 ||
+		stored.ContentType != "application/json" || string(stored.Body) != `{"ok":true}` {
+		t.Fatalf("CompleteIdempotencyRecord stored %+v", stored)
+	}
+	_, err = repo.GetIdempotencyRecord(ctx, "k2", "allocate")
+	expectErr(t, "GetIdempotencyRecord missing", err, storage.ErrNotFound)
+
+	// Only pending records are released
+	if err := repo.ReleaseIdempotencyRecord(ctx, "k1", "allocate"); err != nil {
+		t.Fatalf("ReleaseIdempotencyRecord completed: %v", err)
+	}
+	if _, err := repo.GetIdempotencyRecord(ctx, "k1", "allocate"); err != nil {
+		t.Fatalf("ReleaseIdempotencyRecord removed a completed record: %v", err)
+	}
+
+	claim := models.IdempotencyRecord{
+		RequestHash: "h2",
+		State:       models.IdempotencyStatePending,
+		CreatedAt:   now.Add(2 * time.Hour),
+		ExpiresAt:   now.Add(3 * time.Hour),
+	}
+	reclaimed, err := repo.ReclaimIdempotencyRecord(ctx, stored, claim)
+	if err != nil || !reclaimed {
+		t.Fatalf("ReclaimIdempotencyRecord = %v, %v", reclaimed, err)
+	}
+	reclaimed, err = repo.ReclaimIdempotencyRecord(ctx, stored, claim)
+	if err != nil || reclaimed {
+		t.Fatalf("ReclaimIdempotencyRecord of a changed record = %v, %v", reclaimed, err)
+	}
+	stored, _ = repo.GetIdempotencyRecord(ctx, "k1", "allocate")
+	if stored.RequestHash != "h2" || stored.State != models.IdempotencyStatePending || stored.StatusCode != 0 ||
+		stored.Body != nil || !stored.CreatedAt.Equal(claim.CreatedAt) || !stored.ExpiresAt.Equal(claim.ExpiresAt) {
+		t.Fatalf("ReclaimIdempotencyRecord stored %+v", stored)
+	}
+
+	if err := repo.ReleaseIdempotencyRecord(ctx, "k1", "allocate"); err != nil {
+		t.Fatalf("ReleaseIdempotencyRecord: %v", err)
+	}
+	_, err = repo.GetIdempotencyRecord(ctx, "k1", "allocate")
+	expectErr(t, "GetIdempotencyRecord released", err, storage.ErrNotFound)
+}
+
+func testAllocationCursors(t *testing.T, repo storage.Repository) {
+	ctx := context.Background()
+	s1 := storage.IPLocation{Region: "r1", Zone: "z1", SubZone: "s1"}
+
+	_, err := repo.GetAllocationCursor(ctx, "t1", s1)
+	expectErr(t, "GetAllocationCursor missing", err, storage.ErrNotFound)
+
+	if err := repo.AdvanceAllocationCursor(ctx, "t1", s1, "ipv4", "10.0.0.5", now); err != nil {
+		t.Fatalf("AdvanceAllocationCursor: %v", err)
+	}
+	if err := repo.AdvanceAllocationCursor(ctx, "t1", s1, "ipv6", "fd00::5", now); err != nil {
+		t.Fatalf("AdvanceAllocationCursor ipv6: %v", err)
+	}
+	if err := repo.AdvanceAllocationCursor(ctx, "t1", s1, "ipv4", "10.0.0.6", now); err != nil {
+		t.Fatalf("AdvanceAllocationCursor again: %v", err)
+	}
+	cursor, err := repo.GetAllocationCursor(ctx, "t1", s1)
+	if err != nil {
+		t.Fatalf("GetAllocationCursor: %v", err)
+	}
+	if cursor.LastIPv4 != "10.0.0.6" || cursor.LastIPv6 != "fd00::5" || cursor.SubZone != "s1" {
+		t.Fatalf("AdvanceAllocationCursor stored %+v", cursor)
+	}
+	_, err = repo.GetAllocationCursor(ctx, "t2", s1)
+	expectErr(t, "GetAllocationCursor of another tenant", err, storage.ErrNotFound)
+
+	// Only the newest entries are kept, oldest first
+	for i := 1; i <= 4; i++ {
+		released := []models.ReleasedIP{{IPAddress: fmt.Sprintf("10.0.0.%d", i), ReleasedAt: now.Add(time.Duration(i) * time.Second)}}
+		if err := repo.RecordReleasedIPs(ctx, "t1", s1, released, 3); err != nil {
+			t.Fatalf("RecordReleasedIPs: %v", err)
+		}
+	}
+	cursor, _ = repo.GetAllocationCursor(ctx, "t1", s1)
+	var released []string
+	for _, entry := range cursor.Released {
+		released = append(released, entry.IPAddress)
+	}
+	if fmt.Sprint(released) != "[10.0.0.2 10.0.0.3 10.0.0.4]" || cursor.LastIPv4 != "10.0.0.6" {
+		t.Fatalf("RecordReleasedIPs stored %+v", cursor)
+	}
+
+	s2 := storage.IPLocation{Region: "r1", Zone: "z1", SubZone: "s2"}
+	if err := repo.RecordReleasedIPs(ctx, "t1", s2, []models.ReleasedIP{{IPAddress: "10.0.1.1", ReleasedAt: now}}, 3); err != nil {
+		t.Fatalf("RecordReleasedIPs s2: %v", err)
+	}
+	expectErr(t, "MoveAllocationCursors onto an existing cursor",
+		repo.MoveAllocationCursors(ctx, storage.IPFilter{Tenant: "t1", Region: "r1", Zone: "z1", SubZone: "s1"}, storage.IPLocation{SubZone: "s2"}),
+		storage.ErrDuplicate)
+	if err := repo.MoveAllocationCursors(ctx, storage.IPFilter{Tenant: "t1", Region: "r1"}, storage.IPLocation{Zone: "z9"}); err != nil {
+		t.Fatalf("MoveAllocationCursors: %v", err)
+	}
+	_, err = repo.GetAllocationCursor(ctx, "t1", s1)
+	expectErr(t, "GetAllocationCursor after moving", err, storage.ErrNotFound)
+	moved := storage.IPLocation{Region: "r1", Zone: "z9", SubZone: "s1"}
+	if cursor, err := repo.GetAllocationCursor(ctx, "t1", moved); err != nil || cursor.LastIPv4 != "10.0.0.6" {
+		t.Fatalf("GetAllocationCursor moved = %+v, %v", cursor, err)
+	}
+
+	if err := repo.DeleteAllocationCursors(ctx, storage.IPFilter{Tenant: "t1", Region: "r1", Zone: "z9", SubZone: "s1"}); err != nil {
+		t.Fatalf("DeleteAllocationCursors: %v", err)
+	}
+	_, err = repo.GetAllocationCursor(ctx, "t1", moved)
+	expectErr(t, "GetAllocationCursor deleted", err, storage.ErrNotFound)
+	if _, err := repo.GetAllocationCursor(ctx, "t1", storage.IPLocation{Region: "r1", Zone: "z9", SubZone: "s2"}); err != nil {
+		t.Fatalf("DeleteAllocationCursors removed another sub-zone: %v", err)
+	}
+}
+
+// RunDurable checks that a repository kept in a directory comes back with every write after
+// it is closed and opened again. open must return a repository that implements io.Closer.
+func RunDurable(t *testing.T, open func(t *testing.T, dir string) storage.Repository) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	reopen := func(repo storage.Repository) storage.Repository {
+		t.Helper()
+		closer, ok := repo.(io.Closer)
+		if !ok {
+			t.Fatalf("%T does not implement io.Closer", repo)
+		}
+		if err := closer.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+		return open(t, dir)
+	}
+
+	repo := open(t, dir)
+	region := mustCreateRegion(t, repo, newRegion("t1", "r1"))
+	if err := repo.AddZone(ctx, "t1", "r1", models.Zone{Name: "z1", UpdatedAt: now}, time.Time{}); err != nil {
+		t.Fatalf("AddZone: %v", err)
+	}
+	mustCreateRegion(t, repo, newRegion("t1", "gone"))
+	if _, err := repo.DeleteRegion(ctx, "t1", "gone"); err != nil {
+		t.Fatalf("DeleteRegion: %v", err)
+	}
+	mustInsert(t, repo, newIP("t1", "s1", "10.0.0.1"), newIP("t1", "s1", "10.0.0.2"))
+	if _, err := repo.MoveIPs(ctx, storage.IPFilter{IPAddresses: []string{"10.0.0.2"}}, storage.IPLocation{SubZone: "s2"}); err != nil {
+		t.Fatalf("MoveIPs: %v", err)
+	}
+	tenant := models.Tenant{Name: "t1", CreatedAt: now, UpdatedAt: now}
+	if err := repo.CreateTenant(ctx, &tenant); err != nil {
+		t.Fatalf("CreateTenant: %v", err)
+	}
+	key := newAPIKey("k1", "t1", now)
+	if err := repo.CreateAPIKey(ctx, &key); err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	if err := repo.InsertAuditEvent(ctx, newAuditEvent("t1", "regions/r1", now)); err != nil {
+		t.Fatalf("InsertAuditEvent: %v", err)
+	}
+	s1 := storage.IPLocation{Region: "r1", Zone: "z1", SubZone: "s1"}
+	if err := repo.AdvanceAllocationCursor(ctx, "t1", s1, "ipv4", "10.0.0.2", now); err != nil {
+		t.Fatalf("AdvanceAllocationCursor: %v", err)
+	}
+
+	repo = reopen(repo)
+	got, err := repo.GetRegion(ctx, "t1", "r1")
+	if err != nil {
+		t.Fatalf("GetRegion after reopening: %v", err)
+	}
+	if got.ID != region.ID || len(got.Zones) != 1 || got.Zones[0].Name != "z1" {
+		t.Fatalf("GetRegion after reopening = %+v", got)
+	}
+	_, err = repo.GetRegion(ctx, "t1", "gone")
+	expectErr(t, "GetRegion deleted after reopening", err, storage.ErrNotFound)
+	docs, _ := repo.FindIPs(ctx, storage.IPFilter{SubZone: "s2"})
+	expectIPs(t, "FindIPs after reopening", docs, "10.0.0.2")
+	if _, err := repo.GetTenant(ctx, "t1"); err != nil {
+		t.Fatalf("GetTenant after reopening: %v", err)
+	}
+	if _, err := repo.FindAPIKeyByHash(ctx, key.KeyHash); err != nil {
+		t.Fatalf("FindAPIKeyByHash after reopening: %v", err)
+	}
+	raws, _ := repo.FindAuditEvents(ctx, storage.AuditFilter{Tenant: "t1"})
+	if len(raws) != 1 {
+		t.Fatalf("FindAuditEvents after reopening returned %d events, want 1", len(raws))
+	}
+	if cursor, err := repo.GetAllocationCursor(ctx, "t1", s1); err != nil || cursor.LastIPv4 != "10.0.0.2" {
+		t.Fatalf("GetAllocationCursor after reopening = %+v, %v", cursor, err)
+	}
+
+	// The unique indexes are rebuilt too
+	expectErr(t, "InsertIPs duplicate after reopening",
+		repo.InsertIPs(ctx, []models.IPAllocation{newIP("t1", "s2", "10.0.0.2")}), storage.ErrDuplicate)
+	mustInsert(t, repo, newIP("t1", "s1", "10.0.0.2"))
+	if _, err := repo.DeleteIPs(ctx, storage.IPFilter{IPAddresses: []string{"10.0.0.1"}}); err != nil {
+		t.Fatalf("DeleteIPs: %v", err)
+	}
+
+	repo = reopen(repo)
+	docs, _ = repo.FindIPs(ctx, storage.IPFilter{Tenant: "t1"})
+	expectIPs(t, "FindIPs after reopening twice", docs, "10.0.0.2", "10.0.0.2")
+	reopen(repo).(io.Closer).Close()
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
@@ -69,6 +70,16 @@ func getLastIPInNetwork(network *net.IPNet) net.IP {
 	return lastIP
 }
 
+// ParseIPRange returns the first and last address of a range given as start-end, as a CIDR or
+// as a single IP
+func ParseIPRange(ipRange string) (string, string, error) {
+	r, err := parseAddrRange(ipRange)
+	if err != nil {
+		return "", "", err
+	}
+	return r.first.String(), r.last.String(), nil
+}
+
 // ValidateIPRangeInCIDRString validates if a range of IPs is within CIDR
 func ValidateIPRangeInCIDRString(startIP, endIP, cidr string) error {
 	_, network, err := net.ParseCIDR(cidr)
@@ -194,3 +205,87 @@ func ValidateSubZoneCIDRHierarchy(zoneIPv4, zoneIPv6, subZoneIPv4, subZoneIPv6 s
 
 	return nil
 }
+
+// ErrNoFreeSubnet is returned by FindFreeSubnet when every block of the prefix length overlaps
+// a used CIDR
+var ErrNoFreeSubnet = errors.New("no free block")
+
+// FindFreeSubnet returns the first block of the given prefix length inside parentCIDR that does
+// not overlap any of the used CIDRs. Blocks are aligned to their own size, so the result is
+// always a valid network address. Used CIDRs of the other IP version are ignored. A full parent
+// yields an error wrapping ErrNoFreeSubnet; any other error is a bad argument or a bug.
+func FindFreeSubnet(parentCIDR string, prefixLen int, usedCIDRs []string) (string, error) {
+	_, parentNet, err := net.ParseCIDR(parentCIDR)
+	if err != nil {
+		return "", fmt.Errorf("invalid parent CIDR: %v", err)
+	}
+
+	parentOnes, bits := parentNet.Mask.Size()
+	if prefixLen < parentOnes || prefixLen > bits {
+		return "", fmt.Errorf("prefix length /%d must be between /%d and /%d for parent CIDR %s", prefixLen, parentOnes, bits, parentCIDR)
+	}
+
+	// Collect the address ranges already taken inside the parent
+	type addressRange struct{ first, last *big.Int }
+	var used []addressRange
+	for _, cidr := range usedCIDRs {
+		if cidr == "" {
+			continue
+		}
+		_, usedNet, err := net.ParseCIDR(cidr)
+		if err != nil || len(usedNet.IP) != len(parentNet.IP) {
+			continue
+		}
+		used = append(used, addressRange{
+			first: new(big.Int).SetBytes(usedNet.IP),
+			last:  new(big.Int).SetBytes(getLastIPInNetwork(usedNet)),
+		})
+	}
+
+	blockSize := new(big.Int).Lsh(big.NewInt(1), uint(bits-prefixLen))
+	parentEnd := new(big.Int).SetBytes(getLastIPInNetwork(parentNet))
+	candidate := new(big.Int).SetBytes(parentNet.IP)
+
+	for {
+		candidateLast := new(big.Int).Add(candidate, blockSize)
+		candidateLast.Sub(candidateLast, big.NewInt(1))
+		if candidateLast.Cmp(parentEnd) > 0 {
+			return "", fmt.Errorf("%w of /%d in %s", ErrNoFreeSubnet, prefixLen, parentCIDR)
+		}
+
+		// Skip past the furthest used range that overlaps the candidate block
+		var skipTo *big.Int
+		for _, r := range used {
+			if r.first.Cmp(candidateLast) <= 0 && r.last.Cmp(candidate) >= 0 {
+				if skipTo == nil || r.last.Cmp(skipTo) > 0 {
+					skipTo = r.last
+				}
+			}
+		}
+
+		if skipTo == nil {
+			ip := make(net.IP, len(parentNet.IP))
+			candidate.FillBytes(ip)
+			subnet := fmt.Sprintf("%s/%d", ip.String(), prefixLen)
+
+			// Double check the result with the same rules used when CIDRs are created by hand
+			if err := ValidateCIDRHierarchy(parentCIDR, subnet); err != nil {
+				return "", err
+			}
+			for _, cidr := range usedCIDRs {
+				if overlap, err := CheckCIDROverlap(subnet, cidr); err == nil && overlap {
+					return "", fmt.Errorf("computed subnet %s overlaps %s", subnet, cidr)
+				}
+			}
+			return subnet, nil
+		}
+
+		// Next aligned block after the overlapping range
+		next := new(big.Int).Add(skipTo, big.NewInt(1))
+		remainder := new(big.Int).Mod(next, blockSize)
+		if remainder.Sign() != 0 {
+			next.Add(next, new(big.Int).Sub(blockSize, remainder))
+		}
+		candidate = next
+	}
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+// errBadArgument marks test cases expecting an error that is not ErrNoFreeSubnet
+var errBadArgument = errors.New("bad argument")
+
+func TestFindFreeSubnet(t *testing.T) {
+	tests := []struct {
+		name      string
+		parent    string
+		prefixLen int
+		used      []string
+		want      string
+		// wantErr is ErrNoFreeSubnet for a full parent or errBadArgument for any other error
+		wantErr error
+	}{
+		{name: "empty parent", parent: "10.0.0.0/16", prefixLen: 24, want: "10.0.0.0/24"},
+		{name: "whole parent", parent: "10.0.0.0/16", prefixLen: 16, want: "10.0.0.0/16"},
+		{name: "after a used block", parent: "10.0.0.0/16", prefixLen: 24, used: []string{"10.0.0.0/24"}, want: "10.0.1.0/24"},
+		{name: "aligned past a smaller block", parent: "10.0.0.0/16", prefixLen: 24, used: []string{"10.0.0.0/25"}, want: "10.0.1.0/24"},
+		{name: "aligned past a misaligned end", parent: "10.0.0.0/16", prefixLen: 22, used: []string{"10.0.0.0/24", "10.0.4.0/23", "10.0.1.0/24"}, want: "10.0.8.0/22"},
+		{name: "gap between used blocks", parent: "10.0.0.0/16", prefixLen: 24, used: []string{"10.0.0.0/24", "10.0.2.0/24"}, want: "10.0.1.0/24"},
+		{name: "skips past the furthest overlap", parent: "10.0.0.0/16", prefixLen: 23, used: []string{"10.0.0.0/24", "10.0.0.0/22", "10.0.1.128/25"}, want: "10.0.4.0/23"},
+		{name: "unaligned parent", parent: "10.0.1.77/24", prefixLen: 26, used: []string{"10.0.1.0/26"}, want: "10.0.1.64/26"},
+		{name: "other family ignored", parent: "10.0.0.0/16", prefixLen: 24, used: []string{"fd00::/64", "bogus", ""}, want: "10.0.0.0/24"},
+		{name: "IPv6", parent: "fd00::/48", prefixLen: 64, used: []string{"fd00::/64", "fd00:0:0:1::/64", "fd00:0:0:2::/63", "10.0.0.0/8"}, want: "fd00:0:0:4::/64"},
+		{name: "full parent", parent: "10.0.0.0/23", prefixLen: 24, used: []string{"10.0.0.0/24", "10.0.1.0/25", "10.0.1.128/25"}, wantErr: ErrNoFreeSubnet},
+		{name: "covered by a wider block", parent: "10.0.0.0/16", prefixLen: 24, used: []string{"10.0.0.0/8"}, wantErr: ErrNoFreeSubnet},
+		{name: "prefix shorter than the parent", parent: "10.0.0.0/16", prefixLen: 8, wantErr: errBadArgument},
+		{name: "prefix longer than the family", parent: "10.0.0.0/16", prefixLen: 33, wantErr: errBadArgument},
+		{name: "invalid parent", parent: "10.0.0.0/99", prefixLen: 24, wantErr: errBadArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FindFreeSubnet(tt.parent, tt.prefixLen, tt.used)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("FindFreeSubnet: %v", err)
+			case tt.wantErr == ErrNoFreeSubnet && !errors.Is(err, ErrNoFreeSubnet):
+				t.Fatalf("FindFreeSubnet = %q, %v, want ErrNoFreeSubnet", got, err)
+			case tt.wantErr == errBadArgument && (err == nil || errors.Is(err, ErrNoFreeSubnet)):
+				t.Fatalf("FindFreeSubnet = %q, %v, want an error other than ErrNoFreeSubnet", got, err)
+			case got != tt.want:
+				t.Fatalf("FindFreeSubnet = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
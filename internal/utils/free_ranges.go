@@ -0,0 +1,558 @@
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// FreeRangeIndex tracks the unused addresses of a CIDR as disjoint free intervals held in a
+// balanced tree, so its size follows the number of used addresses rather than the size of the
+// range. Building it sorts the u used addresses, O(u log u). For n free intervals, Next, IsFree,
+// Take, Release and TakeRandom are O(log n); Exclude rewrites the intervals in one
+// O(n + k log k) pass for k ranges. The free count is kept in the tree nodes.
+//
+// An index is meant to outlive a request: the allocation service keeps one per sub-zone and
+// family, takes and releases addresses on it as it writes and deletes documents, and only
+// builds it again when the sub-zone changed behind its back.
+type FreeRangeIndex struct {
+	prefix netip.Prefix
+	first  netip.Addr // first usable address
+	last   netip.Addr // last usable address
+	ranges rangeTree
+}
+
+// addrRange is an inclusive interval of addresses
+type addrRange struct {
+	first netip.Addr
+	last  netip.Addr
+}
+
+// FreeBlock is a run of consecutive free addresses
+type FreeBlock struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Size  string `json:"size"`
+}
+
+// NewFreeRangeIndex builds the free intervals of cidr given the addresses already in use. Like
+// GetNextAvailableIP, the IPv4 network and broadcast addresses and the IPv6 subnet-router
+// address are never free. Used addresses outside the CIDR or of the other version are ignored.
+func NewFreeRangeIndex(cidr string, used ...[]string) (*FreeRangeIndex, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR: %v", err)
+	}
+	prefix = prefix.Masked()
+
+	idx := &FreeRangeIndex{
+		prefix: prefix,
+		first:  prefix.Addr(),
+		last:   lastAddrInPrefix(prefix),
+	}
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if prefix.Addr().Is4() && hostBits > 1 {
+		idx.first = idx.first.Next()
+		idx.last = idx.last.Prev()
+	} else if prefix.Addr().Is6() && hostBits > 0 {
+		idx.first = idx.first.Next()
+	}
+
+	// Sort and de-duplicate the used addresses inside the usable range
+	var taken []netip.Addr
+	for _, list := range used {
+		for _, ipStr := range list {
+			if addr, ok := idx.parse(ipStr); ok {
+				taken = append(taken, addr)
+			}
+		}
+	}
+	sort.Slice(taken, func(i, j int) bool { return taken[i].Less(taken[j]) })
+
+	// Insert the gaps between used addresses as free intervals in one pass
+	next := idx.first
+	exhausted := false
+	for i, addr := range taken {
+		if i > 0 && addr == taken[i-1] {
+			continue
+		}
+		if next.Less(addr) {
+			idx.ranges.insert(addrRange{first: next, last: addr.Prev()})
+		}
+		if addr == idx.last {
+			exhausted = true
+			break
+		}
+		next = addr.Next()
+	}
+	if !exhausted && !idx.last.Less(next) {
+		idx.ranges.insert(addrRange{first: next, last: idx.last})
+	}
+
+	return idx, nil
+}
+
+// Exclude removes the ranges, in any form ParseIPRange accepts, from the free addresses.
+// Addresses outside the usable range or of the other version are ignored. The ranges are
+// merged first, so the free intervals are rewritten in a single pass.
+func (idx *FreeRangeIndex) Exclude(ranges []string) error {
+	excluded := make([]addrRange, 0, len(ranges))
+	for _, s := range ranges {
+		ex, err := parseAddrRange(s)
+		if err != nil {
+			return err
+		}
+		if ex.first.Is4() != idx.first.Is4() {
+			continue
+		}
+		if ex.first.Less(idx.first) {
+			ex.first = idx.first
+		}
+		if idx.last.Less(ex.last) {
+			ex.last = idx.last
+		}
+		if !ex.last.Less(ex.first) {
+			excluded = append(excluded, ex)
+		}
+	}
+	if len(excluded) == 0 {
+		return nil
+	}
+
+	// Sort and coalesce the excluded ranges so they are disjoint
+	sort.Slice(excluded, func(i, j int) bool { return excluded[i].first.Less(excluded[j].first) })
+	merged := excluded[:1]
+	for _, ex := range excluded[1:] {
+		last := &merged[len(merged)-1]
+		if !last.last.Less(ex.first) || last.last.Next() == ex.first {
+			if last.last.Less(ex.last) {
+				last.last = ex.last
+			}
+			continue
+		}
+		merged = append(merged, ex)
+	}
+
+	// Keep the parts of every free interval between the excluded ranges
+	var kept rangeTree
+	j := 0
+	idx.ranges.ascend(netip.Addr{}, func(r addrRange) bool {
+		for j < len(merged) && merged[j].last.Less(r.first) {
+			j++
+		}
+		first, covered := r.first, false
+		for k := j; k < len(merged) && !r.last.Less(merged[k].first); k++ {
+			ex := merged[k]
+			if first.Less(ex.first) {
+				kept.insert(addrRange{first: first, last: ex.first.Prev()})
+			}
+			if !ex.last.Less(r.last) {
+				covered = true
+				break
+			}
+			first = ex.last.Next()
+		}
+		if !covered {
+			kept.insert(addrRange{first: first, last: r.last})
+		}
+		return true
+	})
+	idx.ranges = kept
+	return nil
+}
+
+// CIDR returns the range the index covers
+func (idx *FreeRangeIndex) CIDR() string {
+	return idx.prefix.String()
+}
+
+// Next returns the lowest free address
+func (idx *FreeRangeIndex) Next() (string, bool) {
+	r, ok := idx.ranges.min()
+	if !ok {
+		return "", false
+	}
+	return r.first.String(), true
+}
+
+// Usable reports whether the address is one the index covers, free or not: an address of the
+// range that is neither the IPv4 network or broadcast address nor the IPv6 subnet-router one
+func (idx *FreeRangeIndex) Usable(ipStr string) bool {
+	_, ok := idx.parse(ipStr)
+	return ok
+}
+
+// IsFree reports whether the address is free
+func (idx *FreeRangeIndex) IsFree(ipStr string) bool {
+	addr, ok := idx.parse(ipStr)
+	if !ok {
+		return false
+	}
+	r, ok := idx.ranges.ceil(addr)
+	return ok && !addr.Less(r.first)
+}
+
+// Take marks a free address as used, reporting false when it was not free
+func (idx *FreeRangeIndex) Take(ipStr string) bool {
+	addr, ok := idx.parse(ipStr)
+	if !ok {
+		return false
+	}
+	r, ok := idx.ranges.ceil(addr)
+	if !ok || addr.Less(r.first) {
+		return false
+	}
+	idx.takeSpan(r, addr, addr)
+	return true
+}
+
+// takeSpan removes the addresses from first to last, which lie within the free interval r
+func (idx *FreeRangeIndex) takeSpan(r addrRange, first, last netip.Addr) {
+	parts := make([]addrRange, 0, 2)
+	if r.first.Less(first) {
+		parts = append(parts, addrRange{first: r.first, last: first.Prev()})
+	}
+	if last.Less(r.last) {
+		parts = append(parts, addrRange{first: last.Next(), last: r.last})
+	}
+	idx.ranges.replace(r.first, parts...)
+}
+
+// TakeNext marks the lowest free address as used and returns it
+func (idx *FreeRangeIndex) TakeNext() (string, bool) {
+	r, ok := idx.ranges.min()
+	if !ok {
+		return "", false
+	}
+	idx.takeSpan(r, r.first, r.first)
+	return r.first.String(), true
+}
+
+// TakeLast marks the highest free address as used and returns it
+func (idx *FreeRangeIndex) TakeLast() (string, bool) {
+	r, ok := idx.ranges.max()
+	if !ok {
+		return "", false
+	}
+	idx.takeSpan(r, r.last, r.last)
+	return r.last.String(), true
+}
+
+// TakeNextAfter marks the lowest free address above ipStr as used and returns it, wrapping
+// around to the lowest free address at the end of the range. Without a usable ipStr it
+// behaves like TakeNext.
+func (idx *FreeRangeIndex) TakeNextAfter(ipStr string) (string, bool) {
+	if addr, ok := idx.parse(ipStr); ok && addr != idx.last {
+		next := addr.Next()
+		if r, ok := idx.ranges.ceil(next); ok {
+			pick := r.first
+			if pick.Less(next) {
+				pick = next
+			}
+			idx.takeSpan(r, pick, pick)
+			return pick.String(), true
+		}
+	}
+	return idx.TakeNext()
+}
+
+// TakeNextExcluding marks the lowest free address that is not in excluded as used and returns
+// it. Runs of excluded addresses are stepped over in one go and every free interval they cover
+// is skipped with a single lookup, so for k excluded addresses it costs O(k + k log n) at most,
+// however large the range. A nil excluded set is empty.
+func (idx *FreeRangeIndex) TakeNextExcluding(excluded *AddrSet) (string, bool) {
+	r, ok := idx.ranges.min()
+	for ok {
+		pick, found := excluded.nextOutside(r.first)
+		if found && !r.last.Less(pick) {
+			idx.takeSpan(r, pick, pick)
+			return pick.String(), true
+		}
+		if !found || r.last == idx.last {
+			break
+		}
+		// Everything left in this interval is excluded, carry on past the run
+		r, ok = idx.ranges.ceil(pick)
+	}
+	return "", false
+}
+
+// TakeRandom marks a free address picked uniformly at random as used and returns it. The pick
+// comes from crypto/rand, so earlier picks do not tell which address comes next.
+func (idx *FreeRangeIndex) TakeRandom() (string, bool) {
+	total := idx.ranges.total()
+	if total.isZero() {
+		return "", false
+	}
+
+	// crypto/rand.Reader never fails since Go 1.24
+	k, _ := rand.Int(rand.Reader, total.big())
+	r, offset := idx.ranges.at(bigUint128(k))
+	pick := r.offset(offset)
+	idx.takeSpan(r, pick, pick)
+	return pick.String(), true
+}
+
+// TakeRun marks the lowest run of size consecutive free addresses as used and returns it. With
+// a non-zero alignPrefix the run must start on a boundary of that prefix length, e.g. 8
+// addresses aligned to a /29.
+func (idx *FreeRangeIndex) TakeRun(size, alignPrefix int) ([]string, bool) {
+	bits := idx.first.BitLen()
+	if size <= 0 || alignPrefix < 0 || alignPrefix > bits {
+		return nil, false
+	}
+
+	length := big.NewInt(int64(size))
+	align := big.NewInt(1)
+	if alignPrefix > 0 {
+		align.Lsh(align, uint(bits-alignPrefix))
+	}
+	var found addrRange
+	var first, last netip.Addr
+	idx.ranges.ascend(netip.Addr{}, func(r addrRange) bool {
+		// Round the start of the interval up to the next boundary
+		start := addrInt(r.first)
+		if rem := new(big.Int).Mod(start, align); rem.Sign() != 0 {
+			start.Add(start, align).Sub(start, rem)
+		}
+		end := new(big.Int).Add(start, length)
+		end.Sub(end, big.NewInt(1))
+		if end.Cmp(addrInt(r.last)) > 0 {
+			return true
+		}
+		found, first, last = r, intAddr(start, bits), intAddr(end, bits)
+		return false
+	})
+	if !first.IsValid() {
+		return nil, false
+	}
+
+	ips := make([]string, 0, size)
+	for addr, i := first, 0; i < size; addr, i = addr.Next(), i+1 {
+		ips = append(ips, addr.String())
+	}
+	idx.takeSpan(found, first, last)
+	return ips, true
+}
+
+// LargestBlock returns the longest run of consecutive free addresses, the lowest one of equal
+// runs, reporting false when nothing is free
+func (idx *FreeRangeIndex) LargestBlock() (FreeBlock, bool) {
+	var largest addrRange
+	var largestSize uint128
+	idx.ranges.ascend(netip.Addr{}, func(r addrRange) bool {
+		if size := r.size(); largestSize.less(size) {
+			largest, largestSize = r, size
+		}
+		return true
+	})
+	if largestSize.isZero() {
+		return FreeBlock{}, false
+	}
+	return FreeBlock{
+		Start: largest.first.String(),
+		End:   largest.last.String(),
+		Size:  largestSize.big().String(),
+	}, true
+}
+
+// Release marks a used address as free again, reporting false when it was already free or
+// is not a usable address of the range
+func (idx *FreeRangeIndex) Release(ipStr string) bool {
+	addr, ok := idx.parse(ipStr)
+	if !ok {
+		return false
+	}
+
+	next, hasNext := idx.ranges.ceil(addr)
+	if hasNext && !addr.Less(next.first) {
+		return false
+	}
+	prev, hasPrev := idx.ranges.floor(addr)
+
+	// Merge with the neighbouring intervals when they are adjacent
+	joinsPrev := hasPrev && prev.last.Next() == addr
+	joinsNext := hasNext && addr.Next() == next.first
+	switch {
+	case joinsPrev && joinsNext:
+		idx.ranges.replace(next.first)
+		idx.ranges.replace(prev.first, addrRange{first: prev.first, last: next.last})
+	case joinsPrev:
+		idx.ranges.replace(prev.first, addrRange{first: prev.first, last: addr})
+	case joinsNext:
+		idx.ranges.replace(next.first, addrRange{first: addr, last: next.last})
+	default:
+		idx.ranges.insert(addrRange{first: addr, last: addr})
+	}
+	return true
+}
+
+// FreeCount returns the number of free addresses
+func (idx *FreeRangeIndex) FreeCount() *big.Int {
+	return idx.ranges.total().big()
+}
+
+// List returns up to limit free addresses in ascending order
+func (idx *FreeRangeIndex) List(limit int) []string {
+	var ips []string
+	idx.ranges.ascend(netip.Addr{}, func(r addrRange) bool {
+		for addr := r.first; len(ips) < limit; addr = addr.Next() {
+			ips = append(ips, addr.String())
+			if addr == r.last {
+				break
+			}
+		}
+		return len(ips) < limit
+	})
+	return ips
+}
+
+// Blocks returns up to limit runs of consecutive free addresses in ascending order
+func (idx *FreeRangeIndex) Blocks(limit int) []FreeBlock {
+	var blocks []FreeBlock
+	idx.ranges.ascend(netip.Addr{}, func(r addrRange) bool {
+		if len(blocks) >= limit {
+			return false
+		}
+		blocks = append(blocks, FreeBlock{
+			Start: r.first.String(),
+			End:   r.last.String(),
+			Size:  r.size().big().String(),
+		})
+		return true
+	})
+	return blocks
+}
+
+// parse converts an address string and checks it belongs to the usable range
+func (idx *FreeRangeIndex) parse(ipStr string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if addr.BitLen() != idx.first.BitLen() || addr.Less(idx.first) || idx.last.Less(addr) {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
+
+// AddrSet is an immutable set of addresses kept sorted, so membership is a binary search and
+// runs of consecutive members can be stepped over without a lookup per address
+type AddrSet struct {
+	addrs []netip.Addr
+}
+
+// NewAddrSet builds a set from address strings, ignoring the ones that do not parse
+func NewAddrSet(ips []string) *AddrSet {
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ipStr := range ips {
+		if addr, err := netip.ParseAddr(ipStr); err == nil {
+			addrs = append(addrs, addr.Unmap())
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+	unique := addrs[:0]
+	for i, addr := range addrs {
+		if i == 0 || addr != addrs[i-1] {
+			unique = append(unique, addr)
+		}
+	}
+	return &AddrSet{addrs: unique}
+}
+
+// Len returns the number of addresses in the set
+func (s *AddrSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.addrs)
+}
+
+// Contains reports whether the address is in the set
+func (s *AddrSet) Contains(ipStr string) bool {
+	addr, err := netip.ParseAddr(ipStr)
+	if err != nil || s == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	i := sort.Search(len(s.addrs), func(i int) bool { return !s.addrs[i].Less(addr) })
+	return i < len(s.addrs) && s.addrs[i] == addr
+}
+
+// nextOutside returns the lowest address at or above addr that is not in the set, reporting
+// false when the members run up to the last address of the version
+func (s *AddrSet) nextOutside(addr netip.Addr) (netip.Addr, bool) {
+	if s == nil {
+		return addr, true
+	}
+	i := sort.Search(len(s.addrs), func(i int) bool { return !s.addrs[i].Less(addr) })
+	for ; i < len(s.addrs) && s.addrs[i] == addr; i++ {
+		if addr = addr.Next(); !addr.IsValid() {
+			return netip.Addr{}, false
+		}
+	}
+	return addr, true
+}
+
+// lastAddrInPrefix returns the highest address of a masked prefix
+func lastAddrInPrefix(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
+
+// parseAddrRange parses a range in any form ParseIPRange accepts
+func parseAddrRange(s string) (addrRange, error) {
+	s = strings.TrimSpace(s)
+	if startStr, endStr, ok := strings.Cut(s, "-"); ok {
+		start, err := netip.ParseAddr(strings.TrimSpace(startStr))
+		if err != nil {
+			return addrRange{}, fmt.Errorf("invalid start IP in range %s: %v", s, err)
+		}
+		end, err := netip.ParseAddr(strings.TrimSpace(endStr))
+		if err != nil {
+			return addrRange{}, fmt.Errorf("invalid end IP in range %s: %v", s, err)
+		}
+		start, end = start.Unmap(), end.Unmap()
+		if start.Is4() != end.Is4() {
+			return addrRange{}, fmt.Errorf("range %s mixes IPv4 and IPv6 addresses", s)
+		}
+		if end.Less(start) {
+			return addrRange{}, fmt.Errorf("start IP %s must be less than or equal to end IP %s", start, end)
+		}
+		return addrRange{first: start, last: end}, nil
+	}
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return addrRange{}, fmt.Errorf("invalid CIDR: %v", err)
+		}
+		prefix = prefix.Masked()
+		return addrRange{first: prefix.Addr(), last: lastAddrInPrefix(prefix)}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return addrRange{}, fmt.Errorf("invalid IP address: %s", s)
+	}
+	addr = addr.Unmap()
+	return addrRange{first: addr, last: addr}, nil
+}
+
+// addrInt returns the address as an integer
+func addrInt(addr netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(addr.AsSlice())
+}
+
+// intAddr returns the address of the given bit length with the integer value n, which must fit
+func intAddr(n *big.Int, bits int) netip.Addr {
+	addr, _ := netip.AddrFromSlice(n.FillBytes(make([]byte, bits/8)))
+	return addr
+}
@@ -0,0 +1,430 @@
+package utils
+
+import (
+	"math/big"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func newIndex(t *testing.T, cidr string, used ...string) *FreeRangeIndex {
+	t.Helper()
+	idx, err := NewFreeRangeIndex(cidr, used)
+	if err != nil {
+		t.Fatalf("NewFreeRangeIndex(%s): %v", cidr, err)
+	}
+	return idx
+}
+
+func expectFree(t *testing.T, idx *FreeRangeIndex, want int64) {
+	t.Helper()
+	if got := idx.FreeCount(); got.Cmp(big.NewInt(want)) != 0 {
+		t.Fatalf("FreeCount = %s, want %d", got, want)
+	}
+	// The count must match the intervals it summarises
+	sum := new(big.Int)
+	idx.ranges.ascend(netip.Addr{}, func(r addrRange) bool {
+		sum.Add(sum, r.size().big())
+		return true
+	})
+	if sum.Cmp(idx.FreeCount()) != 0 {
+		t.Fatalf("FreeCount = %s but the intervals hold %s", idx.FreeCount(), sum)
+	}
+}
+
+func TestFreeRangeIndexUsableBounds(t *testing.T) {
+	tests := []struct {
+		cidr        string
+		first, last string
+		free        int64
+	}{
+		{"10.0.0.0/24", "10.0.0.1", "10.0.0.254", 254},
+		{"10.0.0.5/30", "10.0.0.5", "10.0.0.6", 2},
+		{"10.0.0.0/31", "10.0.0.0", "10.0.0.1", 2},
+		{"10.0.0.7/32", "10.0.0.7", "10.0.0.7", 1},
+		{"2001:db8::/120", "2001:db8::1", "2001:db8::ff", 255},
+		{"2001:db8::7/128", "2001:db8::7", "2001:db8::7", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			idx := newIndex(t, tt.cidr)
+			expectFree(t, idx, tt.free)
+			if next, _ := idx.Next(); next != tt.first {
+				t.Fatalf("Next = %s, want %s", next, tt.first)
+			}
+			if last, _ := idx.TakeLast(); last != tt.last {
+				t.Fatalf("TakeLast = %s, want %s", last, tt.last)
+			}
+			if first, _ := idx.TakeNext(); first != tt.first && tt.free > 1 {
+				t.Fatalf("TakeNext = %s, want %s", first, tt.first)
+			}
+		})
+	}
+}
+
+func TestFreeRangeIndexFullRange(t *testing.T) {
+	idx := newIndex(t, "10.0.0.0/30", "10.0.0.1", "10.0.0.2")
+	expectFree(t, idx, 0)
+	if ip, ok := idx.Next(); ok {
+		t.Fatalf("Next = %s in a full range", ip)
+	}
+	if ip, ok := idx.TakeRandom(); ok {
+		t.Fatalf("TakeRandom = %s in a full range", ip)
+	}
+	if _, ok := idx.TakeRun(1, 0); ok {
+		t.Fatal("TakeRun found a run in a full range")
+	}
+	if _, ok := idx.LargestBlock(); ok {
+		t.Fatal("LargestBlock found a block in a full range")
+	}
+
+	// Releasing the used addresses merges them back into one interval
+	idx.Release("10.0.0.2")
+	idx.Release("10.0.0.1")
+	expectFree(t, idx, 2)
+	if blocks := idx.Blocks(10); len(blocks) != 1 || blocks[0].Start != "10.0.0.1" || blocks[0].End != "10.0.0.2" {
+		t.Fatalf("Blocks after release = %v, want one block 10.0.0.1-10.0.0.2", blocks)
+	}
+}
+
+func TestFreeRangeIndexIgnoresForeignUsedAddresses(t *testing.T) {
+	idx := newIndex(t, "10.0.0.0/29", "10.0.0.0", "10.0.0.7", "10.0.1.1", "2001:db8::1", "bogus", "10.0.0.3", "10.0.0.3")
+	expectFree(t, idx, 5)
+	if idx.IsFree("10.0.0.3") || !idx.IsFree("10.0.0.4") || idx.IsFree("10.0.0.0") {
+		t.Fatal("IsFree disagrees with the used addresses")
+	}
+}
+
+func TestFreeRangeIndexExclude(t *testing.T) {
+	idx := newIndex(t, "10.0.0.0/24", "10.0.0.5", "10.0.0.50", "10.0.0.100")
+	err := idx.Exclude([]string{
+		"10.0.0.1",
+		"10.0.0.3-10.0.0.7",   // overlaps the used 10.0.0.5
+		"10.0.0.6-10.0.0.9",   // overlaps the previous range
+		"10.0.0.10",           // adjacent to it
+		"10.0.0.48/29",        // 10.0.0.48-10.0.0.55 around the used 10.0.0.50
+		"10.0.0.240-10.0.1.9", // runs past the CIDR
+		"9.0.0.0-10.0.0.1",    // starts before it
+		"2001:db8::1",         // other version
+	})
+	if err != nil {
+		t.Fatalf("Exclude: %v", err)
+	}
+
+	// 254 usable, 3 used, excluded outside the used ones: .1, .3-.4, .6-.10, .48-.55 but .50,
+	// and .240-.254
+	expectFree(t, idx, 254-3-1-2-5-7-15)
+	want := []FreeBlock{
+		{Start: "10.0.0.2", End: "10.0.0.2", Size: "1"},
+		{Start: "10.0.0.11", End: "10.0.0.47", Size: "37"},
+		{Start: "10.0.0.56", End: "10.0.0.99", Size: "44"},
+		{Start: "10.0.0.101", End: "10.0.0.239", Size: "139"},
+	}
+	if got := idx.Blocks(10); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Blocks after Exclude = %v, want %v", got, want)
+	}
+
+	if err := idx.Exclude([]string{"10.0.0.9-10.0.0.1"}); err == nil {
+		t.Fatal("Exclude accepted a range that ends before it starts")
+	}
+}
+
+func TestFreeRangeIndexTakeRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		cidr        string
+		used        []string
+		size, align int
+		want        []string
+	}{
+		{"lowest fit", "10.0.0.0/24", []string{"10.0.0.3"}, 3, 0, []string{"10.0.0.4", "10.0.0.5", "10.0.0.6"}},
+		{"first interval fits", "10.0.0.0/24", []string{"10.0.0.3"}, 2, 0, []string{"10.0.0.1", "10.0.0.2"}},
+		{"aligned to /30", "10.0.0.0/24", nil, 4, 30, []string{"10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7"}},
+		{"aligned past used", "10.0.0.0/24", []string{"10.0.0.9"}, 8, 29, []string{"10.0.0.16", "10.0.0.17", "10.0.0.18", "10.0.0.19", "10.0.0.20", "10.0.0.21", "10.0.0.22", "10.0.0.23"}},
+		{"aligned to /32", "10.0.0.0/24", nil, 1, 32, []string{"10.0.0.1"}},
+		{"ipv6 aligned", "2001:db8::/120", nil, 2, 127, []string{"2001:db8::2", "2001:db8::3"}},
+		{"aligned after used", "10.0.0.0/29", []string{"10.0.0.1"}, 2, 31, []string{"10.0.0.2", "10.0.0.3"}},
+		{"too long", "10.0.0.0/29", nil, 7, 0, nil},
+		{"no aligned fit", "10.0.0.0/29", nil, 4, 30, nil},
+		{"network address boundary", "10.0.0.0/30", nil, 2, 30, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idx := newIndex(t, tt.cidr, tt.used...)
+			before := new(big.Int).Set(idx.FreeCount())
+			run, ok := idx.TakeRun(tt.size, tt.align)
+			if len(tt.want) == 0 {
+				if ok {
+					t.Fatalf("TakeRun = %v, want no run", run)
+				}
+				expectFree(t, idx, before.Int64())
+				return
+			}
+			if !ok || !reflect.DeepEqual(run, tt.want) {
+				t.Fatalf("TakeRun = %v, %v, want %v", run, ok, tt.want)
+			}
+			expectFree(t, idx, before.Int64()-int64(len(run)))
+			for _, ip := range run {
+				if idx.IsFree(ip) {
+					t.Fatalf("%s is still free after TakeRun", ip)
+				}
+			}
+		})
+	}
+}
+
+func TestFreeRangeIndexTakeNextExcluding(t *testing.T) {
+	idx := newIndex(t, "10.0.0.0/28", "10.0.0.4", "10.0.0.8")
+	// Free: .1-.3, .5-.7, .9-.14. The excluded run .1-.6 crosses the used .4.
+	excluded := NewAddrSet([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.6", "bogus"})
+	if excluded.Len() != 6 || !excluded.Contains("10.0.0.4") || excluded.Contains("10.0.0.7") {
+		t.Fatalf("NewAddrSet holds %d addresses, want .1-.6", excluded.Len())
+	}
+
+	for _, want := range []string{"10.0.0.7", "10.0.0.9", "10.0.0.10"} {
+		if ip, ok := idx.TakeNextExcluding(excluded); !ok || ip != want {
+			t.Fatalf("TakeNextExcluding = %s, %v, want %s", ip, ok, want)
+		}
+	}
+	if ip, ok := idx.TakeNextExcluding(nil); !ok || ip != "10.0.0.1" {
+		t.Fatalf("TakeNextExcluding(nil) = %s, %v, want 10.0.0.1", ip, ok)
+	}
+
+	// Nothing left outside the excluded addresses
+	full := newIndex(t, "10.0.0.0/29")
+	if ip, ok := full.TakeNextExcluding(NewAddrSet(sequentialIPs("10.0.0.1", 6))); ok {
+		t.Fatalf("TakeNextExcluding = %s with every free address excluded", ip)
+	}
+	expectFree(t, full, 6)
+}
+
+// TestFreeRangeIndexMatchesModel applies random takes and releases to the index and to a plain
+// set of free addresses and checks they agree after every step
+func TestFreeRangeIndexMatchesModel(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for _, cidr := range []string{"10.0.0.0/26", "2001:db8::/122"} {
+		idx := newIndex(t, cidr)
+		all := idx.List(1 << 10)
+		free := make(map[string]bool, len(all))
+		for _, ip := range all {
+			free[ip] = true
+		}
+
+		for step := 0; step < 5000; step++ {
+			ip := all[rng.IntN(len(all))]
+			var ok bool
+			switch rng.IntN(4) {
+			case 0:
+				ok = idx.Release(ip)
+				if ok == free[ip] {
+					t.Fatalf("%s step %d: Release(%s) = %v with the address free = %v", cidr, step, ip, ok, free[ip])
+				}
+				free[ip] = true
+			case 1:
+				if ip, ok = idx.TakeRandom(); ok {
+					if !free[ip] {
+						t.Fatalf("%s step %d: TakeRandom = %s, which was not free", cidr, step, ip)
+					}
+					free[ip] = false
+				}
+			default:
+				ok = idx.Take(ip)
+				if ok != free[ip] {
+					t.Fatalf("%s step %d: Take(%s) = %v with the address free = %v", cidr, step, ip, ok, free[ip])
+				}
+				free[ip] = false
+			}
+
+			var want []string
+			for _, ip := range all {
+				if free[ip] {
+					want = append(want, ip)
+				}
+			}
+			if got := idx.List(len(all)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s step %d: List = %v, want %v", cidr, step, got, want)
+			}
+			expectFree(t, idx, int64(len(want)))
+		}
+	}
+}
+
+func TestParseAddrRange(t *testing.T) {
+	tests := []struct {
+		in          string
+		first, last string
+	}{
+		{"10.0.0.5-10.0.0.9", "10.0.0.5", "10.0.0.9"},
+		{" 10.0.0.5 - 10.0.0.9 ", "10.0.0.5", "10.0.0.9"},
+		{"10.0.0.5-10.0.0.5", "10.0.0.5", "10.0.0.5"},
+		{"10.0.0.66/30", "10.0.0.64", "10.0.0.67"},
+		{"10.0.0.7/32", "10.0.0.7", "10.0.0.7"},
+		{"10.0.0.7", "10.0.0.7", "10.0.0.7"},
+		{"::ffff:10.0.0.7", "10.0.0.7", "10.0.0.7"},
+		{"::ffff:10.0.0.1-10.0.0.3", "10.0.0.1", "10.0.0.3"},
+		{"2001:db8::1-2001:db8::ff", "2001:db8::1", "2001:db8::ff"},
+		{"2001:db8::/126", "2001:db8::", "2001:db8::3"},
+		{"2001:db8::0001", "2001:db8::1", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		first, last, err := ParseIPRange(tt.in)
+		if err != nil {
+			t.Fatalf("ParseIPRange(%q): %v", tt.in, err)
+		}
+		if first != tt.first || last != tt.last {
+			t.Fatalf("ParseIPRange(%q) = %s, %s, want %s, %s", tt.in, first, last, tt.first, tt.last)
+		}
+	}
+
+	for _, in := range []string{"", "bogus", "10.0.0.9-10.0.0.1", "10.0.0.1-2001:db8::1", "10.0.0.1-", "10.0.0.0/33", "10.0.0.256"} {
+		if first, last, err := ParseIPRange(in); err == nil {
+			t.Fatalf("ParseIPRange(%q) = %s, %s, want an error", in, first, last)
+		}
+	}
+}
+
+// Benchmarks compare the index with the linear CIDR scan it replaced, on ranges large enough
+// for the difference to matter
+
+const (
+	benchUsed  = 60000
+	benchCount = 100
+)
+
+var (
+	benchIPv4Used = sequentialIPs("10.0.0.1", benchUsed)
+	benchIPv6Used = sequentialIPs("2001:db8::1", benchUsed)
+)
+
+func BenchmarkNextFree_ScanIPv4(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		legacyAllocate("10.0.0.0/16", benchIPv4Used, benchCount)
+	}
+}
+
+func BenchmarkNextFree_IndexIPv4(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		indexAllocate("10.0.0.0/16", benchIPv4Used, benchCount)
+	}
+}
+
+func BenchmarkNextFree_ScanIPv6(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		legacyAllocate("2001:db8::/64", benchIPv6Used, benchCount)
+	}
+}
+
+func BenchmarkNextFree_IndexIPv6(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		indexAllocate("2001:db8::/64", benchIPv6Used, benchCount)
+	}
+}
+
+func BenchmarkFreeCount_Scan(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		legacyList("10.0.0.0/16", benchIPv4Used, 1<<16)
+	}
+}
+
+func BenchmarkFreeCount_Index(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		idx, _ := NewFreeRangeIndex("10.0.0.0/16", benchIPv4Used)
+		idx.FreeCount()
+	}
+}
+
+// BenchmarkTakeRelease_Fragmented takes and releases addresses in a range split into 30000
+// free intervals, the cost a kept index pays per address
+func BenchmarkTakeRelease_Fragmented(b *testing.B) {
+	var used []string
+	for _, ip := range sequentialIPs("10.0.0.1", benchUsed) {
+		if addr := netip.MustParseAddr(ip); addr.As4()[3]%2 == 0 {
+			used = append(used, ip)
+		}
+	}
+	idx, _ := NewFreeRangeIndex("10.0.0.0/16", used)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip, _ := idx.TakeRandom()
+		idx.Release(ip)
+	}
+}
+
+// indexAllocate picks count addresses the way the allocation service does
+func indexAllocate(cidr string, used []string, count int) []string {
+	idx, err := NewFreeRangeIndex(cidr, used)
+	if err != nil {
+		return nil
+	}
+	ips := make([]string, 0, count)
+	for len(ips) < count {
+		ip, ok := idx.TakeNext()
+		if !ok {
+			break
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// legacyAllocate picks count addresses the way the allocation service did before the index:
+// one full lookup per address with the already picked ones appended to the used list
+func legacyAllocate(cidr string, used []string, count int) []string {
+	var ips []string
+	for i := 0; i < count; i++ {
+		found := legacyList(cidr, append(used, ips...), 1)
+		if len(found) == 0 {
+			break
+		}
+		ips = append(ips, found[0])
+	}
+	return ips
+}
+
+// legacyList is the linear scan formerly used by GetAvailableIPsInRange and GetNextAvailableIP
+func legacyList(cidr string, used []string, limit int) []string {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil
+	}
+
+	usedIPs := make(map[string]bool, len(used))
+	for _, ip := range used {
+		usedIPs[ip] = true
+	}
+
+	broadcast := make(net.IP, len(network.IP))
+	for i := range network.IP {
+		broadcast[i] = network.IP[i] | ^network.Mask[i]
+	}
+
+	var available []string
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP)
+	for network.Contains(ip) && len(available) < limit {
+		isReserved := ip.Equal(network.IP) || (IsIPv4(ip) && ip.Equal(broadcast))
+		if ipStr := ip.String(); !usedIPs[ipStr] && !isReserved {
+			available = append(available, ipStr)
+		}
+		for i := len(ip) - 1; i >= 0; i-- {
+			ip[i]++
+			if ip[i] != 0 {
+				break
+			}
+		}
+	}
+	return available
+}
+
+// sequentialIPs returns n consecutive addresses starting at start
+func sequentialIPs(start string, n int) []string {
+	addr := netip.MustParseAddr(start)
+	ips := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		ips = append(ips, addr.String())
+		addr = addr.Next()
+	}
+	return ips
+}
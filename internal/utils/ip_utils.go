@@ -55,33 +55,22 @@ func IsIPInCIDR(ipStr, cidrStr string) (bool, error) {
 	return network.Contains(ip), nil
 }
 
-// GetNextAvailableIP finds the next available IP in a CIDR range
-func GetNextAvailableIP(cidrStr string, allocated, reserved []string) (string, error) {
-	_, network, err := net.ParseCIDR(cidrStr)
+// GetNextAvailableIP finds the next available IP in a CIDR range, skipping the excluded
+// ranges in any form ParseIPRange accepts
+func GetNextAvailableIP(cidrStr string, allocated, reserved, excluded []string) (string, error) {
+	idx, err := NewFreeRangeIndex(cidrStr, allocated, reserved)
 	if err != nil {
 		return "", err
 	}
-
-	// Create a map for faster lookup
-	usedIPs := make(map[string]bool)
-	for _, ip := range allocated {
-		usedIPs[ip] = true
-	}
-	for _, ip := range reserved {
-		usedIPs[ip] = true
+	if err := idx.Exclude(excluded); err != nil {
+		return "", err
 	}
 
-	// Start from the first usable IP in the network
-	ip := network.IP
-	for network.Contains(ip) {
-		ipStr := ip.String()
-		if !usedIPs[ipStr] && !isNetworkOrBroadcast(ip, network) {
-			return ipStr, nil
-		}
-		ip = incrementIP(ip)
+	ip, ok := idx.Next()
+	if !ok {
+		return "", fmt.Errorf("no available IPs in CIDR range %s", cidrStr)
 	}
-
-	return "", fmt.Errorf("no available IPs in CIDR range %s", cidrStr)
+	return ip, nil
 }
 
 // incrementIP increments an IP address by 1
@@ -101,29 +90,6 @@ func incrementIP(ip net.IP) net.IP {
 	return result
 }
 
-// isNetworkOrBroadcast checks if IP is network or broadcast address
-func isNetworkOrBroadcast(ip net.IP, network *net.IPNet) bool {
-	// Network address
-	if ip.Equal(network.IP) {
-		return true
-	}
-
-	// For IPv4, check broadcast address
-	if IsIPv4(ip) {
-		broadcast := make(net.IP, len(network.IP))
-		copy(broadcast, network.IP)
-
-		mask := network.Mask
-		for i := 0; i < len(mask); i++ {
-			broadcast[i] |= ^mask[i]
-		}
-
-		return ip.Equal(broadcast)
-	}
-
-	return false
-}
-
 // CountIPsInCIDR counts the number of usable IPs in a CIDR range
 func CountIPsInCIDR(cidrStr string) (*big.Int, error) {
 	if cidrStr == "" {
@@ -222,34 +188,14 @@ func ValidateIPList(ips []string) error {
 	return nil
 }
 
-// GetAvailableIPsInRange returns available IPs in a CIDR range
-func GetAvailableIPsInRange(cidrStr string, allocated, reserved []string, limit int) ([]string, error) {
-	_, network, err := net.ParseCIDR(cidrStr)
+// GetAvailableIPsInRange returns available IPs in a CIDR range outside the excluded ranges
+func GetAvailableIPsInRange(cidrStr string, allocated, reserved, excluded []string, limit int) ([]string, error) {
+	idx, err := NewFreeRangeIndex(cidrStr, allocated, reserved)
 	if err != nil {
 		return nil, err
 	}
-
-	// Create map for faster lookup
-	usedIPs := make(map[string]bool)
-	for _, ip := range allocated {
-		usedIPs[ip] = true
-	}
-	for _, ip := range reserved {
-		usedIPs[ip] = true
-	}
-
-	var available []string
-	ip := network.IP
-	count := 0
-
-	for network.Contains(ip) && count < limit {
-		ipStr := ip.String()
-		if !usedIPs[ipStr] && !isNetworkOrBroadcast(ip, network) {
-			available = append(available, ipStr)
-			count++
-		}
-		ip = incrementIP(ip)
+	if err := idx.Exclude(excluded); err != nil {
+		return nil, err
 	}
-
-	return available, nil
+	return idx.List(limit), nil
 }
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// PrefixTrie maps CIDR prefixes to values and finds every stored prefix containing an address
+// or a smaller prefix. It is a binary trie over the address bits with one root per IP version,
+// so inserts and lookups cost at most 32 or 128 steps regardless of how many prefixes it holds.
+// A PrefixTrie is not safe for concurrent modification; build it once and then only read it.
+type PrefixTrie[T any] struct {
+	ipv4 *trieNode[T]
+	ipv6 *trieNode[T]
+	size int
+}
+
+type trieNode[T any] struct {
+	children [2]*trieNode[T]
+	prefix   netip.Prefix
+	values   []T
+}
+
+// PrefixMatch is a stored prefix with the values inserted for it
+type PrefixMatch[T any] struct {
+	Prefix netip.Prefix
+	Values []T
+}
+
+func NewPrefixTrie[T any]() *PrefixTrie[T] {
+	return &PrefixTrie[T]{
+		ipv4: &trieNode[T]{},
+		ipv6: &trieNode[T]{},
+	}
+}
+
+// Insert stores the value under the CIDR; several values may share a CIDR
+func (t *PrefixTrie[T]) Insert(cidr string, value T) error {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR: %v", err)
+	}
+	prefix = prefix.Masked()
+
+	node := t.root(prefix.Addr())
+	bytes := prefix.Addr().AsSlice()
+	for bit := 0; bit < prefix.Bits(); bit++ {
+		b := addrBit(bytes, bit)
+		if node.children[b] == nil {
+			node.children[b] = &trieNode[T]{}
+		}
+		node = node.children[b]
+	}
+
+	node.prefix = prefix
+	node.values = append(node.values, value)
+	t.size++
+	return nil
+}
+
+// Len returns the number of values stored
+func (t *PrefixTrie[T]) Len() int {
+	return t.size
+}
+
+// LookupAddr returns every stored prefix containing the address, least specific first
+func (t *PrefixTrie[T]) LookupAddr(addr netip.Addr) []PrefixMatch[T] {
+	addr = addr.Unmap()
+	return t.LookupPrefix(netip.PrefixFrom(addr, addr.BitLen()))
+}
+
+// LookupPrefix returns every stored prefix containing the whole of the given prefix, least
+// specific first; the last match is the longest prefix match
+func (t *PrefixTrie[T]) LookupPrefix(prefix netip.Prefix) []PrefixMatch[T] {
+	prefix = prefix.Masked()
+
+	var matches []PrefixMatch[T]
+	node := t.root(prefix.Addr())
+	bytes := prefix.Addr().AsSlice()
+	for bit := 0; node != nil; bit++ {
+		if len(node.values) > 0 {
+			matches = append(matches, PrefixMatch[T]{Prefix: node.prefix, Values: node.values})
+		}
+		if bit >= prefix.Bits() {
+			break
+		}
+		node = node.children[addrBit(bytes, bit)]
+	}
+	return matches
+}
+
+func (t *PrefixTrie[T]) root(addr netip.Addr) *trieNode[T] {
+	if addr.Is4() {
+		return t.ipv4
+	}
+	return t.ipv6
+}
+
+// addrBit returns the bit of the address at the given position, counted from the most significant
+func addrBit(bytes []byte, bit int) int {
+	return int(bytes[bit/8]>>(7-bit%8)) & 1
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func newTrie(t *testing.T, entries ...[2]string) *PrefixTrie[string] {
+	t.Helper()
+	trie := NewPrefixTrie[string]()
+	for _, entry := range entries {
+		if err := trie.Insert(entry[0], entry[1]); err != nil {
+			t.Fatalf("Insert(%s): %v", entry[0], err)
+		}
+	}
+	return trie
+}
+
+// matchValues flattens matches into their values, least specific first
+func matchValues(matches []PrefixMatch[string]) []string {
+	var values []string
+	for _, match := range matches {
+		values = append(values, match.Values...)
+	}
+	return values
+}
+
+func TestPrefixTrieLookupAddr(t *testing.T) {
+	trie := newTrie(t,
+		[2]string{"10.1.2.0/24", "subzone"},
+		[2]string{"0.0.0.0/0", "default-v4"},
+		[2]string{"10.0.0.0/8", "region"},
+		[2]string{"10.1.2.3/32", "host"},
+		[2]string{"10.1.0.0/16", "zone"},
+		[2]string{"::/0", "default-v6"},
+		[2]string{"2001:db8::/32", "region-v6"},
+		[2]string{"2001:db8::1/128", "host-v6"},
+	)
+
+	tests := []struct {
+		addr string
+		want []string
+	}{
+		{"10.1.2.3", []string{"default-v4", "region", "zone", "subzone", "host"}},
+		{"10.1.2.4", []string{"default-v4", "region", "zone", "subzone"}},
+		{"10.2.0.1", []string{"default-v4", "region"}},
+		{"192.0.2.1", []string{"default-v4"}},
+		{"::ffff:10.1.2.3", []string{"default-v4", "region", "zone", "subzone", "host"}},
+		{"2001:db8::1", []string{"default-v6", "region-v6", "host-v6"}},
+		{"2001:db9::1", []string{"default-v6"}},
+	}
+	for _, tt := range tests {
+		got := matchValues(trie.LookupAddr(netip.MustParseAddr(tt.addr)))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("LookupAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	// The last match is the longest prefix match and carries its prefix
+	matches := trie.LookupAddr(netip.MustParseAddr("10.1.2.4"))
+	if last := matches[len(matches)-1]; last.Prefix != netip.MustParsePrefix("10.1.2.0/24") {
+		t.Fatalf("longest match is %s, want 10.1.2.0/24", last.Prefix)
+	}
+}
+
+func TestPrefixTrieLookupPrefix(t *testing.T) {
+	trie := newTrie(t,
+		[2]string{"10.0.0.0/8", "region"},
+		[2]string{"10.1.0.0/16", "zone"},
+		[2]string{"10.1.2.77/24", "subzone"},
+	)
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"10.1.2.0/24", []string{"region", "zone", "subzone"}},
+		{"10.1.2.128/25", []string{"region", "zone", "subzone"}},
+		{"10.1.2.0/23", []string{"region", "zone"}},
+		{"10.1.2.99/24", []string{"region", "zone", "subzone"}},
+		{"10.0.0.0/7", nil},
+		{"0.0.0.0/0", nil},
+	}
+	for _, tt := range tests {
+		got := matchValues(trie.LookupPrefix(netip.MustParsePrefix(tt.prefix)))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("LookupPrefix(%s) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixTrieSharedCIDR(t *testing.T) {
+	trie := newTrie(t,
+		[2]string{"10.0.0.0/24", "first"},
+		[2]string{"10.0.0.0/24", "second"},
+		[2]string{"10.0.0.128/24", "unmasked"},
+	)
+	if trie.Len() != 3 {
+		t.Fatalf("Len = %d, want 3", trie.Len())
+	}
+
+	matches := trie.LookupAddr(netip.MustParseAddr("10.0.0.1"))
+	if len(matches) != 1 || !reflect.DeepEqual(matches[0].Values, []string{"first", "second", "unmasked"}) {
+		t.Fatalf("LookupAddr = %v, want one prefix holding every value in insertion order", matches)
+	}
+
+	if err := trie.Insert("10.0.0.0/33", "bad"); err == nil {
+		t.Fatal("Insert accepted an invalid CIDR")
+	}
+	if trie.Len() != 3 {
+		t.Fatalf("Len = %d after a failed insert, want 3", trie.Len())
+	}
+}
@@ -0,0 +1,274 @@
+package utils
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+	"math/rand/v2"
+	"net/netip"
+)
+
+// rangeTree holds disjoint address intervals ordered by address in a treap, a binary search
+// tree kept balanced by random node priorities, so finding, inserting and removing an interval
+// cost O(log n) expected for n intervals. Every node also counts the addresses of its subtree,
+// which finds the interval holding the k-th address in O(log n) as well.
+type rangeTree struct {
+	root *rangeNode
+}
+
+type rangeNode struct {
+	r           addrRange
+	priority    uint64
+	total       uint128 // addresses in the subtree
+	left, right *rangeNode
+}
+
+// update recounts the addresses of the node's subtree after a child changed
+func (n *rangeNode) update() {
+	total := n.r.size()
+	if n.left != nil {
+		total = total.add(n.left.total)
+	}
+	if n.right != nil {
+		total = total.add(n.right.total)
+	}
+	n.total = total
+}
+
+// total returns the number of addresses in all intervals
+func (t *rangeTree) total() uint128 {
+	if t.root == nil {
+		return uint128{}
+	}
+	return t.root.total
+}
+
+// insert adds an interval that overlaps none of the others
+func (t *rangeTree) insert(r addrRange) {
+	node := &rangeNode{r: r, priority: rand.Uint64()}
+	node.update()
+	left, right := splitRanges(t.root, r.first)
+	t.root = mergeRanges(mergeRanges(left, node), right)
+}
+
+// replace removes the interval starting at first and inserts the given ones, which must lie
+// within it, in ascending order
+func (t *rangeTree) replace(first netip.Addr, with ...addrRange) {
+	left, right := splitRanges(t.root, first)
+	right = removeFirstRange(right)
+	for _, r := range with {
+		node := &rangeNode{r: r, priority: rand.Uint64()}
+		node.update()
+		left = mergeRanges(left, node)
+	}
+	t.root = mergeRanges(left, right)
+}
+
+// ceil returns the first interval ending at or after addr
+func (t *rangeTree) ceil(addr netip.Addr) (addrRange, bool) {
+	var found *rangeNode
+	for n := t.root; n != nil; {
+		if n.r.last.Less(addr) {
+			n = n.right
+		} else {
+			found, n = n, n.left
+		}
+	}
+	if found == nil {
+		return addrRange{}, false
+	}
+	return found.r, true
+}
+
+// floor returns the last interval starting before addr
+func (t *rangeTree) floor(addr netip.Addr) (addrRange, bool) {
+	var found *rangeNode
+	for n := t.root; n != nil; {
+		if n.r.first.Less(addr) {
+			found, n = n, n.right
+		} else {
+			n = n.left
+		}
+	}
+	if found == nil {
+		return addrRange{}, false
+	}
+	return found.r, true
+}
+
+// min returns the lowest interval
+func (t *rangeTree) min() (addrRange, bool) {
+	if t.root == nil {
+		return addrRange{}, false
+	}
+	n := t.root
+	for n.left != nil {
+		n = n.left
+	}
+	return n.r, true
+}
+
+// max returns the highest interval
+func (t *rangeTree) max() (addrRange, bool) {
+	if t.root == nil {
+		return addrRange{}, false
+	}
+	n := t.root
+	for n.right != nil {
+		n = n.right
+	}
+	return n.r, true
+}
+
+// ascend calls fn with the intervals ending at or after from in ascending order until it
+// returns false. The zero Addr sorts before every address, so it visits every interval. fn
+// must not change the tree.
+func (t *rangeTree) ascend(from netip.Addr, fn func(r addrRange) bool) {
+	ascendRanges(t.root, from, fn)
+}
+
+func ascendRanges(n *rangeNode, from netip.Addr, fn func(r addrRange) bool) bool {
+	if n == nil {
+		return true
+	}
+	if !n.r.last.Less(from) {
+		if !ascendRanges(n.left, from, fn) || !fn(n.r) {
+			return false
+		}
+	}
+	return ascendRanges(n.right, from, fn)
+}
+
+// at returns the interval holding the k-th address of all intervals, counting from 0, and
+// the offset of that address within it. k must be less than the total.
+func (t *rangeTree) at(k uint128) (addrRange, uint128) {
+	for n := t.root; n != nil; {
+		if n.left != nil {
+			if k.less(n.left.total) {
+				n = n.left
+				continue
+			}
+			k = k.sub(n.left.total)
+		}
+		size := n.r.size()
+		if k.less(size) {
+			return n.r, k
+		}
+		k = k.sub(size)
+		n = n.right
+	}
+	return addrRange{}, uint128{}
+}
+
+// splitRanges divides a subtree into the intervals starting before addr and the rest
+func splitRanges(n *rangeNode, addr netip.Addr) (*rangeNode, *rangeNode) {
+	if n == nil {
+		return nil, nil
+	}
+	if n.r.first.Less(addr) {
+		left, right := splitRanges(n.right, addr)
+		n.right = left
+		n.update()
+		return n, right
+	}
+	left, right := splitRanges(n.left, addr)
+	n.left = right
+	n.update()
+	return left, n
+}
+
+// mergeRanges joins two subtrees where every interval of left comes before those of right
+func mergeRanges(left, right *rangeNode) *rangeNode {
+	switch {
+	case left == nil:
+		return right
+	case right == nil:
+		return left
+	case left.priority > right.priority:
+		left.right = mergeRanges(left.right, right)
+		left.update()
+		return left
+	default:
+		right.left = mergeRanges(left, right.left)
+		right.update()
+		return right
+	}
+}
+
+// removeFirstRange removes the lowest interval of a subtree
+func removeFirstRange(n *rangeNode) *rangeNode {
+	if n == nil {
+		return nil
+	}
+	if n.left == nil {
+		return n.right
+	}
+	n.left = removeFirstRange(n.left)
+	n.update()
+	return n
+}
+
+// uint128 counts addresses without allocating; the 2^128 - 1 usable addresses of ::/0 are
+// the most it has to hold
+type uint128 struct {
+	hi, lo uint64
+}
+
+// addrUint128 returns the address as an integer; IPv4 addresses are taken in their IPv6-mapped
+// form, so only differences between addresses of the same version are meaningful
+func addrUint128(addr netip.Addr) uint128 {
+	b := addr.As16()
+	return uint128{hi: binary.BigEndian.Uint64(b[:8]), lo: binary.BigEndian.Uint64(b[8:])}
+}
+
+// bigUint128 converts a non-negative integer below 2^128
+func bigUint128(n *big.Int) uint128 {
+	var b [16]byte
+	n.FillBytes(b[:])
+	return uint128{hi: binary.BigEndian.Uint64(b[:8]), lo: binary.BigEndian.Uint64(b[8:])}
+}
+
+func (u uint128) add(v uint128) uint128 {
+	lo, carry := bits.Add64(u.lo, v.lo, 0)
+	hi, _ := bits.Add64(u.hi, v.hi, carry)
+	return uint128{hi: hi, lo: lo}
+}
+
+func (u uint128) sub(v uint128) uint128 {
+	lo, borrow := bits.Sub64(u.lo, v.lo, 0)
+	hi, _ := bits.Sub64(u.hi, v.hi, borrow)
+	return uint128{hi: hi, lo: lo}
+}
+
+func (u uint128) less(v uint128) bool {
+	return u.hi < v.hi || (u.hi == v.hi && u.lo < v.lo)
+}
+
+func (u uint128) isZero() bool {
+	return u.hi == 0 && u.lo == 0
+}
+
+func (u uint128) big() *big.Int {
+	n := new(big.Int).SetUint64(u.hi)
+	n.Lsh(n, 64)
+	return n.Or(n, new(big.Int).SetUint64(u.lo))
+}
+
+// size returns the number of addresses in the interval
+func (r addrRange) size() uint128 {
+	return addrUint128(r.last).sub(addrUint128(r.first)).add(uint128{lo: 1})
+}
+
+// offset returns the address k places above the first one of the interval; k must be less
+// than its size
+func (r addrRange) offset(k uint128) netip.Addr {
+	u := addrUint128(r.first).add(k)
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], u.hi)
+	binary.BigEndian.PutUint64(b[8:], u.lo)
+	addr := netip.AddrFrom16(b)
+	if r.first.Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
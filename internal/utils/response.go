@@ -2,6 +2,7 @@ package utils
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -13,9 +14,17 @@ type StandardResponse struct {
 	Data      interface{} `json:"data,omitempty"`
 	Message   string      `json:"message"`
 	Timestamp string      `json:"timestamp"`
-	Error     string      `json:"error,omitempty"`
 }
 
+// ProblemContentType is the media type of error responses, RFC 7807 problem details
+const ProblemContentType = "application/problem+json"
+
+// CodeValidationFailed is the error code of requests rejected by validation
+const CodeValidationFailed = "validation_failed"
+
+// problemTypePrefix turns an error code into the URI of its problem type
+const problemTypePrefix = "urn:ip-allocator-api:problem:"
+
 // WriteSuccessResponse writes a successful JSON response using Gin
 func WriteSuccessResponse(c *gin.Context, statusCode int, data interface{}, message string) {
 	response := StandardResponse{
@@ -27,25 +36,52 @@ func WriteSuccessResponse(c *gin.Context, statusCode int, data interface{}, mess
 	c.JSON(statusCode, response)
 }
 
-// WriteErrorResponse writes an error JSON response using Gin
-func WriteErrorResponse(c *gin.Context, statusCode int, message string) {
-	response := StandardResponse{
-		Success:   false,
-		Message:   message,
-		Error:     message,
-		Timestamp: time.Now().Format(time.RFC3339),
+// WriteProblem writes an RFC 7807 problem document. code is the stable, machine-readable error
+// code, which also names the problem type, and extensions are added as extra members. The
+// success, message and timestamp members of the standard response are kept for older clients.
+func WriteProblem(c *gin.Context, statusCode int, code, detail string, extensions map[string]interface{}) {
+	problem := gin.H{}
+	for key, value := range extensions {
+		problem[key] = value
 	}
-	c.JSON(statusCode, response)
+	problem["type"] = problemTypePrefix + code
+	problem["title"] = http.StatusText(statusCode)
+	problem["status"] = statusCode
+	problem["detail"] = detail
+	problem["instance"] = c.Request.URL.Path
+	problem["code"] = code
+	problem["success"] = false
+	problem["message"] = detail
+	problem["timestamp"] = time.Now().Format(time.RFC3339)
+
+	// Gin keeps a content type that is already set
+	c.Header("Content-Type", ProblemContentType)
+	c.JSON(statusCode, problem)
+}
+
+// StatusErrorCode returns the generic error code of an HTTP status, such as not_found, for
+// errors that have no more specific code
+func StatusErrorCode(statusCode int) string {
+	text := http.StatusText(statusCode)
+	if text == "" {
+		return "error"
+	}
+	return strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
+
+// WriteErrorResponse writes an error as a problem document with the generic code of its status
+func WriteErrorResponse(c *gin.Context, statusCode int, message string) {
+	WriteProblem(c, statusCode, StatusErrorCode(statusCode), message, nil)
 }
 
-// WriteBadRequestError writes a 400 Bad Request error
+// WriteBadRequestError writes a 400 Bad Request error for a request that failed validation
 func WriteBadRequestError(c *gin.Context, message string) {
-	WriteErrorResponse(c, http.StatusBadRequest, message)
+	WriteProblem(c, http.StatusBadRequest, CodeValidationFailed, message, nil)
 }
 
 // WriteValidationError writes a 400 Bad Request validation error
 func WriteValidationError(c *gin.Context, message string) {
-	WriteErrorResponse(c, http.StatusBadRequest, "Validation error: "+message)
+	WriteBadRequestError(c, "Validation error: "+message)
 }
 
 // WriteNotFoundError writes a 404 Not Found error
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWriteProblem(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/v1/allocate", nil)
+
+	WriteProblem(c, http.StatusConflict, "addresses_exhausted", "No IPs left", map[string]interface{}{
+		"available": 0,
+		// Extensions cannot replace the standard members
+		"status": 200,
+		"code":   "other",
+	})
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != ProblemContentType {
+		t.Fatalf("Content-Type = %q, want %q", contentType, ProblemContentType)
+	}
+
+	var problem map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("invalid JSON %s: %v", w.Body.String(), err)
+	}
+	want := map[string]interface{}{
+		"type":      "urn:ip-allocator-api:problem:addresses_exhausted",
+		"title":     "Conflict",
+		"status":    float64(http.StatusConflict),
+		"detail":    "No IPs left",
+		"instance":  "/api/v1/allocate",
+		"code":      "addresses_exhausted",
+		"success":   false,
+		"message":   "No IPs left",
+		"available": float64(0),
+	}
+	for key, value := range want {
+		if problem[key] != value {
+			t.Fatalf("%s = %v, want %v in %s", key, problem[key], value, w.Body.String())
+		}
+	}
+	if _, ok := problem["timestamp"]; !ok || len(problem) != len(want)+1 {
+		t.Fatalf("problem members = %v, want the standard members, the extension and a timestamp", problem)
+	}
+}
+
+func TestStatusErrorCode(t *testing.T) {
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusBadRequest, "bad_request"},
+		{http.StatusUnauthorized, "unauthorized"},
+		{http.StatusNotFound, "not_found"},
+		{http.StatusTooManyRequests, "too_many_requests"},
+		{http.StatusInternalServerError, "internal_server_error"},
+		{http.StatusNonAuthoritativeInfo, "non_authoritative_information"},
+		{http.StatusTeapot, "im_a_teapot"},
+		{599, "error"},
+	}
+	for _, tt := range tests {
+		if got := StatusErrorCode(tt.status); got != tt.want {
+			t.Fatalf("StatusErrorCode(%d) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+}